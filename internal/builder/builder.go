@@ -0,0 +1,239 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Builder builds OCI images from unpacked Debian packages.
+type Builder interface {
+	// Build builds an OCI image archive.
+	Build(ctx context.Context, opts BuildOptions) error
+}
+
+// OutputType is the format of the build output.
+type OutputType string
+
+const (
+	// OutputOCI is an OCI image layout tarball.
+	OutputOCI OutputType = "oci"
+	// OutputDocker is an image tarball that can be loaded with `docker load`.
+	OutputDocker OutputType = "docker"
+	// OutputTar is a tarball of the root filesystem.
+	OutputTar OutputType = "tar"
+	// OutputLocal is a directory containing the root filesystem.
+	OutputLocal OutputType = "local"
+	// OutputRaw is a bootable raw disk image. Disk images are assembled from
+	// the root filesystem tarball (see the disk package), rather than by the
+	// builder itself.
+	OutputRaw OutputType = "raw"
+	// OutputQCOW2 is a bootable qcow2 disk image.
+	OutputQCOW2 OutputType = "qcow2"
+	// OutputSquashfs is a squashfs filesystem image. Filesystem images are also
+	// assembled from the root filesystem tarball (see the fsimage package).
+	OutputSquashfs OutputType = "squashfs"
+	// OutputErofs is an erofs filesystem image.
+	OutputErofs OutputType = "erofs"
+	// OutputCpio is a newc format cpio archive (eg. for use as an initramfs).
+	OutputCpio OutputType = "cpio"
+	// OutputSysext is a systemd system extension image, containing the files
+	// added relative to a base image.
+	OutputSysext OutputType = "sysext"
+	// OutputPortable is a systemd portable service image (or a portable service
+	// extension, if built on top of a base image).
+	OutputPortable OutputType = "portable"
+)
+
+// IsDisk returns whether the output type is a bootable disk image.
+func (t OutputType) IsDisk() bool {
+	return t == OutputRaw || t == OutputQCOW2
+}
+
+// IsFilesystemImage returns whether the output type is a filesystem image.
+func (t OutputType) IsFilesystemImage() bool {
+	return t == OutputSquashfs || t == OutputErofs || t == OutputCpio
+}
+
+// IsExtension returns whether the output type is a systemd extension (or
+// portable service) image.
+func (t OutputType) IsExtension() bool {
+	return t == OutputSysext || t == OutputPortable
+}
+
+// Output configures where (and in what format) to write the image. For
+// multi-platform builds, the tar and local outputs contain a directory for
+// each platform (eg. linux_amd64/).
+type Output struct {
+	// Type is the format of the output.
+	Type OutputType
+	// Dest is the path to write the output to.
+	Dest string
+	// Compression is the optional compression algorithm of filesystem images.
+	Compression string
+	// Filesystem is the optional filesystem (squashfs or erofs) of extension
+	// images.
+	Filesystem string
+	// Base is the recipe file of the base image that extension images are
+	// built on top of.
+	Base string
+}
+
+// ParseOutput parses an output specification in the 'type=<type>,dest=<path>'
+// format (with an optional compression=<algorithm> field for filesystem and
+// extension images, and filesystem=<type> and base=<recipe> fields for
+// extension images). A plain path is treated as the destination of an OCI archive.
+func ParseOutput(spec string) (Output, error) {
+	if !strings.Contains(spec, "=") {
+		return Output{Type: OutputOCI, Dest: spec}, nil
+	}
+
+	var output Output
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return Output{}, fmt.Errorf("invalid output field: %q", field)
+		}
+
+		switch strings.TrimSpace(key) {
+		case "type":
+			output.Type = OutputType(strings.TrimSpace(value))
+		case "dest":
+			output.Dest = value
+		case "compression":
+			output.Compression = strings.TrimSpace(value)
+		case "filesystem":
+			output.Filesystem = strings.TrimSpace(value)
+		case "base":
+			output.Base = value
+		default:
+			return Output{}, fmt.Errorf("unknown output field: %q", key)
+		}
+	}
+
+	switch output.Type {
+	case OutputOCI, OutputDocker, OutputTar, OutputLocal, OutputRaw, OutputQCOW2,
+		OutputSquashfs, OutputErofs, OutputCpio, OutputSysext, OutputPortable:
+	case "":
+		return Output{}, fmt.Errorf("output type is required")
+	default:
+		return Output{}, fmt.Errorf("unsupported output type: %q", output.Type)
+	}
+
+	if output.Dest == "" {
+		return Output{}, fmt.Errorf("output destination is required")
+	}
+
+	if output.Compression != "" && !output.Type.IsFilesystemImage() && !output.Type.IsExtension() {
+		return Output{}, fmt.Errorf("compression is not supported for %s outputs", output.Type)
+	}
+
+	if !output.Type.IsExtension() {
+		if output.Filesystem != "" {
+			return Output{}, fmt.Errorf("filesystem is not supported for %s outputs", output.Type)
+		}
+
+		if output.Base != "" {
+			return Output{}, fmt.Errorf("base is not supported for %s outputs", output.Type)
+		}
+	}
+
+	if output.Type.IsExtension() {
+		switch output.Filesystem {
+		case "":
+			output.Filesystem = string(OutputErofs)
+		case string(OutputSquashfs), string(OutputErofs):
+		default:
+			return Output{}, fmt.Errorf("unsupported %s filesystem: %q", output.Type, output.Filesystem)
+		}
+	}
+
+	if output.Type == OutputSysext && output.Base == "" {
+		return Output{}, fmt.Errorf("base recipe is required for sysext outputs")
+	}
+
+	return output, nil
+}
+
+// BuildOptions configures an image build.
+type BuildOptions struct {
+	// Output is where (and in what format) to write the image.
+	Output Output
+	// RecipePath is the path to the immutos recipe file.
+	RecipePath string
+	// SourceDateEpoch is the source date epoch for the image.
+	SourceDateEpoch time.Time
+	// SecondStageBinaryPath optionally overrides the path to the second-stage binary.
+	SecondStageBinaryPath string
+	// DownloadOnly specifies whether to only download packages and not install them.
+	DownloadOnly bool
+	// ImageConf is the optional OCI image configuration.
+	ImageConf ocispecs.ImageConfig
+	// Tags is a list of tags to apply to the image.
+	Tags []string
+	// Push is an optional list of image references (eg. registry/name:tag) to
+	// push the image to, instead of writing the output.
+	Push []string
+	// PlatformOpts is a list of platform build options.
+	PlatformOpts []PlatformBuildOptions
+}
+
+// PlatformBuildOptions configures the build of an image for a single platform.
+type PlatformBuildOptions struct {
+	// Platform is the platform to build the image for.
+	Platform ocispecs.Platform
+	// BuildContextDir is the path to the build context directory.
+	BuildContextDir string
+	// DpkgDatabaseArchivePath is the path to the dpkg configuration archive.
+	// The path must be relative to the build context directory.
+	DpkgDatabaseArchivePath string
+	// DataArchivePaths is a list of paths to package data archives.
+	// The paths must be relative to the build context directory.
+	DataArchivePaths []string
+	// ManifestPath is the optional path to the build manifest.
+	// The path must be relative to the build context directory.
+	ManifestPath string
+	// Layers optionally splits the image into multiple layers. Each layer
+	// contains the files owned by a group of packages, and the files not owned
+	// by any package make up the final layer (see layers.Plan). If not
+	// specified, the image has a single layer.
+	Layers [][]string
+}
+
+// NewImage returns the OCI image configuration for an image built for the
+// given platform.
+func NewImage(imageConf ocispecs.ImageConfig, platform ocispecs.Platform) ocispecs.Image {
+	defaultEnv := []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"TERM=xterm",
+	}
+
+	imageConf.Env = append(defaultEnv, imageConf.Env...)
+
+	return ocispecs.Image{
+		Platform: platform,
+		Config:   imageConf,
+		RootFS: ocispecs.RootFS{
+			Type: "layers",
+		},
+	}
+}
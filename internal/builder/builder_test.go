@@ -0,0 +1,81 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package builder_test
+
+import (
+	"testing"
+
+	"github.com/immutos/immutos/internal/builder"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOutput(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	output, err := builder.ParseOutput("debian-image.tar")
+	require.NoError(t, err)
+	require.Equal(t, builder.Output{Type: builder.OutputOCI, Dest: "debian-image.tar"}, output)
+
+	output, err = builder.ParseOutput("type=docker,dest=image.tar")
+	require.NoError(t, err)
+	require.Equal(t, builder.Output{Type: builder.OutputDocker, Dest: "image.tar"}, output)
+
+	output, err = builder.ParseOutput("dest=rootfs,type=local")
+	require.NoError(t, err)
+	require.Equal(t, builder.Output{Type: builder.OutputLocal, Dest: "rootfs"}, output)
+
+	output, err = builder.ParseOutput("type=qcow2,dest=disk.qcow2")
+	require.NoError(t, err)
+	require.Equal(t, builder.Output{Type: builder.OutputQCOW2, Dest: "disk.qcow2"}, output)
+	require.True(t, output.Type.IsDisk())
+
+	output, err = builder.ParseOutput("type=squashfs,dest=rootfs.img,compression=zstd")
+	require.NoError(t, err)
+	require.Equal(t, builder.Output{Type: builder.OutputSquashfs, Dest: "rootfs.img", Compression: "zstd"}, output)
+	require.True(t, output.Type.IsFilesystemImage())
+
+	output, err = builder.ParseOutput("type=sysext,dest=tools.raw,base=base.yaml")
+	require.NoError(t, err)
+	require.Equal(t, builder.Output{Type: builder.OutputSysext, Dest: "tools.raw", Filesystem: "erofs", Base: "base.yaml"}, output)
+	require.True(t, output.Type.IsExtension())
+
+	output, err = builder.ParseOutput("type=portable,dest=app.raw,filesystem=squashfs,compression=xz")
+	require.NoError(t, err)
+	require.Equal(t, builder.Output{Type: builder.OutputPortable, Dest: "app.raw", Compression: "xz", Filesystem: "squashfs"}, output)
+
+	_, err = builder.ParseOutput("type=sysext,dest=tools.raw")
+	require.Error(t, err)
+
+	_, err = builder.ParseOutput("type=portable,dest=app.raw,filesystem=ext4")
+	require.Error(t, err)
+
+	_, err = builder.ParseOutput("type=tar,dest=rootfs.tar,base=base.yaml")
+	require.Error(t, err)
+
+	_, err = builder.ParseOutput("type=ext2,dest=rootfs.img")
+	require.Error(t, err)
+
+	_, err = builder.ParseOutput("type=tar")
+	require.Error(t, err)
+
+	_, err = builder.ParseOutput("dest=image.tar")
+	require.Error(t, err)
+
+	_, err = builder.ParseOutput("type=tar,dest=rootfs.tar,compression=gzip")
+	require.Error(t, err)
+}
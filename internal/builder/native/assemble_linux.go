@@ -0,0 +1,483 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package native
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/immutos/immutos/internal/layers"
+	"github.com/immutos/immutos/internal/manifest"
+	"golang.org/x/sys/unix"
+)
+
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Assemble assembles the root filesystem of an image and writes it out as an
+// uncompressed layer tarball. It must be run as root (possibly in a user
+// namespace), in a private mount namespace.
+func Assemble(ctx context.Context, opts *AssembleOptions) error {
+	// Don't propagate any of our mounts back to the host.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	if err := os.RemoveAll(opts.RootFSDir); err != nil {
+		return fmt.Errorf("failed to remove root filesystem directory: %w", err)
+	}
+
+	if err := os.MkdirAll(opts.RootFSDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create root filesystem directory: %w", err)
+	}
+
+	x := &extractor{root: opts.RootFSDir}
+
+	if err := x.extractFile(opts.DpkgDatabaseArchivePath); err != nil {
+		return fmt.Errorf("failed to extract dpkg database archive: %w", err)
+	}
+
+	for _, dataArchivePath := range opts.DataArchivePaths {
+		if err := x.extractFile(dataArchivePath); err != nil {
+			return fmt.Errorf("failed to extract data archive %s: %w", filepath.Base(dataArchivePath), err)
+		}
+	}
+
+	if err := x.finishDirs(); err != nil {
+		return fmt.Errorf("failed to apply directory metadata: %w", err)
+	}
+
+	if opts.ManifestPath != "" {
+		if err := copyFileInRoot(opts.RootFSDir, opts.ManifestPath, manifest.Path, 0o644); err != nil {
+			return fmt.Errorf("failed to copy manifest: %w", err)
+		}
+	}
+
+	if !opts.DownloadOnly {
+		if err := runSecondStage(ctx, opts); err != nil {
+			return err
+		}
+	}
+
+	if opts.LayerPath != "" {
+		if err := layers.Write(opts.RootFSDir, []string{opts.LayerPath}, nil, opts.SourceDateEpoch); err != nil {
+			return fmt.Errorf("failed to write layer: %w", err)
+		}
+	}
+
+	if len(opts.Layers) > 0 {
+		owners, err := layers.ReadOwners(os.DirFS(opts.RootFSDir))
+		if err != nil {
+			return err
+		}
+
+		if err := layers.Write(opts.RootFSDir, opts.LayerPaths, layers.Assign(opts.Layers, owners), opts.SourceDateEpoch); err != nil {
+			return fmt.Errorf("failed to write layers: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// runSecondStage installs the unpacked packages and provisions the image.
+func runSecondStage(ctx context.Context, opts *AssembleOptions) error {
+	root := opts.RootFSDir
+
+	if opts.SecondStageBinaryPath != "" {
+		// Copy the immutos binary into the root filesystem.
+		if err := copyFileInRoot(root, opts.SecondStageBinaryPath, "/usr/bin/immutos", 0o755); err != nil {
+			return fmt.Errorf("failed to copy second-stage binary: %w", err)
+		}
+	}
+
+	if err := copyFileInRoot(root, opts.RecipePath, "/etc/immutos/config.yaml", 0o644); err != nil {
+		return fmt.Errorf("failed to copy recipe: %w", err)
+	}
+
+	unmount, err := mountPseudoFilesystems(root)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	steps := [][]string{
+		{"immutos", "second-stage", "merge-usr"},                                   // Merge the /usr directory into the root filesystem.
+		{"/var/lib/dpkg/info/base-passwd.preinst", "install"},                      // Create the /etc/group and /etc/passwd files (needed by dpkg).
+		{"immutos", "second-stage", "configure", "-f", "/etc/immutos/config.yaml"}, // Configure the packages (in dependency order).
+	}
+
+	for _, step := range steps {
+		if err := runInRoot(ctx, root, step...); err != nil {
+			return err
+		}
+	}
+
+	// Remove the dpkg log file, alternatives log file, and ldconfig cache file.
+	// These files are no longer needed and will lead to irreproducible builds.
+	for _, name := range []string{"/var/log/dpkg.log", "/var/log/alternatives.log", "/var/cache/ldconfig/aux-cache"} {
+		if err := os.Remove(filepath.Join(root, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+	}
+
+	// Provision image (eg. create users/groups etc).
+	if err := runInRoot(ctx, root, "immutos", "second-stage", "provision", "-f", "/etc/immutos/config.yaml"); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "etc/immutos")); err != nil {
+		return fmt.Errorf("failed to remove recipe: %w", err)
+	}
+
+	// Remove the no longer needed immutos binary.
+	if opts.SecondStageBinaryPath != "" {
+		if err := os.Remove(filepath.Join(root, "usr/bin/immutos")); err != nil {
+			return fmt.Errorf("failed to remove second-stage binary: %w", err)
+		}
+	} else if err := runInRoot(ctx, root, "dpkg", "-r", "immutos"); err != nil {
+		return err
+	}
+
+	unmount()
+
+	return nil
+}
+
+// mountPseudoFilesystems makes a minimal /dev, /proc and (a read-only) /sys
+// available inside the root filesystem. The returned function unmounts them
+// again (and is safe to call more than once).
+func mountPseudoFilesystems(root string) (func(), error) {
+	var mounted []string
+	unmount := func() {
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if err := unix.Unmount(mounted[i], unix.MNT_DETACH); err != nil {
+				slog.Warn("Failed to unmount", slog.String("path", mounted[i]), slog.Any("error", err))
+			}
+		}
+		mounted = nil
+	}
+
+	// The root filesystem has to be a mount point to pivot into it.
+	if err := unix.Mount(root, root, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return nil, fmt.Errorf("failed to mount root filesystem: %w", err)
+	}
+	mounted = append(mounted, root)
+
+	for _, name := range []string{"dev", "proc", "sys"} {
+		if err := os.MkdirAll(filepath.Join(root, name), 0o755); err != nil {
+			unmount()
+			return nil, fmt.Errorf("failed to create /%s: %w", name, err)
+		}
+	}
+
+	devDir := filepath.Join(root, "dev")
+	if err := mountDev(devDir, &mounted); err != nil {
+		unmount()
+		return nil, err
+	}
+
+	procDir := filepath.Join(root, "proc")
+	if err := unix.Mount("proc", procDir, "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		unmount()
+		return nil, fmt.Errorf("failed to mount /proc: %w", err)
+	}
+	mounted = append(mounted, procDir)
+
+	// A new sysfs can't be mounted without a network namespace, so bind mount
+	// the host /sys instead (read-only, so packages can't modify the host).
+	sysDir := filepath.Join(root, "sys")
+	if err := unix.Mount("/sys", sysDir, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		unmount()
+		return nil, fmt.Errorf("failed to mount /sys: %w", err)
+	}
+	mounted = append(mounted, sysDir)
+
+	if err := unix.Mount("", sysDir, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		unmount()
+		return nil, fmt.Errorf("failed to remount /sys read-only: %w", err)
+	}
+
+	return unmount, nil
+}
+
+// devices are the host devices that are made available in /dev.
+var devices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// mountDev mounts a tmpfs on /dev containing only the devices above (rather
+// than exposing every host device), along with /dev/pts and /dev/shm. The
+// mount points are appended to mounted.
+func mountDev(devDir string, mounted *[]string) error {
+	if err := unix.Mount("tmpfs", devDir, "tmpfs", unix.MS_NOSUID|unix.MS_NOEXEC, "mode=755"); err != nil {
+		return fmt.Errorf("failed to mount /dev: %w", err)
+	}
+	*mounted = append(*mounted, devDir)
+
+	for _, name := range devices {
+		target := filepath.Join(devDir, name)
+
+		// Device nodes can't be created in a user namespace, so bind mount the
+		// host devices over empty files instead.
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o666)
+		if err != nil {
+			return fmt.Errorf("failed to create /dev/%s: %w", name, err)
+		}
+		_ = f.Close()
+
+		if err := unix.Mount(filepath.Join("/dev", name), target, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to mount /dev/%s: %w", name, err)
+		}
+		*mounted = append(*mounted, target)
+	}
+
+	for _, name := range []string{"pts", "shm"} {
+		if err := os.Mkdir(filepath.Join(devDir, name), 0o755); err != nil {
+			return fmt.Errorf("failed to create /dev/%s: %w", name, err)
+		}
+	}
+
+	ptsDir := filepath.Join(devDir, "pts")
+	if err := unix.Mount("devpts", ptsDir, "devpts", unix.MS_NOSUID|unix.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"); err != nil {
+		return fmt.Errorf("failed to mount /dev/pts: %w", err)
+	}
+	*mounted = append(*mounted, ptsDir)
+
+	shmDir := filepath.Join(devDir, "shm")
+	if err := unix.Mount("shm", shmDir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=1777"); err != nil {
+		return fmt.Errorf("failed to mount /dev/shm: %w", err)
+	}
+	*mounted = append(*mounted, shmDir)
+
+	for name, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+		"ptmx":   "pts/ptmx",
+	} {
+		if err := os.Symlink(target, filepath.Join(devDir, name)); err != nil {
+			return fmt.Errorf("failed to create /dev/%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// runInRoot runs a command inside the root filesystem. The command is run by
+// a re-executed helper, which pivots into the root filesystem in its own mount
+// namespace (see enterRootAndExec).
+func runInRoot(ctx context.Context, root string, args ...string) error {
+	name, err := lookPathInRoot(root, args[0])
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("Running command", slog.String("command", strings.Join(args, " ")))
+
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", append([]string{name}, args[1:]...)...)
+	cmd.Dir = root
+	cmd.Env = []string{
+		"DEBIAN_FRONTEND=noninteractive",
+		"DEBCONF_NONINTERACTIVE_SEEN=true",
+		"PATH=" + defaultPath,
+		enterRootEnv + "=1",
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS,
+		Pdeathsig:  syscall.SIGKILL,
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run %q: %w", strings.Join(args, " "), err)
+	}
+
+	return nil
+}
+
+// enterRootAndExec makes the working directory (the root filesystem mount)
+// the root of the mount namespace, detaches the old root and executes the
+// command. Unlike a chroot, the host filesystem is no longer reachable.
+func enterRootAndExec(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no command to run")
+	}
+
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	// Stack the new root on top of the old one, then detach the old root.
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("failed to pivot root: %w", err)
+	}
+
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount old root: %w", err)
+	}
+
+	if err := unix.Chdir("/"); err != nil {
+		return fmt.Errorf("failed to change directory: %w", err)
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, enterRootEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	if err := syscall.Exec(args[0], args, env); err != nil {
+		return fmt.Errorf("failed to execute %q: %w", args[0], err)
+	}
+
+	return nil
+}
+
+// lookPathInRoot searches for an executable in the PATH of the root
+// filesystem and returns its path (relative to the root filesystem).
+func lookPathInRoot(root, name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+
+	for _, dir := range filepath.SplitList(defaultPath) {
+		candidate := path.Join(dir, name)
+
+		resolved, err := resolveInRoot(root, candidate)
+		if err != nil {
+			return "", err
+		}
+
+		fi, err := os.Stat(resolved)
+		if err == nil && fi.Mode().IsRegular() && fi.Mode()&0o111 != 0 {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("executable %q not found in root filesystem", name)
+}
+
+// resolveInRoot resolves a path inside the root filesystem, following
+// symbolic links as if the root filesystem was the real root. The returned
+// path (on the host) is always contained within the root directory. Missing
+// path components are left unresolved.
+func resolveInRoot(root, name string) (string, error) {
+	var (
+		current = "/"
+		parts   = strings.Split(name, "/")
+		links   int
+	)
+
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = path.Dir(current)
+			continue
+		}
+
+		next := path.Join(current, part)
+
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				current = next
+				continue
+			}
+
+			return "", err
+		}
+
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		links++
+		if links > 255 {
+			return "", &fs.PathError{Op: "resolve", Path: name, Err: syscall.ELOOP}
+		}
+
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+
+		if path.IsAbs(target) {
+			current = "/"
+		}
+
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+
+	return filepath.Join(root, current), nil
+}
+
+// copyFileInRoot copies a file from the host into the root filesystem,
+// creating any missing parent directories.
+func copyFileInRoot(root, src, dst string, mode fs.FileMode) error {
+	parent, err := resolveInRoot(root, path.Dir(dst))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return err
+	}
+
+	target := filepath.Join(parent, path.Base(dst))
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+
+	if err := dstFile.Close(); err != nil {
+		return err
+	}
+
+	// Apply the mode explicitly, ignoring the umask.
+	return os.Chmod(target, mode)
+}
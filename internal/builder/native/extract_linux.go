@@ -0,0 +1,307 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package native
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+// extractor extracts tarballs into a root filesystem, preserving ownership,
+// permissions, timestamps, and extended attributes.
+type extractor struct {
+	root string
+	// ignoreOwnership skips changing the ownership of extracted files (eg.
+	// when extracting as an unprivileged user).
+	ignoreOwnership bool
+	// warnedOwnership is set once we've warned about ownership that can't be
+	// preserved (eg. in a user namespace with only a single id mapped).
+	warnedOwnership bool
+	// warnedDevices is set once we've warned about device nodes that can't be
+	// created (eg. in a user namespace).
+	warnedDevices bool
+	// warnedXattrs is set once we've warned about extended attributes that
+	// can't be set.
+	warnedXattrs bool
+	// dirs records the metadata of extracted directories, which is applied
+	// once extraction has finished (as the modification time changes whenever
+	// a directory's entries change, and read-only directories can't be
+	// written to by unprivileged users).
+	dirs map[string]dirMetadata
+}
+
+type dirMetadata struct {
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+// extractLayer extracts a layer tarball into a directory. File ownership is
+// only preserved when running as root.
+func extractLayer(layerPath, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	x := &extractor{root: dir, ignoreOwnership: os.Geteuid() != 0}
+	if err := x.extractFile(layerPath); err != nil {
+		return err
+	}
+
+	return x.finishDirs()
+}
+
+func (x *extractor) extractFile(archivePath string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return x.extract(f)
+}
+
+func (x *extractor) extract(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+
+		if err := x.extractEntry(tr, hdr, name); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+	}
+}
+
+func (x *extractor) extractEntry(tr *tar.Reader, hdr *tar.Header, name string) error {
+	// Resolve the parent directory (but not the entry itself) so that symlinks
+	// can never be used to write outside of the root filesystem.
+	parent, err := resolveInRoot(x.root, path.Dir(name))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return err
+	}
+
+	target := filepath.Join(parent, path.Base(name))
+
+	if err := removeExisting(target, hdr.Typeflag == tar.TypeDir); err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(f, tr); err != nil {
+			_ = f.Close()
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		linkName := path.Clean("/" + hdr.Linkname)
+
+		linkParent, err := resolveInRoot(x.root, path.Dir(linkName))
+		if err != nil {
+			return err
+		}
+
+		// The metadata is shared with the link target, so we're done.
+		return os.Link(filepath.Join(linkParent, path.Base(linkName)), target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		mode := uint32(hdr.Mode & 0o7777)
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			mode |= unix.S_IFCHR
+		case tar.TypeBlock:
+			mode |= unix.S_IFBLK
+		case tar.TypeFifo:
+			mode |= unix.S_IFIFO
+		}
+
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(target, mode, int(dev)); err != nil {
+			if errors.Is(err, fs.ErrPermission) {
+				if !x.warnedDevices {
+					slog.Warn("Unable to create device nodes, skipping", slog.String("path", name))
+					x.warnedDevices = true
+				}
+
+				return nil
+			}
+
+			return err
+		}
+	default:
+		slog.Warn("Skipping unsupported tar entry", slog.String("path", name), slog.Int("type", int(hdr.Typeflag)))
+		return nil
+	}
+
+	return x.applyMetadata(target, hdr)
+}
+
+func (x *extractor) applyMetadata(target string, hdr *tar.Header) error {
+	if err := x.chown(target, hdr); err != nil {
+		return err
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+
+		attr := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := unix.Lsetxattr(target, attr, []byte(value), 0); err != nil {
+			if !errors.Is(err, unix.EPERM) && !errors.Is(err, unix.ENOTSUP) {
+				return fmt.Errorf("failed to set extended attribute %s: %w", attr, err)
+			}
+
+			if !x.warnedXattrs {
+				slog.Warn("Unable to set extended attributes, skipping", slog.String("attr", attr), slog.Any("error", err))
+				x.warnedXattrs = true
+			}
+		}
+	}
+
+	mode := hdr.FileInfo().Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+
+	if hdr.Typeflag == tar.TypeDir {
+		if x.dirs == nil {
+			x.dirs = map[string]dirMetadata{}
+		}
+		x.dirs[target] = dirMetadata{mode: mode, modTime: hdr.ModTime}
+
+		return nil
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		// Chmod after chown, as chown clears the setuid/setgid bits.
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	}
+
+	return setModTime(target, hdr.ModTime)
+}
+
+func (x *extractor) chown(target string, hdr *tar.Header) error {
+	if x.ignoreOwnership {
+		return nil
+	}
+
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		// Ids that are not mapped into our user namespace can't be used.
+		if !errors.Is(err, unix.EINVAL) {
+			return err
+		}
+
+		if !x.warnedOwnership {
+			slog.Warn("Unable to preserve file ownership, files will be owned by root",
+				slog.Int("uid", hdr.Uid), slog.Int("gid", hdr.Gid))
+			x.warnedOwnership = true
+		}
+	}
+
+	return nil
+}
+
+// finishDirs applies the permissions and modification times of the extracted
+// directories, once all archives have been extracted.
+func (x *extractor) finishDirs() error {
+	for target, metadata := range x.dirs {
+		if err := os.Chmod(target, metadata.mode); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return err
+		}
+
+		if err := setModTime(target, metadata.modTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setModTime(target string, modTime time.Time) error {
+	ts := unix.NsecToTimespec(modTime.UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, target, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// removeExisting removes any existing file at the target path, so that it can
+// be replaced. Existing directories are kept if the entry is a directory.
+func removeExisting(target string, isDir bool) error {
+	fi, err := os.Lstat(target)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	if fi.IsDir() {
+		if isDir {
+			return nil
+		}
+
+		return os.RemoveAll(target)
+	}
+
+	return os.Remove(target)
+}
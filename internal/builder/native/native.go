@@ -0,0 +1,189 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package native implements a daemonless image builder. The root filesystem
+// is assembled directly on the host, the second stage is run inside a user
+// namespace (root is never the real root) with the root filesystem as its
+// root, and the OCI image is written without the help of BuildKit.
+package native
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/immutos/internal/builder"
+	"github.com/immutos/immutos/internal/registry"
+)
+
+var _ builder.Builder = (*Builder)(nil)
+
+// AssembleOptions configures the assembly of a root filesystem.
+type AssembleOptions struct {
+	// RootFSDir is the directory in which the root filesystem is assembled.
+	RootFSDir string
+	// LayerPath is the optional path to write the uncompressed tarball of the
+	// complete root filesystem to.
+	LayerPath string
+	// Layers optionally splits the image into multiple layers (see
+	// builder.PlatformBuildOptions).
+	Layers [][]string
+	// LayerPaths are the paths to write the uncompressed layer tarballs of a
+	// multi-layer image to (one more than the number of package layers).
+	LayerPaths []string
+	// DpkgDatabaseArchivePath is the path to the dpkg database archive.
+	DpkgDatabaseArchivePath string
+	// DataArchivePaths is a list of paths to package data archives.
+	DataArchivePaths []string
+	// ManifestPath is the optional path to the build manifest.
+	ManifestPath string
+	// RecipePath is the path to the immutos recipe file.
+	RecipePath string
+	// SecondStageBinaryPath optionally overrides the path to the second-stage binary.
+	SecondStageBinaryPath string
+	// DownloadOnly specifies whether to only unpack packages and not install them.
+	DownloadOnly bool
+	// SourceDateEpoch is the source date epoch for the image.
+	SourceDateEpoch time.Time
+	// LogLevel is the minimum level of messages to log.
+	LogLevel slog.Level
+}
+
+// Builder is a daemonless image builder.
+type Builder struct {
+	registry *registry.Client
+}
+
+// New creates a new native builder.
+func New() *Builder {
+	return &Builder{
+		registry: registry.NewClient(),
+	}
+}
+
+// Build builds an OCI image archive.
+func (b *Builder) Build(ctx context.Context, opts builder.BuildOptions) error {
+	logLevel := slog.LevelInfo
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		logLevel = slog.LevelDebug
+	}
+
+	var images []image
+	for _, platformOpt := range opts.PlatformOpts {
+		slog.Info("Assembling root filesystem", slog.String("platform", platforms.Format(platformOpt.Platform)))
+
+		if !opts.DownloadOnly && platformOpt.Platform.Architecture != runtime.GOARCH {
+			slog.Warn("Building for a foreign architecture requires binfmt_misc emulation",
+				slog.String("platform", platforms.Format(platformOpt.Platform)))
+		}
+
+		assembleOpts := AssembleOptions{
+			RootFSDir:               filepath.Join(platformOpt.BuildContextDir, "rootfs"),
+			Layers:                  platformOpt.Layers,
+			DpkgDatabaseArchivePath: platformOpt.DpkgDatabaseArchivePath,
+			DataArchivePaths:        platformOpt.DataArchivePaths,
+			ManifestPath:            platformOpt.ManifestPath,
+			RecipePath:              opts.RecipePath,
+			SecondStageBinaryPath:   opts.SecondStageBinaryPath,
+			DownloadOnly:            opts.DownloadOnly,
+			SourceDateEpoch:         opts.SourceDateEpoch,
+			LogLevel:                logLevel,
+		}
+
+		// Multi-layer images only need the complete root filesystem for the tar
+		// and local outputs.
+		if len(platformOpt.Layers) == 0 || opts.Output.Type == builder.OutputTar || opts.Output.Type == builder.OutputLocal {
+			assembleOpts.LayerPath = filepath.Join(platformOpt.BuildContextDir, "layer.tar")
+		}
+
+		// The files not owned by any package make up an additional final layer.
+		if len(platformOpt.Layers) > 0 {
+			for i := 0; i <= len(platformOpt.Layers); i++ {
+				assembleOpts.LayerPaths = append(assembleOpts.LayerPaths,
+					filepath.Join(platformOpt.BuildContextDir, fmt.Sprintf("layer-%d.tar", i)))
+			}
+		}
+
+		if err := assembleInNamespace(ctx, &assembleOpts); err != nil {
+			return fmt.Errorf("failed to assemble root filesystem: %w", err)
+		}
+
+		images = append(images, image{
+			platform:   platformOpt.Platform,
+			config:     builder.NewImage(opts.ImageConf, platformOpt.Platform),
+			layerPath:  assembleOpts.LayerPath,
+			layerPaths: assembleOpts.LayerPaths,
+		})
+	}
+
+	if len(opts.Push) > 0 {
+		l, err := newLayout(images, opts.SourceDateEpoch)
+		if err != nil {
+			return fmt.Errorf("failed to create OCI image: %w", err)
+		}
+
+		for _, ref := range opts.Push {
+			slog.Info("Pushing image", slog.String("reference", ref))
+
+			if err := b.registry.Push(ctx, ref, l.root, l.open); err != nil {
+				return fmt.Errorf("failed to push image: %w", err)
+			}
+		}
+
+		return nil
+	}
+
+	slog.Info("Writing output", slog.String("type", string(opts.Output.Type)), slog.String("dest", opts.Output.Dest))
+
+	switch opts.Output.Type {
+	case builder.OutputOCI, builder.OutputDocker:
+		if opts.Output.Type == builder.OutputDocker && len(images) > 1 {
+			return fmt.Errorf("docker output does not support multi-platform images")
+		}
+
+		l, err := newLayout(images, opts.SourceDateEpoch)
+		if err != nil {
+			return fmt.Errorf("failed to create OCI image: %w", err)
+		}
+
+		if err := l.writeArchive(opts.Output.Dest, opts.Tags, opts.SourceDateEpoch, opts.Output.Type == builder.OutputDocker); err != nil {
+			return fmt.Errorf("failed to write image: %w", err)
+		}
+	case builder.OutputTar:
+		if err := writeRootFSArchive(opts.Output.Dest, images, opts.SourceDateEpoch); err != nil {
+			return fmt.Errorf("failed to write root filesystem archive: %w", err)
+		}
+	case builder.OutputLocal:
+		for _, img := range images {
+			dir := opts.Output.Dest
+			if len(images) > 1 {
+				dir = filepath.Join(dir, platformDir(img.platform))
+			}
+
+			if err := extractLayer(img.layerPath, dir); err != nil {
+				return fmt.Errorf("failed to extract root filesystem: %w", err)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported output type: %q", opts.Output.Type)
+	}
+
+	return nil
+}
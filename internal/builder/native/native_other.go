@@ -0,0 +1,36 @@
+//go:build !linux
+
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package native
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Init must be called at the start of main().
+func Init() {}
+
+func assembleInNamespace(_ context.Context, _ *AssembleOptions) error {
+	return fmt.Errorf("the native builder requires Linux: %w", errors.ErrUnsupported)
+}
+
+func extractLayer(_, _ string) error {
+	return fmt.Errorf("extracting a root filesystem requires Linux: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,300 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package native_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/immutos/internal/builder"
+	"github.com/immutos/immutos/internal/builder/native"
+	"github.com/immutos/immutos/internal/manifest"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/immutos/immutos/internal/unpack"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// The test binary is re-executed to assemble the root filesystem.
+	native.Init()
+
+	os.Exit(m.Run())
+}
+
+func TestBuild(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	if runtime.GOOS != "linux" {
+		t.Skip("The native builder requires Linux")
+	}
+
+	ctx := context.Background()
+
+	sourceDateEpoch, err := time.Parse(time.RFC3339, "2024-01-01T00:00:00Z")
+	require.NoError(t, err)
+
+	// build builds the image, returning the path to the output.
+	build := func(t *testing.T, outputType builder.OutputType, push []string, layerPlan [][]string) string {
+		tempDir := t.TempDir()
+
+		packagePaths := []string{
+			filepath.Join(testutil.Root(), "testdata/debs/base-files_12.4+deb12u5_amd64.deb"),
+			filepath.Join(testutil.Root(), "testdata/debs/base-passwd_3.6.1_amd64.deb"),
+		}
+
+		dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths, nil)
+		require.NoError(t, err)
+
+		manifestPath := filepath.Join(tempDir, "manifest.json")
+		require.NoError(t, (&manifest.Manifest{Platform: "linux/amd64"}).WriteFile(manifestPath))
+
+		dest := filepath.Join(t.TempDir(), "output")
+
+		err = native.New().Build(ctx, builder.BuildOptions{
+			Output:          builder.Output{Type: outputType, Dest: dest},
+			SourceDateEpoch: sourceDateEpoch,
+			DownloadOnly:    true,
+			Tags:            []string{"immutos/test:latest"},
+			Push:            push,
+			PlatformOpts: []builder.PlatformBuildOptions{
+				{
+					Platform:                platforms.MustParse("linux/amd64"),
+					BuildContextDir:         tempDir,
+					DpkgDatabaseArchivePath: dpkgDatabaseArchivePath,
+					DataArchivePaths:        dataArchivePaths,
+					ManifestPath:            manifestPath,
+					Layers:                  layerPlan,
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		return dest
+	}
+
+	archive, err := os.ReadFile(build(t, builder.OutputOCI, nil, nil))
+	require.NoError(t, err)
+
+	t.Run("Reproducible", func(t *testing.T) {
+		rebuiltArchive, err := os.ReadFile(build(t, builder.OutputOCI, nil, nil))
+		require.NoError(t, err)
+
+		require.Equal(t, archive, rebuiltArchive)
+	})
+
+	files := readTar(t, bytes.NewReader(archive))
+
+	var layout ocispecs.ImageLayout
+	require.NoError(t, json.Unmarshal(files[ocispecs.ImageLayoutFile].data, &layout))
+	require.Equal(t, ocispecs.ImageLayoutVersion, layout.Version)
+
+	var index ocispecs.Index
+	require.NoError(t, json.Unmarshal(files["index.json"].data, &index))
+	require.Len(t, index.Manifests, 1)
+	require.Equal(t, "docker.io/immutos/test:latest", index.Manifests[0].Annotations["io.containerd.image.name"])
+	require.Equal(t, "latest", index.Manifests[0].Annotations[ocispecs.AnnotationRefName])
+
+	var imageManifest ocispecs.Manifest
+	require.NoError(t, json.Unmarshal(files["blobs/sha256/"+index.Manifests[0].Digest.Encoded()].data, &imageManifest))
+	require.Len(t, imageManifest.Layers, 1)
+
+	var config ocispecs.Image
+	require.NoError(t, json.Unmarshal(files["blobs/sha256/"+imageManifest.Config.Digest.Encoded()].data, &config))
+	require.Equal(t, "amd64", config.Architecture)
+	require.Equal(t, sourceDateEpoch, config.Created.UTC())
+	require.Len(t, config.RootFS.DiffIDs, 1)
+
+	zr, err := gzip.NewReader(bytes.NewReader(files["blobs/sha256/"+imageManifest.Layers[0].Digest.Encoded()].data))
+	require.NoError(t, err)
+
+	layer := readTar(t, zr)
+
+	require.Contains(t, layer, "etc/debian_version")
+	require.Contains(t, layer, "var/lib/dpkg/status")
+	require.Contains(t, layer, "var/lib/immutos/manifest.json")
+
+	for name, f := range layer {
+		require.False(t, f.hdr.ModTime.After(sourceDateEpoch), "modification time of %s is after the source date epoch", name)
+		require.Zero(t, f.hdr.Uid, "owner of %s", name)
+	}
+
+	t.Run("Layers", func(t *testing.T) {
+		f, err := os.Open(build(t, builder.OutputOCI, nil, [][]string{{"base-files"}, {"base-passwd"}}))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		layeredFiles := readTar(t, f)
+
+		var index ocispecs.Index
+		require.NoError(t, json.Unmarshal(layeredFiles["index.json"].data, &index))
+
+		var imageManifest ocispecs.Manifest
+		require.NoError(t, json.Unmarshal(layeredFiles["blobs/sha256/"+index.Manifests[0].Digest.Encoded()].data, &imageManifest))
+		require.Len(t, imageManifest.Layers, 3)
+
+		var config ocispecs.Image
+		require.NoError(t, json.Unmarshal(layeredFiles["blobs/sha256/"+imageManifest.Config.Digest.Encoded()].data, &config))
+		require.Len(t, config.RootFS.DiffIDs, 3)
+		require.Len(t, config.History, 3)
+
+		readLayer := func(desc ocispecs.Descriptor) map[string]tarFile {
+			zr, err := gzip.NewReader(bytes.NewReader(layeredFiles["blobs/sha256/"+desc.Digest.Encoded()].data))
+			require.NoError(t, err)
+
+			return readTar(t, zr)
+		}
+
+		baseFilesLayer := readLayer(imageManifest.Layers[0])
+		require.Contains(t, baseFilesLayer, "etc/debian_version")
+		require.NotContains(t, baseFilesLayer, "var/lib/dpkg/status")
+
+		basePasswdLayer := readLayer(imageManifest.Layers[1])
+		require.Contains(t, basePasswdLayer, "usr/sbin/update-passwd")
+		require.NotContains(t, basePasswdLayer, "etc/debian_version")
+
+		finalLayer := readLayer(imageManifest.Layers[2])
+		require.Contains(t, finalLayer, "var/lib/dpkg/status")
+		require.Contains(t, finalLayer, "var/lib/immutos/manifest.json")
+
+		// Every file is in exactly one layer.
+		for name, f := range layer {
+			if f.hdr.Typeflag == tar.TypeDir {
+				continue
+			}
+
+			var count int
+			for _, l := range []map[string]tarFile{baseFilesLayer, basePasswdLayer, finalLayer} {
+				if _, ok := l[name]; ok {
+					count++
+				}
+			}
+			require.Equal(t, 1, count, name)
+		}
+	})
+
+	t.Run("Push", func(t *testing.T) {
+		reg := testutil.NewRegistry(t, "user", "secret")
+		reg.SetupDockerConfig(t)
+
+		dest := build(t, builder.OutputOCI, []string{reg.Host + "/immutos/test:latest"}, nil)
+		require.NoFileExists(t, dest)
+
+		m, ok := reg.Manifest("immutos/test", "latest")
+		require.True(t, ok)
+		require.Equal(t, ocispecs.MediaTypeImageManifest, m.MediaType)
+		require.Equal(t, files["blobs/sha256/"+index.Manifests[0].Digest.Encoded()].data, m.Data)
+	})
+
+	t.Run("Docker", func(t *testing.T) {
+		f, err := os.Open(build(t, builder.OutputDocker, nil, nil))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		dockerFiles := readTar(t, f)
+
+		var dockerManifest []struct {
+			Config   string
+			RepoTags []string
+			Layers   []string
+		}
+		require.NoError(t, json.Unmarshal(dockerFiles["manifest.json"].data, &dockerManifest))
+		require.Len(t, dockerManifest, 1)
+		require.Equal(t, "blobs/sha256/"+imageManifest.Config.Digest.Encoded(), dockerManifest[0].Config)
+		require.Equal(t, []string{"immutos/test:latest"}, dockerManifest[0].RepoTags)
+		require.Equal(t, []string{"blobs/sha256/" + imageManifest.Layers[0].Digest.Encoded()}, dockerManifest[0].Layers)
+
+		for _, name := range append(dockerManifest[0].Layers, dockerManifest[0].Config) {
+			require.Contains(t, dockerFiles, name)
+		}
+	})
+
+	t.Run("Tar", func(t *testing.T) {
+		f, err := os.Open(build(t, builder.OutputTar, nil, nil))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		rootFS := readTar(t, f)
+		require.Len(t, rootFS, len(layer))
+		require.Equal(t, layer["etc/debian_version"].data, rootFS["etc/debian_version"].data)
+
+		// Layered images still write the complete root filesystem.
+		layeredF, err := os.Open(build(t, builder.OutputTar, nil, [][]string{{"base-files"}, {"base-passwd"}}))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, layeredF.Close())
+		})
+
+		require.Equal(t, rootFS, readTar(t, layeredF))
+	})
+
+	t.Run("Local", func(t *testing.T) {
+		dest := build(t, builder.OutputLocal, nil, nil)
+
+		data, err := os.ReadFile(filepath.Join(dest, "etc/debian_version"))
+		require.NoError(t, err)
+		require.Equal(t, layer["etc/debian_version"].data, data)
+
+		fi, err := os.Stat(filepath.Join(dest, "etc"))
+		require.NoError(t, err)
+		require.Equal(t, layer["etc/"].hdr.ModTime.Unix(), fi.ModTime().Unix())
+
+		require.FileExists(t, filepath.Join(dest, "var/lib/immutos/manifest.json"))
+	})
+}
+
+type tarFile struct {
+	hdr  *tar.Header
+	data []byte
+}
+
+func readTar(t *testing.T, r io.Reader) map[string]tarFile {
+	files := map[string]tarFile{}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		files[hdr.Name] = tarFile{hdr: hdr, data: data}
+	}
+
+	return files
+}
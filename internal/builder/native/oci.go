@@ -0,0 +1,398 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package native
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/klauspost/compress/gzip"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// image is a single platform image.
+type image struct {
+	platform ocispecs.Platform
+	config   ocispecs.Image
+	// layerPath is the path to the complete root filesystem layer.
+	layerPath string
+	// layerPaths optionally splits the image into multiple layers.
+	layerPaths []string
+}
+
+// blob is a content addressed blob in an OCI image layout. The content is
+// either held in memory or read from a file.
+type blob struct {
+	digest digest.Digest
+	size   int64
+	data   []byte
+	path   string
+}
+
+// layout is an OCI image layout, with all of its blobs.
+type layout struct {
+	blobs map[digest.Digest]blob
+	// root is the descriptor of the image manifest, or of the image index for
+	// multi-platform images.
+	root ocispecs.Descriptor
+}
+
+// newLayout creates an OCI image layout containing the images. If more than
+// one image is provided, they are referenced by an image index.
+func newLayout(images []image, sourceDateEpoch time.Time) (*layout, error) {
+	l := &layout{
+		blobs: map[digest.Digest]blob{},
+	}
+
+	addJSON := func(mediaType string, v any) (ocispecs.Descriptor, error) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return ocispecs.Descriptor{}, err
+		}
+
+		dgst := digest.FromBytes(data)
+		l.blobs[dgst] = blob{digest: dgst, size: int64(len(data)), data: data}
+
+		return ocispecs.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}, nil
+	}
+
+	var manifestDescs []ocispecs.Descriptor
+	for _, img := range images {
+		layerPaths := img.layerPaths
+		if len(layerPaths) == 0 {
+			layerPaths = []string{img.layerPath}
+		}
+
+		config := img.config
+
+		var created *time.Time
+		if !sourceDateEpoch.IsZero() {
+			t := sourceDateEpoch.UTC()
+			created = &t
+			config.Created = created
+		}
+
+		var layerDescs []ocispecs.Descriptor
+		for _, layerPath := range layerPaths {
+			layer, diffID, err := compressLayer(layerPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compress layer: %w", err)
+			}
+			l.blobs[layer.digest] = layer
+
+			layerDescs = append(layerDescs, ocispecs.Descriptor{
+				MediaType: ocispecs.MediaTypeImageLayerGzip,
+				Digest:    layer.digest,
+				Size:      layer.size,
+			})
+
+			config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+			config.History = append(config.History, ocispecs.History{Created: created, CreatedBy: "immutos build"})
+		}
+
+		configDesc, err := addJSON(ocispecs.MediaTypeImageConfig, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal image config: %w", err)
+		}
+
+		manifestDesc, err := addJSON(ocispecs.MediaTypeImageManifest, ocispecs.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageManifest,
+			Config:    configDesc,
+			Layers:    layerDescs,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal image manifest: %w", err)
+		}
+
+		platform := img.platform
+		manifestDesc.Platform = &platform
+
+		manifestDescs = append(manifestDescs, manifestDesc)
+	}
+
+	l.root = manifestDescs[0]
+	if len(manifestDescs) > 1 {
+		var err error
+		l.root, err = addJSON(ocispecs.MediaTypeImageIndex, ocispecs.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageIndex,
+			Manifests: manifestDescs,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal image index: %w", err)
+		}
+	}
+
+	return l, nil
+}
+
+// open opens the content of a blob.
+func (l *layout) open(dgst digest.Digest) (io.ReadCloser, error) {
+	b, ok := l.blobs[dgst]
+	if !ok {
+		return nil, fmt.Errorf("blob %s: %w", dgst, os.ErrNotExist)
+	}
+
+	if b.path != "" {
+		return os.Open(b.path)
+	}
+
+	return io.NopCloser(bytes.NewReader(b.data)), nil
+}
+
+// writeArchive writes the layout out as a tarball, tagging the image with
+// the given tags. If dockerManifest is set, a manifest.json is included so
+// that the archive can be loaded with `docker load`.
+func (l *layout) writeArchive(archivePath string, tags []string, sourceDateEpoch time.Time, dockerManifest bool) error {
+	index := ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+	}
+
+	if len(tags) == 0 {
+		index.Manifests = append(index.Manifests, l.root)
+	}
+
+	for _, tag := range tags {
+		named, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			return fmt.Errorf("failed to parse tag %q: %w", tag, err)
+		}
+		named = reference.TagNameOnly(named)
+
+		desc := l.root
+		desc.Annotations = map[string]string{
+			"io.containerd.image.name": named.String(),
+		}
+
+		if tagged, ok := named.(reference.Tagged); ok {
+			desc.Annotations[ocispecs.AnnotationRefName] = tagged.Tag()
+		}
+
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	indexData, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %w", err)
+	}
+
+	layoutData, err := json.Marshal(ocispecs.ImageLayout{Version: ocispecs.ImageLayoutVersion})
+	if err != nil {
+		return fmt.Errorf("failed to marshal image layout: %w", err)
+	}
+
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+
+	var modTime time.Time
+	if !sourceDateEpoch.IsZero() {
+		modTime = sourceDateEpoch
+	}
+
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     dir,
+			Mode:     0o755,
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return fmt.Errorf("failed to write archive: %w", err)
+		}
+	}
+
+	digests := make([]digest.Digest, 0, len(l.blobs))
+	for dgst := range l.blobs {
+		digests = append(digests, dgst)
+	}
+	slices.Sort(digests)
+
+	for _, dgst := range digests {
+		if err := l.writeBlob(tw, dgst, modTime); err != nil {
+			return err
+		}
+	}
+
+	if err := writeArchiveFile(tw, ocispecs.ImageLayoutFile, int64(len(layoutData)), modTime, bytes.NewReader(layoutData)); err != nil {
+		return err
+	}
+
+	if err := writeArchiveFile(tw, "index.json", int64(len(indexData)), modTime, bytes.NewReader(indexData)); err != nil {
+		return err
+	}
+
+	if dockerManifest {
+		manifestData, err := l.dockerManifest(tags)
+		if err != nil {
+			return fmt.Errorf("failed to create docker manifest: %w", err)
+		}
+
+		if err := writeArchiveFile(tw, "manifest.json", int64(len(manifestData)), modTime, bytes.NewReader(manifestData)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	return f.Close()
+}
+
+// dockerManifest returns the manifest.json used by `docker load`. Only
+// single platform images are supported.
+func (l *layout) dockerManifest(tags []string) ([]byte, error) {
+	if l.root.MediaType != ocispecs.MediaTypeImageManifest {
+		return nil, fmt.Errorf("unsupported media type: %s", l.root.MediaType)
+	}
+
+	rc, err := l.open(l.root.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var manifest ocispecs.Manifest
+	if err := json.NewDecoder(rc).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+
+	blobPath := func(dgst digest.Digest) string {
+		return path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded())
+	}
+
+	repoTags := []string{}
+	for _, tag := range tags {
+		named, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse tag %q: %w", tag, err)
+		}
+
+		repoTags = append(repoTags, reference.FamiliarString(reference.TagNameOnly(named)))
+	}
+
+	layers := []string{}
+	for _, layer := range manifest.Layers {
+		layers = append(layers, blobPath(layer.Digest))
+	}
+
+	return json.Marshal([]struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}{{
+		Config:   blobPath(manifest.Config.Digest),
+		RepoTags: repoTags,
+		Layers:   layers,
+	}})
+}
+
+func (l *layout) writeBlob(tw *tar.Writer, dgst digest.Digest, modTime time.Time) error {
+	rc, err := l.open(dgst)
+	if err != nil {
+		return fmt.Errorf("failed to open blob: %w", err)
+	}
+	defer rc.Close()
+
+	return writeArchiveFile(tw, path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded()), l.blobs[dgst].size, modTime, rc)
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, size int64, modTime time.Time, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     size,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	if _, err := io.CopyN(tw, r, size); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	return nil
+}
+
+// compressLayer gzip compresses an uncompressed layer tarball, returning the
+// compressed blob and the digest of the uncompressed content (the diff id).
+func compressLayer(layerPath string) (blob, digest.Digest, error) {
+	src, err := os.Open(layerPath)
+	if err != nil {
+		return blob{}, "", err
+	}
+	defer src.Close()
+
+	compressedPath := layerPath + ".gz"
+	dst, err := os.Create(compressedPath)
+	if err != nil {
+		return blob{}, "", err
+	}
+	defer dst.Close()
+
+	compressedDigester := digest.Canonical.Digester()
+	diffIDDigester := digest.Canonical.Digester()
+
+	counter := &countingWriter{}
+	zw := gzip.NewWriter(io.MultiWriter(dst, compressedDigester.Hash(), counter))
+
+	if _, err := io.Copy(zw, io.TeeReader(src, diffIDDigester.Hash())); err != nil {
+		return blob{}, "", err
+	}
+
+	if err := zw.Close(); err != nil {
+		return blob{}, "", err
+	}
+
+	if err := dst.Close(); err != nil {
+		return blob{}, "", err
+	}
+
+	return blob{
+		digest: compressedDigester.Digest(),
+		size:   counter.n,
+		path:   compressedPath,
+	}, diffIDDigester.Digest(), nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,460 @@
+//go:build linux
+
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package native
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	cp "github.com/otiai10/copy"
+)
+
+// assembleEnv is set when the process has been re-executed to assemble a root
+// filesystem. Its value is the stage of the assembly (see assembleInNamespace).
+const assembleEnv = "IMMUTOS_NATIVE_ASSEMBLE"
+
+const (
+	assembleStageUserNamespace  = "user"
+	assembleStageMountNamespace = "mount"
+)
+
+// enterRootEnv is set when the process has been re-executed to run a command
+// inside the root filesystem (see runInRoot).
+const enterRootEnv = "IMMUTOS_NATIVE_ENTER_ROOT"
+
+// The subordinate ids that root is mapped to, if none are allocated to root
+// in /etc/subuid and /etc/subgid (the same default range as LXD).
+const (
+	defaultSubordinateIDStart = 1000000
+	defaultSubordinateIDCount = 65536
+)
+
+// Init must be called at the start of main(). If the process was re-executed
+// by the native builder, it assembles the root filesystem (or runs a command
+// inside it) and exits.
+func Init() {
+	if _, ok := os.LookupEnv(enterRootEnv); ok {
+		err := enterRootAndExec(os.Args[1:])
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var err error
+	switch os.Getenv(assembleEnv) {
+	case "":
+		return
+	case assembleStageUserNamespace:
+		err = enterMountNamespace()
+
+		// The second stage has already reported the error.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+	case assembleStageMountNamespace:
+		err = assembleFromPipe()
+	default:
+		err = fmt.Errorf("unknown assembly stage: %q", os.Getenv(assembleEnv))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+// assembleInNamespace re-executes the current binary to assemble the root
+// filesystem in new user, mount and pid namespaces. Root (in the namespace)
+// is never the real root: it is mapped to the current user, or to a range of
+// subordinate ids when running as root.
+//
+// The work directory (containing the root filesystem) might not be reachable
+// by root in the namespace, as its parent directories can belong to a user
+// that isn't mapped. So the first stage (in the user namespace) changes into
+// the work directory through an inherited descriptor, and the second stage
+// (in a new mount namespace, where the working directory is translated into
+// a mount of its own) assembles the root filesystem relative to it.
+func assembleInNamespace(ctx context.Context, opts *AssembleOptions) error {
+	idMap, err := newIDMapping()
+	if err != nil {
+		return err
+	}
+
+	// The root filesystem and layers are written next to each other.
+	workDir := filepath.Dir(opts.RootFSDir)
+
+	childOpts, err := prepareWorkDir(workDir, opts, idMap)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(childOpts)
+	if err != nil {
+		return fmt.Errorf("failed to marshal assemble options: %w", err)
+	}
+
+	workDirFile, err := os.Open(workDir)
+	if err != nil {
+		return fmt.Errorf("failed to open work directory: %w", err)
+	}
+	defer workDirFile.Close()
+
+	syncReader, syncWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create sync pipe: %w", err)
+	}
+	defer syncWriter.Close()
+
+	// The executable might not be reachable by path either.
+	cmd := exec.CommandContext(ctx, "/proc/self/exe")
+	cmd.Env = append(os.Environ(), assembleEnv+"="+assembleStageUserNamespace)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{syncReader, workDirFile}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID,
+		Pdeathsig:   syscall.SIGKILL,
+		UidMappings: idMap.uidMappings,
+		GidMappings: idMap.gidMappings,
+		// Only allowed if the mappings are written by a privileged parent.
+		GidMappingsEnableSetgroups: os.Geteuid() == 0,
+	}
+
+	if os.Geteuid() == 0 {
+		// The real root isn't mapped, so switch to root in the namespace.
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: 0, Gid: 0}
+	}
+
+	err = cmd.Start()
+	_ = syncReader.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start assembly: %w", err)
+	}
+
+	if idMap.mapIDs != nil {
+		if err := idMap.mapIDs(cmd.Process.Pid); err != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			return err
+		}
+	}
+
+	// Signal the child to start, followed by the options for the second stage.
+	if _, err := syncWriter.Write(append([]byte{0}, data...)); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("failed to signal assembly: %w", err)
+	}
+	_ = syncWriter.Close()
+
+	return cmd.Wait()
+}
+
+// enterMountNamespace is the first stage of the assembly. It waits for the
+// user namespace to be set up, changes into the work directory and
+// re-executes the second stage in a new mount namespace.
+func enterMountNamespace() error {
+	syncPipe := os.NewFile(3, "sync")
+	defer syncPipe.Close()
+
+	if _, err := syncPipe.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("failed to wait for parent: %w", err)
+	}
+
+	workDir := os.NewFile(4, "workdir")
+	if err := workDir.Chdir(); err != nil {
+		return fmt.Errorf("failed to change to work directory: %w", err)
+	}
+	_ = workDir.Close()
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Env = append(os.Environ(), assembleEnv+"="+assembleStageMountNamespace)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{syncPipe}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS,
+		Pdeathsig:  syscall.SIGKILL,
+	}
+
+	return cmd.Run()
+}
+
+// assembleFromPipe is the second stage of the assembly. It reads the options
+// (with paths relative to the work directory) and assembles the root
+// filesystem.
+func assembleFromPipe() error {
+	syncPipe := os.NewFile(3, "sync")
+	data, err := io.ReadAll(syncPipe)
+	if err != nil {
+		return fmt.Errorf("failed to read assemble options: %w", err)
+	}
+	_ = syncPipe.Close()
+
+	var opts AssembleOptions
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return fmt.Errorf("failed to unmarshal assemble options: %w", err)
+	}
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: opts.LogLevel,
+	})))
+
+	return Assemble(context.Background(), &opts)
+}
+
+// idMapping maps the ids of a user namespace to the host.
+type idMapping struct {
+	// uid and gid are the host ids of root in the namespace.
+	uid, gid int
+	// uidMappings and gidMappings are written when the child is created.
+	uidMappings []syscall.SysProcIDMap
+	gidMappings []syscall.SysProcIDMap
+	// mapIDs otherwise writes the mappings of the child (using newuidmap(1)
+	// and newgidmap(1)).
+	mapIDs func(pid int) error
+}
+
+func newIDMapping() (*idMapping, error) {
+	if os.Geteuid() == 0 {
+		uidStart, uidCount, err := subordinateIDs("/etc/subuid", "root", "0")
+		if err != nil {
+			slog.Debug("Using the default subordinate uids for root", slog.Any("error", err))
+			uidStart, uidCount = defaultSubordinateIDStart, defaultSubordinateIDCount
+		}
+
+		gidStart, gidCount, err := subordinateIDs("/etc/subgid", "root", "0")
+		if err != nil {
+			slog.Debug("Using the default subordinate gids for root", slog.Any("error", err))
+			gidStart, gidCount = defaultSubordinateIDStart, defaultSubordinateIDCount
+		}
+
+		return &idMapping{
+			uid:         uidStart,
+			gid:         gidStart,
+			uidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: uidStart, Size: uidCount}},
+			gidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: gidStart, Size: gidCount}},
+		}, nil
+	}
+
+	idMap := &idMapping{uid: os.Geteuid(), gid: os.Getegid()}
+
+	var err error
+	idMap.mapIDs, err = subordinateIDMapper()
+	if err != nil {
+		slog.Warn("Subordinate ids are not available, packages that change file ownership will fail to install",
+			slog.Any("error", err))
+
+		// Fall back to only mapping the current user to root.
+		idMap.uidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}}
+		idMap.gidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}}
+	}
+
+	return idMap, nil
+}
+
+// prepareWorkDir hands the work directory over to root in the namespace, and
+// returns the assemble options as seen by the child (relative to the work
+// directory). Inputs outside of the work directory are copied into
+// it, as the child might not be able to read them.
+func prepareWorkDir(workDir string, opts *AssembleOptions, idMap *idMapping) (*AssembleOptions, error) {
+	workDir, err := filepath.Abs(workDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Lchown(workDir, idMap.uid, idMap.gid); err != nil {
+		return nil, fmt.Errorf("failed to change owner of work directory: %w", err)
+	}
+
+	inputsDir := filepath.Join(workDir, "inputs")
+	if err := os.RemoveAll(inputsDir); err != nil {
+		return nil, fmt.Errorf("failed to remove inputs directory: %w", err)
+	}
+
+	var inputs int
+	pass := func(name string, input bool) (string, error) {
+		if name == "" {
+			return "", nil
+		}
+
+		name, err := filepath.Abs(name)
+		if err != nil {
+			return "", err
+		}
+
+		rel, err := filepath.Rel(workDir, name)
+		if err != nil {
+			return "", err
+		}
+
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			if !input {
+				return "", fmt.Errorf("output %s is not in the work directory", name)
+			}
+
+			if err := os.MkdirAll(inputsDir, 0o700); err != nil {
+				return "", fmt.Errorf("failed to create inputs directory: %w", err)
+			}
+
+			if err := os.Lchown(inputsDir, idMap.uid, idMap.gid); err != nil {
+				return "", fmt.Errorf("failed to change owner of inputs directory: %w", err)
+			}
+
+			inputs++
+			rel = filepath.Join("inputs", fmt.Sprintf("%d-%s", inputs, filepath.Base(name)))
+			if err := cp.Copy(name, filepath.Join(workDir, rel)); err != nil {
+				return "", fmt.Errorf("failed to copy %s: %w", name, err)
+			}
+		}
+
+		if input {
+			if err := os.Lchown(filepath.Join(workDir, rel), idMap.uid, idMap.gid); err != nil {
+				return "", fmt.Errorf("failed to change owner of %s: %w", name, err)
+			}
+		}
+
+		return rel, nil
+	}
+
+	childOpts := *opts
+	for _, field := range []struct {
+		name  *string
+		input bool
+	}{
+		{&childOpts.RootFSDir, false},
+		{&childOpts.LayerPath, false},
+		{&childOpts.DpkgDatabaseArchivePath, true},
+		{&childOpts.ManifestPath, true},
+		{&childOpts.RecipePath, true},
+		{&childOpts.SecondStageBinaryPath, true},
+	} {
+		if *field.name, err = pass(*field.name, field.input); err != nil {
+			return nil, err
+		}
+	}
+
+	childOpts.LayerPaths = make([]string, len(opts.LayerPaths))
+	for i, name := range opts.LayerPaths {
+		if childOpts.LayerPaths[i], err = pass(name, false); err != nil {
+			return nil, err
+		}
+	}
+
+	childOpts.DataArchivePaths = make([]string, len(opts.DataArchivePaths))
+	for i, name := range opts.DataArchivePaths {
+		if childOpts.DataArchivePaths[i], err = pass(name, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return &childOpts, nil
+}
+
+// subordinateIDMapper returns a function that maps root (and the subordinate
+// ids of the current user) into the user namespace of a process, using the
+// setuid newuidmap(1) and newgidmap(1) helpers.
+func subordinateIDMapper() (func(pid int) error, error) {
+	newuidmap, err := exec.LookPath("newuidmap")
+	if err != nil {
+		return nil, err
+	}
+
+	newgidmap, err := exec.LookPath("newgidmap")
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current user: %w", err)
+	}
+
+	uidStart, uidCount, err := subordinateIDs("/etc/subuid", u.Username, u.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	gidStart, gidCount, err := subordinateIDs("/etc/subgid", u.Username, u.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(pid int) error {
+		uidMap := []string{strconv.Itoa(pid), "0", strconv.Itoa(os.Geteuid()), "1", "1", strconv.Itoa(uidStart), strconv.Itoa(uidCount)}
+		if out, err := exec.Command(newuidmap, uidMap...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to map user ids: %w: %s", err, out)
+		}
+
+		gidMap := []string{strconv.Itoa(pid), "0", strconv.Itoa(os.Getegid()), "1", "1", strconv.Itoa(gidStart), strconv.Itoa(gidCount)}
+		if out, err := exec.Command(newgidmap, gidMap...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to map group ids: %w: %s", err, out)
+		}
+
+		return nil
+	}, nil
+}
+
+// subordinateIDs returns the first range of subordinate ids allocated to the
+// user (see subuid(5)).
+func subordinateIDs(path, username, uid string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != username && fields[0] != uid) {
+			continue
+		}
+
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid subordinate id range in %s: %w", path, err)
+		}
+
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid subordinate id range in %s: %w", path, err)
+		}
+
+		return start, count, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	return 0, 0, fmt.Errorf("no subordinate ids allocated to %s in %s", username, path)
+}
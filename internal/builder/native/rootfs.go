@@ -0,0 +1,123 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package native
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	cp "github.com/otiai10/copy"
+)
+
+// writeRootFSArchive writes the root filesystem of the images out as a
+// tarball. For multi-platform builds, each root filesystem is placed in a
+// directory named after its platform (eg. linux_amd64/).
+func writeRootFSArchive(archivePath string, images []image, sourceDateEpoch time.Time) error {
+	// The layer already is a tarball of the root filesystem.
+	if len(images) == 1 {
+		return cp.Copy(images[0].layerPath, archivePath)
+	}
+
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+
+	var modTime time.Time
+	if !sourceDateEpoch.IsZero() {
+		modTime = sourceDateEpoch
+	}
+
+	for _, img := range images {
+		prefix := platformDir(img.platform)
+
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     prefix + "/",
+			Mode:     0o755,
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return err
+		}
+
+		if err := copyLayer(tw, img.layerPath, prefix); err != nil {
+			return fmt.Errorf("failed to copy root filesystem for %s: %w", platforms.Format(img.platform), err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// copyLayer copies the entries of a layer tarball, placing them under prefix.
+func copyLayer(tw *tar.Writer, layerPath, prefix string) error {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		hdr.Name = path.Join(prefix, hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = path.Join(prefix, hdr.Linkname)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// platformDir returns the directory name used for a platform in
+// multi-platform outputs (matching BuildKit's platform split).
+func platformDir(platform ocispecs.Platform) string {
+	return strings.ReplaceAll(platforms.Format(platforms.Normalize(platform)), "/", "_")
+}
@@ -28,26 +28,53 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/containerd/containerd/platforms"
 	"github.com/moby/buildkit/client"
+	_ "github.com/moby/buildkit/client/connhelper/dockercontainer"
 	"github.com/moby/buildkit/client/llb"
 
+	"github.com/immutos/immutos/internal/builder"
 	"github.com/immutos/immutos/internal/buildkit/exptypes"
+	"github.com/immutos/immutos/internal/manifest"
 	gateway "github.com/moby/buildkit/frontend/gateway/client"
 	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth/authprovider"
 	"github.com/moby/buildkit/util/progress/progresswriter"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+var _ builder.Builder = (*BuildKit)(nil)
+
+// layerPlanFile is the name of the layer plan in the build context.
+const layerPlanFile = "layers.json"
+
 // BuildKit is a wrapper around BuildKit that provides a simplified interface
 // for building OCI images using BuildKit running in a Docker container.
 type BuildKit struct {
 	certsDir      string
 	containerName string
 	address       string
+	// external is true if the daemon is not managed by immutos.
+	external bool
+	tls      *TLSOptions
+	// Caches to import from, and export to.
+	cacheImports []CacheOptions
+	cacheExports []CacheOptions
+}
+
+// TLSOptions configures the TLS credentials for connecting to an existing
+// BuildKit daemon over TCP.
+type TLSOptions struct {
+	// ServerName is the expected name of the daemon certificate.
+	ServerName string
+	// CACert is the path to the CA certificate used to verify the daemon.
+	CACert string
+	// Cert is the optional path to the client certificate.
+	Cert string
+	// Key is the optional path to the client key.
+	Key string
 }
 
 // New creates a new BuildKit instance.
@@ -58,42 +85,41 @@ func New(name, certsDir string) *BuildKit {
 	}
 }
 
-type BuildOptions struct {
-	// OCIArchivePath is the path to the output OCI image tarball.
-	OCIArchivePath string
-	// RecipePath is the path to the immutos recipe file.
-	RecipePath string
-	// SourceDateEpoch is the source date epoch for the image.
-	SourceDateEpoch time.Time
-	// SecondStageBinaryPath optionally overrides the path to the second-stage binary.
-	SecondStageBinaryPath string
-	// DownloadOnly specifies whether to only download packages and not install them.
-	DownloadOnly bool
-	// ImageConf is the optional OCI image configuration.
-	ImageConf ocispecs.ImageConfig
-	// Tags is a list of tags to apply to the image.
-	Tags []string
-	// PlatformOpts is a list of platform build options.
-	PlatformOpts []PlatformBuildOptions
-}
+// Connect creates a BuildKit instance that uses an existing BuildKit daemon,
+// at a unix://, tcp://, or docker-container:// address. The daemon is not
+// managed by immutos, so there is no need to start it.
+func Connect(address string, tls *TLSOptions) (*BuildKit, error) {
+	addressURL, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse buildkit address: %w", err)
+	}
 
-type PlatformBuildOptions struct {
-	// Platform is the platform to build the image for.
-	Platform ocispecs.Platform
-	// BuildContextDir is the path to the build context directory.
-	BuildContextDir string
-	// DpkgDatabaseArchivePath is the path to the dpkg configuration archive.
-	// The path must be relative to the build context directory.
-	DpkgDatabaseArchivePath string
-	// DataArchivePaths is a list of paths to package data archives.
-	// The paths must be relative to the build context directory.
-	DataArchivePaths []string
+	switch addressURL.Scheme {
+	case "unix", "docker-container":
+		if tls != nil {
+			return nil, fmt.Errorf("TLS is not supported for %s addresses", addressURL.Scheme)
+		}
+	case "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported buildkit address scheme: %s", addressURL.Scheme)
+	}
+
+	return &BuildKit{
+		address:  address,
+		external: true,
+		tls:      tls,
+	}, nil
 }
 
 // Build builds an OCI image tarball using BuildKit.
-func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
+func (b *BuildKit) Build(ctx context.Context, opts builder.BuildOptions) error {
 	isMultiPlatform := len(opts.PlatformOpts) > 1
 
+	cacheImports, cacheExports, err := b.cacheEntries()
+	if err != nil {
+		return err
+	}
+
 	buildFunc := func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
 		res := gateway.NewResult()
 
@@ -115,6 +141,8 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 				AddEnv("PATH", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin").
 				File(llb.Copy(llb.Local(buildContextKey), dpkgDatabaseArchiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
 
+			var provisioned llb.State
+
 			for _, dataArchivePath := range platformOpt.DataArchivePaths {
 				dataArchiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, dataArchivePath)
 				if err != nil {
@@ -124,6 +152,15 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 				state = state.File(llb.Copy(llb.Local(buildContextKey), dataArchiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
 			}
 
+			if platformOpt.ManifestPath != "" {
+				manifestRelPath, err := filepath.Rel(platformOpt.BuildContextDir, platformOpt.ManifestPath)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get relative path to manifest: %w", err)
+				}
+
+				state = state.File(llb.Copy(llb.Local(buildContextKey), manifestRelPath, manifest.Path, &llb.CopyInfo{CreateDestPath: true}))
+			}
+
 			if !opts.DownloadOnly {
 				if opts.SecondStageBinaryPath != "" {
 					// Copy the immutos binary into the root filesystem.
@@ -131,9 +168,10 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 				}
 
 				state = state.
-					Run(llb.Shlex("immutos second-stage merge-usr")).                 // Merge the /usr directory into the root filesystem.
-					Run(llb.Shlex("/var/lib/dpkg/info/base-passwd.preinst install")). // Create the /etc/group and /etc/passwd files (needed by dpkg).
-					Run(llb.Shlex("dpkg --configure -a")).                            // Configure the packages.
+					File(llb.Copy(llb.Local("conf"), filepath.Base(opts.RecipePath), "/etc/immutos/config.yaml", &llb.CopyInfo{CreateDestPath: true})).
+					Run(llb.Shlex("immutos second-stage merge-usr")).                             // Merge the /usr directory into the root filesystem.
+					Run(llb.Shlex("/var/lib/dpkg/info/base-passwd.preinst install")).             // Create the /etc/group and /etc/passwd files (needed by dpkg).
+					Run(llb.Shlex("immutos second-stage configure -f /etc/immutos/config.yaml")). // Configure the packages (in dependency order).
 					// Remove the dpkg log file, alternatives log file, and ldconfig cache file.
 					// These files are no longer needed and will lead to irreproducible builds.
 					File(llb.Rm("/var/log/dpkg.log")).
@@ -142,10 +180,14 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 
 				// Provision image (eg. create users/groups etc).
 				state = state.
-					File(llb.Copy(llb.Local("conf"), filepath.Base(opts.RecipePath), "/etc/immutos/config.yaml", &llb.CopyInfo{CreateDestPath: true})).
 					Run(llb.Shlex("immutos second-stage provision -f /etc/immutos/config.yaml")).
-					Root().
-					File(llb.Rm("/etc/immutos"))
+					Root()
+
+				// The provisioned image still contains the immutos binary (needed to
+				// split the image into layers).
+				provisioned = state
+
+				state = state.File(llb.Rm("/etc/immutos"))
 
 				// Remove the no longer needed immutos binary.
 				if opts.SecondStageBinaryPath != "" {
@@ -156,9 +198,23 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 				}
 			}
 
-			// Squash everything into a single final layer.
-			state = llb.Scratch().
-				File(llb.Copy(state, "/", "/", &llb.CopyInfo{}))
+			if len(platformOpt.Layers) > 0 && !opts.DownloadOnly {
+				// Split the root filesystem into a layer per group of packages.
+				layersState := provisioned.
+					File(llb.Copy(llb.Local(buildContextKey), layerPlanFile, "/etc/immutos/layers.json", &llb.CopyInfo{CreateDestPath: true})).
+					Run(llb.Shlex("immutos second-stage write-layers -f /etc/immutos/layers.json --rootfs /rootfs --output /layers"),
+						llb.AddMount("/rootfs", state, llb.Readonly)).
+					AddMount("/layers", llb.Scratch())
+
+				state = llb.Scratch()
+				for i := 0; i <= len(platformOpt.Layers); i++ {
+					state = state.File(llb.Copy(layersState, fmt.Sprintf("layer-%d.tar", i), "/", &llb.CopyInfo{AttemptUnpack: true}))
+				}
+			} else {
+				// Squash everything into a single final layer.
+				state = llb.Scratch().
+					File(llb.Copy(state, "/", "/", &llb.CopyInfo{}))
+			}
 
 			// Marshal the LLB definition.
 			def, err := state.Marshal(ctx, llb.Platform(platformOpt.Platform))
@@ -166,9 +222,7 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 				return nil, err
 			}
 
-			r, err := c.Solve(ctx, gateway.SolveRequest{
-				Definition: def.ToPB(),
-			})
+			r, err := c.Solve(ctx, solveRequest(def, cacheImports))
 			if err != nil {
 				return nil, err
 			}
@@ -202,19 +256,9 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 		return res, nil
 	}
 
-	buildkitURL, err := url.Parse(b.address)
+	c, err := b.newClient(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to parse buildkit address: %w", err)
-	}
-
-	c, err := client.New(ctx, "buildkitd", client.WithCredentials("buildkitd",
-		filepath.Join(b.certsDir, "ca.pem"), filepath.Join(b.certsDir, "immutos.pem"), filepath.Join(b.certsDir, "immutos-key.pem")),
-		client.WithContextDialer(func(_ context.Context, address string) (net.Conn, error) {
-			var d net.Dialer
-			return d.DialContext(ctx, "tcp", buildkitURL.Host)
-		}))
-	if err != nil {
-		return fmt.Errorf("failed to create buildkit client: %w", err)
+		return err
 	}
 	defer c.Close()
 
@@ -258,29 +302,24 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 
 		buildContextKey := fmt.Sprintf("build-context-%s", strings.ReplaceAll(platformStr, "/", "-"))
 		localDirs[buildContextKey] = platformOpt.BuildContextDir
+
+		if len(platformOpt.Layers) > 0 {
+			if opts.DownloadOnly {
+				slog.Warn("Download only images are not split into layers", slog.String("platform", platformStr))
+			}
+
+			if err := writeLayerPlan(platformOpt); err != nil {
+				return err
+			}
+		}
 	}
 
-	_, err = c.Build(ctx, client.SolveOpt{
-		LocalDirs: localDirs,
-		Exports: []client.ExportEntry{
-			{
-				Type: client.ExporterOCI,
-				Output: func(_ map[string]string) (io.WriteCloser, error) {
-					ociArchiveFile, err := os.Create(opts.OCIArchivePath)
-					if err != nil {
-						return nil, fmt.Errorf("failed to create output oci tarball: %w", err)
-					}
-
-					return ociArchiveFile, nil
-				},
-				Attrs: map[string]string{
-					"name":                          strings.Join(opts.Tags, ","),
-					exptypes.OptKeySourceDateEpoch:  strconv.Itoa(int(opts.SourceDateEpoch.UTC().Unix())),
-					exptypes.OptKeyRewriteTimestamp: "true",
-				},
-			},
-		},
-	}, "", buildFunc, pw.Status())
+	export, err := exportEntry(opts)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Build(ctx, solveOpt(localDirs, export, cacheImports, cacheExports), "", buildFunc, pw.Status())
 	if err != nil {
 		return fmt.Errorf("failed to build image: %w", err)
 	}
@@ -288,7 +327,136 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 	return nil
 }
 
-func exporterPlatforms(platformOpts ...PlatformBuildOptions) []byte {
+// solveOpt returns the options of the solve that builds the image.
+func solveOpt(localDirs map[string]string, export client.ExportEntry, cacheImports, cacheExports []client.CacheOptionsEntry) client.SolveOpt {
+	return client.SolveOpt{
+		LocalDirs: localDirs,
+		Exports:   []client.ExportEntry{export},
+		// The cache imports are also passed to the client, so that it can
+		// provide local caches to the daemon.
+		CacheImports: cacheImports,
+		CacheExports: cacheExports,
+		// Registry credentials (from the Docker config) for pushing images.
+		Session: []session.Attachable{authprovider.NewDockerAuthProvider(os.Stderr)},
+	}
+}
+
+// solveRequest returns the solve request of the root filesystem of a platform.
+func solveRequest(def *llb.Definition, cacheImports []client.CacheOptionsEntry) gateway.SolveRequest {
+	return gateway.SolveRequest{
+		Definition:   def.ToPB(),
+		CacheImports: gatewayCacheImports(cacheImports),
+	}
+}
+
+func (b *BuildKit) newClient(ctx context.Context) (*client.Client, error) {
+	var c *client.Client
+	if b.external {
+		var opts []client.ClientOpt
+		if b.tls != nil {
+			opts = append(opts, client.WithCredentials(b.tls.ServerName, b.tls.CACert, b.tls.Cert, b.tls.Key))
+		}
+
+		var err error
+		c, err = client.New(ctx, b.address, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create buildkit client: %w", err)
+		}
+	} else {
+		buildkitURL, err := url.Parse(b.address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse buildkit address: %w", err)
+		}
+
+		c, err = client.New(ctx, "buildkitd", client.WithCredentials("buildkitd",
+			filepath.Join(b.certsDir, "ca.pem"), filepath.Join(b.certsDir, "immutos.pem"), filepath.Join(b.certsDir, "immutos-key.pem")),
+			client.WithContextDialer(func(_ context.Context, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", buildkitURL.Host)
+			}))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create buildkit client: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// exportEntry returns the BuildKit exporter for the build output.
+func exportEntry(opts builder.BuildOptions) (client.ExportEntry, error) {
+	// Timestamps are clamped to the source date epoch for every output type.
+	attrs := map[string]string{
+		exptypes.OptKeySourceDateEpoch: strconv.Itoa(int(opts.SourceDateEpoch.UTC().Unix())),
+	}
+
+	if len(opts.Push) > 0 {
+		attrs["name"] = strings.Join(opts.Push, ",")
+		attrs["push"] = "true"
+		attrs[exptypes.OptKeyRewriteTimestamp] = "true"
+
+		return client.ExportEntry{
+			Type:  client.ExporterImage,
+			Attrs: attrs,
+		}, nil
+	}
+
+	output := func(_ map[string]string) (io.WriteCloser, error) {
+		f, err := os.Create(opts.Output.Dest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create output file: %w", err)
+		}
+
+		return f, nil
+	}
+
+	switch opts.Output.Type {
+	case builder.OutputOCI, builder.OutputDocker:
+		attrs["name"] = strings.Join(opts.Tags, ",")
+		attrs[exptypes.OptKeyRewriteTimestamp] = "true"
+
+		exporterType := client.ExporterOCI
+		if opts.Output.Type == builder.OutputDocker {
+			exporterType = client.ExporterDocker
+		}
+
+		return client.ExportEntry{
+			Type:   exporterType,
+			Output: output,
+			Attrs:  attrs,
+		}, nil
+	case builder.OutputTar:
+		return client.ExportEntry{
+			Type:   client.ExporterTar,
+			Output: output,
+			Attrs:  attrs,
+		}, nil
+	case builder.OutputLocal:
+		return client.ExportEntry{
+			Type:      client.ExporterLocal,
+			OutputDir: opts.Output.Dest,
+			Attrs:     attrs,
+		}, nil
+	default:
+		return client.ExportEntry{}, fmt.Errorf("unsupported output type: %q", opts.Output.Type)
+	}
+}
+
+// writeLayerPlan writes the layer plan into the build context, for use by the
+// write-layers second stage command.
+func writeLayerPlan(platformOpt builder.PlatformBuildOptions) error {
+	data, err := json.Marshal(platformOpt.Layers)
+	if err != nil {
+		return fmt.Errorf("failed to marshal layer plan: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(platformOpt.BuildContextDir, layerPlanFile), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write layer plan: %w", err)
+	}
+
+	return nil
+}
+
+func exporterPlatforms(platformOpts ...builder.PlatformBuildOptions) []byte {
 	exporterPlatforms := exptypes.Platforms{
 		Platforms: make([]exptypes.Platform, len(platformOpts)),
 	}
@@ -308,23 +476,8 @@ func exporterPlatforms(platformOpts ...PlatformBuildOptions) []byte {
 	return exporterPlatformsBytes
 }
 
-func exporterImageConfig(imageConf ocispecs.ImageConfig, platformOpt PlatformBuildOptions) ([]byte, error) {
-	defaultEnv := []string{
-		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-		"TERM=xterm",
-	}
-
-	imageConf.Env = append(defaultEnv, imageConf.Env...)
-
-	img := ocispecs.Image{
-		Platform: platformOpt.Platform,
-		Config:   imageConf,
-		RootFS: ocispecs.RootFS{
-			Type: "layers",
-		},
-	}
-
-	data, err := json.Marshal(img)
+func exporterImageConfig(imageConf ocispecs.ImageConfig, platformOpt builder.PlatformBuildOptions) ([]byte, error) {
+	data, err := json.Marshal(builder.NewImage(imageConf, platformOpt.Platform))
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal image config: %w", err)
 	}
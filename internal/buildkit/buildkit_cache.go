@@ -0,0 +1,189 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package buildkit
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+)
+
+// CacheType is the type of a BuildKit cache import/export.
+type CacheType string
+
+const (
+	// CacheLocal is a cache stored in a local directory.
+	CacheLocal CacheType = "local"
+	// CacheRegistry is a cache stored in a registry.
+	CacheRegistry CacheType = "registry"
+)
+
+// CacheOptions configures a BuildKit cache import (--cache-from) or export
+// (--cache-to).
+type CacheOptions struct {
+	// Type is the type of the cache.
+	Type CacheType
+	// Attrs are the attributes of the cache (eg. dest, src, ref, mode).
+	Attrs map[string]string
+}
+
+// ParseCacheOptions parses a cache import/export specification, in the
+// 'type=local,src|dest=<dir>' or 'type=registry,ref=<ref>[,mode=min|max]'
+// format. A specification without any fields is a registry reference.
+func ParseCacheOptions(spec string, export bool) (CacheOptions, error) {
+	if !strings.Contains(spec, "=") {
+		spec = "type=registry,ref=" + spec
+	}
+
+	opts := CacheOptions{Attrs: map[string]string{}}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return CacheOptions{}, fmt.Errorf("invalid cache field: %q", field)
+		}
+
+		key = strings.TrimSpace(key)
+		if key == "type" {
+			opts.Type = CacheType(strings.TrimSpace(value))
+		} else {
+			opts.Attrs[key] = value
+		}
+	}
+
+	var required string
+	allowed := map[string]bool{}
+	switch opts.Type {
+	case CacheLocal:
+		required = "src"
+		if export {
+			required = "dest"
+		}
+		allowed[required] = true
+	case CacheRegistry:
+		required = "ref"
+		allowed["ref"] = true
+	case "":
+		return CacheOptions{}, fmt.Errorf("cache type is required")
+	default:
+		return CacheOptions{}, fmt.Errorf("unsupported cache type: %q", opts.Type)
+	}
+
+	if export {
+		allowed["mode"] = true
+
+		// The image is squashed (or split) into new layers, so the cache of the
+		// intermediate steps (eg. configuring packages) is only exported in
+		// max mode.
+		if opts.Attrs["mode"] == "" {
+			opts.Attrs["mode"] = "max"
+		}
+
+		if mode := opts.Attrs["mode"]; mode != "min" && mode != "max" {
+			return CacheOptions{}, fmt.Errorf("unsupported cache mode: %q", mode)
+		}
+	}
+
+	for key := range opts.Attrs {
+		if !allowed[key] {
+			return CacheOptions{}, fmt.Errorf("unknown %s cache field: %q", opts.Type, key)
+		}
+	}
+
+	if opts.Attrs[required] == "" {
+		return CacheOptions{}, fmt.Errorf("%s cache %s is required", opts.Type, required)
+	}
+
+	return opts, nil
+}
+
+// SetCache configures the caches to import from, and export to, when
+// building images.
+func (b *BuildKit) SetCache(imports, exports []CacheOptions) {
+	b.cacheImports = imports
+	b.cacheExports = exports
+}
+
+// WithoutCacheExport returns a copy of the BuildKit instance that only
+// imports the caches. Builds that are followed by another build (eg. the base
+// image of an extension) use it, as every export to the same destination
+// replaces the previous one.
+func (b *BuildKit) WithoutCacheExport() *BuildKit {
+	copied := *b
+	copied.cacheExports = nil
+	return &copied
+}
+
+// cacheEntries returns the cache imports and exports of a solve.
+func (b *BuildKit) cacheEntries() (imports, exports []client.CacheOptionsEntry, err error) {
+	for _, opts := range b.cacheImports {
+		if opts.Type == CacheLocal {
+			// The cache won't exist until it has been exported once.
+			if _, err := os.Stat(filepath.Join(opts.Attrs["src"], "index.json")); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					slog.Warn("Local cache not found, skipping import", slog.String("src", opts.Attrs["src"]))
+					continue
+				}
+
+				return nil, nil, fmt.Errorf("failed to stat local cache: %w", err)
+			}
+		}
+
+		imports = append(imports, client.CacheOptionsEntry{
+			Type:  string(opts.Type),
+			Attrs: copyAttrs(opts.Attrs),
+		})
+	}
+
+	for _, opts := range b.cacheExports {
+		exports = append(exports, client.CacheOptionsEntry{
+			Type:  string(opts.Type),
+			Attrs: copyAttrs(opts.Attrs),
+		})
+	}
+
+	return imports, exports, nil
+}
+
+// gatewayCacheImports returns the cache imports of the solve requests made by
+// the build function. The client resolves the digest of local caches (in
+// place) when the solve starts, so this must be called from the build function.
+func gatewayCacheImports(imports []client.CacheOptionsEntry) []gateway.CacheOptionsEntry {
+	var entries []gateway.CacheOptionsEntry
+	for _, im := range imports {
+		entries = append(entries, gateway.CacheOptionsEntry{
+			Type:  im.Type,
+			Attrs: im.Attrs,
+		})
+	}
+
+	return entries
+}
+
+func copyAttrs(attrs map[string]string) map[string]string {
+	copied := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		copied[k] = v
+	}
+
+	return copied
+}
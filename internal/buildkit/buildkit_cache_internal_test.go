@@ -0,0 +1,77 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package buildkit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachePlumbing(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	localCacheDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(localCacheDir, "index.json"), []byte("{}"), 0o644))
+
+	b := New("immutos-test", t.TempDir())
+	b.SetCache([]CacheOptions{
+		{Type: CacheLocal, Attrs: map[string]string{"src": localCacheDir}},
+		{Type: CacheLocal, Attrs: map[string]string{"src": filepath.Join(t.TempDir(), "missing")}},
+		{Type: CacheRegistry, Attrs: map[string]string{"ref": "registry.example.com/debian:cache"}},
+	}, []CacheOptions{
+		{Type: CacheRegistry, Attrs: map[string]string{"ref": "registry.example.com/debian:cache", "mode": "max"}},
+	})
+
+	cacheImports, cacheExports, err := b.cacheEntries()
+	require.NoError(t, err)
+
+	opt := solveOpt(map[string]string{}, client.ExportEntry{Type: client.ExporterOCI}, cacheImports, cacheExports)
+
+	// The missing local cache is skipped.
+	require.Equal(t, []client.CacheOptionsEntry{
+		{Type: "local", Attrs: map[string]string{"src": localCacheDir}},
+		{Type: "registry", Attrs: map[string]string{"ref": "registry.example.com/debian:cache"}},
+	}, opt.CacheImports)
+	require.Equal(t, []client.CacheOptionsEntry{
+		{Type: "registry", Attrs: map[string]string{"ref": "registry.example.com/debian:cache", "mode": "max"}},
+	}, opt.CacheExports)
+
+	// The client resolves the digest of local caches in place when the solve
+	// starts, which the solve requests of the build function must see.
+	opt.CacheImports[0].Attrs["digest"] = "sha256:0123"
+
+	def, err := llb.Scratch().Marshal(context.Background())
+	require.NoError(t, err)
+
+	req := solveRequest(def, cacheImports)
+	require.Len(t, req.CacheImports, 2)
+	require.Equal(t, "local", req.CacheImports[0].Type)
+	require.Equal(t, "sha256:0123", req.CacheImports[0].Attrs["digest"])
+	require.Equal(t, "registry", req.CacheImports[1].Type)
+
+	// Builds that are followed by another build only import the caches.
+	_, cacheExports, err = b.WithoutCacheExport().cacheEntries()
+	require.NoError(t, err)
+	require.Empty(t, cacheExports)
+}
@@ -35,13 +35,20 @@ import (
 	"github.com/docker/docker/api/types/mount"
 	dockerclient "github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 	"github.com/immutos/immutos/internal/constants"
+	"github.com/moby/buildkit/client"
 	"golang.org/x/term"
 )
 
 // StartDaemon starts the BuildKit daemon in a Docker container (if it is not already running).
 func (b *BuildKit) StartDaemon(ctx context.Context) error {
+	// Mutual TLS certificates for the BuildKit daemon.
+	if err := os.MkdirAll(b.certsDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create certs directory: %w", err)
+	}
+
 	needsRestart, err := refreshCertificates(b.certsDir)
 	if err != nil {
 		return fmt.Errorf("failed to refresh certificates: %w", err)
@@ -67,9 +74,22 @@ func (b *BuildKit) StartDaemon(ctx context.Context) error {
 				goto BUILDKITD_ALREADY_RUNNING
 			}
 
+			// Restart a stopped container (preserving its cache).
+			if !needsRestart {
+				slog.Debug("Restarting existing buildkit container", slog.String("name", b.containerName))
+
+				if err := cli.ContainerStart(ctx, c.ID, types.ContainerStartOptions{}); err != nil {
+					slog.Warn("Failed to restart existing buildkit container", slog.Any("error", err))
+				} else {
+					containerID = c.ID
+					goto BUILDKITD_ALREADY_RUNNING
+				}
+			}
+
 			slog.Debug("Removing existing buildkit container", slog.String("name", b.containerName))
 
-			if err := cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			// Also remove the cache volume, as it won't be reused.
+			if err := cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true}); err != nil {
 				return fmt.Errorf("failed to remove existing buildkit container %s: %w", b.containerName, err)
 			}
 		}
@@ -155,7 +175,60 @@ BUILDKITD_ALREADY_RUNNING:
 	return nil
 }
 
-// StopDaemon stops the BuildKit daemon running in a Docker container.
+// DaemonStatus is the status of the BuildKit daemon container.
+type DaemonStatus struct {
+	// ContainerName is the name of the container.
+	ContainerName string
+	// ContainerID is the ID of the container.
+	ContainerID string
+	// Image is the image of the container.
+	Image string
+	// State is the state of the container (eg. running, exited).
+	State string
+	// Status is the human readable status of the container (eg. Up 2 hours).
+	Status string
+	// Address is the address of the daemon (only set if it is running).
+	Address string
+}
+
+// DaemonStatus returns the status of the BuildKit daemon container, or nil if
+// the container does not exist.
+func (b *BuildKit) DaemonStatus(ctx context.Context) (*DaemonStatus, error) {
+	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	c, err := b.findContainer(ctx, cli)
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return nil, nil
+	}
+
+	status := &DaemonStatus{
+		ContainerName: b.containerName,
+		ContainerID:   c.ID,
+		Image:         c.Image,
+		State:         c.State,
+		Status:        c.Status,
+	}
+
+	if c.State == "running" {
+		status.Address, err = getBuildKitAddress(ctx, cli, c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get buildkit address: %w", err)
+		}
+	}
+
+	return status, nil
+}
+
+// StopDaemon stops the BuildKit daemon running in a Docker container. The
+// container (and the BuildKit cache) is kept, see RemoveDaemon.
 func (b *BuildKit) StopDaemon(ctx context.Context) error {
 	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
 	if err != nil {
@@ -163,20 +236,158 @@ func (b *BuildKit) StopDaemon(ctx context.Context) error {
 	}
 	defer cli.Close()
 
-	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{})
+	c, err := b.findContainer(ctx, cli)
 	if err != nil {
-		return fmt.Errorf("failed to list containers: %w", err)
+		return err
+	}
+
+	if c == nil || c.State != "running" {
+		return nil
+	}
+
+	if err := cli.ContainerStop(ctx, c.ID, container.StopOptions{}); err != nil {
+		return fmt.Errorf("failed to stop buildkit container: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveDaemon removes the BuildKit daemon container (stopping it if
+// necessary), along with the BuildKit cache.
+func (b *BuildKit) RemoveDaemon(ctx context.Context) error {
+	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	c, err := b.findContainer(ctx, cli)
+	if err != nil {
+		return err
+	}
+
+	if c == nil {
+		return nil
+	}
+
+	if err := cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true}); err != nil {
+		return fmt.Errorf("failed to remove buildkit container: %w", err)
+	}
+
+	return nil
+}
+
+// DaemonLogs writes the logs of the BuildKit daemon container to w. If tail is
+// not "all", only the given number of lines from the end of the logs are
+// written. If follow is true, new logs are written until the context is
+// cancelled.
+func (b *BuildKit) DaemonLogs(ctx context.Context, w io.Writer, tail string, follow bool) error {
+	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	c, err := b.findContainer(ctx, cli)
+	if err != nil {
+		return err
+	}
+
+	if c == nil {
+		return fmt.Errorf("buildkit container %s does not exist", b.containerName)
+	}
+
+	logs, err := cli.ContainerLogs(ctx, c.ID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       tail,
+		Follow:     follow,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get buildkit container logs: %w", err)
+	}
+	defer logs.Close()
+
+	// The container doesn't have a TTY, so stdout and stderr are multiplexed.
+	if _, err := stdcopy.StdCopy(w, w, logs); err != nil && !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("failed to read buildkit container logs: %w", err)
+	}
+
+	return nil
+}
+
+// PruneResult is the result of pruning the BuildKit cache.
+type PruneResult struct {
+	// Removed is the number of cache records removed.
+	Removed int
+	// ReclaimedBytes is the total size of the removed cache records.
+	ReclaimedBytes int64
+}
+
+// Prune removes BuildKit cache records that have not been used within
+// keepDuration, until at most keepBytes of cache remains (zero means no
+// limit). The daemon must be running.
+func (b *BuildKit) Prune(ctx context.Context, keepDuration time.Duration, keepBytes int64) (*PruneResult, error) {
+	if !b.external {
+		status, err := b.DaemonStatus(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if status == nil || status.State != "running" {
+			return nil, fmt.Errorf("buildkit container %s is not running", b.containerName)
+		}
+
+		b.address = status.Address
+	}
+
+	c, err := b.newClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	ch := make(chan client.UsageInfo)
+	done := make(chan struct{})
+
+	var result PruneResult
+	go func() {
+		defer close(done)
+
+		for info := range ch {
+			slog.Debug("Removed cache record",
+				slog.String("id", info.ID), slog.String("description", info.Description), slog.Int64("size", info.Size))
+
+			result.Removed++
+			result.ReclaimedBytes += info.Size
+		}
+	}()
+
+	err = c.Prune(ctx, ch, client.WithKeepOpt(keepDuration, keepBytes))
+	close(ch)
+	<-done
+	if err != nil {
+		return nil, fmt.Errorf("failed to prune buildkit cache: %w", err)
+	}
+
+	return &result, nil
+}
+
+// findContainer returns the BuildKit daemon container (in any state), or nil
+// if it does not exist.
+func (b *BuildKit) findContainer(ctx context.Context, cli *dockerclient.Client) (*types.Container, error) {
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
 	}
 
 	for _, c := range containers {
 		if c.Names[0] == "/"+b.containerName {
-			if err := cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
-				return fmt.Errorf("failed to remove buildkit container: %w", err)
-			}
+			return &c, nil
 		}
 	}
 
-	return nil
+	return nil, nil
 }
 
 func getBuildKitAddress(ctx context.Context, cli *dockerclient.Client, containerID string) (string, error) {
@@ -34,6 +34,7 @@ import (
 	"github.com/adrg/xdg"
 	"github.com/containerd/containerd/platforms"
 	"github.com/gregjones/httpcache"
+	"github.com/immutos/immutos/internal/builder"
 	"github.com/immutos/immutos/internal/buildkit"
 	"github.com/immutos/immutos/internal/testutil"
 	"github.com/immutos/immutos/internal/unpack"
@@ -54,17 +55,13 @@ func TestBuild(t *testing.T) {
 	binaryDir := filepath.Join(tempDir, "bin")
 	require.NoError(t, buildimmutosBinary(ctx, binaryDir))
 
-	certsDir := filepath.Join(tempDir, "certs")
-	err := os.MkdirAll(certsDir, 0o700)
-	require.NoError(t, err)
-
-	b := buildkit.New("immutos-test", certsDir)
+	b := buildkit.New("immutos-test", filepath.Join(tempDir, "certs"))
 
 	// Make sure we're starting with a clean slate.
-	_ = b.StopDaemon(ctx)
+	_ = b.RemoveDaemon(ctx)
 	require.NoError(t, b.StartDaemon(ctx))
 	t.Cleanup(func() {
-		require.NoError(t, b.StopDaemon(ctx))
+		require.NoError(t, b.RemoveDaemon(ctx))
 	})
 
 	packagesDir := filepath.Join(tempDir, "packages")
@@ -80,7 +77,7 @@ func TestBuild(t *testing.T) {
 		packagePaths = append(packagePaths, filepath.Join(packagesDir, e.Name()))
 	}
 
-	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths)
+	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths, nil)
 	require.NoError(t, err)
 
 	outputDir := t.TempDir()
@@ -89,12 +86,12 @@ func TestBuild(t *testing.T) {
 	sourceDateEpoch, err := time.Parse(time.RFC3339, "2024-01-01T00:00:00Z")
 	require.NoError(t, err)
 
-	err = b.Build(ctx, buildkit.BuildOptions{
-		OCIArchivePath:        ociArchivePath,
+	err = b.Build(ctx, builder.BuildOptions{
+		Output:                builder.Output{Type: builder.OutputOCI, Dest: ociArchivePath},
 		RecipePath:            "testdata/immutos.yaml",
 		SecondStageBinaryPath: filepath.Join(binaryDir, "immutos"),
 		SourceDateEpoch:       sourceDateEpoch,
-		PlatformOpts: []buildkit.PlatformBuildOptions{
+		PlatformOpts: []builder.PlatformBuildOptions{
 			{
 				Platform:                platforms.MustParse("linux/amd64"),
 				BuildContextDir:         tempDir,
@@ -114,6 +111,38 @@ func TestBuild(t *testing.T) {
 
 	// Check that the OCI tarball was created.
 	require.FileExists(t, ociArchivePath)
+
+	t.Run("Daemon", func(t *testing.T) {
+		status, err := b.DaemonStatus(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, status)
+		require.Equal(t, "immutos-test-buildkitd", status.ContainerName)
+		require.Equal(t, "running", status.State)
+		require.NotEmpty(t, status.Address)
+
+		// The build left cache records behind.
+		result, err := b.Prune(ctx, 0, 0)
+		require.NoError(t, err)
+		require.NotZero(t, result.Removed)
+
+		require.NoError(t, b.StopDaemon(ctx))
+
+		status, err = b.DaemonStatus(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, status)
+		require.NotEqual(t, "running", status.State)
+		require.Empty(t, status.Address)
+
+		_, err = b.Prune(ctx, 0, 0)
+		require.Error(t, err)
+
+		// A stopped daemon is restarted.
+		require.NoError(t, b.StartDaemon(ctx))
+
+		status, err = b.DaemonStatus(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "running", status.State)
+	})
 }
 
 const repositoryURL = "https://snapshot.debian.org/archive/debian/20240801T024036Z"
@@ -265,6 +294,78 @@ var packages = []struct {
 	},
 }
 
+func TestConnect(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	for _, address := range []string{
+		"unix:///run/buildkit/buildkitd.sock",
+		"tcp://buildkitd:1234",
+		"docker-container://buildkitd",
+	} {
+		_, err := buildkit.Connect(address, nil)
+		require.NoError(t, err, address)
+	}
+
+	tlsOpts := &buildkit.TLSOptions{CACert: "ca.pem"}
+
+	_, err := buildkit.Connect("tcp://buildkitd:1234", tlsOpts)
+	require.NoError(t, err)
+
+	_, err = buildkit.Connect("unix:///run/buildkit/buildkitd.sock", tlsOpts)
+	require.Error(t, err)
+
+	_, err = buildkit.Connect("ssh://buildkitd", nil)
+	require.Error(t, err)
+}
+
+func TestParseCacheOptions(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	opts, err := buildkit.ParseCacheOptions("type=local,src=/tmp/cache", false)
+	require.NoError(t, err)
+	require.Equal(t, buildkit.CacheOptions{
+		Type:  buildkit.CacheLocal,
+		Attrs: map[string]string{"src": "/tmp/cache"},
+	}, opts)
+
+	opts, err = buildkit.ParseCacheOptions("type=local,dest=/tmp/cache", true)
+	require.NoError(t, err)
+	require.Equal(t, buildkit.CacheOptions{
+		Type:  buildkit.CacheLocal,
+		Attrs: map[string]string{"dest": "/tmp/cache", "mode": "max"},
+	}, opts)
+
+	opts, err = buildkit.ParseCacheOptions("registry.example.com/debian:cache", true)
+	require.NoError(t, err)
+	require.Equal(t, buildkit.CacheOptions{
+		Type:  buildkit.CacheRegistry,
+		Attrs: map[string]string{"ref": "registry.example.com/debian:cache", "mode": "max"},
+	}, opts)
+
+	opts, err = buildkit.ParseCacheOptions("type=registry,ref=registry.example.com/debian:cache", false)
+	require.NoError(t, err)
+	require.Equal(t, buildkit.CacheOptions{
+		Type:  buildkit.CacheRegistry,
+		Attrs: map[string]string{"ref": "registry.example.com/debian:cache"},
+	}, opts)
+
+	for _, tc := range []struct {
+		spec   string
+		export bool
+	}{
+		{spec: "type=local,dest=/tmp/cache", export: false},
+		{spec: "type=local,src=/tmp/cache", export: true},
+		{spec: "type=registry", export: false},
+		{spec: "type=registry,ref=registry.example.com/debian:cache,mode=max", export: false},
+		{spec: "type=registry,ref=registry.example.com/debian:cache,mode=all", export: true},
+		{spec: "type=gha,scope=immutos", export: true},
+		{spec: "dest=/tmp/cache", export: true},
+	} {
+		_, err := buildkit.ParseCacheOptions(tc.spec, tc.export)
+		require.Error(t, err, tc.spec)
+	}
+}
+
 func downloadPackages(packagesDir string) error {
 	cacheDir, err := xdg.CacheFile("immutos")
 	if err != nil {
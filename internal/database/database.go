@@ -95,6 +95,20 @@ func (db *PackageDB) addPackage(pkg types.Package) {
 			}
 		}
 
+		// Likewise for the origins of the package.
+		for _, origin := range pkg.Origins {
+			var found bool
+			for _, existingOrigin := range existing.Origins {
+				if origin.URL == existingOrigin.URL {
+					found = true
+					break
+				}
+			}
+			if !found {
+				existing.Origins = append(existing.Origins, origin)
+			}
+		}
+
 		pkg = existing
 	}
 
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package deb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+)
+
+// arMember is a member of an ar(1) archive.
+type arMember struct {
+	name   string
+	offset int64
+	size   int64
+}
+
+// arReader reads the members of an ar(1) archive, in order.
+type arReader struct {
+	ra     io.ReaderAt
+	offset int64
+}
+
+func newArReader(ra io.ReaderAt) (*arReader, error) {
+	magic := make([]byte, len(arMagic))
+	if _, err := ra.ReadAt(magic, 0); err != nil {
+		return nil, fmt.Errorf("failed to read archive magic: %w", err)
+	}
+
+	if string(magic) != arMagic {
+		return nil, errors.New("not an ar archive")
+	}
+
+	return &arReader{ra: ra, offset: int64(len(arMagic))}, nil
+}
+
+// Next returns the next member in the archive, or io.EOF if there are no
+// more members.
+func (r *arReader) Next() (*arMember, error) {
+	hdr := make([]byte, arHeaderSize)
+	n, err := r.ra.ReadAt(hdr, r.offset)
+	if n == 0 && errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	} else if n != arHeaderSize {
+		if err == nil || errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, fmt.Errorf("failed to read member header: %w", err)
+	}
+
+	if string(hdr[58:60]) != "`\n" {
+		return nil, errors.New("corrupt member header: bad magic")
+	}
+
+	// GNU ar(1) terminates member names with a slash.
+	name := strings.TrimSuffix(strings.TrimRight(string(hdr[0:16]), " "), "/")
+
+	size, err := strconv.ParseInt(strings.TrimRight(string(hdr[48:58]), " "), 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid size for member %q", name)
+	}
+
+	m := &arMember{
+		name:   name,
+		offset: r.offset + arHeaderSize,
+		size:   size,
+	}
+
+	// Members are aligned to an even offset.
+	r.offset = m.offset + size + size%2
+
+	return m, nil
+}
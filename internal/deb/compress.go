@@ -0,0 +1,88 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package deb
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+type decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// controlCompressors are the compression formats (by member name suffix)
+// supported by dpkg-deb for the control archive.
+var controlCompressors = map[string]decompressor{
+	"":     uncompressed,
+	".gz":  gunzip,
+	".xz":  unxz,
+	".zst": unzstd,
+}
+
+// dataCompressors are the compression formats (by member name suffix)
+// supported by dpkg-deb for the data archive.
+var dataCompressors = map[string]decompressor{
+	"":      uncompressed,
+	".gz":   gunzip,
+	".xz":   unxz,
+	".zst":  unzstd,
+	".bz2":  bunzip2,
+	".lzma": unlzma,
+}
+
+func uncompressed(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+func gunzip(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func unxz(r io.Reader) (io.ReadCloser, error) {
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(xr), nil
+}
+
+func unzstd(r io.Reader) (io.ReadCloser, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return zr.IOReadCloser(), nil
+}
+
+func bunzip2(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(bzip2.NewReader(r)), nil
+}
+
+func unlzma(r io.Reader) (io.ReadCloser, error) {
+	lr, err := lzma.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(lr), nil
+}
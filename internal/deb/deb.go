@@ -0,0 +1,244 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package deb
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/dpeckett/deb822"
+	"github.com/dpeckett/deb822/types"
+)
+
+// Archive is a Debian binary package (.deb) archive.
+type Archive struct {
+	ra                 io.ReaderAt
+	version            string
+	debianBinaryMember *arMember
+	controlMember      *arMember
+	dataMember         *arMember
+	// Optional members (with an underscore prefix), eg. signatures.
+	optionalMembers map[string]*arMember
+}
+
+// Open opens a Debian binary package. The layout of the package is validated
+// in the same way as dpkg-deb(1): debian-binary must be the first member, and
+// must be followed by the control and data archives (in that order). Optional
+// members with an underscore prefix (eg. signatures) may appear anywhere.
+func Open(ra io.ReaderAt) (*Archive, error) {
+	ar, err := newArReader(ra)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse debian package: %w", err)
+	}
+
+	m, err := ar.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse debian package: %w", err)
+	}
+
+	if m.name != "debian-binary" {
+		return nil, fmt.Errorf("not a debian package: unexpected first member %q", m.name)
+	}
+
+	a := &Archive{
+		ra:                 ra,
+		debianBinaryMember: m,
+		optionalMembers:    map[string]*arMember{},
+	}
+
+	// Check that the package is a debian 2.x format package.
+	debianBinary, err := io.ReadAll(io.NewSectionReader(ra, m.offset, m.size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read debian-binary file: %w", err)
+	}
+
+	version, _, ok := strings.Cut(string(debianBinary), "\n")
+	if !ok {
+		return nil, fmt.Errorf("invalid debian-binary file: no newline")
+	}
+
+	major, _, ok := strings.Cut(version, ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid debian-binary file: no dot in version number")
+	}
+
+	if major != "2" {
+		return nil, fmt.Errorf("unsupported debian package version: %s", version)
+	}
+
+	a.version = version
+
+	for a.dataMember == nil {
+		m, err := ar.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, fmt.Errorf("failed to parse debian package: %w", err)
+		}
+
+		switch {
+		case strings.HasPrefix(m.name, "_"):
+			a.optionalMembers[m.name] = m
+		case a.controlMember == nil:
+			if !strings.HasPrefix(m.name, "control.tar") {
+				return nil, fmt.Errorf("unexpected member %q before control archive", m.name)
+			}
+
+			if _, ok := controlCompressors[strings.TrimPrefix(m.name, "control.tar")]; !ok {
+				return nil, fmt.Errorf("unsupported compression for member %q", m.name)
+			}
+
+			a.controlMember = m
+		case strings.HasPrefix(m.name, "data.tar"):
+			if _, ok := dataCompressors[strings.TrimPrefix(m.name, "data.tar")]; !ok {
+				return nil, fmt.Errorf("unsupported compression for member %q", m.name)
+			}
+
+			a.dataMember = m
+		case strings.HasPrefix(m.name, "control.tar"):
+			return nil, fmt.Errorf("debian package contains two control archives")
+		default:
+			return nil, fmt.Errorf("unexpected member %q before data archive", m.name)
+		}
+	}
+
+	if a.controlMember == nil {
+		return nil, fmt.Errorf("failed to find control archive in debian package")
+	}
+	if a.dataMember == nil {
+		return nil, fmt.Errorf("failed to find data archive in debian package")
+	}
+
+	// Like dpkg-deb, anything after the data archive is not validated. But
+	// signatures are often appended to the end of the package.
+	for {
+		m, err := ar.Next()
+		if err != nil {
+			break
+		}
+
+		if strings.HasPrefix(m.name, "_") {
+			a.optionalMembers[m.name] = m
+		}
+	}
+
+	return a, nil
+}
+
+// Version returns the format version of the package (eg. "2.0").
+func (a *Archive) Version() string {
+	return a.version
+}
+
+// OptionalMember returns the contents of an optional member (eg.
+// "_gpgorigin"), or fs.ErrNotExist if the package does not contain it.
+func (a *Archive) OptionalMember(name string) ([]byte, error) {
+	m, ok := a.optionalMembers[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	return io.ReadAll(io.NewSectionReader(a.ra, m.offset, m.size))
+}
+
+// SignedContent returns a reader for the content covered by embedded (debsig)
+// signatures, the debian-binary, control, and data members concatenated.
+func (a *Archive) SignedContent() io.Reader {
+	var readers []io.Reader
+	for _, m := range []*arMember{a.debianBinaryMember, a.controlMember, a.dataMember} {
+		readers = append(readers, io.NewSectionReader(a.ra, m.offset, m.size))
+	}
+
+	return io.MultiReader(readers...)
+}
+
+// ControlArchiveName returns the name of the control archive member.
+func (a *Archive) ControlArchiveName() string {
+	return a.controlMember.name
+}
+
+// DataArchiveName returns the name of the data archive member.
+func (a *Archive) DataArchiveName() string {
+	return a.dataMember.name
+}
+
+// ControlArchive returns a reader for the decompressed control archive.
+func (a *Archive) ControlArchive() (io.ReadCloser, error) {
+	return openMember(a.ra, a.controlMember, "control.tar", controlCompressors)
+}
+
+// DataArchive returns a reader for the decompressed data archive.
+func (a *Archive) DataArchive() (io.ReadCloser, error) {
+	return openMember(a.ra, a.dataMember, "data.tar", dataCompressors)
+}
+
+// Control reads and parses the control file from the control archive.
+func (a *Archive) Control() (*types.Package, error) {
+	controlArchive, err := a.ControlArchive()
+	if err != nil {
+		return nil, err
+	}
+	defer controlArchive.Close()
+
+	tr := tar.NewReader(controlArchive)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("failed to find control file in control archive")
+			}
+
+			return nil, fmt.Errorf("failed to read control archive: %w", err)
+		}
+
+		if path.Clean(hdr.Name) != "control" {
+			continue
+		}
+
+		decoder, err := deb822.NewDecoder(tr, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create control file decoder: %w", err)
+		}
+
+		var pkg types.Package
+		if err := decoder.Decode(&pkg); err != nil {
+			return nil, fmt.Errorf("failed to decode control file: %w", err)
+		}
+
+		return &pkg, nil
+	}
+}
+
+func openMember(ra io.ReaderAt, m *arMember, prefix string, compressors map[string]decompressor) (io.ReadCloser, error) {
+	// The compression format is determined by the member name (not by
+	// sniffing the content), as with dpkg-deb.
+	decompress := compressors[strings.TrimPrefix(m.name, prefix)]
+
+	dr, err := decompress(io.NewSectionReader(ra, m.offset, m.size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", m.name, err)
+	}
+
+	return dr, nil
+}
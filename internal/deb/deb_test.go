@@ -0,0 +1,122 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package deb_test
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/immutos/internal/deb"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	tests := []struct {
+		filename    string
+		version     string
+		controlName string
+		dataName    string
+	}{
+		{"base-files_12.4+deb12u5_amd64.deb", "2.0", "control.tar.xz", "data.tar.xz"},
+		{"formats/hello_1.0_all_none.deb", "2.0", "control.tar", "data.tar"},
+		{"formats/hello_1.0_all_zstd.deb", "2.0", "control.tar.zst", "data.tar.zst"},
+		{"formats/hello_1.0_all_extra-members.deb", "2.0", "control.tar.gz", "data.tar.gz"},
+		{"formats/hello_1.0_all_gnu.deb", "2.1", "control.tar.gz", "data.tar.gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			a := openPackage(t, tt.filename)
+
+			require.Equal(t, tt.version, a.Version())
+			require.Equal(t, tt.controlName, a.ControlArchiveName())
+			require.Equal(t, tt.dataName, a.DataArchiveName())
+
+			pkg, err := a.Control()
+			require.NoError(t, err)
+			require.NotEmpty(t, pkg.Name)
+
+			dataArchive, err := a.DataArchive()
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, dataArchive.Close())
+			})
+
+			var names []string
+			tr := tar.NewReader(dataArchive)
+			for {
+				hdr, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				require.NoError(t, err)
+
+				names = append(names, hdr.Name)
+			}
+
+			if pkg.Name == "hello" {
+				require.Contains(t, names, "./usr/share/hello/greeting")
+			} else {
+				require.NotEmpty(t, names)
+			}
+		})
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	tests := map[string]string{
+		"formats/invalid_order.deb":   `unexpected member "data.tar.gz" before control archive`,
+		"formats/invalid_member.deb":  `unexpected member "extra" before control archive`,
+		"formats/invalid_version.deb": "unsupported debian package version: 3.0",
+		"formats/generate.sh":         "failed to parse debian package",
+	}
+
+	for filename, expected := range tests {
+		t.Run(filename, func(t *testing.T) {
+			f, err := os.Open(filepath.Join(testutil.Root(), "testdata/debs", filename))
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			_, err = deb.Open(f)
+			require.ErrorContains(t, err, expected)
+		})
+	}
+}
+
+func openPackage(t *testing.T, filename string) *deb.Archive {
+	f, err := os.Open(filepath.Join(testutil.Root(), "testdata/debs", filename))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	a, err := deb.Open(f)
+	require.NoError(t, err)
+
+	return a
+}
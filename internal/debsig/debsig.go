@@ -0,0 +1,75 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package debsig verifies embedded (debsig-verify style) signatures of Debian
+// binary packages.
+package debsig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/immutos/immutos/internal/deb"
+)
+
+// OriginMember is the name of the package member containing the signature
+// of the package origin (eg. the vendor).
+const OriginMember = "_gpgorigin"
+
+// ErrNotSigned is returned when a package does not have an embedded origin
+// signature.
+var ErrNotSigned = errors.New("package does not have an embedded origin signature")
+
+// Verify verifies the embedded origin signature of a Debian binary package
+// against the keyring, and returns the fingerprint of the signing key.
+func Verify(packagePath string, keyring openpgp.EntityList) (string, error) {
+	f, err := os.Open(packagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open package: %w", err)
+	}
+	defer f.Close()
+
+	debArchive, err := deb.Open(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to open package: %w", err)
+	}
+
+	signature, err := debArchive.OptionalMember(OriginMember)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", ErrNotSigned
+		}
+
+		return "", fmt.Errorf("failed to read signature: %w", err)
+	}
+
+	// Signatures can be either armored or binary.
+	var signer *openpgp.Entity
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN PGP SIGNATURE-----")) {
+		signer, err = openpgp.CheckArmoredDetachedSignature(keyring, debArchive.SignedContent(), bytes.NewReader(signature), nil)
+	} else {
+		signer, err = openpgp.CheckDetachedSignature(keyring, debArchive.SignedContent(), bytes.NewReader(signature), nil)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to verify signature: %w", err)
+	}
+
+	return fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint), nil
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debsig_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/immutos/immutos/internal/deb"
+	"github.com/immutos/immutos/internal/debsig"
+	"github.com/immutos/immutos/internal/keyring"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	signer, err := keyring.LoadOrGenerateSigningKey(filepath.Join(t.TempDir(), "signer.asc"), "signer")
+	require.NoError(t, err)
+
+	other, err := keyring.LoadOrGenerateSigningKey(filepath.Join(t.TempDir(), "other.asc"), "other")
+	require.NoError(t, err)
+
+	packagePath := filepath.Join(testutil.Root(), "testdata/debs/formats/hello_1.0_all_extra-members.deb")
+
+	t.Run("Armored", func(t *testing.T) {
+		signedPackagePath := signPackage(t, packagePath, signer, true)
+
+		fingerprint, err := debsig.Verify(signedPackagePath, openpgp.EntityList{other, signer})
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint), fingerprint)
+	})
+
+	t.Run("Binary", func(t *testing.T) {
+		signedPackagePath := signPackage(t, packagePath, signer, false)
+
+		fingerprint, err := debsig.Verify(signedPackagePath, openpgp.EntityList{signer})
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint), fingerprint)
+	})
+
+	t.Run("Unknown Key", func(t *testing.T) {
+		signedPackagePath := signPackage(t, packagePath, other, true)
+
+		_, err := debsig.Verify(signedPackagePath, openpgp.EntityList{signer})
+		require.Error(t, err)
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		signedPackagePath := signPackage(t, packagePath, signer, true)
+
+		data, err := os.ReadFile(signedPackagePath)
+		require.NoError(t, err)
+
+		// The debian-binary member is covered by the signature.
+		tamperedPackagePath := filepath.Join(t.TempDir(), "tampered.deb")
+		tampered := bytes.Replace(data, []byte("2.0\n"), []byte("2.1\n"), 1)
+		require.NoError(t, os.WriteFile(tamperedPackagePath, tampered, 0o644))
+
+		_, err = debsig.Verify(tamperedPackagePath, openpgp.EntityList{signer})
+		require.Error(t, err)
+	})
+
+	t.Run("Not Signed", func(t *testing.T) {
+		_, err := debsig.Verify(packagePath, openpgp.EntityList{signer})
+		require.ErrorIs(t, err, debsig.ErrNotSigned)
+	})
+}
+
+// signPackage appends an origin signature to a copy of the package.
+func signPackage(t *testing.T, packagePath string, signer *openpgp.Entity, armored bool) string {
+	f, err := os.Open(packagePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	debArchive, err := deb.Open(f)
+	require.NoError(t, err)
+
+	var signature bytes.Buffer
+	if armored {
+		require.NoError(t, openpgp.ArmoredDetachSign(&signature, signer, debArchive.SignedContent(), nil))
+	} else {
+		require.NoError(t, openpgp.DetachSign(&signature, signer, debArchive.SignedContent(), nil))
+	}
+
+	data, err := os.ReadFile(packagePath)
+	require.NoError(t, err)
+
+	data = append(data, fmt.Sprintf("%-16s%-12d%-6d%-6d%-8s%-10d`\n", debsig.OriginMember, 0, 0, 0, "100644", signature.Len())...)
+	data = append(data, signature.Bytes()...)
+	if signature.Len()%2 == 1 {
+		data = append(data, '\n')
+	}
+
+	signedPackagePath := filepath.Join(t.TempDir(), filepath.Base(packagePath))
+	require.NoError(t, os.WriteFile(signedPackagePath, data, 0o644))
+
+	return signedPackagePath
+}
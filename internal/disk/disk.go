@@ -0,0 +1,592 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package disk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/immutos/immutos/internal/fsimage"
+	latestrecipe "github.com/immutos/immutos/internal/recipe/v1alpha1"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Format is the format of a disk image.
+type Format string
+
+const (
+	// FormatRaw is a raw disk image.
+	FormatRaw Format = "raw"
+	// FormatQCOW2 is a QEMU copy-on-write disk image (requires qemu-img).
+	FormatQCOW2 Format = "qcow2"
+)
+
+const (
+	// DefaultSize is the default size of a disk image.
+	DefaultSize = "2GiB"
+	// DefaultFilesystem is the default root filesystem type.
+	DefaultFilesystem = "ext4"
+	// DefaultBootloader is the default boot loader.
+	DefaultBootloader = "systemd-boot"
+)
+
+const (
+	// partitionAlignment is the alignment of partitions (and the disk size).
+	partitionAlignment = 1 << 20
+	espSize            = 256 << 20
+)
+
+// efiArchs maps platform architectures to the suffix used by EFI binaries.
+var efiArchs = map[string]string{
+	"386":     "ia32",
+	"amd64":   "x64",
+	"arm":     "arm",
+	"arm64":   "aa64",
+	"riscv64": "riscv64",
+}
+
+// gptMBRPaths are the locations of the syslinux GPT MBR boot code on different
+// distributions.
+var gptMBRPaths = []string{
+	"/usr/lib/syslinux/mbr/gptmbr.bin",  // Debian and Ubuntu
+	"/usr/share/syslinux/gptmbr.bin",    // Fedora
+	"/usr/lib/syslinux/bios/gptmbr.bin", // Arch Linux
+}
+
+// mbrBootCodeSize is the size of the boot code area of the MBR.
+const mbrBootCodeSize = 440
+
+// Options are the options for creating a disk image.
+type Options struct {
+	// RootFSArchivePath is the path to a tarball of the root filesystem.
+	RootFSArchivePath string
+	// Platform is the platform of the root filesystem.
+	Platform ocispecs.Platform
+	// Format is the format of the disk image.
+	Format Format
+	// SourceDateEpoch is used for all timestamps.
+	SourceDateEpoch time.Time
+}
+
+// Create creates a bootable disk image from a root filesystem tarball. The
+// disk has an EFI system partition (containing the kernel, initramfs, and boot
+// loader configuration) and a root partition. Root privileges are not
+// required.
+func Create(ctx context.Context, diskPath string, conf latestrecipe.DiskConfig, opts Options) error {
+	if conf.Size == "" {
+		conf.Size = DefaultSize
+	}
+
+	if conf.Filesystem == "" {
+		conf.Filesystem = DefaultFilesystem
+	}
+
+	if conf.Bootloader == "" {
+		conf.Bootloader = DefaultBootloader
+	}
+
+	size, err := units.RAMInBytes(conf.Size)
+	if err != nil {
+		return fmt.Errorf("failed to parse disk size: %w", err)
+	}
+	size = (size + partitionAlignment - 1) &^ (partitionAlignment - 1)
+
+	var efiBinaryPath, gptMBRPath string
+	switch conf.Bootloader {
+	case "systemd-boot":
+		efiArch, ok := efiArchs[opts.Platform.Architecture]
+		if !ok {
+			return fmt.Errorf("systemd-boot is not supported on %s", opts.Platform.Architecture)
+		}
+
+		efiBinaryPath = "/usr/lib/systemd/boot/efi/systemd-boot" + efiArch + ".efi"
+	case "extlinux":
+		// Other platforms (eg. U-Boot) read the configuration directly, but
+		// BIOS firmware needs the syslinux boot code and loader.
+		if opts.Platform.Architecture == "386" || opts.Platform.Architecture == "amd64" {
+			gptMBRPath, err = findSyslinux()
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported bootloader: %s", conf.Bootloader)
+	}
+
+	tempDir, err := os.MkdirTemp("", "immutos-disk-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	// Identifiers are derived from the contents of the root filesystem, so that
+	// disk images are reproducible.
+	seed, err := hashFile(opts.RootFSArchivePath)
+	if err != nil {
+		return fmt.Errorf("failed to hash root filesystem: %w", err)
+	}
+
+	slog.Debug("Extracting boot files")
+
+	boot, err := extractBootFiles(opts.RootFSArchivePath, filepath.Join(tempDir, "boot"), efiBinaryPath)
+	if err != nil {
+		return fmt.Errorf("failed to extract boot files: %w", err)
+	}
+
+	if boot.kernelPath == "" {
+		return fmt.Errorf("no kernel found in /boot, please specify a kernel package (disk.kernel)")
+	}
+
+	if boot.initrdPath == "" {
+		slog.Warn("No initramfs found in /boot, the kernel must be able to mount the root filesystem without one",
+			slog.String("kernel", boot.kernelVersion))
+	}
+
+	if efiBinaryPath != "" && boot.efiPath == "" {
+		return fmt.Errorf("%s not found, please install the systemd-boot-efi package", efiBinaryPath)
+	}
+
+	espStart := int64(partitionAlignment)
+	rootStart := espStart + espSize
+	rootSize := size - partitionAlignment - rootStart
+	if rootSize <= 0 {
+		return fmt.Errorf("disk size is too small: %s", conf.Size)
+	}
+
+	diskGUID := deriveGUID(seed, "disk")
+	espGUID := deriveGUID(seed, "esp")
+	rootGUID := deriveGUID(seed, "root")
+
+	rootImagePath := filepath.Join(tempDir, "root.img")
+
+	cmdline := []string{"root=PARTUUID=" + rootGUID.String(), "rootfstype=" + conf.Filesystem}
+
+	switch conf.Filesystem {
+	case "ext4":
+		slog.Debug("Creating ext4 root filesystem")
+
+		cmdline = append(cmdline, "rw")
+		err = createExt4(ctx, opts.RootFSArchivePath, rootImagePath, rootSize, deriveGUID(seed, "root-fs"), opts.SourceDateEpoch)
+	case "erofs":
+		slog.Debug("Creating erofs root filesystem")
+
+		cmdline = append(cmdline, "ro")
+		err = fsimage.Create(ctx, rootImagePath, fsimage.FormatErofs, opts.RootFSArchivePath, fsimage.Options{
+			SourceDateEpoch: opts.SourceDateEpoch,
+			Label:           "root",
+			UUID:            deriveGUID(seed, "root-fs").String(),
+		})
+	default:
+		return fmt.Errorf("unsupported filesystem: %s", conf.Filesystem)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create root filesystem: %w", err)
+	}
+
+	fi, err := os.Stat(rootImagePath)
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() > rootSize {
+		return fmt.Errorf("root filesystem (%s) does not fit on the disk, please increase the disk size",
+			units.BytesSize(float64(fi.Size())))
+	}
+
+	cmdline = append(cmdline, conf.Cmdline...)
+
+	slog.Debug("Creating EFI system partition")
+
+	esp := newFATImage("ESP", binary.LittleEndian.Uint32(seed), opts.SourceDateEpoch)
+
+	espFiles := map[string]string{
+		"/vmlinuz-" + boot.kernelVersion: boot.kernelPath,
+	}
+
+	if boot.initrdPath != "" {
+		espFiles["/initrd.img-"+boot.kernelVersion] = boot.initrdPath
+	}
+
+	var espAttributes uint64
+	switch conf.Bootloader {
+	case "systemd-boot":
+		espFiles["/EFI/BOOT/BOOT"+strings.ToUpper(efiArchs[opts.Platform.Architecture])+".EFI"] = boot.efiPath
+		espFiles["/loader/loader.conf"], err = writeConfig(tempDir, "loader.conf", systemdBootLoaderConf())
+		if err != nil {
+			return err
+		}
+
+		espFiles["/loader/entries/immutos.conf"], err = writeConfig(tempDir, "immutos.conf", systemdBootEntry(boot, cmdline))
+		if err != nil {
+			return err
+		}
+	case "extlinux":
+		// U-Boot (and syslinux) look for the configuration on the bootable partition.
+		// Syslinux itself is installed once the disk image has been written.
+		espAttributes = attrLegacyBIOSBootable
+
+		espFiles["/extlinux/extlinux.conf"], err = writeConfig(tempDir, "extlinux.conf", extlinuxConf(boot, cmdline))
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, srcPath := range espFiles {
+		if err := esp.addFile(name, srcPath); err != nil {
+			return fmt.Errorf("failed to add %s to EFI system partition: %w", name, err)
+		}
+	}
+
+	rawPath := diskPath
+	if opts.Format == FormatQCOW2 {
+		rawPath = filepath.Join(tempDir, "disk.raw")
+	}
+
+	slog.Debug("Writing disk image", slog.String("path", rawPath))
+
+	f, err := os.OpenFile(rawPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create disk image: %w", err)
+	}
+	defer f.Close()
+
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("failed to resize disk image: %w", err)
+	}
+
+	err = writeGPT(f, size, diskGUID, []partition{
+		{
+			name:       "ESP",
+			typeGUID:   espTypeGUID,
+			guid:       espGUID,
+			startLBA:   uint64(espStart / sectorSize),
+			endLBA:     uint64((espStart+espSize)/sectorSize) - 1,
+			attributes: espAttributes,
+		},
+		{
+			name:     "root",
+			typeGUID: rootTypeGUID(opts.Platform),
+			guid:     rootGUID,
+			startLBA: uint64(rootStart / sectorSize),
+			endLBA:   uint64((rootStart+rootSize)/sectorSize) - 1,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if gptMBRPath != "" {
+		if err := writeMBRBootCode(f, gptMBRPath); err != nil {
+			return fmt.Errorf("failed to write MBR boot code: %w", err)
+		}
+	}
+
+	if err := esp.write(f, espStart, espSize); err != nil {
+		return fmt.Errorf("failed to write EFI system partition: %w", err)
+	}
+
+	if err := copyFileAt(f, rootImagePath, rootStart); err != nil {
+		return fmt.Errorf("failed to write root partition: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close disk image: %w", err)
+	}
+
+	if gptMBRPath != "" {
+		slog.Debug("Installing syslinux")
+
+		if err := installSyslinux(ctx, rawPath, espStart, opts.SourceDateEpoch); err != nil {
+			return err
+		}
+	}
+
+	if opts.Format == FormatQCOW2 {
+		slog.Debug("Converting disk image to qcow2")
+
+		cmd := exec.CommandContext(ctx, "qemu-img", "convert", "-f", "raw", "-O", "qcow2", rawPath, diskPath)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to convert disk image to qcow2: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	return nil
+}
+
+func rootTypeGUID(platform ocispecs.Platform) guid {
+	if typeGUID, ok := rootTypeGUIDs[platform.Architecture]; ok {
+		return typeGUID
+	}
+
+	return linuxFilesystemTypeGUID
+}
+
+// bootFiles are the files extracted from the root filesystem that are required
+// to boot the image.
+type bootFiles struct {
+	kernelVersion string
+	kernelPath    string
+	initrdPath    string
+	efiPath       string
+}
+
+// extractBootFiles extracts the newest kernel (and its initramfs), and the EFI
+// boot loader binary (if specified) from a root filesystem tarball.
+func extractBootFiles(rootFSArchivePath, dir, efiBinaryPath string) (*bootFiles, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(rootFSArchivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var boot bootFiles
+	var kernelVersions []string
+	initrdPaths := map[string]string{}
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean("/" + hdr.Name)
+
+		var dest string
+		switch {
+		case strings.HasPrefix(name, "/boot/vmlinuz-"):
+			kernelVersion := strings.TrimPrefix(name, "/boot/vmlinuz-")
+			kernelVersions = append(kernelVersions, kernelVersion)
+			dest = filepath.Join(dir, "vmlinuz-"+kernelVersion)
+		case strings.HasPrefix(name, "/boot/initrd.img-"):
+			kernelVersion := strings.TrimPrefix(name, "/boot/initrd.img-")
+			dest = filepath.Join(dir, "initrd.img-"+kernelVersion)
+			initrdPaths[kernelVersion] = dest
+		case efiBinaryPath != "" && name == efiBinaryPath:
+			dest = filepath.Join(dir, path.Base(name))
+			boot.efiPath = dest
+		default:
+			continue
+		}
+
+		if err := writeFile(dest, tr); err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+	}
+
+	for _, kernelVersion := range kernelVersions {
+		if boot.kernelVersion == "" || compareKernelVersions(kernelVersion, boot.kernelVersion) > 0 {
+			boot.kernelVersion = kernelVersion
+		}
+	}
+
+	if boot.kernelVersion != "" {
+		boot.kernelPath = filepath.Join(dir, "vmlinuz-"+boot.kernelVersion)
+		boot.initrdPath = initrdPaths[boot.kernelVersion]
+	}
+
+	return &boot, nil
+}
+
+// findSyslinux checks that the syslinux installer is available, and returns the
+// path to the GPT MBR boot code.
+func findSyslinux() (string, error) {
+	if _, err := exec.LookPath("syslinux"); err != nil {
+		return "", fmt.Errorf("syslinux not found, please install the syslinux and mtools packages: %w", err)
+	}
+
+	for _, gptMBRPath := range gptMBRPaths {
+		if _, err := os.Stat(gptMBRPath); err == nil {
+			return gptMBRPath, nil
+		}
+	}
+
+	return "", fmt.Errorf("gptmbr.bin not found, please install the syslinux-common package")
+}
+
+// writeMBRBootCode writes the boot code into the protective MBR, which chain
+// loads the partition with the legacy BIOS bootable attribute.
+func writeMBRBootCode(w io.WriterAt, gptMBRPath string) error {
+	bootCode, err := os.ReadFile(gptMBRPath)
+	if err != nil {
+		return err
+	}
+
+	if len(bootCode) > mbrBootCodeSize {
+		return fmt.Errorf("%s is too large (%d bytes)", gptMBRPath, len(bootCode))
+	}
+
+	_, err = w.WriteAt(bootCode, 0)
+	return err
+}
+
+// installSyslinux installs the syslinux boot sector and loader (ldlinux.sys and
+// ldlinux.c32) into the EFI system partition, alongside extlinux.conf (which
+// syslinux looks for in its own directory).
+func installSyslinux(ctx context.Context, diskPath string, espOffset int64, sourceDateEpoch time.Time) error {
+	cmd := exec.CommandContext(ctx, "syslinux", "--install",
+		"--offset", strconv.FormatInt(espOffset, 10), "--directory", "/extlinux", diskPath)
+	// Timestamps of the loader files (written by mtools).
+	cmd.Env = append(os.Environ(), "SOURCE_DATE_EPOCH="+strconv.FormatInt(sourceDateEpoch.Unix(), 10))
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to install syslinux: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+func compareKernelVersions(a, b string) int {
+	va, errA := version.Parse(a)
+	vb, errB := version.Parse(b)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+
+	return va.Compare(vb)
+}
+
+func systemdBootLoaderConf() string {
+	return "default immutos.conf\ntimeout 0\n"
+}
+
+func systemdBootEntry(boot *bootFiles, cmdline []string) string {
+	var sb strings.Builder
+	sb.WriteString("title immutos\n")
+	fmt.Fprintf(&sb, "version %s\n", boot.kernelVersion)
+	fmt.Fprintf(&sb, "linux /vmlinuz-%s\n", boot.kernelVersion)
+	if boot.initrdPath != "" {
+		fmt.Fprintf(&sb, "initrd /initrd.img-%s\n", boot.kernelVersion)
+	}
+	fmt.Fprintf(&sb, "options %s\n", strings.Join(cmdline, " "))
+	return sb.String()
+}
+
+func extlinuxConf(boot *bootFiles, cmdline []string) string {
+	var sb strings.Builder
+	sb.WriteString("default immutos\n")
+	sb.WriteString("label immutos\n")
+	fmt.Fprintf(&sb, "  kernel /vmlinuz-%s\n", boot.kernelVersion)
+	if boot.initrdPath != "" {
+		fmt.Fprintf(&sb, "  initrd /initrd.img-%s\n", boot.kernelVersion)
+	}
+	fmt.Fprintf(&sb, "  append %s\n", strings.Join(cmdline, " "))
+	return sb.String()
+}
+
+func writeConfig(dir, name, contents string) (string, error) {
+	configPath := filepath.Join(dir, name)
+	if err := os.WriteFile(configPath, []byte(contents), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	return configPath, nil
+}
+
+func writeFile(dest string, r io.Reader) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// copyFileAt copies a file to w at the given offset. Blocks of zeros are
+// skipped (w must be initially zeroed), so that sparse files stay sparse.
+func copyFileAt(w io.WriterAt, srcPath string, offset int64) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 1<<20)
+	zeros := make([]byte, 4096)
+	for {
+		n, err := io.ReadFull(f, buf)
+		for i := 0; i < n; i += len(zeros) {
+			block := buf[i:min(i+len(zeros), n)]
+			if bytes.Equal(block, zeros[:len(block)]) {
+				continue
+			}
+
+			if _, err := w.WriteAt(block, offset+int64(i)); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package disk_test
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/immutos/internal/disk"
+	latestrecipe "github.com/immutos/immutos/internal/recipe/v1alpha1"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreate(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	testutil.RequireTools(t, "mke2fs", "debugfs", "e2fsck")
+
+	ctx := context.Background()
+
+	sourceDateEpoch, err := time.Parse(time.RFC3339, "2024-01-01T00:00:00Z")
+	require.NoError(t, err)
+
+	rootFSArchivePath := filepath.Join(t.TempDir(), "rootfs.tar")
+	writeRootFS(t, rootFSArchivePath, sourceDateEpoch)
+
+	create := func(t *testing.T, conf latestrecipe.DiskConfig) string {
+		diskPath := filepath.Join(t.TempDir(), "disk.img")
+
+		err := disk.Create(ctx, diskPath, conf, disk.Options{
+			RootFSArchivePath: rootFSArchivePath,
+			Platform:          platforms.MustParse("linux/amd64"),
+			Format:            disk.FormatRaw,
+			SourceDateEpoch:   sourceDateEpoch,
+		})
+		require.NoError(t, err)
+
+		return diskPath
+	}
+
+	conf := latestrecipe.DiskConfig{
+		Size:    "512MiB",
+		Cmdline: []string{"console=ttyS0"},
+	}
+
+	diskPath := create(t, conf)
+
+	t.Run("Reproducible", func(t *testing.T) {
+		require.Equal(t, hashFile(t, diskPath), hashFile(t, create(t, conf)))
+	})
+
+	f, err := os.Open(diskPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(512<<20), fi.Size())
+
+	readAt := func(off, n int64) []byte {
+		buf := make([]byte, n)
+		_, err := f.ReadAt(buf, off)
+		require.NoError(t, err)
+		return buf
+	}
+
+	// Protective MBR and GPT header.
+	mbr := readAt(0, 512)
+	require.Equal(t, []byte{0x55, 0xaa}, mbr[510:512])
+	require.Equal(t, byte(0xee), mbr[446+4])
+	require.Equal(t, "EFI PART", string(readAt(512, 8)))
+
+	// The backup GPT header is stored in the last sector.
+	require.Equal(t, "EFI PART", string(readAt(fi.Size()-512, 8)))
+
+	type partition struct {
+		start, end int64
+	}
+
+	var partitions []partition
+	for i := int64(0); i < 2; i++ {
+		entry := readAt(1024+i*128, 128)
+		partitions = append(partitions, partition{
+			start: int64(binary.LittleEndian.Uint64(entry[32:])) * 512,
+			end:   (int64(binary.LittleEndian.Uint64(entry[40:])) + 1) * 512,
+		})
+	}
+
+	// The files are stored at the start of the EFI system partition.
+	esp := readAt(partitions[0].start, 8<<20)
+	require.Equal(t, "FAT32   ", string(esp[82:90]))
+	require.Contains(t, string(esp), "linux /vmlinuz-6.1.0-18-amd64\n")
+	require.Contains(t, string(esp), "console=ttyS0\n")
+	require.Contains(t, string(esp), "fake kernel")
+	require.Contains(t, string(esp), "fake systemd-boot")
+
+	rootImagePath := filepath.Join(t.TempDir(), "root.img")
+	rootImage, err := os.Create(rootImagePath)
+	require.NoError(t, err)
+
+	_, err = io.Copy(rootImage, io.NewSectionReader(f, partitions[1].start, partitions[1].end-partitions[1].start))
+	require.NoError(t, err)
+	require.NoError(t, rootImage.Close())
+
+	out, err := exec.Command("e2fsck", "-fn", rootImagePath).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	stat := func(name string) string {
+		out, err := exec.Command("debugfs", "-R", "stat \""+name+"\"", rootImagePath).Output()
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	passwd := stat("/etc/passwd")
+	require.Contains(t, passwd, "Mode:  0644")
+	require.Contains(t, passwd, "Links: 2")
+	require.Contains(t, passwd, "user.test (5) = \"hello\"")
+
+	sudo := stat("/usr/bin/sudo")
+	require.Contains(t, sudo, "User:     0   Group:    42")
+	require.Contains(t, sudo, "Mode:  04755")
+
+	require.Contains(t, stat("/home/nonroot"), "User: 65532   Group: 65532")
+	require.Contains(t, stat("/etc"), "mtime: 0x65920080")
+	require.Contains(t, stat("/dev/null"), "Type: character special")
+	require.Contains(t, stat("/bin"), "Type: symlink")
+
+	t.Run("Extlinux", func(t *testing.T) {
+		testutil.RequireTools(t, "syslinux", "mdir")
+
+		diskPath := create(t, latestrecipe.DiskConfig{
+			Size:       "512MiB",
+			Bootloader: "extlinux",
+		})
+
+		f, err := os.Open(diskPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		esp := make([]byte, 8<<20)
+		_, err = f.ReadAt(esp, partitions[0].start)
+		require.NoError(t, err)
+
+		require.Contains(t, string(esp), "  kernel /vmlinuz-6.1.0-18-amd64\n")
+		require.NotContains(t, string(esp), "fake systemd-boot")
+
+		// The MBR boot code chain loads the syslinux boot sector.
+		mbr := make([]byte, 512)
+		_, err = f.ReadAt(mbr, 0)
+		require.NoError(t, err)
+		require.NotEqual(t, make([]byte, 440), mbr[:440])
+		require.Equal(t, []byte{0x55, 0xaa}, mbr[510:512])
+
+		// Which loads syslinux from the EFI system partition.
+		out, err := exec.Command("mdir", "-b", "-i", diskPath+"@@"+strconv.FormatInt(partitions[0].start, 10), "::/extlinux").CombinedOutput()
+		require.NoError(t, err, string(out))
+		require.Contains(t, strings.ToLower(string(out)), "/extlinux/ldlinux.sys")
+		require.Contains(t, strings.ToLower(string(out)), "/extlinux/ldlinux.c32")
+		require.Contains(t, strings.ToLower(string(out)), "/extlinux/extlinux.conf")
+	})
+
+	t.Run("Too Small", func(t *testing.T) {
+		err := disk.Create(ctx, filepath.Join(t.TempDir(), "disk.img"), latestrecipe.DiskConfig{Size: "256MiB"}, disk.Options{
+			RootFSArchivePath: rootFSArchivePath,
+			Platform:          platforms.MustParse("linux/amd64"),
+			Format:            disk.FormatRaw,
+			SourceDateEpoch:   sourceDateEpoch,
+		})
+		require.Error(t, err)
+	})
+}
+
+func hashFile(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	require.NoError(t, err)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeRootFS(t *testing.T, rootFSArchivePath string, modTime time.Time) {
+	f, err := os.Create(rootFSArchivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	tw := tar.NewWriter(f)
+
+	dir := func(name string, uid int) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0o755, Uid: uid, Gid: uid, ModTime: modTime}))
+	}
+
+	file := func(hdr *tar.Header, data string) {
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(len(data))
+		hdr.ModTime = modTime
+		hdr.Format = tar.FormatPAX
+		require.NoError(t, tw.WriteHeader(hdr))
+
+		_, err := tw.Write([]byte(data))
+		require.NoError(t, err)
+	}
+
+	dir("boot/", 0)
+	file(&tar.Header{Name: "boot/vmlinuz-6.1.0-18-amd64", Mode: 0o600}, "fake kernel")
+	file(&tar.Header{Name: "boot/initrd.img-6.1.0-18-amd64", Mode: 0o644}, "fake initrd")
+	dir("dev/", 0)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3, ModTime: modTime}))
+	dir("etc/", 0)
+	file(&tar.Header{Name: "etc/passwd", Mode: 0o644, PAXRecords: map[string]string{"SCHILY.xattr.user.test": "hello"}}, "root:x:0:0:root:/root:/bin/sh\n")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: "etc/passwd-", Linkname: "etc/passwd", ModTime: modTime}))
+	dir("home/nonroot/", 65532)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin", ModTime: modTime}))
+	file(&tar.Header{Name: "usr/bin/sudo", Mode: 0o4755, Gid: 42}, "fake sudo")
+	file(&tar.Header{Name: "usr/lib/systemd/boot/efi/systemd-bootx64.efi", Mode: 0o644}, "fake systemd-boot")
+
+	require.NoError(t, tw.Close())
+}
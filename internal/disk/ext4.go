@@ -0,0 +1,343 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package disk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+// createExt4 creates an ext4 filesystem image containing the contents of a
+// root filesystem tarball.
+//
+// The filesystem is populated with debugfs(8), rather than by mounting it or
+// by using mke2fs -d, so that file ownership is preserved without requiring
+// root privileges.
+func createExt4(ctx context.Context, rootFSArchivePath, imagePath string, size int64, uuid guid, epoch time.Time) error {
+	stagingDir, err := os.MkdirTemp(filepath.Dir(imagePath), "ext4-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(stagingDir)
+	}()
+
+	f, err := os.Create(imagePath)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(size); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Timestamps that aren't explicitly set (eg. the superblock and inode
+	// change times) use the source date epoch.
+	env := append(os.Environ(), "E2FSPROGS_FAKE_TIME="+strconv.FormatInt(epoch.Unix(), 10))
+
+	cmd := exec.CommandContext(ctx, "mke2fs", "-q", "-F", "-t", "ext4", "-L", "root",
+		"-U", uuid.String(), "-E", "hash_seed="+uuid.String()+",root_owner=0:0", imagePath)
+	cmd.Env = env
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create filesystem: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	scriptPath := filepath.Join(stagingDir, "debugfs.script")
+	if err := writeDebugfsScript(rootFSArchivePath, scriptPath, stagingDir); err != nil {
+		return fmt.Errorf("failed to generate debugfs script: %w", err)
+	}
+
+	var stderr bytes.Buffer
+	cmd = exec.CommandContext(ctx, "debugfs", "-w", "-f", scriptPath, imagePath)
+	cmd.Env = env
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to populate filesystem: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// debugfs doesn't exit with an error if a command fails, so check for any
+	// error messages (other than the version banner).
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		if line != "" && !strings.HasPrefix(line, "debugfs ") {
+			return fmt.Errorf("failed to populate filesystem: %s", line)
+		}
+	}
+
+	return nil
+}
+
+// writeDebugfsScript converts a tarball into a debugfs script that recreates
+// its contents. File contents and extended attributes are written to the
+// staging directory.
+func writeDebugfsScript(rootFSArchivePath, scriptPath, stagingDir string) error {
+	f, err := os.Open(rootFSArchivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scriptFile, err := os.Create(scriptPath)
+	if err != nil {
+		return err
+	}
+	defer scriptFile.Close()
+
+	script := &debugfsScript{
+		w:          bufio.NewWriter(scriptFile),
+		stagingDir: stagingDir,
+		dirs: map[string]*tar.Header{
+			"/":           nil,
+			"/lost+found": nil,
+		},
+		linkCounts: map[string]int{},
+	}
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		if err := script.add(tr, hdr, name); err != nil {
+			return fmt.Errorf("failed to add %s: %w", name, err)
+		}
+	}
+
+	if err := script.finish(); err != nil {
+		return err
+	}
+
+	if err := script.w.Flush(); err != nil {
+		return err
+	}
+
+	return scriptFile.Close()
+}
+
+type debugfsScript struct {
+	w          *bufio.Writer
+	stagingDir string
+	nextID     int
+	// dirs records the directories that have been created, and their headers
+	// (whose metadata is applied once all entries have been added).
+	dirs map[string]*tar.Header
+	// linkCounts records the number of hard links to each file.
+	linkCounts map[string]int
+}
+
+func (s *debugfsScript) add(tr *tar.Reader, hdr *tar.Header, name string) error {
+	if err := checkDebugfsName(name); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		if err := s.mkdirAll(name); err != nil {
+			return err
+		}
+
+		s.dirs[name] = hdr
+		return nil
+	}
+
+	if err := s.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+
+	var fileType uint32
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		fileType = 0o100000
+
+		srcPath, err := s.stage(tr)
+		if err != nil {
+			return err
+		}
+
+		s.printf("write %s %s\n", quote(srcPath), quote(name))
+	case tar.TypeSymlink:
+		fileType = 0o120000
+
+		if err := checkDebugfsName(hdr.Linkname); err != nil {
+			return err
+		}
+
+		s.printf("symlink %s %s\n", quote(name), quote(hdr.Linkname))
+	case tar.TypeLink:
+		target := path.Clean("/" + hdr.Linkname)
+		if err := checkDebugfsName(target); err != nil {
+			return err
+		}
+
+		if _, ok := s.linkCounts[target]; !ok {
+			s.linkCounts[target] = 1
+		}
+		s.linkCounts[target]++
+
+		// The metadata is shared with the link target, so we're done.
+		s.printf("ln %s %s\n", quote(target), quote(name))
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		// mknod only accepts a file name, relative to the current directory.
+		s.printf("cd %s\n", quote(path.Dir(name)))
+
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			fileType = 0o020000
+			s.printf("mknod %s c %d %d\n", quote(path.Base(name)), hdr.Devmajor, hdr.Devminor)
+		case tar.TypeBlock:
+			fileType = 0o060000
+			s.printf("mknod %s b %d %d\n", quote(path.Base(name)), hdr.Devmajor, hdr.Devminor)
+		case tar.TypeFifo:
+			fileType = 0o010000
+			s.printf("mknod %s p\n", quote(path.Base(name)))
+		}
+
+		s.printf("cd /\n")
+	default:
+		return fmt.Errorf("unsupported tar entry type: %d", hdr.Typeflag)
+	}
+
+	return s.setMetadata(name, hdr, fileType)
+}
+
+// mkdirAll creates a directory and any missing parents.
+func (s *debugfsScript) mkdirAll(name string) error {
+	if _, ok := s.dirs[name]; ok {
+		return nil
+	}
+
+	if err := s.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+
+	s.printf("mkdir %s\n", quote(name))
+	s.dirs[name] = nil
+
+	return nil
+}
+
+func (s *debugfsScript) setMetadata(name string, hdr *tar.Header, fileType uint32) error {
+	s.printf("sif %s mode 0%o\n", quote(name), fileType|uint32(hdr.Mode&0o7777))
+	s.printf("sif %s uid %d\n", quote(name), hdr.Uid)
+	s.printf("sif %s gid %d\n", quote(name), hdr.Gid)
+	s.printf("sif %s mtime %s\n", quote(name), hdr.ModTime.UTC().Format("20060102150405"))
+
+	keys := make([]string, 0, len(hdr.PAXRecords))
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, paxXattrPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		valuePath, err := s.stage(strings.NewReader(hdr.PAXRecords[key]))
+		if err != nil {
+			return err
+		}
+
+		s.printf("ea_set -f %s %s %s\n", quote(valuePath), quote(name), quote(strings.TrimPrefix(key, paxXattrPrefix)))
+	}
+
+	return nil
+}
+
+// finish applies the metadata of directories (as adding entries would change
+// their modification times) and the link counts of hard linked files.
+func (s *debugfsScript) finish() error {
+	names := make([]string, 0, len(s.dirs))
+	for name := range s.dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if hdr := s.dirs[name]; hdr != nil {
+			if err := s.setMetadata(name, hdr, 0o040000); err != nil {
+				return err
+			}
+		}
+	}
+
+	targets := make([]string, 0, len(s.linkCounts))
+	for target := range s.linkCounts {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		s.printf("sif %s links_count %d\n", quote(target), s.linkCounts[target])
+	}
+
+	return nil
+}
+
+// stage writes data to a new file in the staging directory.
+func (s *debugfsScript) stage(r io.Reader) (string, error) {
+	s.nextID++
+	stagedPath := filepath.Join(s.stagingDir, strconv.Itoa(s.nextID))
+
+	if err := writeFile(stagedPath, r); err != nil {
+		return "", err
+	}
+
+	return stagedPath, nil
+}
+
+func (s *debugfsScript) printf(format string, args ...any) {
+	// Errors are returned when the writer is flushed.
+	_, _ = fmt.Fprintf(s.w, format, args...)
+}
+
+// checkDebugfsName checks that a name can be quoted in a debugfs script.
+func checkDebugfsName(name string) error {
+	if strings.ContainsAny(name, "\"\n") {
+		return fmt.Errorf("unsupported characters in file name: %q", name)
+	}
+
+	return nil
+}
+
+func quote(name string) string {
+	return "\"" + name + "\""
+}
@@ -0,0 +1,476 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package disk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	fatReservedSectors   = 32
+	fatSectorsPerCluster = 2
+	fatClusterSize       = fatSectorsPerCluster * sectorSize
+	fatDirEntrySize      = 32
+	// fatMinClusters is the minimum number of clusters in a FAT32 filesystem.
+	fatMinClusters = 65525
+	fatEndOfChain  = 0x0fffffff
+)
+
+const (
+	fatAttrVolumeID  = 0x08
+	fatAttrDirectory = 0x10
+	fatAttrArchive   = 0x20
+	fatAttrLongName  = 0x0f
+)
+
+// fatFile is a file or directory in a FAT filesystem.
+type fatFile struct {
+	name     string
+	isDir    bool
+	parent   *fatFile
+	children map[string]*fatFile
+	// srcPath is the path of the file contents on the host.
+	srcPath string
+	size    int64
+	cluster uint32
+}
+
+// fatImage builds a FAT32 filesystem (eg. an EFI system partition). All
+// timestamps are set to the modification time, so images are reproducible.
+type fatImage struct {
+	label    string
+	volumeID uint32
+	modTime  time.Time
+	root     *fatFile
+}
+
+func newFATImage(label string, volumeID uint32, modTime time.Time) *fatImage {
+	return &fatImage{
+		label:    label,
+		volumeID: volumeID,
+		modTime:  modTime,
+		root:     &fatFile{isDir: true, children: map[string]*fatFile{}},
+	}
+}
+
+// addFile adds a file (copied from a path on the host) to the filesystem,
+// creating any parent directories.
+func (img *fatImage) addFile(name, srcPath string) error {
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	dir := img.root
+	parts := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := dir.children[strings.ToUpper(part)]
+		if !ok {
+			child = &fatFile{name: part, isDir: true, parent: dir, children: map[string]*fatFile{}}
+			dir.children[strings.ToUpper(part)] = child
+		} else if !child.isDir {
+			return fmt.Errorf("not a directory: %s", part)
+		}
+
+		dir = child
+	}
+
+	base := parts[len(parts)-1]
+	if _, ok := dir.children[strings.ToUpper(base)]; ok {
+		return fmt.Errorf("file already exists: %s", name)
+	}
+
+	dir.children[strings.ToUpper(base)] = &fatFile{name: base, parent: dir, srcPath: srcPath, size: fi.Size()}
+
+	return nil
+}
+
+// write writes the filesystem to w (at the given offset), which must be size
+// bytes long and initially zeroed.
+func (img *fatImage) write(w io.WriterAt, offset, size int64) error {
+	totalSectors := uint32(size / sectorSize)
+
+	// Overestimate the size of each FAT, by assuming there are no FATs.
+	fatSectors := ((totalSectors-fatReservedSectors)/fatSectorsPerCluster + 2) * 4
+	fatSectors = (fatSectors + sectorSize - 1) / sectorSize
+
+	dataStartSector := fatReservedSectors + 2*fatSectors
+	totalClusters := (totalSectors - dataStartSector) / fatSectorsPerCluster
+	if totalClusters < fatMinClusters {
+		return fmt.Errorf("filesystem too small for FAT32: %d bytes", size)
+	}
+
+	// Allocate clusters for every directory and file.
+	fat := make([]uint32, totalClusters+2)
+	fat[0] = 0x0ffffff8
+	fat[1] = fatEndOfChain
+
+	nextCluster := uint32(2)
+	allocate := func(n int64) (uint32, error) {
+		if n == 0 {
+			return 0, nil
+		}
+
+		if int64(nextCluster)+n > int64(len(fat)) {
+			return 0, fmt.Errorf("filesystem is full")
+		}
+
+		start := nextCluster
+		for i := int64(0); i < n-1; i++ {
+			fat[nextCluster] = nextCluster + 1
+			nextCluster++
+		}
+		fat[nextCluster] = fatEndOfChain
+		nextCluster++
+
+		return start, nil
+	}
+
+	clusterOffset := func(cluster uint32) int64 {
+		return offset + (int64(dataStartSector)+int64(cluster-2)*fatSectorsPerCluster)*sectorSize
+	}
+
+	var dirs []*fatFile
+	var files []*fatFile
+	var walk func(f *fatFile)
+	walk = func(f *fatFile) {
+		if !f.isDir {
+			files = append(files, f)
+			return
+		}
+
+		dirs = append(dirs, f)
+		for _, child := range sortedChildren(f) {
+			walk(child)
+		}
+	}
+	walk(img.root)
+
+	for _, dir := range dirs {
+		// The size of the entries doesn't depend upon the allocated clusters.
+		entries, err := img.dirEntries(dir)
+		if err != nil {
+			return err
+		}
+
+		// The root directory always has at least one cluster.
+		clusters := max((int64(len(entries))+fatClusterSize-1)/fatClusterSize, 1)
+		if dir.cluster, err = allocate(clusters); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		var err error
+		if f.cluster, err = allocate((f.size + fatClusterSize - 1) / fatClusterSize); err != nil {
+			return err
+		}
+	}
+
+	// Now that every cluster is known, the directory entries can be written.
+	for _, dir := range dirs {
+		entries, err := img.dirEntries(dir)
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.WriteAt(entries, clusterOffset(dir.cluster)); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		if err := copyFileAt(w, f.srcPath, clusterOffset(f.cluster)); err != nil {
+			return err
+		}
+	}
+
+	fatBytes := make([]byte, len(fat)*4)
+	for i, entry := range fat {
+		binary.LittleEndian.PutUint32(fatBytes[i*4:], entry)
+	}
+
+	for i := uint32(0); i < 2; i++ {
+		if _, err := w.WriteAt(fatBytes, offset+int64(fatReservedSectors+i*fatSectors)*sectorSize); err != nil {
+			return err
+		}
+	}
+
+	bootSector := img.bootSector(totalSectors, fatSectors, offset)
+	fsInfo := fsInfoSector(totalClusters-(nextCluster-2), nextCluster)
+
+	// The backup boot sector and FSInfo sector are stored at sector 6.
+	for _, sector := range []uint32{0, 6} {
+		if _, err := w.WriteAt(bootSector, offset+int64(sector)*sectorSize); err != nil {
+			return err
+		}
+
+		if _, err := w.WriteAt(fsInfo, offset+int64(sector+1)*sectorSize); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (img *fatImage) bootSector(totalSectors, fatSectors uint32, offset int64) []byte {
+	b := make([]byte, sectorSize)
+	copy(b[0:], []byte{0xeb, 0x58, 0x90})
+	copy(b[3:], "IMMUTOS ")
+	binary.LittleEndian.PutUint16(b[11:], sectorSize)
+	b[13] = fatSectorsPerCluster
+	binary.LittleEndian.PutUint16(b[14:], fatReservedSectors)
+	b[16] = 2
+	b[21] = 0xf8
+	binary.LittleEndian.PutUint16(b[24:], 63)
+	binary.LittleEndian.PutUint16(b[26:], 255)
+	binary.LittleEndian.PutUint32(b[28:], uint32(offset/sectorSize))
+	binary.LittleEndian.PutUint32(b[32:], totalSectors)
+	binary.LittleEndian.PutUint32(b[36:], fatSectors)
+	binary.LittleEndian.PutUint32(b[44:], 2)
+	binary.LittleEndian.PutUint16(b[48:], 1)
+	binary.LittleEndian.PutUint16(b[50:], 6)
+	b[64] = 0x80
+	b[66] = 0x29
+	binary.LittleEndian.PutUint32(b[67:], img.volumeID)
+	copy(b[71:], fatLabel(img.label))
+	copy(b[82:], "FAT32   ")
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+func fsInfoSector(freeClusters, nextFree uint32) []byte {
+	b := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(b[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(b[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(b[488:], freeClusters)
+	binary.LittleEndian.PutUint32(b[492:], nextFree)
+	binary.LittleEndian.PutUint32(b[508:], 0xaa550000)
+	return b
+}
+
+// dirEntries returns the encoded entries of a directory.
+func (img *fatImage) dirEntries(dir *fatFile) ([]byte, error) {
+	date, tm := fatTimestamp(img.modTime)
+
+	entry := func(shortName []byte, attr byte, cluster uint32, size uint32) []byte {
+		b := make([]byte, fatDirEntrySize)
+		copy(b[0:], shortName)
+		b[11] = attr
+		binary.LittleEndian.PutUint16(b[14:], tm)
+		binary.LittleEndian.PutUint16(b[16:], date)
+		binary.LittleEndian.PutUint16(b[18:], date)
+		binary.LittleEndian.PutUint16(b[20:], uint16(cluster>>16))
+		binary.LittleEndian.PutUint16(b[22:], tm)
+		binary.LittleEndian.PutUint16(b[24:], date)
+		binary.LittleEndian.PutUint16(b[26:], uint16(cluster))
+		binary.LittleEndian.PutUint32(b[28:], size)
+		return b
+	}
+
+	var entries []byte
+	if dir == img.root {
+		entries = append(entries, entry(fatLabel(img.label), fatAttrVolumeID, 0, 0)...)
+	} else {
+		entries = append(entries, entry([]byte(".          "), fatAttrDirectory, dir.cluster, 0)...)
+		// The root directory is always referred to as cluster 0.
+		var parentCluster uint32
+		if dir.parent != img.root {
+			parentCluster = dir.parent.cluster
+		}
+		entries = append(entries, entry([]byte("..         "), fatAttrDirectory, parentCluster, 0)...)
+	}
+
+	shortNames := map[string]bool{}
+	for _, child := range sortedChildren(dir) {
+		shortName, needsLongName, err := fatShortName(child.name, shortNames)
+		if err != nil {
+			return nil, err
+		}
+
+		if needsLongName {
+			entries = append(entries, fatLongNameEntries(child.name, shortName)...)
+		}
+
+		if child.isDir {
+			entries = append(entries, entry(shortName, fatAttrDirectory, child.cluster, 0)...)
+		} else {
+			if child.size > 0xffffffff {
+				return nil, fmt.Errorf("file too large for FAT32: %s", child.name)
+			}
+
+			entries = append(entries, entry(shortName, fatAttrArchive, child.cluster, uint32(child.size))...)
+		}
+	}
+
+	return entries, nil
+}
+
+func sortedChildren(dir *fatFile) []*fatFile {
+	children := make([]*fatFile, 0, len(dir.children))
+	for _, child := range dir.children {
+		children = append(children, child)
+	}
+
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].name < children[j].name
+	})
+
+	return children
+}
+
+// fatShortName returns the 8.3 name for a file, and whether a long file name
+// is required (ie. the name isn't already a valid uppercase 8.3 name).
+func fatShortName(name string, used map[string]bool) ([]byte, bool, error) {
+	if name == "" || name == "." || name == ".." {
+		return nil, false, fmt.Errorf("invalid file name: %q", name)
+	}
+
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+
+	valid := func(s string, maxLen int) bool {
+		if len(s) == 0 || len(s) > maxLen {
+			return false
+		}
+
+		for _, c := range s {
+			if !((c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.ContainsRune("!#$%&'()-@^_`{}~", c)) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	pad := func(base, ext string) []byte {
+		return []byte(fmt.Sprintf("%-8s%-3s", base, ext))
+	}
+
+	key := func(base, ext string) string {
+		return strings.TrimSuffix(base+"."+ext, ".")
+	}
+
+	if valid(base, 8) && (ext == "" || valid(ext, 3)) && !used[key(base, ext)] {
+		used[key(base, ext)] = true
+		return pad(base, ext), false, nil
+	}
+
+	sanitize := func(s string, maxLen int) string {
+		var sb strings.Builder
+		for _, c := range strings.ToUpper(s) {
+			if sb.Len() == maxLen {
+				break
+			}
+
+			if valid(string(c), 1) {
+				sb.WriteRune(c)
+			} else if c != '.' && c != ' ' {
+				sb.WriteRune('_')
+			}
+		}
+
+		return sb.String()
+	}
+
+	base, ext = sanitize(base, 6), sanitize(ext, 3)
+	for i := 1; i < 1000000; i++ {
+		suffix := fmt.Sprintf("~%d", i)
+		alias := base[:min(len(base), 8-len(suffix))] + suffix
+		if !used[key(alias, ext)] {
+			used[key(alias, ext)] = true
+			return pad(alias, ext), true, nil
+		}
+	}
+
+	return nil, false, fmt.Errorf("too many similar file names: %s", name)
+}
+
+// fatLongNameEntries returns the VFAT long file name entries for a file, which
+// precede its short name entry.
+func fatLongNameEntries(name string, shortName []byte) []byte {
+	var checksum byte
+	for _, c := range shortName {
+		checksum = (checksum>>1 | checksum<<7) + c
+	}
+
+	chars := utf16.Encode([]rune(name))
+	if len(chars)%13 != 0 {
+		chars = append(chars, 0)
+	}
+	for len(chars)%13 != 0 {
+		chars = append(chars, 0xffff)
+	}
+
+	n := len(chars) / 13
+	entries := make([]byte, 0, n*fatDirEntrySize)
+
+	// The entries are stored in reverse order.
+	for i := n; i > 0; i-- {
+		b := make([]byte, fatDirEntrySize)
+		b[0] = byte(i)
+		if i == n {
+			b[0] |= 0x40
+		}
+		b[11] = fatAttrLongName
+		b[13] = checksum
+
+		part := chars[(i-1)*13 : i*13]
+		for j, c := range part {
+			var off int
+			switch {
+			case j < 5:
+				off = 1 + j*2
+			case j < 11:
+				off = 14 + (j-5)*2
+			default:
+				off = 28 + (j-11)*2
+			}
+			binary.LittleEndian.PutUint16(b[off:], c)
+		}
+
+		entries = append(entries, b...)
+	}
+
+	return entries
+}
+
+func fatLabel(label string) []byte {
+	return []byte(fmt.Sprintf("%-11s", strings.ToUpper(label))[:11])
+}
+
+// fatTimestamp returns the FAT date and time of t (FAT dates start in 1980).
+func fatTimestamp(t time.Time) (uint16, uint16) {
+	t = t.UTC()
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	date := uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm := uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tm
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package disk
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 512
+	// gptEntries is the number of partition entries in the GPT (the minimum
+	// required by the UEFI specification).
+	gptEntries   = 128
+	gptEntrySize = 128
+	// gptEntriesSectors is the number of sectors used by the partition entries.
+	gptEntriesSectors = gptEntries * gptEntrySize / sectorSize
+)
+
+// Partition attributes.
+const (
+	// attrLegacyBIOSBootable marks a partition as bootable (used by U-Boot and
+	// syslinux to locate the extlinux configuration).
+	attrLegacyBIOSBootable = 1 << 2
+)
+
+// Partition type GUIDs.
+var (
+	espTypeGUID             = mustParseGUID("c12a7328-f81f-11d2-ba4b-00a0c93ec93b")
+	linuxFilesystemTypeGUID = mustParseGUID("0fc63daf-8483-4772-8e79-3d69d8477de4")
+)
+
+// rootTypeGUIDs are the architecture specific root partition type GUIDs from
+// the Discoverable Partitions Specification.
+var rootTypeGUIDs = map[string]guid{
+	"386":     mustParseGUID("44479540-f297-41b2-9af7-d131d5f0458a"),
+	"amd64":   mustParseGUID("4f68bce3-e8cd-4db1-96e7-fbcaf984b709"),
+	"arm":     mustParseGUID("69dad710-2ce4-4e3c-b16c-21a1d49abed3"),
+	"arm64":   mustParseGUID("b921b045-1df0-41c3-af44-4c6f280d3fae"),
+	"ppc64le": mustParseGUID("c31c45e6-3f39-412e-80fb-4809c4980599"),
+	"riscv64": mustParseGUID("72ec70a6-cf74-40e6-bd49-4bda08e8f224"),
+	"s390x":   mustParseGUID("5eead9a9-fe09-4a1e-a1d7-520d00531306"),
+}
+
+// guid is a GUID in its textual byte order.
+type guid [16]byte
+
+func mustParseGUID(s string) guid {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic(fmt.Sprintf("invalid guid: %s", s))
+	}
+
+	var g guid
+	copy(g[:], b)
+	return g
+}
+
+// deriveGUID returns a version 4 (random) GUID derived from the seed and
+// purpose, so that images are reproducible.
+func deriveGUID(seed []byte, purpose string) guid {
+	sum := sha256.Sum256(append(append([]byte{}, seed...), purpose...))
+
+	var g guid
+	copy(g[:], sum[:16])
+	g[6] = (g[6] & 0x0f) | 0x40
+	g[8] = (g[8] & 0x3f) | 0x80
+	return g
+}
+
+func (g guid) String() string {
+	h := hex.EncodeToString(g[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// encode returns the on-disk (mixed endian) representation of the GUID.
+func (g guid) encode() []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint32(b[0:], binary.BigEndian.Uint32(g[0:]))
+	binary.LittleEndian.PutUint16(b[4:], binary.BigEndian.Uint16(g[4:]))
+	binary.LittleEndian.PutUint16(b[6:], binary.BigEndian.Uint16(g[6:]))
+	copy(b[8:], g[8:])
+	return b
+}
+
+type partition struct {
+	name       string
+	typeGUID   guid
+	guid       guid
+	startLBA   uint64
+	endLBA     uint64
+	attributes uint64
+}
+
+// writeGPT writes a protective MBR, and the primary and backup GUID partition
+// tables to a disk image of the given size.
+func writeGPT(w io.WriterAt, diskSize int64, diskGUID guid, partitions []partition) error {
+	if len(partitions) > gptEntries {
+		return fmt.Errorf("too many partitions: %d", len(partitions))
+	}
+
+	lastLBA := uint64(diskSize/sectorSize) - 1
+
+	entries := make([]byte, gptEntries*gptEntrySize)
+	for i, p := range partitions {
+		entry := entries[i*gptEntrySize : (i+1)*gptEntrySize]
+		copy(entry[0:], p.typeGUID.encode())
+		copy(entry[16:], p.guid.encode())
+		binary.LittleEndian.PutUint64(entry[32:], p.startLBA)
+		binary.LittleEndian.PutUint64(entry[40:], p.endLBA)
+		binary.LittleEndian.PutUint64(entry[48:], p.attributes)
+
+		name := utf16.Encode([]rune(p.name))
+		if len(name) > 36 {
+			return fmt.Errorf("partition name too long: %s", p.name)
+		}
+
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(entry[56+2*j:], c)
+		}
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	header := func(myLBA, alternateLBA, entriesLBA uint64) []byte {
+		hdr := make([]byte, sectorSize)
+		copy(hdr[0:], "EFI PART")
+		binary.LittleEndian.PutUint32(hdr[8:], 0x00010000)
+		binary.LittleEndian.PutUint32(hdr[12:], 92)
+		binary.LittleEndian.PutUint64(hdr[24:], myLBA)
+		binary.LittleEndian.PutUint64(hdr[32:], alternateLBA)
+		binary.LittleEndian.PutUint64(hdr[40:], 2+gptEntriesSectors)
+		binary.LittleEndian.PutUint64(hdr[48:], lastLBA-gptEntriesSectors-1)
+		copy(hdr[56:], diskGUID.encode())
+		binary.LittleEndian.PutUint64(hdr[72:], entriesLBA)
+		binary.LittleEndian.PutUint32(hdr[80:], gptEntries)
+		binary.LittleEndian.PutUint32(hdr[84:], gptEntrySize)
+		binary.LittleEndian.PutUint32(hdr[88:], entriesCRC)
+		binary.LittleEndian.PutUint32(hdr[16:], crc32.ChecksumIEEE(hdr[:92]))
+		return hdr
+	}
+
+	// The protective MBR covers the whole disk (or as much of it as can be
+	// represented).
+	mbr := make([]byte, sectorSize)
+	mbrEntry := mbr[446:]
+	copy(mbrEntry[1:], []byte{0x00, 0x02, 0x00})
+	mbrEntry[4] = 0xee
+	copy(mbrEntry[5:], []byte{0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(mbrEntry[8:], 1)
+	binary.LittleEndian.PutUint32(mbrEntry[12:], uint32(min(lastLBA, 0xffffffff)))
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	backupEntriesLBA := lastLBA - gptEntriesSectors
+
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, mbr},
+		{1, header(1, lastLBA, 2)},
+		{2, entries},
+		{backupEntriesLBA, entries},
+		{lastLBA, header(lastLBA, 1, backupEntriesLBA)},
+	}
+
+	for _, write := range writes {
+		if _, err := w.WriteAt(write.data, int64(write.lba)*sectorSize); err != nil {
+			return fmt.Errorf("failed to write partition table: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Options configures how a file is downloaded.
+type Options struct {
+	// Client is the HTTP client to use, if not specified a non-caching client
+	// is used.
+	Client *http.Client
+	// MaxAttempts is the maximum number of attempts to make, if not specified
+	// defaults to 5.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, if not specified
+	// defaults to 1 second. The delay doubles with each subsequent attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum delay between attempts, if not specified
+	// defaults to 30 seconds.
+	MaxBackoff time.Duration
+	// AttemptTimeout is the maximum duration of a single attempt, if not
+	// specified defaults to 10 minutes. As partial downloads are resumed,
+	// a timed out attempt does not lose its progress.
+	AttemptTimeout time.Duration
+	// OnProgress is called with the number of bytes written to the file. It
+	// may be called with a negative value if the download had to be restarted.
+	OnProgress func(n int64)
+}
+
+// PermanentError is an error that will not be resolved by retrying.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// ToFile downloads the resource at url into the file at path. If the file
+// already exists, the download is resumed from the end of the file using an
+// HTTP range request. Transient failures are retried with exponential backoff.
+func ToFile(ctx context.Context, url, path string, opts *Options) error {
+	opts = withDefaults(opts)
+
+	var errs error
+	for attempt := 0; attempt < opts.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := backoff(attempt, opts.InitialBackoff, opts.MaxBackoff)
+
+			slog.Debug("Retrying download",
+				slog.String("url", url), slog.Int("attempt", attempt+1),
+				slog.Duration("delay", delay))
+
+			select {
+			case <-ctx.Done():
+				return errors.Join(errs, ctx.Err())
+			case <-time.After(delay):
+			}
+		}
+
+		err := downloadAttempt(ctx, url, path, opts)
+		if err == nil {
+			return nil
+		}
+
+		errs = errors.Join(errs, fmt.Errorf("attempt %d: %w", attempt+1, err))
+
+		var permanentErr *PermanentError
+		if errors.As(err, &permanentErr) || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return errs
+}
+
+func downloadAttempt(ctx context.Context, url, path string, opts *Options) error {
+	ctx, cancel := context.WithTimeout(ctx, opts.AttemptTimeout)
+	defer cancel()
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return &PermanentError{Err: fmt.Errorf("failed to open file: %w", err)}
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return &PermanentError{Err: fmt.Errorf("failed to seek file: %w", err)}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return &PermanentError{Err: fmt.Errorf("failed to create request: %w", err)}
+	}
+
+	if offset > 0 {
+		slog.Debug("Resuming download", slog.String("url", url), slog.Int64("offset", offset))
+
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	resp, err := opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		// Append to the existing partial download.
+	case resp.StatusCode == http.StatusOK:
+		// The server ignored (or didn't receive) our range request, start over.
+		if offset > 0 {
+			if err := f.Truncate(0); err != nil {
+				return &PermanentError{Err: fmt.Errorf("failed to truncate file: %w", err)}
+			}
+
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return &PermanentError{Err: fmt.Errorf("failed to seek file: %w", err)}
+			}
+
+			opts.OnProgress(-offset)
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The file is already complete.
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	default:
+		return &PermanentError{Err: fmt.Errorf("unexpected status: %s", resp.Status)}
+	}
+
+	if _, err := io.Copy(&progressWriter{w: f, onProgress: opts.OnProgress}, resp.Body); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return &PermanentError{Err: fmt.Errorf("failed to close file: %w", err)}
+	}
+
+	return nil
+}
+
+// backoff returns a randomized exponential backoff delay ("full jitter").
+func backoff(attempt int, initial, max time.Duration) time.Duration {
+	delay := initial << (attempt - 1)
+	if delay <= 0 || delay > max {
+		delay = max
+	}
+
+	return time.Duration(rand.Int64N(int64(delay))) + 1
+}
+
+func withDefaults(opts *Options) *Options {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.Client == nil {
+		o.Client = &http.Client{Transport: http.DefaultTransport}
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 5
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = time.Second
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	if o.AttemptTimeout <= 0 {
+		o.AttemptTimeout = 10 * time.Minute
+	}
+	if o.OnProgress == nil {
+		o.OnProgress = func(int64) {}
+	}
+
+	return &o
+}
+
+type progressWriter struct {
+	w          io.Writer
+	onProgress func(n int64)
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.onProgress(int64(n))
+	return n, err
+}
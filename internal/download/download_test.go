@@ -0,0 +1,112 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package download_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/immutos/immutos/internal/download"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToFile(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog\n"), 1024)
+
+	opts := &download.Options{
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	}
+
+	t.Run("Retry", func(t *testing.T) {
+		var requests atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			http.ServeContent(w, r, "test.deb", time.Time{}, bytes.NewReader(content))
+		}))
+		t.Cleanup(srv.Close)
+
+		path := filepath.Join(t.TempDir(), "test.deb")
+
+		var progress atomic.Int64
+		opts := *opts
+		opts.OnProgress = func(n int64) {
+			progress.Add(n)
+		}
+
+		require.NoError(t, download.ToFile(ctx, srv.URL, path, &opts))
+
+		require.Equal(t, int32(3), requests.Load())
+		require.Equal(t, int64(len(content)), progress.Load())
+
+		downloaded, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, content, downloaded)
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		var rangeHeader string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rangeHeader = r.Header.Get("Range")
+			http.ServeContent(w, r, "test.deb", time.Time{}, bytes.NewReader(content))
+		}))
+		t.Cleanup(srv.Close)
+
+		path := filepath.Join(t.TempDir(), "test.deb")
+		require.NoError(t, os.WriteFile(path, content[:1000], 0o644))
+
+		require.NoError(t, download.ToFile(ctx, srv.URL, path, opts))
+
+		require.Equal(t, "bytes=1000-", rangeHeader)
+
+		downloaded, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, content, downloaded)
+	})
+
+	t.Run("Not Found", func(t *testing.T) {
+		var requests atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			http.NotFound(w, r)
+		}))
+		t.Cleanup(srv.Close)
+
+		path := filepath.Join(t.TempDir(), "test.deb")
+
+		require.Error(t, download.ToFile(ctx, srv.URL, path, opts))
+
+		// Permanent errors should not be retried.
+		require.Equal(t, int32(1), requests.Load())
+	})
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fsimage
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+// archive is a normalized view of a root filesystem tarball: entries are
+// sorted by name, timestamps are clamped to the source date epoch, and hard
+// links always refer to the first (sorted) name of a file.
+type archive struct {
+	f       *os.File
+	entries []archiveEntry
+}
+
+type archiveEntry struct {
+	hdr *tar.Header
+	// offset is the offset of the entry's data in the tarball.
+	offset int64
+	// data is the data of an entry that is not stored in the tarball.
+	data []byte
+}
+
+func openArchive(rootFSArchivePath string, epoch time.Time) (*archive, error) {
+	f, err := os.Open(rootFSArchivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := readEntries(f, epoch)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &archive{f: f, entries: entries}, nil
+}
+
+func (a *archive) Close() error {
+	return a.f.Close()
+}
+
+// open returns a reader for the data of an entry.
+func (a *archive) open(entry archiveEntry) io.Reader {
+	if entry.data != nil {
+		return bytes.NewReader(entry.data)
+	}
+
+	return io.NewSectionReader(a.f, entry.offset, entry.hdr.Size)
+}
+
+// index returns the entries of the archive keyed by name (without a trailing
+// slash).
+func (a *archive) index() map[string]archiveEntry {
+	entries := make(map[string]archiveEntry, len(a.entries))
+	for _, entry := range a.entries {
+		entries[strings.TrimSuffix(entry.hdr.Name, "/")] = entry
+	}
+
+	return entries
+}
+
+// resolve returns the entry holding the contents of a hard linked file.
+func (a *archive) resolve(entry archiveEntry) archiveEntry {
+	if entry.hdr.Typeflag != tar.TypeLink {
+		return entry
+	}
+
+	i := sort.Search(len(a.entries), func(i int) bool {
+		return strings.TrimSuffix(a.entries[i].hdr.Name, "/") >= entry.hdr.Linkname
+	})
+	if i < len(a.entries) && a.entries[i].hdr.Name == entry.hdr.Linkname {
+		return a.entries[i]
+	}
+
+	return entry
+}
+
+// writeTar writes the normalized tarball.
+func (a *archive) writeTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	for _, entry := range a.entries {
+		if err := tw.WriteHeader(entry.hdr); err != nil {
+			return fmt.Errorf("failed to write tar header: %w", err)
+		}
+
+		if entry.hdr.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(tw, a.open(entry)); err != nil {
+				return fmt.Errorf("failed to write %s: %w", entry.hdr.Name, err)
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+func readEntries(f *os.File, epoch time.Time) ([]archiveEntry, error) {
+	cr := &countingReader{r: f}
+
+	// Later entries replace earlier entries with the same name.
+	entriesByName := map[string]archiveEntry{}
+
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			// The attributes of the root directory are not preserved.
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeGNUSparse {
+			return nil, fmt.Errorf("sparse files are not supported: %s", name)
+		}
+
+		normalized := &tar.Header{
+			Typeflag: hdr.Typeflag,
+			Name:     name,
+			Linkname: hdr.Linkname,
+			Mode:     hdr.Mode,
+			Uid:      hdr.Uid,
+			Gid:      hdr.Gid,
+			ModTime:  hdr.ModTime,
+			Devmajor: hdr.Devmajor,
+			Devminor: hdr.Devminor,
+			Format:   tar.FormatPAX,
+		}
+
+		if normalized.ModTime.After(epoch) {
+			normalized.ModTime = epoch
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			normalized.Name += "/"
+		case tar.TypeReg:
+			normalized.Size = hdr.Size
+		case tar.TypeLink:
+			normalized.Linkname = strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/")
+		case tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		default:
+			return nil, fmt.Errorf("unsupported tar entry type %d: %s", hdr.Typeflag, name)
+		}
+
+		for key, value := range hdr.PAXRecords {
+			if strings.HasPrefix(key, paxXattrPrefix) {
+				if normalized.PAXRecords == nil {
+					normalized.PAXRecords = map[string]string{}
+				}
+
+				normalized.PAXRecords[key] = value
+			}
+		}
+
+		entriesByName[name] = archiveEntry{hdr: normalized, offset: cr.n}
+	}
+
+	// Group hard links with the file they refer to.
+	links := map[string][]string{}
+	for name, entry := range entriesByName {
+		if entry.hdr.Typeflag != tar.TypeLink {
+			continue
+		}
+
+		target, ok := entriesByName[entry.hdr.Linkname]
+		if !ok || target.hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("hard link %s refers to missing file: %s", name, entry.hdr.Linkname)
+		}
+
+		links[entry.hdr.Linkname] = append(links[entry.hdr.Linkname], name)
+	}
+
+	// The first (sorted) name of a hard linked file holds its contents.
+	for target, names := range links {
+		names = append(names, target)
+		sort.Strings(names)
+
+		entry := entriesByName[target]
+		primary := *entry.hdr
+		primary.Name = names[0]
+		entriesByName[names[0]] = archiveEntry{hdr: &primary, offset: entry.offset}
+
+		for _, name := range names[1:] {
+			entriesByName[name] = archiveEntry{hdr: &tar.Header{
+				Typeflag: tar.TypeLink,
+				Name:     name,
+				Linkname: names[0],
+				Mode:     primary.Mode,
+				Uid:      primary.Uid,
+				Gid:      primary.Gid,
+				ModTime:  primary.ModTime,
+				Format:   tar.FormatPAX,
+			}}
+		}
+	}
+
+	entries := make([]archiveEntry, 0, len(entriesByName))
+	for _, entry := range entriesByName {
+		entries = append(entries, entry)
+	}
+
+	sortEntries(entries)
+
+	return entries, nil
+}
+
+func sortEntries(entries []archiveEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.TrimSuffix(entries[i].hdr.Name, "/") < strings.TrimSuffix(entries[j].hdr.Name, "/")
+	})
+}
+
+// countingReader counts the number of bytes read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
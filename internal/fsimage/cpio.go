@@ -0,0 +1,208 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fsimage
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const cpioTrailer = "TRAILER!!!"
+
+// File type bits of the cpio mode field.
+const (
+	cpioModeFifo    = 0o010000
+	cpioModeChar    = 0o020000
+	cpioModeDir     = 0o040000
+	cpioModeBlock   = 0o060000
+	cpioModeRegular = 0o100000
+	cpioModeSymlink = 0o120000
+)
+
+type compressor func(w io.Writer) (io.WriteCloser, error)
+
+// cpioCompressors are the compression formats supported by the Linux kernel
+// for initramfs archives.
+var cpioCompressors = map[string]compressor{
+	"none": uncompressed,
+	"gzip": gzipCompress,
+	"xz":   xzCompress,
+	"zstd": zstdCompress,
+}
+
+func uncompressed(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func gzipCompress(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, gzip.BestCompression)
+}
+
+func xzCompress(w io.Writer) (io.WriteCloser, error) {
+	// The kernel only supports the CRC32 integrity check.
+	return xz.WriterConfig{CheckSum: xz.CRC32}.NewWriter(w)
+}
+
+func zstdCompress(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// writeCpio writes the archive as a newc (SVR4) format cpio archive, as used
+// for initramfs images.
+func writeCpio(w io.Writer, a *archive) error {
+	cw := &cpioWriter{w: w}
+
+	// Hard linked files share an inode number.
+	inodes := map[string]int{}
+	linkCounts := map[string]int{}
+	for _, entry := range a.entries {
+		if entry.hdr.Typeflag == tar.TypeLink {
+			linkCounts[entry.hdr.Linkname]++
+		}
+	}
+
+	for i, entry := range a.entries {
+		hdr := entry.hdr
+		name := strings.TrimSuffix(hdr.Name, "/")
+
+		ino := i + 1
+		nlink := 1
+		mode := int(hdr.Mode & 0o7777)
+
+		var data io.Reader
+		var size int64
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			mode |= cpioModeDir
+			nlink = 2
+		case tar.TypeReg:
+			mode |= cpioModeRegular
+			nlink += linkCounts[name]
+			inodes[name] = ino
+			data, size = a.open(entry), hdr.Size
+		case tar.TypeLink:
+			// The contents are stored with the first name of the file.
+			mode |= cpioModeRegular
+			nlink += linkCounts[hdr.Linkname]
+			ino = inodes[hdr.Linkname]
+		case tar.TypeSymlink:
+			mode |= cpioModeSymlink
+			data, size = strings.NewReader(hdr.Linkname), int64(len(hdr.Linkname))
+		case tar.TypeChar:
+			mode |= cpioModeChar
+		case tar.TypeBlock:
+			mode |= cpioModeBlock
+		case tar.TypeFifo:
+			mode |= cpioModeFifo
+		}
+
+		if err := cw.writeHeader(name, cpioHeader{
+			ino:       ino,
+			mode:      mode,
+			uid:       hdr.Uid,
+			gid:       hdr.Gid,
+			nlink:     nlink,
+			mtime:     hdr.ModTime.Unix(),
+			size:      size,
+			rdevMajor: hdr.Devmajor,
+			rdevMinor: hdr.Devminor,
+		}); err != nil {
+			return fmt.Errorf("failed to write cpio header for %s: %w", name, err)
+		}
+
+		if data != nil {
+			if err := cw.writeData(data, size); err != nil {
+				return fmt.Errorf("failed to write %s: %w", name, err)
+			}
+		}
+	}
+
+	return cw.writeHeader(cpioTrailer, cpioHeader{nlink: 1})
+}
+
+type cpioHeader struct {
+	ino       int
+	mode      int
+	uid       int
+	gid       int
+	nlink     int
+	mtime     int64
+	size      int64
+	rdevMajor int64
+	rdevMinor int64
+}
+
+type cpioWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *cpioWriter) writeHeader(name string, hdr cpioHeader) error {
+	if hdr.size > 0xffffffff {
+		return fmt.Errorf("file too large for cpio archive")
+	}
+
+	header := fmt.Sprintf("070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		hdr.ino, hdr.mode, hdr.uid, hdr.gid, hdr.nlink, uint32(hdr.mtime), hdr.size,
+		0, 0, hdr.rdevMajor, hdr.rdevMinor, len(name)+1, 0)
+
+	if err := cw.write([]byte(header + name + "\x00")); err != nil {
+		return err
+	}
+
+	return cw.pad()
+}
+
+func (cw *cpioWriter) writeData(r io.Reader, size int64) error {
+	n, err := io.Copy(cw.w, r)
+	cw.n += n
+	if err != nil {
+		return err
+	}
+
+	if n != size {
+		return fmt.Errorf("unexpected size: %d != %d", n, size)
+	}
+
+	return cw.pad()
+}
+
+// pad pads the archive to a multiple of 4 bytes.
+func (cw *cpioWriter) pad() error {
+	return cw.write(make([]byte, (4-cw.n%4)%4))
+}
+
+func (cw *cpioWriter) write(b []byte) error {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return err
+}
@@ -0,0 +1,409 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fsimage
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ExtensionType is the type of an extension image.
+type ExtensionType string
+
+const (
+	// ExtensionSysext is a systemd system extension (see systemd-sysext(8)). It
+	// contains the files under /usr and /opt that were added (or changed)
+	// relative to a base image.
+	ExtensionSysext ExtensionType = "sysext"
+	// ExtensionPortable is a portable service image (see portablectl(1)). If
+	// built on top of a base image, it is a portable service extension.
+	ExtensionPortable ExtensionType = "portable"
+)
+
+// systemdArchitectures maps platform architectures to the architecture
+// identifiers used by systemd (eg. in extension-release files).
+var systemdArchitectures = map[string]string{
+	"386":      "x86",
+	"amd64":    "x86-64",
+	"arm":      "arm",
+	"arm64":    "arm64",
+	"loong64":  "loongarch64",
+	"mips64le": "mips64-le",
+	"ppc64le":  "ppc64-le",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+var extensionNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+
+// ExtensionOptions are the options for creating an extension image.
+type ExtensionOptions struct {
+	Options
+	// Type is the type of extension image.
+	Type ExtensionType
+	// Name is the name of the extension. systemd requires it to match the file
+	// name of the image, so if not specified, it is derived from the image path
+	// (without the .raw suffix).
+	Name string
+	// BaseRootFSArchivePath is the root filesystem tarball of the base image.
+	// Only files that were added (or changed) relative to the base image are
+	// included. Required for system extensions.
+	BaseRootFSArchivePath string
+	// Architecture is the platform architecture of the image (eg. amd64).
+	Architecture string
+}
+
+// CreateExtension creates a system extension or portable service image (either
+// a squashfs or erofs filesystem) from a root filesystem tarball. Unless the
+// root filesystem already contains one, an extension-release file compatible
+// with the base image is generated.
+func CreateExtension(ctx context.Context, imagePath string, format Format, rootFSArchivePath string, opts ExtensionOptions) error {
+	if format != FormatSquashfs && format != FormatErofs {
+		return fmt.Errorf("unsupported %s image format: %s", opts.Type, format)
+	}
+
+	if opts.Name == "" {
+		opts.Name = strings.TrimSuffix(filepath.Base(imagePath), ".raw")
+	}
+
+	if !extensionNamePattern.MatchString(opts.Name) {
+		return fmt.Errorf("invalid extension name: %q", opts.Name)
+	}
+
+	if opts.Type == ExtensionSysext && opts.BaseRootFSArchivePath == "" {
+		return fmt.Errorf("system extensions require a base image")
+	}
+
+	if opts.Compression == "" {
+		opts.Compression = DefaultCompression[format]
+	}
+
+	if err := ValidateCompression(format, opts.Compression); err != nil {
+		return err
+	}
+
+	a, err := openArchive(rootFSArchivePath, opts.SourceDateEpoch)
+	if err != nil {
+		return fmt.Errorf("failed to read root filesystem: %w", err)
+	}
+	defer a.Close()
+
+	if opts.BaseRootFSArchivePath == "" {
+		// A complete portable service image.
+		if _, err := readOSRelease(a); err != nil {
+			return err
+		}
+
+		checkPortableUnits(a, opts.Name)
+
+		return createImage(ctx, imagePath, format, a, opts.Options)
+	}
+
+	base, err := openArchive(opts.BaseRootFSArchivePath, opts.SourceDateEpoch)
+	if err != nil {
+		return fmt.Errorf("failed to read base root filesystem: %w", err)
+	}
+	defer base.Close()
+
+	osRelease, err := readOSRelease(base)
+	if err != nil {
+		return fmt.Errorf("failed to read base image: %w", err)
+	}
+
+	// systemd only merges /usr and /opt from system extensions.
+	include := func(name string) bool { return true }
+	if opts.Type == ExtensionSysext {
+		include = func(name string) bool {
+			top, _, _ := strings.Cut(name, "/")
+			return top == "usr" || top == "opt"
+		}
+	}
+
+	delta, err := diff(a, base, include)
+	if err != nil {
+		return fmt.Errorf("failed to compare root filesystem with base image: %w", err)
+	}
+
+	releasePath := "usr/lib/extension-release.d/extension-release." + opts.Name
+	if _, ok := delta[releasePath]; !ok {
+		delta[releasePath] = archiveEntry{
+			hdr: &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     releasePath,
+				Mode:     0o644,
+				ModTime:  opts.SourceDateEpoch,
+				Format:   tar.FormatPAX,
+			},
+			data: extensionRelease(osRelease, opts.Architecture),
+		}
+	}
+
+	ext := &archive{f: a.f, entries: toEntries(a, delta, opts)}
+
+	if opts.Type == ExtensionPortable {
+		checkPortableUnits(ext, opts.Name)
+	}
+
+	return createImage(ctx, imagePath, format, ext, opts.Options)
+}
+
+// diff returns the entries of the archive that were added (or changed)
+// relative to the base archive, keyed by name.
+func diff(a, base *archive, include func(name string) bool) (map[string]archiveEntry, error) {
+	entries, baseEntries := a.index(), base.index()
+
+	delta := map[string]archiveEntry{}
+	var ignored, removed int
+	for name, entry := range entries {
+		if baseEntry, ok := baseEntries[name]; ok {
+			same, err := sameEntry(a, a.resolve(entry), base, base.resolve(baseEntry))
+			if err != nil {
+				return nil, fmt.Errorf("failed to compare %s: %w", name, err)
+			}
+
+			if same {
+				continue
+			}
+		}
+
+		if !include(name) {
+			ignored++
+			continue
+		}
+
+		delta[name] = entry
+	}
+
+	for name := range baseEntries {
+		if _, ok := entries[name]; !ok && include(name) {
+			removed++
+		}
+	}
+
+	if ignored > 0 {
+		slog.Warn("Ignoring changed files outside of /usr and /opt", slog.Int("count", ignored))
+	}
+
+	if removed > 0 {
+		slog.Warn("Files removed relative to the base image will still be present", slog.Int("count", removed))
+	}
+
+	return delta, nil
+}
+
+// toEntries returns the sorted entries of an extension image, including any
+// missing parent directories. Hard links to files that are not part of the
+// extension are replaced with copies of the file.
+func toEntries(a *archive, delta map[string]archiveEntry, opts ExtensionOptions) []archiveEntry {
+	entries := a.index()
+
+	for name := range delta {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := delta[dir]; ok {
+				continue
+			}
+
+			if entry, ok := entries[dir]; ok && entry.hdr.Typeflag == tar.TypeDir {
+				delta[dir] = entry
+				continue
+			}
+
+			delta[dir] = archiveEntry{hdr: &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir + "/",
+				Mode:     0o755,
+				ModTime:  opts.SourceDateEpoch,
+				Format:   tar.FormatPAX,
+			}}
+		}
+	}
+
+	sorted := make([]archiveEntry, 0, len(delta))
+	for _, entry := range delta {
+		sorted = append(sorted, entry)
+	}
+	sortEntries(sorted)
+
+	// Links are always sorted after the first name of the file.
+	primaries := map[string]string{}
+	for i, entry := range sorted {
+		if entry.hdr.Typeflag != tar.TypeLink {
+			continue
+		}
+
+		if _, ok := delta[entry.hdr.Linkname]; ok {
+			continue
+		}
+
+		if primary, ok := primaries[entry.hdr.Linkname]; ok {
+			hdr := *entry.hdr
+			hdr.Linkname = primary
+			sorted[i].hdr = &hdr
+			continue
+		}
+
+		target := entries[entry.hdr.Linkname]
+		hdr := *target.hdr
+		hdr.Name = entry.hdr.Name
+		sorted[i] = archiveEntry{hdr: &hdr, offset: target.offset}
+
+		primaries[entry.hdr.Linkname] = entry.hdr.Name
+	}
+
+	return sorted
+}
+
+// sameEntry returns whether two (resolved) entries have the same type,
+// attributes and contents. Modification times are ignored.
+func sameEntry(a *archive, entry archiveEntry, base *archive, baseEntry archiveEntry) (bool, error) {
+	hdr, baseHdr := entry.hdr, baseEntry.hdr
+
+	if hdr.Typeflag != baseHdr.Typeflag ||
+		hdr.Mode != baseHdr.Mode ||
+		hdr.Uid != baseHdr.Uid ||
+		hdr.Gid != baseHdr.Gid ||
+		hdr.Linkname != baseHdr.Linkname ||
+		hdr.Devmajor != baseHdr.Devmajor ||
+		hdr.Devminor != baseHdr.Devminor ||
+		hdr.Size != baseHdr.Size ||
+		!maps.Equal(hdr.PAXRecords, baseHdr.PAXRecords) {
+		return false, nil
+	}
+
+	if hdr.Typeflag != tar.TypeReg {
+		return true, nil
+	}
+
+	return sameContents(a.open(entry), base.open(baseEntry))
+}
+
+func sameContents(r, baseR io.Reader) (bool, error) {
+	buf, baseBuf := make([]byte, 32*1024), make([]byte, 32*1024)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, err
+		}
+
+		baseN, baseErr := io.ReadFull(baseR, baseBuf)
+		if baseErr != nil && !errors.Is(baseErr, io.EOF) && !errors.Is(baseErr, io.ErrUnexpectedEOF) {
+			return false, baseErr
+		}
+
+		if !bytes.Equal(buf[:n], baseBuf[:baseN]) {
+			return false, nil
+		}
+
+		if err != nil || baseErr != nil {
+			return err != nil && baseErr != nil, nil
+		}
+	}
+}
+
+// readOSRelease reads the os-release file (see os-release(5)) of a root
+// filesystem.
+func readOSRelease(a *archive) (map[string]string, error) {
+	entries := a.index()
+
+	for _, name := range []string{"etc/os-release", "usr/lib/os-release"} {
+		entry, ok := entries[name]
+		if !ok {
+			continue
+		}
+
+		entry = a.resolve(entry)
+		if entry.hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		osRelease := map[string]string{}
+
+		scanner := bufio.NewScanner(a.open(entry))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			key, value, ok := strings.Cut(line, "=")
+			if ok {
+				osRelease[key] = strings.Trim(value, `"'`)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+
+		return osRelease, nil
+	}
+
+	return nil, fmt.Errorf("os-release file not found")
+}
+
+// extensionRelease returns the contents of an extension-release file that
+// matches the base image.
+func extensionRelease(osRelease map[string]string, arch string) []byte {
+	var b strings.Builder
+
+	if id := osRelease["ID"]; id != "" {
+		fmt.Fprintf(&b, "ID=%s\n", id)
+	} else {
+		b.WriteString("ID=_any\n")
+	}
+
+	for _, key := range []string{"VERSION_ID", "SYSEXT_LEVEL"} {
+		if value := osRelease[key]; value != "" {
+			fmt.Fprintf(&b, "%s=%s\n", key, value)
+		}
+	}
+
+	if systemdArch, ok := systemdArchitectures[arch]; ok {
+		fmt.Fprintf(&b, "ARCHITECTURE=%s\n", systemdArch)
+	}
+
+	return []byte(b.String())
+}
+
+// checkPortableUnits warns if a portable service image doesn't contain any
+// unit files matching its name (which portablectl requires).
+func checkPortableUnits(a *archive, name string) {
+	for _, entry := range a.entries {
+		dir, unit := path.Split(strings.TrimSuffix(entry.hdr.Name, "/"))
+		if dir != "usr/lib/systemd/system/" && dir != "lib/systemd/system/" && dir != "etc/systemd/system/" {
+			continue
+		}
+
+		prefix := strings.TrimSuffix(unit, path.Ext(unit))
+		if prefix == name || strings.HasPrefix(prefix, name+"-") || strings.HasPrefix(prefix, name+"@") {
+			return
+		}
+	}
+
+	slog.Warn("No unit files match the name of the portable service image", slog.String("name", name))
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fsimage creates reproducible filesystem images (squashfs, erofs, and
+// cpio initramfs archives) from root filesystem tarballs.
+package fsimage
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is the format of a filesystem image.
+type Format string
+
+const (
+	// FormatSquashfs is a squashfs image (requires squashfs-tools 4.6 or later).
+	FormatSquashfs Format = "squashfs"
+	// FormatErofs is an erofs image (requires erofs-utils 1.7 or later).
+	FormatErofs Format = "erofs"
+	// FormatCpio is a newc format cpio archive (eg. an initramfs).
+	FormatCpio Format = "cpio"
+)
+
+// DefaultCompression is the default compression algorithm of each format.
+var DefaultCompression = map[Format]string{
+	FormatSquashfs: "gzip",
+	FormatErofs:    "lz4hc",
+	FormatCpio:     "gzip",
+}
+
+// Compressions are the compression algorithms supported by each format.
+var Compressions = map[Format][]string{
+	FormatSquashfs: {"gzip", "lz4", "lzo", "lzma", "xz", "zstd"},
+	FormatErofs:    {"none", "deflate", "lz4", "lz4hc", "lzma"},
+	FormatCpio:     {"none", "gzip", "xz", "zstd"},
+}
+
+// Options are the options for creating a filesystem image.
+type Options struct {
+	// Compression is the compression algorithm to use. If not specified, the
+	// default for the format is used.
+	Compression string
+	// SourceDateEpoch is the maximum timestamp of any file, and the creation
+	// time of the image.
+	SourceDateEpoch time.Time
+	// Label is the optional volume label (squashfs images don't have labels).
+	Label string
+	// UUID is the optional filesystem UUID. If not specified, one is derived
+	// from the contents of the image.
+	UUID string
+}
+
+// Create creates a filesystem image from a root filesystem tarball. Files are
+// sorted, timestamps are clamped to the source date epoch, and ownership is
+// preserved (without requiring root privileges).
+func Create(ctx context.Context, imagePath string, format Format, rootFSArchivePath string, opts Options) error {
+	if opts.Compression == "" {
+		opts.Compression = DefaultCompression[format]
+	}
+
+	if err := ValidateCompression(format, opts.Compression); err != nil {
+		return err
+	}
+
+	a, err := openArchive(rootFSArchivePath, opts.SourceDateEpoch)
+	if err != nil {
+		return fmt.Errorf("failed to read root filesystem: %w", err)
+	}
+	defer a.Close()
+
+	return createImage(ctx, imagePath, format, a, opts)
+}
+
+func createImage(ctx context.Context, imagePath string, format Format, a *archive, opts Options) error {
+	if format == FormatCpio {
+		return createCpio(imagePath, a, opts)
+	}
+
+	tempDir, err := os.MkdirTemp("", "immutos-fsimage-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	normalizedPath := filepath.Join(tempDir, "rootfs.tar")
+	if err := writeFile(normalizedPath, a.writeTar); err != nil {
+		return fmt.Errorf("failed to write normalized root filesystem: %w", err)
+	}
+
+	if opts.UUID == "" {
+		opts.UUID, err = deriveUUID(normalizedPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Any existing image would otherwise be appended to.
+	if err := os.Remove(imagePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	epoch := strconv.FormatInt(opts.SourceDateEpoch.Unix(), 10)
+
+	var cmd *exec.Cmd
+	switch format {
+	case FormatSquashfs:
+		cmd = exec.CommandContext(ctx, "sqfstar", "-quiet", "-no-progress", "-comp", opts.Compression,
+			"-mkfs-time", epoch, "-root-time", epoch, "-root-mode", "0755", "-root-uid", "0", "-root-gid", "0",
+			imagePath)
+
+		f, err := os.Open(normalizedPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		cmd.Stdin = f
+	case FormatErofs:
+		// The modification times in the tarball have already been clamped to the
+		// source date epoch, so -T only needs to fix the build time (by default it
+		// would also overwrite every modification time).
+		args := []string{"--quiet", "--tar=f", "-T", epoch, "--mkfs-time", "-U", opts.UUID}
+		if opts.Label != "" {
+			args = append(args, "-L", opts.Label)
+		}
+
+		if opts.Compression != "none" {
+			args = append(args, "-z"+opts.Compression)
+		}
+
+		cmd = exec.CommandContext(ctx, "mkfs.erofs", append(args, imagePath, normalizedPath)...)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create %s image: %w: %s", format, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// ValidateCompression checks that a compression algorithm is supported by the
+// format. An empty compression algorithm selects the default.
+func ValidateCompression(format Format, compression string) error {
+	compressions, ok := Compressions[format]
+	if !ok {
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+
+	if compression != "" && !slices.Contains(compressions, compression) {
+		return fmt.Errorf("unsupported %s compression: %s (supported: %s)",
+			format, compression, strings.Join(compressions, ", "))
+	}
+
+	return nil
+}
+
+func createCpio(imagePath string, a *archive, opts Options) error {
+	return writeFile(imagePath, func(w io.Writer) error {
+		cw, err := cpioCompressors[opts.Compression](w)
+		if err != nil {
+			return fmt.Errorf("failed to create compressor: %w", err)
+		}
+
+		if err := writeCpio(cw, a); err != nil {
+			_ = cw.Close()
+			return err
+		}
+
+		return cw.Close()
+	})
+}
+
+// deriveUUID returns a (version 4) UUID derived from the contents of a file.
+func deriveUUID(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+
+	sum := h.Sum(nil)[:16]
+	sum[6] = (sum[6] & 0x0f) | 0x40
+	sum[8] = (sum[8] & 0x3f) | 0x80
+
+	s := hex.EncodeToString(sum)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:], nil
+}
+
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	if err := write(bw); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,331 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fsimage_test
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/uncompr"
+	"github.com/immutos/immutos/internal/fsimage"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreate(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	sourceDateEpoch, err := time.Parse(time.RFC3339, "2024-01-01T00:00:00Z")
+	require.NoError(t, err)
+
+	rootFSArchivePath := filepath.Join(t.TempDir(), "rootfs.tar")
+	writeRootFS(t, rootFSArchivePath, sourceDateEpoch, nil)
+
+	expectedNames := []string{
+		"bin",
+		"dev",
+		"dev/null",
+		"etc",
+		"etc/passwd",
+		"etc/passwd-",
+		"home",
+		"home/nonroot",
+		"usr",
+		"usr/bin",
+		"usr/bin/sudo",
+		"usr/lib",
+		"usr/lib/os-release",
+	}
+
+	create := func(t *testing.T, format fsimage.Format, compression string) string {
+		imagePath := filepath.Join(t.TempDir(), "rootfs.img")
+
+		err := fsimage.Create(ctx, imagePath, format, rootFSArchivePath, fsimage.Options{
+			Compression:     compression,
+			SourceDateEpoch: sourceDateEpoch,
+		})
+		require.NoError(t, err)
+
+		return imagePath
+	}
+
+	t.Run("Cpio", func(t *testing.T) {
+		for _, compression := range fsimage.Compressions[fsimage.FormatCpio] {
+			t.Run(compression, func(t *testing.T) {
+				imagePath := create(t, fsimage.FormatCpio, compression)
+
+				image, err := os.ReadFile(imagePath)
+				require.NoError(t, err)
+
+				rebuiltImage, err := os.ReadFile(create(t, fsimage.FormatCpio, compression))
+				require.NoError(t, err)
+				require.Equal(t, image, rebuiltImage, "not reproducible")
+
+				entries := readCpio(t, image)
+
+				var names []string
+				for _, entry := range entries {
+					names = append(names, entry.name)
+				}
+				require.Equal(t, expectedNames, names)
+
+				byName := map[string]cpioEntry{}
+				for _, entry := range entries {
+					require.LessOrEqual(t, entry.mtime, sourceDateEpoch.Unix(), "modification time of %s", entry.name)
+					byName[entry.name] = entry
+				}
+
+				// The first name of a hard linked file holds its contents.
+				require.Equal(t, "root:x:0:0:root:/root:/bin/sh\n", string(byName["etc/passwd"].data))
+				require.Equal(t, 2, byName["etc/passwd"].nlink)
+				require.Equal(t, byName["etc/passwd"].ino, byName["etc/passwd-"].ino)
+				require.Empty(t, byName["etc/passwd-"].data)
+
+				require.Equal(t, 0o104755, byName["usr/bin/sudo"].mode)
+				require.Equal(t, 42, byName["usr/bin/sudo"].gid)
+				require.Equal(t, 65532, byName["home/nonroot"].uid)
+				require.Equal(t, 0o120777, byName["bin"].mode)
+				require.Equal(t, "usr/bin", string(byName["bin"].data))
+				require.Equal(t, 0o020666, byName["dev/null"].mode)
+				require.Equal(t, 1, byName["dev/null"].rdevMajor)
+				require.Equal(t, 3, byName["dev/null"].rdevMinor)
+			})
+		}
+	})
+
+	t.Run("Squashfs", func(t *testing.T) {
+		testutil.RequireTools(t, "sqfstar", "unsquashfs")
+
+		imagePath := create(t, fsimage.FormatSquashfs, "zstd")
+		require.Equal(t, readFile(t, imagePath), readFile(t, create(t, fsimage.FormatSquashfs, "zstd")), "not reproducible")
+
+		out, err := exec.Command("unsquashfs", "-d", "", "-lln", imagePath).Output()
+		require.NoError(t, err)
+
+		listing := string(out)
+		for _, name := range expectedNames {
+			require.Contains(t, listing, " /"+name)
+		}
+		require.Contains(t, listing, "-rwsr-xr-x 0/42")
+		require.Contains(t, listing, "drwxr-xr-x 65532/65532")
+		require.Contains(t, listing, "2024-01-01 00:00 /etc/passwd\n")
+	})
+
+	t.Run("Erofs", func(t *testing.T) {
+		testutil.RequireTools(t, "mkfs.erofs", "dump.erofs")
+
+		imagePath := create(t, fsimage.FormatErofs, "")
+		require.Equal(t, readFile(t, imagePath), readFile(t, create(t, fsimage.FormatErofs, "")), "not reproducible")
+
+		out, err := exec.Command("dump.erofs", "--ls", "--path=/etc", imagePath).Output()
+		require.NoError(t, err)
+		require.Contains(t, string(out), "passwd-")
+
+		out, err = exec.Command("dump.erofs", "--path=/usr/bin/sudo", imagePath).Output()
+		require.NoError(t, err)
+		require.Contains(t, string(out), "Uid: 0   Gid: 42")
+	})
+
+	t.Run("Sysext", func(t *testing.T) {
+		testutil.RequireTools(t, "mkfs.erofs", "dump.erofs")
+
+		extRootFSArchivePath := filepath.Join(t.TempDir(), "rootfs.tar")
+		writeRootFS(t, extRootFSArchivePath, sourceDateEpoch, map[string]string{
+			"usr/bin/tool":  "fake tool",
+			"usr/bin/sudo":  "patched sudo",
+			"etc/tool.conf": "ignored",
+		})
+
+		imagePath := filepath.Join(t.TempDir(), "tools.raw")
+		err := fsimage.CreateExtension(ctx, imagePath, fsimage.FormatErofs, extRootFSArchivePath, fsimage.ExtensionOptions{
+			Options:               fsimage.Options{SourceDateEpoch: sourceDateEpoch},
+			Type:                  fsimage.ExtensionSysext,
+			BaseRootFSArchivePath: rootFSArchivePath,
+			Architecture:          "amd64",
+		})
+		require.NoError(t, err)
+
+		out, err := exec.Command("dump.erofs", "--ls", "--path=/usr/bin", imagePath).Output()
+		require.NoError(t, err)
+		require.Contains(t, string(out), "tool")
+		require.Contains(t, string(out), "sudo")
+
+		out, err = exec.Command("dump.erofs", "--ls", "--path=/", imagePath).Output()
+		require.NoError(t, err)
+		require.NotContains(t, string(out), "etc")
+
+		out, err = exec.Command("dump.erofs", "--ls", "--path=/usr/lib/extension-release.d", imagePath).Output()
+		require.NoError(t, err)
+		require.Contains(t, string(out), "extension-release.tools")
+	})
+
+	t.Run("Sysext Without Base", func(t *testing.T) {
+		err := fsimage.CreateExtension(ctx, filepath.Join(t.TempDir(), "tools.raw"), fsimage.FormatErofs, rootFSArchivePath, fsimage.ExtensionOptions{
+			Options: fsimage.Options{SourceDateEpoch: sourceDateEpoch},
+			Type:    fsimage.ExtensionSysext,
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("Unsupported Compression", func(t *testing.T) {
+		err := fsimage.Create(ctx, filepath.Join(t.TempDir(), "rootfs.img"), fsimage.FormatCpio, rootFSArchivePath, fsimage.Options{
+			Compression:     "lzo",
+			SourceDateEpoch: sourceDateEpoch,
+		})
+		require.Error(t, err)
+	})
+}
+
+type cpioEntry struct {
+	name      string
+	ino       int
+	mode      int
+	uid       int
+	gid       int
+	nlink     int
+	mtime     int64
+	rdevMajor int
+	rdevMinor int
+	data      []byte
+}
+
+// readCpio lists the contents of a (possibly compressed) newc cpio archive.
+func readCpio(t *testing.T, image []byte) []cpioEntry {
+	dr, err := uncompr.NewReader(bytes.NewReader(image))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(dr)
+	var offset int
+
+	read := func(n int) []byte {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(br, buf)
+		require.NoError(t, err)
+		offset += n
+		return buf
+	}
+
+	pad := func() {
+		read((4 - offset%4) % 4)
+	}
+
+	var entries []cpioEntry
+	for {
+		hdr := read(110)
+		require.Equal(t, "070701", string(hdr[:6]))
+
+		field := func(i int) int {
+			v, err := strconv.ParseUint(string(hdr[6+i*8:14+i*8]), 16, 32)
+			require.NoError(t, err)
+			return int(v)
+		}
+
+		name := strings.TrimSuffix(string(read(field(11))), "\x00")
+		pad()
+
+		if name == "TRAILER!!!" {
+			return entries
+		}
+
+		data := read(field(6))
+		pad()
+
+		entries = append(entries, cpioEntry{
+			name:      name,
+			ino:       field(0),
+			mode:      field(1),
+			uid:       field(2),
+			gid:       field(3),
+			nlink:     field(4),
+			mtime:     int64(field(5)),
+			rdevMajor: field(9),
+			rdevMinor: field(10),
+			data:      data,
+		})
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	return string(data)
+}
+
+// writeRootFS writes an (unsorted) root filesystem tarball, with any extra
+// files (which replace existing files).
+func writeRootFS(t *testing.T, rootFSArchivePath string, sourceDateEpoch time.Time, extraFiles map[string]string) {
+	f, err := os.Create(rootFSArchivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	// Some timestamps are after the source date epoch.
+	modTime := sourceDateEpoch.Add(time.Hour)
+
+	tw := tar.NewWriter(f)
+
+	dir := func(name string, uid int) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0o755, Uid: uid, Gid: uid, ModTime: modTime}))
+	}
+
+	file := func(hdr *tar.Header, data string) {
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(len(data))
+		hdr.ModTime = modTime
+		hdr.Format = tar.FormatPAX
+		require.NoError(t, tw.WriteHeader(hdr))
+
+		_, err := tw.Write([]byte(data))
+		require.NoError(t, err)
+	}
+
+	dir("./", 0)
+	dir("usr/", 0)
+	dir("usr/bin/", 0)
+	file(&tar.Header{Name: "usr/bin/sudo", Mode: 0o4755, Gid: 42}, "fake sudo")
+	dir("etc/", 0)
+	// The link sorts before its target.
+	file(&tar.Header{Name: "etc/passwd-", Mode: 0o644, PAXRecords: map[string]string{"SCHILY.xattr.user.test": "hello"}}, "root:x:0:0:root:/root:/bin/sh\n")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: "etc/passwd", Linkname: "etc/passwd-", ModTime: modTime}))
+	dir("home/", 0)
+	dir("home/nonroot/", 65532)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin", Mode: 0o777, ModTime: sourceDateEpoch.Add(-time.Hour)}))
+	dir("dev/", 0)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3, ModTime: modTime}))
+	dir("usr/lib/", 0)
+	file(&tar.Header{Name: "usr/lib/os-release", Mode: 0o644}, "PRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\nID=debian\nVERSION_ID=\"12\"\n")
+
+	for name, data := range extraFiles {
+		file(&tar.Header{Name: name, Mode: 0o755}, data)
+	}
+
+	require.NoError(t, tw.Close())
+}
@@ -29,6 +29,8 @@ import (
 	"strings"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 )
 
 // Load reads an OpenPGP keyring from a file or URL.
@@ -85,3 +87,84 @@ func Load(ctx context.Context, key string) (openpgp.EntityList, error) {
 		return openpgp.ReadArmoredKeyRing(f)
 	}
 }
+
+// LoadOrGenerateSigningKey reads an armored OpenPGP private key from a file.
+// If the file does not exist, a new signing key will be generated and saved.
+func LoadOrGenerateSigningKey(path, name string) (*openpgp.Entity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		slog.Info("Generating signing key", slog.String("path", path))
+
+		return generateSigningKey(path, name)
+	}
+	defer f.Close()
+
+	keyring, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	for _, entity := range keyring {
+		if entity.PrivateKey != nil {
+			if entity.PrivateKey.Encrypted {
+				return nil, errors.New("encrypted signing keys are not supported")
+			}
+
+			return entity, nil
+		}
+	}
+
+	return nil, errors.New("no private key found")
+}
+
+// WritePublicKey writes the armored public key of the entity to the writer.
+func WritePublicKey(w io.Writer, entity *openpgp.Entity) error {
+	aw, err := armor.Encode(w, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create armor encoder: %w", err)
+	}
+
+	if err := entity.Serialize(aw); err != nil {
+		return fmt.Errorf("failed to serialize public key: %w", err)
+	}
+
+	return aw.Close()
+}
+
+func generateSigningKey(path, name string) (*openpgp.Entity, error) {
+	entity, err := openpgp.NewEntity(name, "", "", &packet.Config{
+		Algorithm: packet.PubKeyAlgoEdDSA,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signing key file: %w", err)
+	}
+	defer f.Close()
+
+	aw, err := armor.Encode(f, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create armor encoder: %w", err)
+	}
+
+	if err := entity.SerializePrivate(aw, nil); err != nil {
+		return nil, fmt.Errorf("failed to serialize signing key: %w", err)
+	}
+
+	if err := aw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close armor encoder: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close signing key file: %w", err)
+	}
+
+	return entity, nil
+}
@@ -17,7 +17,9 @@
 package keyring_test
 
 import (
+	"bytes"
 	"context"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -45,3 +47,28 @@ func TestKeyringRead(t *testing.T) {
 		require.NotEmpty(t, keyring)
 	})
 }
+
+func TestLoadOrGenerateSigningKey(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	path := filepath.Join(t.TempDir(), "signing-key.asc")
+
+	generated, err := keyring.LoadOrGenerateSigningKey(path, "test")
+	require.NoError(t, err)
+	require.NotNil(t, generated.PrivateKey)
+
+	loaded, err := keyring.LoadOrGenerateSigningKey(path, "test")
+	require.NoError(t, err)
+	require.Equal(t, generated.PrimaryKey.Fingerprint, loaded.PrimaryKey.Fingerprint)
+
+	var publicKey bytes.Buffer
+	require.NoError(t, keyring.WritePublicKey(&publicKey, loaded))
+
+	publicKeyPath := filepath.Join(t.TempDir(), "signing-key.pub.asc")
+	require.NoError(t, os.WriteFile(publicKeyPath, publicKey.Bytes(), 0o644))
+
+	keyring, err := keyring.Load(context.Background(), publicKeyPath)
+	require.NoError(t, err)
+	require.Len(t, keyring, 1)
+	require.Nil(t, keyring[0].PrivateKey)
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package layers splits the root filesystem of an image into multiple layers,
+// so that layers containing unchanged packages can be shared between images.
+package layers
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// Strategy is a strategy for splitting an image into layers.
+type Strategy string
+
+const (
+	// StrategySingle squashes the root filesystem into a single layer.
+	StrategySingle Strategy = "single"
+	// StrategyPackages puts the files of each package into its own layer. If
+	// there are more packages than layers, the highest ranked packages (see
+	// Ranking) get their own layers and the remaining packages share a layer.
+	StrategyPackages Strategy = "packages"
+	// StrategySplit puts the files of the application packages and the files
+	// of all other (base) packages into separate layers.
+	StrategySplit Strategy = "split"
+)
+
+// Ranking is how the packages strategy chooses which packages get their own
+// layers.
+type Ranking string
+
+const (
+	// RankingSize ranks packages by their installed size, largest first.
+	RankingSize Ranking = "size"
+	// RankingPopularity ranks packages by the number of installed packages that
+	// depend on them, as widely depended upon packages (eg. libc6) are the most
+	// likely to be shared with other images.
+	RankingPopularity Ranking = "popularity"
+)
+
+// DefaultMaxLayers is the default maximum number of layers of the packages
+// strategy.
+const DefaultMaxLayers = 16
+
+// Package is a package installed in the image.
+type Package struct {
+	// Name is the name of the package.
+	Name string
+	// InstalledSize is the (estimated) installed size of the package.
+	InstalledSize int64
+	// Dependents is the number of installed packages that depend on the package.
+	Dependents int
+}
+
+// Plan returns the names of the packages whose files make up each layer of
+// the image. The files that are not owned by any package (eg. the dpkg
+// database and generated configuration files) make up an additional final
+// layer. A nil plan means the image has a single layer.
+func Plan(strategy Strategy, maxLayers int, ranking Ranking, applicationPackages []string, packages []Package) ([][]string, error) {
+	switch strategy {
+	case "", StrategySingle:
+		return nil, nil
+	case StrategyPackages:
+		if maxLayers == 0 {
+			maxLayers = DefaultMaxLayers
+		}
+
+		if maxLayers < 2 {
+			return nil, fmt.Errorf("the packages layer strategy requires at least 2 layers")
+		}
+
+		if ranking != "" && ranking != RankingSize && ranking != RankingPopularity {
+			return nil, fmt.Errorf("unsupported layer ranking: %s", ranking)
+		}
+
+		sorted := make([]Package, len(packages))
+		copy(sorted, packages)
+
+		// The highest ranked packages get their own layers (ties are broken by
+		// size and then by name).
+		sort.Slice(sorted, func(i, j int) bool {
+			if ranking == RankingPopularity && sorted[i].Dependents != sorted[j].Dependents {
+				return sorted[i].Dependents > sorted[j].Dependents
+			}
+
+			if sorted[i].InstalledSize != sorted[j].InstalledSize {
+				return sorted[i].InstalledSize > sorted[j].InstalledSize
+			}
+
+			return sorted[i].Name < sorted[j].Name
+		})
+
+		var plan [][]string
+		for i, pkg := range sorted {
+			// The last package layer holds all of the remaining packages.
+			if i == maxLayers-2 && len(sorted) > maxLayers-1 {
+				var rest []string
+				for _, pkg := range sorted[i:] {
+					rest = append(rest, pkg.Name)
+				}
+				sort.Strings(rest)
+
+				plan = append(plan, rest)
+				break
+			}
+
+			plan = append(plan, []string{pkg.Name})
+		}
+
+		return plan, nil
+	case StrategySplit:
+		var base, app []string
+		for _, pkg := range packages {
+			isApp, err := matchesAny(applicationPackages, pkg.Name)
+			if err != nil {
+				return nil, err
+			}
+
+			if isApp {
+				app = append(app, pkg.Name)
+			} else {
+				base = append(base, pkg.Name)
+			}
+		}
+
+		if len(app) == 0 {
+			return nil, fmt.Errorf("no packages match the application packages of the split layer strategy")
+		}
+
+		sort.Strings(base)
+		sort.Strings(app)
+
+		if len(base) == 0 {
+			return [][]string{app}, nil
+		}
+
+		return [][]string{base, app}, nil
+	default:
+		return nil, fmt.Errorf("unsupported layer strategy: %s", strategy)
+	}
+}
+
+// Assign returns a function that returns the index of the layer that a file
+// (by its path relative to the root) belongs to.
+func Assign(plan [][]string, owners Owners) func(name string) int {
+	layerOfPackage := map[string]int{}
+	for i, names := range plan {
+		for _, name := range names {
+			layerOfPackage[name] = i
+		}
+	}
+
+	return func(name string) int {
+		if pkg, ok := owners.Owner(name); ok {
+			if i, ok := layerOfPackage[pkg]; ok {
+				return i
+			}
+		}
+
+		return len(plan)
+	}
+}
+
+func matchesAny(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return false, fmt.Errorf("invalid package pattern %q: %w", pattern, err)
+		}
+
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
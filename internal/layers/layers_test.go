@@ -0,0 +1,243 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layers_test
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/immutos/immutos/internal/layers"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	packages := []layers.Package{
+		{Name: "libc6", InstalledSize: 12000, Dependents: 2},
+		{Name: "base-files", InstalledSize: 300, Dependents: 3},
+		{Name: "myapp", InstalledSize: 5000},
+		{Name: "myapp-data", InstalledSize: 100, Dependents: 1},
+		{Name: "tzdata", InstalledSize: 2000},
+	}
+
+	t.Run("Single", func(t *testing.T) {
+		plan, err := layers.Plan(layers.StrategySingle, 0, "", nil, packages)
+		require.NoError(t, err)
+		require.Nil(t, plan)
+	})
+
+	t.Run("Packages", func(t *testing.T) {
+		plan, err := layers.Plan(layers.StrategyPackages, 0, "", nil, packages)
+		require.NoError(t, err)
+		require.Equal(t, [][]string{{"libc6"}, {"myapp"}, {"tzdata"}, {"base-files"}, {"myapp-data"}}, plan)
+	})
+
+	t.Run("Packages Grouped", func(t *testing.T) {
+		plan, err := layers.Plan(layers.StrategyPackages, 4, "", nil, packages)
+		require.NoError(t, err)
+		require.Equal(t, [][]string{{"libc6"}, {"myapp"}, {"base-files", "myapp-data", "tzdata"}}, plan)
+
+		_, err = layers.Plan(layers.StrategyPackages, 1, "", nil, packages)
+		require.Error(t, err)
+	})
+
+	t.Run("Packages By Popularity", func(t *testing.T) {
+		plan, err := layers.Plan(layers.StrategyPackages, 4, layers.RankingPopularity, nil, packages)
+		require.NoError(t, err)
+		require.Equal(t, [][]string{{"base-files"}, {"libc6"}, {"myapp", "myapp-data", "tzdata"}}, plan)
+
+		_, err = layers.Plan(layers.StrategyPackages, 4, "downloads", nil, packages)
+		require.Error(t, err)
+	})
+
+	t.Run("Split", func(t *testing.T) {
+		plan, err := layers.Plan(layers.StrategySplit, 0, "", []string{"myapp*"}, packages)
+		require.NoError(t, err)
+		require.Equal(t, [][]string{{"base-files", "libc6", "tzdata"}, {"myapp", "myapp-data"}}, plan)
+
+		_, err = layers.Plan(layers.StrategySplit, 0, "", []string{"nginx"}, packages)
+		require.Error(t, err)
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		_, err := layers.Plan("popularity", 0, "", nil, packages)
+		require.Error(t, err)
+	})
+}
+
+func TestReadOwners(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	rootFS := fstest.MapFS{
+		"var/lib/dpkg/info/coreutils.list":         {Data: []byte("/.\n/bin\n/bin/ls\n/usr/share/doc/coreutils\n")},
+		"var/lib/dpkg/info/libc6:amd64.list":       {Data: []byte("/.\n/lib/x86_64-linux-gnu/libc.so.6\n")},
+		"var/lib/dpkg/info/coreutils.md5sums":      {Data: []byte("ignored")},
+		"var/lib/dpkg/info/libc6:amd64.conffiles":  {Data: []byte("/etc/ld.so.conf.d/x86_64-linux-gnu.conf\n")},
+		"usr/lib/x86_64-linux-gnu/libc.so.6":       {},
+		"usr/share/doc/coreutils/copyright":        {},
+		"var/lib/dpkg/info/base-files.postinst.sh": {},
+	}
+
+	owners, err := layers.ReadOwners(rootFS)
+	require.NoError(t, err)
+
+	for name, expected := range map[string]string{
+		"bin/ls":                             "coreutils",
+		"usr/bin/ls":                         "coreutils",
+		"usr/lib/x86_64-linux-gnu/libc.so.6": "libc6",
+		"usr/share/doc/coreutils":            "coreutils",
+	} {
+		pkg, ok := owners.Owner(name)
+		require.True(t, ok, name)
+		require.Equal(t, expected, pkg, name)
+	}
+
+	_, ok := owners.Owner("usr/share/doc/coreutils/copyright")
+	require.False(t, ok)
+
+	_, ok = owners.Owner("var/lib/dpkg/status")
+	require.False(t, ok)
+}
+
+func TestWrite(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	if runtime.GOOS != "linux" {
+		t.Skip("Writing layers requires Linux")
+	}
+
+	sourceDateEpoch, err := time.Parse(time.RFC3339, "2024-01-01T00:00:00Z")
+	require.NoError(t, err)
+
+	root := t.TempDir()
+
+	writeFile := func(name, data string) {
+		hostPath := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(hostPath), 0o755))
+		require.NoError(t, os.WriteFile(hostPath, []byte(data), 0o644))
+	}
+
+	writeFile("var/lib/dpkg/info/base-files.list", "/.\n/etc\n/etc/debian_version\n/usr/share/doc/base-files/copyright\n")
+	writeFile("var/lib/dpkg/info/myapp.list", "/.\n/usr\n/usr/bin\n/usr/bin/myapp\n/usr/share/doc/myapp/copyright\n")
+	writeFile("var/lib/dpkg/info/empty.list", "/.\n")
+	writeFile("var/lib/dpkg/status", "")
+	writeFile("etc/debian_version", "12.5\n")
+	writeFile("etc/passwd", "root:x:0:0:root:/root:/bin/sh\n")
+	writeFile("usr/bin/myapp", "fake myapp")
+	writeFile("usr/share/doc/base-files/copyright", "copyright")
+	writeFile("usr/share/doc/myapp/copyright", "copyright")
+	require.NoError(t, os.Link(filepath.Join(root, "usr/bin/myapp"), filepath.Join(root, "usr/bin/myapp-link")))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "tmp"), 0o1777))
+
+	plan := [][]string{{"base-files"}, {"myapp"}, {"empty"}}
+
+	owners, err := layers.ReadOwners(os.DirFS(root))
+	require.NoError(t, err)
+
+	outputDir := t.TempDir()
+	layerPaths := []string{
+		filepath.Join(outputDir, "layer-0.tar"),
+		filepath.Join(outputDir, "layer-1.tar"),
+		filepath.Join(outputDir, "layer-2.tar"),
+		filepath.Join(outputDir, "layer-3.tar"),
+	}
+
+	require.NoError(t, layers.Write(root, layerPaths, layers.Assign(plan, owners), sourceDateEpoch))
+
+	require.Equal(t, []string{
+		"etc/",
+		"etc/debian_version",
+		"usr/",
+		"usr/share/",
+		"usr/share/doc/",
+		"usr/share/doc/base-files/",
+		"usr/share/doc/base-files/copyright",
+	}, readNames(t, layerPaths[0]))
+
+	require.Equal(t, []string{
+		"usr/",
+		"usr/bin/",
+		"usr/bin/myapp",
+		"usr/bin/myapp-link",
+		"usr/share/",
+		"usr/share/doc/",
+		"usr/share/doc/myapp/",
+		"usr/share/doc/myapp/copyright",
+	}, readNames(t, layerPaths[1]))
+
+	// Layers are never empty.
+	require.Equal(t, []string{"./"}, readNames(t, layerPaths[2]))
+
+	require.Equal(t, []string{
+		"etc/",
+		"etc/passwd",
+		"tmp/",
+		"var/",
+		"var/lib/",
+		"var/lib/dpkg/",
+		"var/lib/dpkg/info/",
+		"var/lib/dpkg/info/base-files.list",
+		"var/lib/dpkg/info/empty.list",
+		"var/lib/dpkg/info/myapp.list",
+		"var/lib/dpkg/status",
+	}, readNames(t, layerPaths[3]))
+
+	t.Run("Reproducible", func(t *testing.T) {
+		rebuiltLayerPath := filepath.Join(t.TempDir(), "layer.tar")
+		require.NoError(t, layers.Write(root, []string{rebuiltLayerPath}, nil, sourceDateEpoch))
+
+		otherLayerPath := filepath.Join(t.TempDir(), "layer.tar")
+		require.NoError(t, layers.Write(root, []string{otherLayerPath}, nil, sourceDateEpoch))
+
+		expected, err := os.ReadFile(rebuiltLayerPath)
+		require.NoError(t, err)
+
+		actual, err := os.ReadFile(otherLayerPath)
+		require.NoError(t, err)
+
+		require.Equal(t, expected, actual)
+	})
+}
+
+func readNames(t *testing.T, layerPath string) []string {
+	f, err := os.Open(layerPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return names
+		}
+		require.NoError(t, err)
+
+		names = append(names, hdr.Name)
+	}
+}
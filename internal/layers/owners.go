@@ -0,0 +1,108 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+const dpkgInfoDir = "var/lib/dpkg/info"
+
+// usrMergedDirs are the directories that are merged into /usr (the file lists
+// of the dpkg database still refer to the unmerged paths).
+var usrMergedDirs = []string{"bin", "lib", "lib32", "lib64", "libo32", "libx32", "sbin"}
+
+// Owners maps the files of a root filesystem to the packages that own them.
+type Owners map[string]string
+
+// ReadOwners reads the file lists of the dpkg database of a root filesystem.
+func ReadOwners(rootFS fs.FS) (Owners, error) {
+	entries, err := fs.ReadDir(rootFS, dpkgInfoDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Owners{}, nil
+		}
+
+		return nil, fmt.Errorf("failed to read dpkg database: %w", err)
+	}
+
+	owners := Owners{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".list")
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		// Multi-Arch: same packages are qualified by their architecture.
+		pkg, _, _ := strings.Cut(name, ":")
+
+		if err := readFileList(rootFS, path.Join(dpkgInfoDir, entry.Name()), pkg, owners); err != nil {
+			return nil, err
+		}
+	}
+
+	return owners, nil
+}
+
+// Owner returns the package that owns a file (by its path relative to the
+// root).
+func (o Owners) Owner(name string) (string, bool) {
+	if pkg, ok := o[name]; ok {
+		return pkg, true
+	}
+
+	// The file was moved by the usr merge.
+	if unmerged, ok := strings.CutPrefix(name, "usr/"); ok {
+		top, _, _ := strings.Cut(unmerged, "/")
+		for _, dir := range usrMergedDirs {
+			if top == dir {
+				pkg, ok := o[unmerged]
+				return pkg, ok
+			}
+		}
+	}
+
+	return "", false
+}
+
+func readFileList(rootFS fs.FS, listPath, pkg string, owners Owners) error {
+	f, err := rootFS.Open(listPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file list: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name := strings.TrimPrefix(path.Clean(scanner.Text()), "/")
+		if name == "" || name == "." {
+			continue
+		}
+
+		owners[name] = pkg
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read file list %s: %w", listPath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,356 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layers
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+// Write writes the root filesystem out as reproducible, uncompressed layer
+// tarballs. Entries are sorted and timestamps are clamped to the source date
+// epoch (if specified). The layerOf function returns the index of the layer
+// that a file belongs to (hard links always belong to the layer of the first
+// name of the file). Each layer contains the parent directories of its files,
+// and empty directories belong to the final layer unless owned by a package.
+// Layers that would otherwise be empty contain the root directory.
+func Write(root string, layerPaths []string, layerOf func(name string) int, sourceDateEpoch time.Time) error {
+	type layerWriter struct {
+		f       *os.File
+		tw      *tar.Writer
+		dirs    map[string]bool
+		entries int
+	}
+
+	writers := make([]*layerWriter, len(layerPaths))
+	for i, layerPath := range layerPaths {
+		f, err := os.Create(layerPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		writers[i] = &layerWriter{f: f, tw: tar.NewWriter(f), dirs: map[string]bool{}}
+	}
+
+	layerWriterOf := func(name string) (*layerWriter, error) {
+		i := len(writers) - 1
+		if layerOf != nil {
+			i = layerOf(name)
+		}
+
+		if i < 0 || i >= len(writers) {
+			return nil, fmt.Errorf("invalid layer %d for %s", i, name)
+		}
+
+		return writers[i], nil
+	}
+
+	// Directories are written to each layer that contains a file beneath
+	// them, before the first such file.
+	dirHeaders := map[string]*tar.Header{}
+	writeDir := func(lw *layerWriter, name string) error {
+		var dirs []string
+		for dir := name; dir != "." && !lw.dirs[dir]; dir = path.Dir(dir) {
+			dirs = append(dirs, dir)
+		}
+
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err := lw.tw.WriteHeader(dirHeaders[dirs[i]]); err != nil {
+				return err
+			}
+
+			lw.dirs[dirs[i]] = true
+			lw.entries++
+		}
+
+		return nil
+	}
+
+	type inode struct {
+		dev, ino uint64
+	}
+	type hardlink struct {
+		name string
+		lw   *layerWriter
+	}
+	hardlinks := map[inode]hardlink{}
+
+	var rootHdr *tar.Header
+
+	err := filepath.WalkDir(root, func(hostPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if hostPath == root {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			rootHdr, err = tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			}
+
+			rootHdr.Name = "./"
+			normalizeHeader(rootHdr, sourceDateEpoch)
+
+			return nil
+		}
+
+		name, err := filepath.Rel(root, hostPath)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		// Sockets can't be represented in a tarball.
+		if fi.Mode()&fs.ModeSocket != 0 {
+			return nil
+		}
+
+		var linkTarget string
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			linkTarget, err = os.Readlink(hostPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, linkTarget)
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		normalizeHeader(hdr, sourceDateEpoch)
+
+		xattrs, err := readXattrs(hostPath)
+		if err != nil {
+			return fmt.Errorf("failed to read extended attributes of %s: %w", name, err)
+		}
+
+		if len(xattrs) > 0 {
+			hdr.PAXRecords = map[string]string{}
+			for attr, value := range xattrs {
+				hdr.PAXRecords[paxXattrPrefix+attr] = value
+			}
+		}
+
+		if fi.IsDir() {
+			dirHeaders[name] = hdr
+
+			empty, err := isEmptyDir(hostPath)
+			if err != nil {
+				return err
+			}
+
+			if !empty {
+				return nil
+			}
+
+			lw, err := layerWriterOf(name)
+			if err != nil {
+				return err
+			}
+
+			return writeDir(lw, name)
+		}
+
+		lw, err := layerWriterOf(name)
+		if err != nil {
+			return err
+		}
+
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if first, ok := hardlinks[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first.name
+				hdr.Size = 0
+				lw = first.lw
+			} else {
+				hardlinks[key] = hardlink{name: name, lw: lw}
+			}
+		}
+
+		if err := writeDir(lw, path.Dir(name)); err != nil {
+			return err
+		}
+
+		if err := lw.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		lw.entries++
+
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			f, err := os.Open(hostPath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if _, err := io.CopyN(lw.tw, f, hdr.Size); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Directories containing nothing but sockets.
+	var remainingDirs []string
+	for name := range dirHeaders {
+		if !slices.ContainsFunc(writers, func(lw *layerWriter) bool { return lw.dirs[name] }) {
+			remainingDirs = append(remainingDirs, name)
+		}
+	}
+	sort.Strings(remainingDirs)
+
+	for _, name := range remainingDirs {
+		if err := writeDir(writers[len(writers)-1], name); err != nil {
+			return err
+		}
+	}
+
+	for _, lw := range writers {
+		if lw.entries == 0 && rootHdr != nil {
+			if err := lw.tw.WriteHeader(rootHdr); err != nil {
+				return err
+			}
+		}
+
+		if err := lw.tw.Close(); err != nil {
+			return err
+		}
+
+		if err := lw.f.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// normalizeHeader removes the host specific (and irreproducible) fields of a
+// tar header.
+func normalizeHeader(hdr *tar.Header, sourceDateEpoch time.Time) {
+	hdr.Format = tar.FormatPAX
+	hdr.Uname = ""
+	hdr.Gname = ""
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+	if !sourceDateEpoch.IsZero() && hdr.ModTime.After(sourceDateEpoch) {
+		hdr.ModTime = sourceDateEpoch
+	}
+}
+
+func isEmptyDir(hostPath string) (bool, error) {
+	f, err := os.Open(hostPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := f.Readdirnames(1); err != nil {
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	return false, nil
+}
+
+// readXattrs reads the extended attributes of a file (without following
+// symbolic links). SELinux labels are specific to the build host and are
+// excluded.
+func readXattrs(hostPath string) (map[string]string, error) {
+	size, err := unix.Llistxattr(hostPath, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(hostPath, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00")
+	slices.Sort(attrs)
+
+	xattrs := map[string]string{}
+	for _, attr := range attrs {
+		if attr == "" || attr == "security.selinux" {
+			continue
+		}
+
+		size, err := unix.Lgetxattr(hostPath, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(hostPath, attr, value)
+		if err != nil {
+			return nil, err
+		}
+
+		xattrs[attr] = string(value[:size])
+	}
+
+	return xattrs, nil
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Path is the location of the build manifest inside the image.
+const Path = "/var/lib/immutos/manifest.json"
+
+// Manifest records metadata about how an image was built.
+type Manifest struct {
+	// Platform is the platform the image was built for (eg. linux/amd64).
+	Platform string `json:"platform"`
+	// Packages is the list of packages installed in the image.
+	Packages []Package `json:"packages"`
+}
+
+// Package is the metadata recorded for an installed package.
+type Package struct {
+	// Name is the name of the package.
+	Name string `json:"name"`
+	// Version is the version of the package.
+	Version string `json:"version"`
+	// Architecture is the architecture of the package.
+	Architecture string `json:"architecture"`
+	// SHA256 is the SHA256 checksum of the package file.
+	SHA256 string `json:"sha256"`
+	// Origin describes where the package was downloaded from (if known).
+	Origin *Origin `json:"origin,omitempty"`
+	// PackageSigner is the fingerprint of the key that made the embedded
+	// (debsig) signature of the package, if it was verified.
+	PackageSigner string `json:"packageSigner,omitempty"`
+}
+
+// Origin describes the repository that supplied a package.
+type Origin struct {
+	// URL is the URL of the package file.
+	URL string `json:"url"`
+	// Suite is the suite (eg. stable) of the repository.
+	Suite string `json:"suite,omitempty"`
+	// Date is when the Release file of the repository was published.
+	Date *time.Time `json:"date,omitempty"`
+	// SignedBy is the fingerprint of the key that signed the Release file.
+	SignedBy string `json:"signedBy,omitempty"`
+}
+
+// WriteFile writes the manifest to the given path as JSON. Packages are
+// sorted so that the output is deterministic.
+func (m *Manifest) WriteFile(path string) error {
+	packages := slices.Clone(m.Packages)
+	slices.SortFunc(packages, func(a, b Package) int {
+		if n := strings.Compare(a.Name, b.Name); n != 0 {
+			return n
+		}
+		if n := strings.Compare(a.Architecture, b.Architecture); n != 0 {
+			return n
+		}
+		return strings.Compare(a.Version, b.Version)
+	})
+
+	data, err := json.MarshalIndent(&Manifest{Platform: m.Platform, Packages: packages}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return nil
+}
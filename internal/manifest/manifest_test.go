@@ -0,0 +1,81 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manifest_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/immutos/immutos/internal/manifest"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	date := time.Date(2024, 6, 29, 9, 47, 0, 0, time.UTC)
+
+	m := manifest.Manifest{
+		Platform: "linux/amd64",
+		Packages: []manifest.Package{
+			{
+				Name:         "libc6",
+				Version:      "2.36-9+deb12u7",
+				Architecture: "amd64",
+				SHA256:       "5f0a8a5c1d8e7c0f2b5e1b0e7f3c3c4d6e0f0a1b2c3d4e5f6a7b8c9d0e1f2a3b",
+				Origin: &manifest.Origin{
+					URL:      "https://deb.debian.org/debian/pool/main/g/glibc/libc6_2.36-9+deb12u7_amd64.deb",
+					Suite:    "stable",
+					Date:     &date,
+					SignedBy: "4CB50190207B4758A3F73A796ED0E7B82643E131",
+				},
+			},
+			{
+				Name:          "base-files",
+				Version:       "12.4+deb12u5",
+				Architecture:  "amd64",
+				SHA256:        "0b6b2b5e3f8c5d1a2e9f7c4b3a2d1e0f9c8b7a6d5e4f3a2b1c0d9e8f7a6b5c4d",
+				Origin:        &manifest.Origin{URL: "file:///debs/base-files_12.4+deb12u5_amd64.deb"},
+				PackageSigner: "0123456789ABCDEF0123456789ABCDEF01234567",
+			},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	require.NoError(t, m.WriteFile(path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var written manifest.Manifest
+	require.NoError(t, json.Unmarshal(data, &written))
+
+	require.Equal(t, "linux/amd64", written.Platform)
+	require.Len(t, written.Packages, 2)
+
+	// Packages are sorted by name.
+	require.Equal(t, m.Packages[1], written.Packages[0])
+	require.Equal(t, m.Packages[0], written.Packages[1])
+
+	// Local packages don't have a suite, date, or release signer.
+	require.NotContains(t, string(data), `"date": null`)
+	require.NotContains(t, string(data), `"suite": ""`)
+}
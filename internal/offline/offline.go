@@ -0,0 +1,110 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package offline
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gregjones/httpcache"
+)
+
+// NotCachedError is returned when artifacts required by an offline build are
+// not available in the local cache.
+type NotCachedError struct {
+	// Artifacts is the list of missing artifacts (eg. URLs or package filenames).
+	Artifacts []string
+}
+
+func (e *NotCachedError) Error() string {
+	if len(e.Artifacts) == 1 {
+		return fmt.Sprintf("%s is not available in the local cache", e.Artifacts[0])
+	}
+
+	return fmt.Sprintf("%d artifacts are not available in the local cache:\n  %s",
+		len(e.Artifacts), strings.Join(e.Artifacts, "\n  "))
+}
+
+// Transport is an http.RoundTripper that serves responses exclusively from
+// the HTTP cache. Cached responses are never revalidated against the origin.
+type Transport struct {
+	Cache httpcache.Cache
+}
+
+// NewTransport creates a new offline transport backed by the given cache.
+func NewTransport(cache httpcache.Cache) *Transport {
+	return &Transport{Cache: cache}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil, fmt.Errorf("unsupported method in offline mode: %s", req.Method)
+	}
+
+	// Local repositories are always available.
+	if req.URL.Scheme == "file" {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	resp, err := httpcache.CachedResponse(t.Cache, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached response: %w", err)
+	}
+
+	if resp == nil {
+		slog.Debug("Not available offline", slog.String("url", req.URL.String()))
+
+		return nil, &NotCachedError{Artifacts: []string{req.URL.String()}}
+	}
+
+	return resp, nil
+}
+
+// Collect merges all the missing artifacts found in the error tree into a
+// single NotCachedError. If there are no missing artifacts the original error
+// is returned.
+func Collect(err error) error {
+	var artifacts []string
+
+	var walk func(err error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case nil:
+		case *NotCachedError:
+			artifacts = append(artifacts, e.Artifacts...)
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				walk(err)
+			}
+		default:
+			walk(errors.Unwrap(err))
+		}
+	}
+	walk(err)
+
+	if len(artifacts) == 0 {
+		return err
+	}
+
+	slices.Sort(artifacts)
+
+	return &NotCachedError{Artifacts: slices.Compact(artifacts)}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package offline_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gregjones/httpcache"
+	"github.com/immutos/immutos/internal/offline"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Force revalidation, so that an online client would always go to the origin.
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write([]byte("cached"))
+	}))
+	t.Cleanup(srv.Close)
+
+	cache := httpcache.NewMemoryCache()
+
+	// Populate the cache.
+	resp, err := httpcache.NewTransport(cache).Client().Get(srv.URL + "/cached")
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	// No more network access.
+	srv.Close()
+
+	client := &http.Client{Transport: offline.NewTransport(cache)}
+
+	t.Run("Cached", func(t *testing.T) {
+		resp, err := client.Get(srv.URL + "/cached")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, resp.Body.Close())
+		})
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "cached", string(body))
+	})
+
+	t.Run("Not Cached", func(t *testing.T) {
+		_, err := client.Get(srv.URL + "/missing")
+		require.Error(t, err)
+
+		var notCachedErr *offline.NotCachedError
+		require.True(t, errors.As(err, &notCachedErr))
+		require.Equal(t, []string{srv.URL + "/missing"}, notCachedErr.Artifacts)
+	})
+}
+
+func TestCollect(t *testing.T) {
+	err := errors.Join(
+		fmt.Errorf("failed to get packages: %w", &offline.NotCachedError{Artifacts: []string{"b"}}),
+		fmt.Errorf("failed to get components: %w", errors.Join(
+			&offline.NotCachedError{Artifacts: []string{"a"}},
+			&offline.NotCachedError{Artifacts: []string{"b"}},
+		)),
+	)
+
+	var notCachedErr *offline.NotCachedError
+	require.True(t, errors.As(offline.Collect(err), &notCachedErr))
+	require.Equal(t, []string{"a", "b"}, notCachedErr.Artifacts)
+
+	otherErr := errors.New("other")
+	require.Equal(t, otherErr, offline.Collect(otherErr))
+}
@@ -0,0 +1,399 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pkgstore
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/immutos/immutos/internal/util/hashreader"
+)
+
+const (
+	tempPrefix    = ".tmp-"
+	partialPrefix = ".partial-"
+	// originSuffix is the suffix of the file recording where a package was
+	// downloaded from.
+	originSuffix = ".origin"
+)
+
+// Store is a content-addressed store of Debian packages, keyed by the SHA256
+// sum of the package file.
+type Store struct {
+	dir string
+}
+
+// Open opens (or creates) a package store in the given directory.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create package store directory: %w", err)
+	}
+
+	return &Store{dir: dir}, nil
+}
+
+// Path returns the path to the package with the given SHA256 sum.
+func (s *Store) Path(sha256 string) string {
+	sha256 = strings.ToLower(sha256)
+	return filepath.Join(s.dir, sha256[:2], sha256)
+}
+
+// Has returns true if the store contains a package with the given SHA256 sum.
+func (s *Store) Has(sha256 string) bool {
+	if !isValidSHA256(sha256) {
+		return false
+	}
+
+	fi, err := os.Stat(s.Path(sha256))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// Put adds a package to the store, verifying that its contents match the
+// expected SHA256 sum.
+func (s *Store) Put(sha256 string, r io.Reader) error {
+	if !isValidSHA256(sha256) {
+		return fmt.Errorf("invalid sha256 sum: %q", sha256)
+	}
+
+	path := s.Path(sha256)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create package store directory: %w", err)
+	}
+
+	// Write to a temporary file first so that partially written packages
+	// are never visible in the store.
+	f, err := os.CreateTemp(filepath.Dir(path), tempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	hr := hashreader.NewReader(r)
+
+	if _, err := io.Copy(f, hr); err != nil {
+		return fmt.Errorf("failed to write package: %w", err)
+	}
+
+	if err := hr.Verify(sha256); err != nil {
+		return fmt.Errorf("failed to verify package: %w", err)
+	}
+
+	if err := f.Chmod(0o444); err != nil {
+		return fmt.Errorf("failed to set package permissions: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close package: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to move package into store: %w", err)
+	}
+
+	return nil
+}
+
+// Partial is a partial download of a package, that may be resumed later on.
+// It holds an exclusive lock on the partial download until it is committed or
+// closed, so that concurrent builds never write to it at the same time.
+type Partial struct {
+	store  *Store
+	sha256 string
+	path   string
+	f      *os.File
+}
+
+// OpenPartial opens (or creates) the partial download of the package with the
+// given SHA256 sum, waiting for any other build that is downloading it. The
+// caller should check whether the package is in the store once it returns.
+func (s *Store) OpenPartial(sha256 string) (*Partial, error) {
+	if !isValidSHA256(sha256) {
+		return nil, fmt.Errorf("invalid sha256 sum: %q", sha256)
+	}
+
+	path := s.Path(sha256)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create package store directory: %w", err)
+	}
+
+	partialPath := filepath.Join(filepath.Dir(path), partialPrefix+filepath.Base(path))
+
+	for {
+		f, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open partial download: %w", err)
+		}
+
+		if err := lockFile(f); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("failed to lock partial download: %w", err)
+		}
+
+		// The partial download might have been committed (or removed) while
+		// waiting for the lock, if so start over with a new one.
+		lockedFi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("failed to stat partial download: %w", err)
+		}
+
+		if fi, err := os.Stat(partialPath); err == nil && os.SameFile(fi, lockedFi) {
+			return &Partial{store: s, sha256: sha256, path: partialPath, f: f}, nil
+		}
+
+		_ = f.Close()
+	}
+}
+
+// Path returns the path of the partial download.
+func (p *Partial) Path() string {
+	return p.path
+}
+
+// Commit verifies the completed partial download and moves it into the store.
+// If verification fails the partial download is discarded. The partial
+// download is closed in either case.
+func (p *Partial) Commit() error {
+	defer p.Close()
+
+	if _, err := p.f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read partial download: %w", err)
+	}
+
+	hr := hashreader.NewReader(p.f)
+	if _, err := io.Copy(io.Discard, hr); err != nil {
+		return fmt.Errorf("failed to read partial download: %w", err)
+	}
+
+	if err := hr.Verify(p.sha256); err != nil {
+		_ = os.Remove(p.path)
+		return fmt.Errorf("failed to verify package: %w", err)
+	}
+
+	if err := p.f.Chmod(0o444); err != nil {
+		return fmt.Errorf("failed to set package permissions: %w", err)
+	}
+
+	// Moved while still holding the lock.
+	if err := os.Rename(p.path, p.store.Path(p.sha256)); err != nil {
+		return fmt.Errorf("failed to move package into store: %w", err)
+	}
+
+	return nil
+}
+
+// Close releases the lock on the partial download (and is safe to call more
+// than once).
+func (p *Partial) Close() error {
+	if p.f == nil {
+		return nil
+	}
+
+	f := p.f
+	p.f = nil
+
+	return f.Close()
+}
+
+// SetOrigin records the URL that the package with the given SHA256 sum was
+// downloaded from.
+func (s *Store) SetOrigin(sha256, url string) error {
+	if !s.Has(sha256) {
+		return fmt.Errorf("package %s not found in store: %w", sha256, fs.ErrNotExist)
+	}
+
+	if err := os.WriteFile(s.Path(sha256)+originSuffix, []byte(url), 0o644); err != nil {
+		return fmt.Errorf("failed to write package origin: %w", err)
+	}
+
+	return nil
+}
+
+// Origin returns the URL that the package with the given SHA256 sum was
+// downloaded from, if it is known.
+func (s *Store) Origin(sha256 string) (string, bool) {
+	if !s.Has(sha256) {
+		return "", false
+	}
+
+	data, err := os.ReadFile(s.Path(sha256) + originSuffix)
+	if err != nil {
+		return "", false
+	}
+
+	return string(data), true
+}
+
+// Link makes the package with the given SHA256 sum available at dst. A hard
+// link is used where possible, falling back to a reflink, and finally to a
+// full copy when dst is on a different filesystem.
+func (s *Store) Link(sha256, dst string) error {
+	if !s.Has(sha256) {
+		return fmt.Errorf("package %s not found in store: %w", sha256, fs.ErrNotExist)
+	}
+
+	src := s.Path(sha256)
+
+	// Record that the package has been used (for garbage collection).
+	now := time.Now()
+	if err := os.Chtimes(src, now, now); err != nil {
+		slog.Warn("Failed to update package access time",
+			slog.String("sha256", sha256), slog.Any("error", err))
+	}
+
+	linkErr := os.Link(src, dst)
+	if linkErr == nil {
+		return nil
+	}
+
+	slog.Debug("Failed to hard link package, falling back to reflink",
+		slog.String("sha256", sha256), slog.Any("error", linkErr))
+
+	if err := reflink(src, dst); err == nil {
+		return nil
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return fmt.Errorf("failed to copy package: %w", err)
+	}
+
+	return nil
+}
+
+// GCResult summarizes a garbage collection run.
+type GCResult struct {
+	// Removed is the number of packages that were removed.
+	Removed int
+	// ReclaimedBytes is the number of bytes that were reclaimed.
+	ReclaimedBytes int64
+}
+
+// GC removes packages that have not been referenced by a build within the
+// keep duration. Packages that are still hard linked into a build context
+// are always retained.
+func (s *Store) GC(keepDuration time.Duration) (*GCResult, error) {
+	cutoff := time.Now().Add(-keepDuration)
+
+	var result GCResult
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Origins are removed along with their packages.
+		if d.IsDir() || strings.HasSuffix(d.Name(), originSuffix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		// Leftovers from interrupted writes are always removed. Partial
+		// downloads are kept around for a while so they can be resumed.
+		isTemp := strings.HasPrefix(d.Name(), tempPrefix)
+		isPartial := strings.HasPrefix(d.Name(), partialPrefix)
+
+		if !isTemp {
+			if fi.ModTime().After(cutoff) || linkCount(fi) > 1 {
+				return nil
+			}
+		}
+
+		if isPartial {
+			// Skip partial downloads that are in progress.
+			f, err := os.Open(path)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+
+				return fmt.Errorf("failed to open partial download: %w", err)
+			}
+			defer f.Close()
+
+			locked, err := tryLockFile(f)
+			if err != nil {
+				return fmt.Errorf("failed to lock partial download: %w", err)
+			}
+
+			if !locked {
+				slog.Debug("Skipping partial download in progress", slog.String("path", path))
+				return nil
+			}
+		}
+
+		slog.Debug("Removing unreferenced package", slog.String("path", path))
+
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove package: %w", err)
+		}
+
+		if !isTemp && !isPartial {
+			if err := os.Remove(path + originSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to remove package origin: %w", err)
+			}
+
+			result.Removed++
+		}
+		result.ReclaimedBytes += fi.Size()
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to walk package store: %w", err)
+	}
+
+	return &result, nil
+}
+
+func isValidSHA256(sha256 string) bool {
+	b, err := hex.DecodeString(sha256)
+	return err == nil && len(b) == 32
+}
+
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+
+	return dstFile.Close()
+}
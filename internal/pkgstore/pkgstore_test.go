@@ -0,0 +1,170 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pkgstore_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/immutos/immutos/internal/pkgstore"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	store, err := pkgstore.Open(t.TempDir())
+	require.NoError(t, err)
+
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	sha256 := "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592"
+
+	t.Run("Put", func(t *testing.T) {
+		require.False(t, store.Has(sha256))
+
+		require.NoError(t, store.Put(sha256, bytes.NewReader(data)))
+
+		require.True(t, store.Has(sha256))
+	})
+
+	t.Run("Put Hash Mismatch", func(t *testing.T) {
+		otherSHA256 := "0000000000000000000000000000000000000000000000000000000000000000"
+
+		require.Error(t, store.Put(otherSHA256, bytes.NewReader(data)))
+
+		require.False(t, store.Has(otherSHA256))
+	})
+
+	t.Run("Link", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "package.deb")
+
+		require.NoError(t, store.Link(sha256, dst))
+
+		linkedData, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		require.Equal(t, data, linkedData)
+	})
+
+	t.Run("Origin", func(t *testing.T) {
+		_, ok := store.Origin(sha256)
+		require.False(t, ok)
+
+		url := "https://deb.debian.org/debian/pool/main/f/fox/fox_1.0_all.deb"
+		require.NoError(t, store.SetOrigin(sha256, url))
+
+		origin, ok := store.Origin(sha256)
+		require.True(t, ok)
+		require.Equal(t, url, origin)
+	})
+
+	t.Run("Partial", func(t *testing.T) {
+		otherData := []byte("Pack my box with five dozen liquor jugs")
+		otherSHA256 := "adf457ba89c70a9999952666bc2f538b1503207802584248ee744690c61a0b97"
+
+		partial, err := store.OpenPartial(otherSHA256)
+		require.NoError(t, err)
+
+		// An interrupted download.
+		require.NoError(t, os.WriteFile(partial.Path(), otherData[:10], 0o644))
+
+		// Concurrent downloads of the same package wait for the lock.
+		opened := make(chan *pkgstore.Partial)
+		go func() {
+			resumed, err := store.OpenPartial(otherSHA256)
+			if err != nil {
+				close(opened)
+				return
+			}
+			opened <- resumed
+		}()
+
+		select {
+		case <-opened:
+			t.Fatal("partial download opened while locked")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		// Locked partial downloads are never garbage collected.
+		old := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(partial.Path(), old, old))
+
+		result, err := store.GC(time.Hour)
+		require.NoError(t, err)
+		require.Zero(t, result.ReclaimedBytes)
+		require.FileExists(t, partial.Path())
+
+		require.NoError(t, partial.Close())
+
+		resumed, ok := <-opened
+		require.True(t, ok)
+
+		f, err := os.OpenFile(resumed.Path(), os.O_WRONLY|os.O_APPEND, 0)
+		require.NoError(t, err)
+		_, err = f.Write(otherData[10:])
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		require.NoError(t, resumed.Commit())
+		require.True(t, store.Has(otherSHA256))
+		require.NoFileExists(t, resumed.Path())
+
+		// Unlocked partial downloads are garbage collected.
+		partial, err = store.OpenPartial(sha256)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(partial.Path(), data[:10], 0o644))
+		require.NoError(t, partial.Close())
+		require.NoError(t, os.Chtimes(partial.Path(), old, old))
+
+		result, err = store.GC(time.Hour)
+		require.NoError(t, err)
+		require.Zero(t, result.Removed)
+		require.Equal(t, int64(10), result.ReclaimedBytes)
+		require.NoFileExists(t, partial.Path())
+	})
+
+	t.Run("GC", func(t *testing.T) {
+		// Recently used packages are retained.
+		result, err := store.GC(time.Hour)
+		require.NoError(t, err)
+		require.Zero(t, result.Removed)
+		require.True(t, store.Has(sha256))
+
+		old := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(store.Path(sha256), old, old))
+
+		// Packages that are still linked into a build context are retained.
+		dst := filepath.Join(t.TempDir(), "package.deb")
+		require.NoError(t, os.Link(store.Path(sha256), dst))
+
+		result, err = store.GC(time.Hour)
+		require.NoError(t, err)
+		require.Zero(t, result.Removed)
+
+		require.NoError(t, os.Remove(dst))
+
+		result, err = store.GC(time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, 1, result.Removed)
+		require.Equal(t, int64(len(data)), result.ReclaimedBytes)
+		require.False(t, store.Has(sha256))
+		require.NoFileExists(t, store.Path(sha256)+".origin")
+	})
+}
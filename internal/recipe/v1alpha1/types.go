@@ -36,8 +36,16 @@ type Recipe struct {
 	Groups []GroupConfig `yaml:"groups,omitempty"`
 	// Users is a list of users to create.
 	Users []UserConfig `yaml:"users,omitempty"`
+	// Diversions is a list of dpkg diversions to create before the packages are
+	// configured.
+	Diversions []DiversionConfig `yaml:"diversions,omitempty"`
+	// Alternatives is a list of alternative selections to apply while the
+	// packages are configured (as soon as a package has registered them).
+	Alternatives []AlternativeConfig `yaml:"alternatives,omitempty"`
 	// Container is the OCI image configuration.
 	Container *ContainerConfig `yaml:"container,omitempty"`
+	// Disk is the bootable disk image configuration.
+	Disk *DiskConfig `yaml:"disk,omitempty"`
 }
 
 // OptionsConfig contains configuration options for the image.
@@ -49,6 +57,31 @@ type OptionsConfig struct {
 	Slimify bool `yaml:"slimify,omitempty"`
 	// DownloadOnly specifies whether to only download packages and not install them.
 	DownloadOnly bool `yaml:"downloadOnly,omitempty"`
+	// BuildKit optionally configures an existing BuildKit daemon to build the
+	// image with, instead of starting one. The --buildkit-addr flag (and the
+	// BUILDKIT_HOST environment variable) take precedence.
+	BuildKit *BuildKitConfig `yaml:"buildkit,omitempty"`
+}
+
+// BuildKitConfig is the configuration for an existing BuildKit daemon.
+type BuildKitConfig struct {
+	// Address is the address of the daemon (unix://, tcp://, or docker-container://).
+	Address string `yaml:"address"`
+	// TLS optionally configures the TLS credentials of a tcp:// daemon.
+	TLS *BuildKitTLSConfig `yaml:"tls,omitempty"`
+}
+
+// BuildKitTLSConfig is the TLS configuration for connecting to a BuildKit
+// daemon. Relative paths are resolved against the directory of the recipe.
+type BuildKitTLSConfig struct {
+	// ServerName is the expected server name of the daemon certificate.
+	ServerName string `yaml:"serverName,omitempty"`
+	// CACert is the path to the CA certificate used to verify the daemon.
+	CACert string `yaml:"caCert"`
+	// Cert is the optional path to the client certificate.
+	Cert string `yaml:"cert,omitempty"`
+	// Key is the optional path to the client key.
+	Key string `yaml:"key,omitempty"`
 }
 
 // SourceConfig is the configuration for an apt repository.
@@ -63,14 +96,38 @@ type SourceConfig struct {
 	// Components is a list of components to use from the repository.
 	// If not specified, defaults to ["main"].
 	Components []string `yaml:"components,omitempty"`
+	// PackageSignedBy is an optional public key URL (https) or file path used to
+	// verify the embedded (debsig) signatures of packages from the repository.
+	// If specified, packages without a valid signature will be rejected.
+	PackageSignedBy string `yaml:"packageSignedBy,omitempty"`
 }
 
 // PackagesConfig is the configuration for packages.
 type PackagesConfig struct {
-	// Include is a list of packages to install.
+	// Include is a list of packages to install. Local .deb files can be
+	// included by path or glob (relative to the recipe file).
 	Include []string `yaml:"include,omitempty"`
 	// Exclude is a list of packages to exclude from installation.
 	Exclude []string `yaml:"exclude,omitempty"`
+	// AllowOverlaps is a list of path patterns (eg. "/usr/share/doc/**") that
+	// packages are permitted to overwrite, even if they do not declare Replaces.
+	// A "/**" suffix matches everything below the directory.
+	// The last package (by name) shipping an overlapping file takes it over.
+	AllowOverlaps []string `yaml:"allowOverlaps,omitempty"`
+	// Signatures is a list of keys used to verify the embedded (debsig)
+	// signatures of specific packages. Takes precedence over the packageSignedBy
+	// option of the source. Local .deb files must always have a valid signature.
+	Signatures []PackageSignatureConfig `yaml:"signatures,omitempty"`
+}
+
+// PackageSignatureConfig is the configuration for verifying the embedded
+// (debsig) signatures of packages.
+type PackageSignatureConfig struct {
+	// Package is the name of the package, or a pattern (eg. "vendor-*").
+	Package string `yaml:"package"`
+	// SignedBy is a public key URL (https) or file path to use for verifying
+	// the package.
+	SignedBy string `yaml:"signedBy"`
 }
 
 // GroupConfig is the configuration for a group.
@@ -107,6 +164,27 @@ type UserConfig struct {
 	System bool `yaml:"system,omitempty"`
 }
 
+// DiversionConfig is the configuration for a dpkg diversion.
+type DiversionConfig struct {
+	// Path is the absolute path of the file to divert.
+	Path string `yaml:"path"`
+	// DivertTo is the absolute path that the file will be diverted to.
+	DivertTo string `yaml:"divertTo"`
+	// Package is the optional name of the package that owns the diversion (its
+	// own copy of the file will not be diverted). If not specified, the diversion
+	// applies to all packages.
+	Package string `yaml:"package,omitempty"`
+}
+
+// AlternativeConfig is the configuration for an alternative selection
+// (see update-alternatives(1)).
+type AlternativeConfig struct {
+	// Name is the name of the alternative group (eg. editor).
+	Name string `yaml:"name"`
+	// Path is the absolute path of the selected alternative (eg. /usr/bin/vim.tiny).
+	Path string `yaml:"path"`
+}
+
 // ContainerConfig is the configuration for the container.
 type ContainerConfig struct {
 	// User defines the username or UID which the process in the container should run as.
@@ -129,6 +207,51 @@ type ContainerConfig struct {
 	Labels map[string]string `yaml:"labels,omitempty"`
 	// StopSignal contains the system call signal that will be sent to the container to exit.
 	StopSignal string `yaml:"stopSignal,omitempty"`
+	// Layers configures how the image is split into layers.
+	Layers *LayersConfig `yaml:"layers,omitempty"`
+}
+
+// LayersConfig is the configuration for splitting the image into layers.
+type LayersConfig struct {
+	// Strategy is the layering strategy, either single (a single layer),
+	// packages (a layer per package), or split (separate base and application
+	// layers). The files not owned by any package always make up an additional
+	// final layer. If not specified, defaults to single.
+	Strategy string `yaml:"strategy,omitempty"`
+	// MaxLayers is the maximum number of layers of the packages strategy. If
+	// there are more packages than layers, the highest ranked packages get
+	// their own layers and the remaining packages share a layer. If not
+	// specified, defaults to 16.
+	MaxLayers int `yaml:"maxLayers,omitempty"`
+	// RankBy is how the packages strategy ranks packages, either size (the
+	// largest packages first) or popularity (the packages with the most
+	// dependents first). If not specified, defaults to size.
+	RankBy string `yaml:"rankBy,omitempty"`
+	// Application is a list of the packages (or patterns, eg. "myapp-*") that
+	// make up the application layer of the split strategy. All other packages
+	// make up the base layer.
+	Application []string `yaml:"application,omitempty"`
+}
+
+// DiskConfig is the configuration for bootable disk images (the raw and qcow2
+// outputs).
+type DiskConfig struct {
+	// Size is the total size of the disk image (eg. 2GiB). If not specified,
+	// defaults to 2GiB.
+	Size string `yaml:"size,omitempty"`
+	// Filesystem is the root filesystem type, either ext4 or erofs (read-only).
+	// If not specified, defaults to ext4.
+	Filesystem string `yaml:"filesystem,omitempty"`
+	// Kernel is the name of the kernel package to install (eg. linux-image-amd64).
+	Kernel string `yaml:"kernel,omitempty"`
+	// Bootloader is the boot loader configuration to generate, either
+	// systemd-boot (UEFI) or extlinux (BIOS via syslinux on x86, or U-Boot). If
+	// not specified, defaults to systemd-boot.
+	// The systemd-boot EFI binary is taken from the image, so the
+	// systemd-boot-efi package must be installed.
+	Bootloader string `yaml:"bootloader,omitempty"`
+	// Cmdline is a list of additional kernel command line arguments.
+	Cmdline []string `yaml:"cmdline,omitempty"`
 }
 
 func (r *Recipe) GetAPIVersion() string {
@@ -0,0 +1,513 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package registry implements a minimal OCI distribution client, for pushing
+// images to container registries.
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/credentials"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// OpenFunc opens the content of a blob.
+type OpenFunc func(dgst digest.Digest) (io.ReadCloser, error)
+
+// Client pushes images to OCI distribution registries.
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient creates a new registry client. Credentials are read from the
+// Docker configuration file (and any configured credential helpers).
+func NewClient() *Client {
+	return &Client{
+		httpClient: &http.Client{},
+	}
+}
+
+// Push pushes an image (a manifest or an index), and all the content it
+// references, to the registry. The image is tagged with the reference.
+func (c *Client) Push(ctx context.Context, ref string, root ocispecs.Descriptor, open OpenFunc) error {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return fmt.Errorf("failed to parse reference %q: %w", ref, err)
+	}
+
+	tagged, ok := reference.TagNameOnly(named).(reference.Tagged)
+	if !ok {
+		return fmt.Errorf("reference %q must be tagged", ref)
+	}
+
+	repo := &repository{
+		client: c,
+		domain: reference.Domain(named),
+		name:   reference.Path(named),
+	}
+
+	if err := repo.pushContent(ctx, root, open); err != nil {
+		return err
+	}
+
+	if err := repo.putManifest(ctx, tagged.Tag(), root, open); err != nil {
+		return err
+	}
+
+	slog.Debug("Pushed image", slog.String("reference", tagged.String()), slog.String("digest", root.Digest.String()))
+
+	return nil
+}
+
+type repository struct {
+	client        *Client
+	domain        string
+	name          string
+	authorization string
+}
+
+// pushContent pushes everything referenced by a manifest or index.
+func (r *repository) pushContent(ctx context.Context, desc ocispecs.Descriptor, open OpenFunc) error {
+	switch desc.MediaType {
+	case ocispecs.MediaTypeImageIndex, mediaTypeDockerManifestList:
+		data, err := readBlob(desc.Digest, open)
+		if err != nil {
+			return err
+		}
+
+		var index ocispecs.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("failed to unmarshal index: %w", err)
+		}
+
+		for _, manifestDesc := range index.Manifests {
+			if err := r.pushContent(ctx, manifestDesc, open); err != nil {
+				return err
+			}
+
+			if err := r.putManifest(ctx, manifestDesc.Digest.String(), manifestDesc, open); err != nil {
+				return err
+			}
+		}
+	case ocispecs.MediaTypeImageManifest, mediaTypeDockerManifest:
+		data, err := readBlob(desc.Digest, open)
+		if err != nil {
+			return err
+		}
+
+		var manifest ocispecs.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("failed to unmarshal manifest: %w", err)
+		}
+
+		for _, blobDesc := range append([]ocispecs.Descriptor{manifest.Config}, manifest.Layers...) {
+			if err := r.pushBlob(ctx, blobDesc, open); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported media type: %s", desc.MediaType)
+	}
+
+	return nil
+}
+
+func (r *repository) pushBlob(ctx context.Context, desc ocispecs.Descriptor, open OpenFunc) error {
+	resp, err := r.do(ctx, http.MethodHead, r.url("blobs", desc.Digest.String()), "", nil, 0)
+	if err != nil {
+		return fmt.Errorf("failed to check blob %s: %w", desc.Digest, err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		slog.Debug("Blob already exists", slog.String("digest", desc.Digest.String()))
+		return nil
+	}
+
+	resp, err = r.do(ctx, http.MethodPost, r.url("blobs", "uploads")+"/", "", nil, 0)
+	if err != nil {
+		return fmt.Errorf("failed to start upload of blob %s: %w", desc.Digest, err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("failed to start upload of blob %s: %s", desc.Digest, resp.Status)
+	}
+
+	uploadURL, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("failed to parse upload location: %w", err)
+	}
+
+	query := uploadURL.Query()
+	query.Set("digest", desc.Digest.String())
+	uploadURL.RawQuery = query.Encode()
+
+	body := func() (io.ReadCloser, error) {
+		return open(desc.Digest)
+	}
+
+	resp, err = r.do(ctx, http.MethodPut, uploadURL.String(), "application/octet-stream", body, desc.Size)
+	if err != nil {
+		return fmt.Errorf("failed to upload blob %s: %w", desc.Digest, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to upload blob %s: %s", desc.Digest, responseError(resp))
+	}
+
+	return nil
+}
+
+func (r *repository) putManifest(ctx context.Context, ref string, desc ocispecs.Descriptor, open OpenFunc) error {
+	data, err := readBlob(desc.Digest, open)
+	if err != nil {
+		return err
+	}
+
+	body := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	resp, err := r.do(ctx, http.MethodPut, r.url("manifests", ref), desc.MediaType, body, int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("failed to push manifest %s: %w", ref, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to push manifest %s: %s", ref, responseError(resp))
+	}
+
+	return nil
+}
+
+func (r *repository) url(kind, ref string) string {
+	host := r.domain
+	// Docker Hub is served from a different host.
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+
+	scheme := "https"
+	if isLocalhost(host) {
+		scheme = "http"
+	}
+
+	return (&url.URL{Scheme: scheme, Host: host, Path: "/v2/" + r.name + "/" + kind + "/" + ref}).String()
+}
+
+// do performs a request against the registry, authenticating (and retrying)
+// if the registry requests it.
+func (r *repository) do(ctx context.Context, method, rawURL, contentType string, body func() (io.ReadCloser, error), size int64) (*http.Response, error) {
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if body != nil {
+			req.Body, err = body()
+			if err != nil {
+				return nil, err
+			}
+			req.ContentLength = size
+		}
+
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		if r.authorization != "" {
+			req.Header.Set("Authorization", r.authorization)
+		}
+
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	_ = resp.Body.Close()
+
+	if err := r.authenticate(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.client.httpClient.Do(req)
+}
+
+// authenticate responds to an authentication challenge from the registry.
+func (r *repository) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+
+	authConfig, err := r.client.credentials(r.domain)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if authConfig.Username == "" {
+			return errors.New("no credentials available")
+		}
+
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(authConfig.Username, authConfig.Password)
+		r.authorization = req.Header.Get("Authorization")
+	case "bearer":
+		if authConfig.RegistryToken != "" {
+			r.authorization = "Bearer " + authConfig.RegistryToken
+			return nil
+		}
+
+		token, err := r.fetchToken(ctx, params, authConfig)
+		if err != nil {
+			return err
+		}
+
+		r.authorization = "Bearer " + token
+	default:
+		return fmt.Errorf("unsupported authentication scheme: %q", scheme)
+	}
+
+	return nil
+}
+
+// fetchToken obtains a bearer token from the registry's token service.
+func (r *repository) fetchToken(ctx context.Context, params map[string]string, authConfig authConfig) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm: %q", params["realm"])
+	}
+
+	scope := params["scope"]
+	if scope == "" || !strings.Contains(scope, "push") {
+		scope = "repository:" + r.name + ":pull,push"
+	}
+
+	var req *http.Request
+	if authConfig.IdentityToken != "" {
+		// Exchange the refresh token for an access token (OAuth2).
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {authConfig.IdentityToken},
+			"service":       {params["service"]},
+			"scope":         {scope},
+			"client_id":     {"immutos"},
+		}
+
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := realm.Query()
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		query.Set("scope", scope)
+		realm.RawQuery = query.Encode()
+
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+
+		if authConfig.Username != "" {
+			req.SetBasicAuth(authConfig.Username, authConfig.Password)
+		}
+	}
+
+	resp, err := r.client.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch token: %s", responseError(resp))
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("failed to decode token: %w", err)
+	}
+
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+
+	if tokenResp.Token == "" {
+		return "", errors.New("no token returned")
+	}
+
+	return tokenResp.Token, nil
+}
+
+type authConfig struct {
+	Username      string
+	Password      string
+	IdentityToken string
+	RegistryToken string
+}
+
+// credentials looks up the credentials for a registry in the Docker
+// configuration.
+func (c *Client) credentials(domain string) (authConfig, error) {
+	key := domain
+	if domain == "docker.io" {
+		key = "https://index.docker.io/v1/"
+	}
+
+	conf, err := loadDockerConfig().GetAuthConfig(key)
+	if err != nil {
+		return authConfig{}, fmt.Errorf("failed to get credentials for %s: %w", domain, err)
+	}
+
+	return authConfig{
+		Username:      conf.Username,
+		Password:      conf.Password,
+		IdentityToken: conf.IdentityToken,
+		RegistryToken: conf.RegistryToken,
+	}, nil
+}
+
+// loadDockerConfig loads the Docker configuration file.
+func loadDockerConfig() *configfile.ConfigFile {
+	// config.Dir() only reads DOCKER_CONFIG once.
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = config.Dir()
+	}
+
+	conf, err := config.Load(dir)
+	if err != nil {
+		slog.Warn("Failed to load Docker config", slog.Any("error", err))
+	}
+
+	if !conf.ContainsAuth() {
+		conf.CredentialsStore = credentials.DetectDefaultStore(conf.CredentialsStore)
+	}
+
+	return conf
+}
+
+// parseChallenge parses a WWW-Authenticate header, eg.
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+
+	params := map[string]string{}
+	for rest != "" {
+		var key string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+
+		if key != "" {
+			params[strings.ToLower(strings.TrimSpace(key))] = value
+		}
+	}
+
+	return scheme, params
+}
+
+// isLocalhost returns whether the registry is running on the local machine,
+// in which case it is accessed over plain HTTP.
+func isLocalhost(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	if hostname == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+func readBlob(dgst digest.Digest, open OpenFunc) ([]byte, error) {
+	rc, err := open(dgst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob %s: %w", dgst, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", dgst, err)
+	}
+
+	return data, nil
+}
+
+func responseError(resp *http.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if len(bytes.TrimSpace(body)) == 0 {
+		return resp.Status
+	}
+
+	return fmt.Sprintf("%s: %s", resp.Status, bytes.TrimSpace(body))
+}
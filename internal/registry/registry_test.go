@@ -0,0 +1,131 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/immutos/immutos/internal/registry"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPush(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	reg := testutil.NewRegistry(t, "user", "secret")
+	reg.SetupDockerConfig(t)
+
+	c := registry.NewClient()
+
+	blobs := map[digest.Digest][]byte{}
+	add := func(mediaType string, data []byte) ocispecs.Descriptor {
+		dgst := digest.FromBytes(data)
+		blobs[dgst] = data
+		return ocispecs.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+	}
+
+	addJSON := func(mediaType string, v any) ocispecs.Descriptor {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return add(mediaType, data)
+	}
+
+	open := func(dgst digest.Digest) (io.ReadCloser, error) {
+		data, ok := blobs[dgst]
+		if !ok {
+			return nil, fmt.Errorf("blob %s: %w", dgst, os.ErrNotExist)
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	var manifestDescs []ocispecs.Descriptor
+	for _, arch := range []string{"amd64", "arm64"} {
+		config := addJSON(ocispecs.MediaTypeImageConfig, ocispecs.Image{
+			Platform: ocispecs.Platform{OS: "linux", Architecture: arch},
+		})
+		layer := add(ocispecs.MediaTypeImageLayerGzip, []byte("layer-"+arch))
+
+		manifestDesc := addJSON(ocispecs.MediaTypeImageManifest, ocispecs.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageManifest,
+			Config:    config,
+			Layers:    []ocispecs.Descriptor{layer},
+		})
+		manifestDesc.Platform = &ocispecs.Platform{OS: "linux", Architecture: arch}
+
+		manifestDescs = append(manifestDescs, manifestDesc)
+	}
+
+	t.Run("Manifest", func(t *testing.T) {
+		err := c.Push(ctx, reg.Host+"/immutos/single:latest", manifestDescs[0], open)
+		require.NoError(t, err)
+
+		m, ok := reg.Manifest("immutos/single", "latest")
+		require.True(t, ok)
+		require.Equal(t, ocispecs.MediaTypeImageManifest, m.MediaType)
+		require.Equal(t, blobs[manifestDescs[0].Digest], m.Data)
+		require.Equal(t, 2, reg.Uploads())
+	})
+
+	t.Run("Index", func(t *testing.T) {
+		indexDesc := addJSON(ocispecs.MediaTypeImageIndex, ocispecs.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageIndex,
+			Manifests: manifestDescs,
+		})
+
+		err := c.Push(ctx, reg.Host+"/immutos/multi:v1", indexDesc, open)
+		require.NoError(t, err)
+
+		m, ok := reg.Manifest("immutos/multi", "v1")
+		require.True(t, ok)
+		require.Equal(t, ocispecs.MediaTypeImageIndex, m.MediaType)
+
+		for _, manifestDesc := range manifestDescs {
+			_, ok := reg.Manifest("immutos/multi", manifestDesc.Digest.String())
+			require.True(t, ok)
+		}
+
+		// Blobs that already exist are not uploaded again.
+		require.Equal(t, 4, reg.Uploads())
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		// No credentials are configured for this registry.
+		otherReg := testutil.NewRegistry(t, "user", "secret")
+
+		err := c.Push(ctx, otherReg.Host+"/immutos/single:latest", manifestDescs[0], open)
+		require.Error(t, err)
+	})
+
+	t.Run("Digest Reference", func(t *testing.T) {
+		err := c.Push(ctx, reg.Host+"/immutos/single@"+manifestDescs[0].Digest.String(), manifestDescs[0], open)
+		require.Error(t, err)
+	})
+}
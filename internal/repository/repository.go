@@ -0,0 +1,412 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package repository
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/dpeckett/deb822"
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/filehash"
+	debtime "github.com/dpeckett/deb822/types/time"
+	"github.com/dpeckett/uncompr"
+	"github.com/immutos/immutos/internal/deb"
+	"github.com/immutos/immutos/internal/keyring"
+)
+
+const (
+	defaultDistribution = "stable"
+	defaultComponent    = "main"
+	// PublicKeyFilename is the name of the file (in the root of the repository)
+	// containing the public key used to sign the repository.
+	PublicKeyFilename = "signing_key.asc"
+)
+
+// Options configures the generated repository.
+type Options struct {
+	// Origin is the optional origin of the repository.
+	Origin string
+	// Label is the optional label of the repository.
+	Label string
+	// Distribution is the name of the distribution, if not specified defaults
+	// to "stable".
+	Distribution string
+	// Component is the name of the component, if not specified defaults to "main".
+	Component string
+	// Date is the date of the release, if not specified defaults to the current time.
+	// Set this to the source date epoch for reproducible repositories.
+	Date time.Time
+	// SigningKey is the OpenPGP private key used to sign the InRelease file.
+	SigningKey *openpgp.Entity
+}
+
+// Create creates (or recreates) a signed apt repository in dir, containing
+// the given packages. The packages are copied into the pool of the repository.
+func Create(dir string, packagePaths []string, opts Options) error {
+	if opts.SigningKey == nil {
+		return errors.New("a signing key is required")
+	}
+
+	if opts.Distribution == "" {
+		opts.Distribution = defaultDistribution
+	}
+
+	if opts.Component == "" {
+		opts.Component = defaultComponent
+	}
+
+	if opts.Date.IsZero() {
+		opts.Date = time.Now()
+	}
+
+	packagesByArch := map[string][]types.Package{}
+	seen := map[string]bool{}
+	for _, packagePath := range packagePaths {
+		pkg, err := addToPool(dir, opts.Component, packagePath)
+		if err != nil {
+			return fmt.Errorf("failed to add package %s: %w", filepath.Base(packagePath), err)
+		}
+
+		// The same package may be provided more than once (eg. architecture
+		// independent packages fetched for multiple platforms).
+		if seen[pkg.Filename] {
+			continue
+		}
+		seen[pkg.Filename] = true
+
+		packagesByArch[pkg.Architecture.String()] = append(packagesByArch[pkg.Architecture.String()], *pkg)
+	}
+
+	// Architecture independent packages are listed in every architecture
+	// specific index.
+	archs := make([]string, 0, len(packagesByArch))
+	for arch := range packagesByArch {
+		if arch != "all" {
+			archs = append(archs, arch)
+		}
+	}
+	if len(archs) == 0 {
+		archs = append(archs, "all")
+	} else {
+		for _, arch := range archs {
+			packagesByArch[arch] = append(packagesByArch[arch], packagesByArch["all"]...)
+		}
+	}
+	slices.Sort(archs)
+
+	distDir := filepath.Join(dir, "dists", opts.Distribution)
+	if err := os.RemoveAll(distDir); err != nil {
+		return fmt.Errorf("failed to remove existing distribution: %w", err)
+	}
+
+	var fileHashes []filehash.FileHash
+	for _, arch := range archs {
+		packageList := packagesByArch[arch]
+
+		slices.SortFunc(packageList, func(a, b types.Package) int {
+			if cmp := a.Compare(b); cmp != 0 {
+				return cmp
+			}
+
+			return strings.Compare(a.Architecture.String(), b.Architecture.String())
+		})
+
+		indexHashes, err := writePackagesIndex(distDir, path.Join(opts.Component, "binary-"+arch), packageList, opts.Date)
+		if err != nil {
+			return fmt.Errorf("failed to write packages index for %s: %w", arch, err)
+		}
+
+		fileHashes = append(fileHashes, indexHashes...)
+	}
+
+	release := types.Release{
+		Origin:      opts.Origin,
+		Label:       opts.Label,
+		Suite:       opts.Distribution,
+		Codename:    opts.Distribution,
+		Date:        debtime.Time(opts.Date.UTC()),
+		Components:  []string{opts.Component},
+		Description: "Generated by immutos",
+		SHA256:      fileHashes,
+	}
+
+	for _, a := range archs {
+		release.Architectures = append(release.Architectures, arch.MustParse(a))
+	}
+
+	if err := writeRelease(distDir, &release, opts.SigningKey); err != nil {
+		return fmt.Errorf("failed to write release: %w", err)
+	}
+
+	publicKeyFile, err := os.Create(filepath.Join(dir, PublicKeyFilename))
+	if err != nil {
+		return fmt.Errorf("failed to create public key file: %w", err)
+	}
+	defer publicKeyFile.Close()
+
+	if err := keyring.WritePublicKey(publicKeyFile, opts.SigningKey); err != nil {
+		return fmt.Errorf("failed to write public key: %w", err)
+	}
+
+	return publicKeyFile.Close()
+}
+
+// Scan returns the paths of all the Debian packages found in dir (including
+// those already in the pool of the repository), in lexical order.
+func Scan(dir string) ([]string, error) {
+	var packagePaths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip hidden directories (eg. .git).
+		if d.IsDir() && path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		if d.Type().IsRegular() && filepath.Ext(path) == ".deb" {
+			packagePaths = append(packagePaths, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan for packages: %w", err)
+	}
+
+	return packagePaths, nil
+}
+
+// PoolPath returns the path, relative to the root of the repository, where
+// the package file will be stored.
+func PoolPath(component string, pkg *types.Package) string {
+	source := pkg.Name
+	if pkg.Source != "" {
+		// The source field may include a version, eg. "foo (1.0-1)".
+		source = strings.Fields(pkg.Source)[0]
+	}
+
+	prefix := source[:1]
+	if strings.HasPrefix(source, "lib") && len(source) > 3 {
+		prefix = source[:4]
+	}
+
+	filename := fmt.Sprintf("%s_%s_%s.deb", pkg.Name, pkg.Version.String(), pkg.Architecture.String())
+
+	// Epochs are not included in filenames.
+	if _, after, ok := strings.Cut(filename, ":"); ok {
+		filename = pkg.Name + "_" + after
+	}
+
+	return path.Join("pool", component, prefix, source, filename)
+}
+
+func addToPool(dir, component, packagePath string) (*types.Package, error) {
+	f, err := os.Open(packagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open package: %w", err)
+	}
+	defer f.Close()
+
+	debArchive, err := deb.Open(f)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg, err := debArchive.Control()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek package: %w", err)
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash package: %w", err)
+	}
+
+	pkg.Filename = PoolPath(component, pkg)
+	pkg.Size = int(size)
+	pkg.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	poolPath := filepath.Join(dir, filepath.FromSlash(pkg.Filename))
+
+	// Is the package already in the pool?
+	if existingSHA256, err := sha256File(poolPath); err == nil {
+		if existingSHA256 != pkg.SHA256 {
+			return nil, fmt.Errorf("a different package already exists at %s", pkg.Filename)
+		}
+
+		return pkg, nil
+	}
+
+	slog.Debug("Adding package to pool", slog.String("path", pkg.Filename))
+
+	if err := os.MkdirAll(filepath.Dir(poolPath), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create pool directory: %w", err)
+	}
+
+	if err := os.Link(packagePath, poolPath); err != nil {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to seek package: %w", err)
+		}
+
+		poolFile, err := os.Create(poolPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pool file: %w", err)
+		}
+		defer poolFile.Close()
+
+		if _, err := io.Copy(poolFile, f); err != nil {
+			return nil, fmt.Errorf("failed to copy package into pool: %w", err)
+		}
+
+		if err := poolFile.Close(); err != nil {
+			return nil, fmt.Errorf("failed to close pool file: %w", err)
+		}
+	}
+
+	return pkg, nil
+}
+
+func writePackagesIndex(distDir, indexDir string, packageList []types.Package, date time.Time) ([]filehash.FileHash, error) {
+	var buf bytes.Buffer
+	encoder, err := deb822.NewEncoder(&buf, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encoder: %w", err)
+	}
+
+	if err := encoder.Encode(packageList); err != nil {
+		return nil, fmt.Errorf("failed to encode packages: %w", err)
+	}
+
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close encoder: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(distDir, filepath.FromSlash(indexDir)), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create index directory: %w", err)
+	}
+
+	var fileHashes []filehash.FileHash
+	for _, name := range []string{"Packages", "Packages.xz"} {
+		data := buf.Bytes()
+		if name != "Packages" {
+			var compressed bytes.Buffer
+			w, err := uncompr.NewWriter(&compressed, name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create compressor: %w", err)
+			}
+
+			if _, err := w.Write(data); err != nil {
+				return nil, fmt.Errorf("failed to compress %s: %w", name, err)
+			}
+
+			if err := w.Close(); err != nil {
+				return nil, fmt.Errorf("failed to compress %s: %w", name, err)
+			}
+
+			data = compressed.Bytes()
+		}
+
+		indexPath := path.Join(indexDir, name)
+
+		if err := os.WriteFile(filepath.Join(distDir, filepath.FromSlash(indexPath)), data, 0o644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", name, err)
+		}
+
+		// The modification time of the index is used as the source date epoch
+		// by builds that consume the repository.
+		if err := os.Chtimes(filepath.Join(distDir, filepath.FromSlash(indexPath)), date, date); err != nil {
+			return nil, fmt.Errorf("failed to set modification time of %s: %w", name, err)
+		}
+
+		sum := sha256.Sum256(data)
+		fileHashes = append(fileHashes, filehash.FileHash{
+			Hash:     hex.EncodeToString(sum[:]),
+			Size:     int64(len(data)),
+			Filename: indexPath,
+		})
+	}
+
+	return fileHashes, nil
+}
+
+func writeRelease(distDir string, release *types.Release, signingKey *openpgp.Entity) error {
+	var releaseBuf bytes.Buffer
+	if err := deb822.Marshal(&releaseBuf, release); err != nil {
+		return fmt.Errorf("failed to marshal release: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(distDir, "Release"), releaseBuf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write release: %w", err)
+	}
+
+	var inReleaseBuf bytes.Buffer
+	encoder, err := deb822.NewEncoder(&inReleaseBuf, signingKey)
+	if err != nil {
+		return fmt.Errorf("failed to create encoder: %w", err)
+	}
+
+	if err := encoder.Encode(release); err != nil {
+		return fmt.Errorf("failed to encode release: %w", err)
+	}
+
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("failed to sign release: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(distDir, "InRelease"), inReleaseBuf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write signed release: %w", err)
+	}
+
+	return nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package repository_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/immutos/immutos/internal/keyring"
+	latestrecipe "github.com/immutos/immutos/internal/recipe/v1alpha1"
+	"github.com/immutos/immutos/internal/repository"
+	"github.com/immutos/immutos/internal/source"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreate(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	signingKey, err := keyring.LoadOrGenerateSigningKey(filepath.Join(t.TempDir(), "signing-key.asc"), "test")
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+
+	packagePaths := []string{
+		filepath.Join(testutil.Root(), "testdata/debs/base-files_12.4+deb12u5_amd64.deb"),
+		filepath.Join(testutil.Root(), "testdata/debs/base-passwd_3.6.1_amd64.deb"),
+	}
+
+	date := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	require.NoError(t, repository.Create(dir, packagePaths, repository.Options{
+		Date:       date,
+		SigningKey: signingKey,
+	}))
+
+	_, err = os.Stat(filepath.Join(dir, "pool/main/b/base-files/base-files_12.4+deb12u5_amd64.deb"))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	t.Cleanup(srv.Close)
+
+	s, err := source.NewSource(ctx, latestrecipe.SourceConfig{
+		URL:      srv.URL,
+		SignedBy: filepath.Join(dir, repository.PublicKeyFilename),
+	})
+	require.NoError(t, err)
+
+	components, err := s.Components(ctx, arch.MustParse("amd64"))
+	require.NoError(t, err)
+	require.Len(t, components, 1)
+
+	componentPackages, lastUpdated, err := components[0].Packages(ctx)
+	require.NoError(t, err)
+
+	require.Len(t, componentPackages, 2)
+	require.Equal(t, "base-files", componentPackages[0].Name)
+	require.Equal(t, "base-passwd", componentPackages[1].Name)
+	require.Equal(t, date, lastUpdated.UTC())
+}
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "incoming"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, ".git"), 0o755))
+
+	for _, name := range []string{"incoming/b.deb", "a.deb", ".git/c.deb", "README.md"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o644))
+	}
+
+	packagePaths, err := repository.Scan(dir)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		filepath.Join(dir, "a.deb"),
+		filepath.Join(dir, "incoming/b.deb"),
+	}, packagePaths)
+}
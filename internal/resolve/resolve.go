@@ -140,9 +140,14 @@ func Resolve(packageDB *database.PackageDB, includeNameVersions, excludeNameVers
 		}
 
 		// If the package is already selected, only replace it if the new version
-		// is higher.
+		// is higher (local packages are always preferred to remote packages).
 		if existing := selectedDB.Get(pkg.Package.Name); len(existing) > 0 {
-			if pkg.Version.Compare(existing[0].Version) > 0 {
+			if pkg.IsLocal != existing[0].IsLocal {
+				if pkg.IsLocal {
+					selectedDB.Remove(existing[0])
+					selectedDB.Add(pkg)
+				}
+			} else if pkg.Version.Compare(existing[0].Version) > 0 {
 				selectedDB.Remove(existing[0])
 				selectedDB.Add(pkg)
 			}
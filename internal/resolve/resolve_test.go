@@ -23,6 +23,8 @@ import (
 	"testing"
 
 	"github.com/dpeckett/deb822"
+	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/version"
 	"github.com/dpeckett/uncompr"
 	"github.com/immutos/immutos/internal/database"
 	"github.com/immutos/immutos/internal/resolve"
@@ -79,3 +81,21 @@ func TestResolve(t *testing.T) {
 
 	require.ElementsMatch(t, expectedNameVersions, selectedNameVersions)
 }
+
+func TestResolveLocal(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	packageDB := database.NewPackageDB()
+	packageDB.AddAll([]types.Package{
+		{Package: debtypes.Package{Name: "hello", Version: version.MustParse("2.0")}},
+		{Package: debtypes.Package{Name: "hello", Version: version.MustParse("1.0-local")}, IsLocal: true},
+	})
+
+	selectedDB, err := resolve.Resolve(packageDB, []string{"hello"}, nil)
+	require.NoError(t, err)
+
+	selected := selectedDB.Get("hello")
+	require.Len(t, selected, 1)
+	require.True(t, selected[0].IsLocal)
+	require.Equal(t, "1.0-local", selected[0].Version.String())
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// AlternativesDir is the update-alternatives administrative directory.
+const AlternativesDir = "/var/lib/dpkg/alternatives"
+
+// Alternative is an alternative selection (see update-alternatives(1)).
+type Alternative struct {
+	// Name is the name of the alternative group (eg. editor).
+	Name string
+	// Path is the absolute path of the selected alternative (eg. /usr/bin/vim.tiny).
+	Path string
+}
+
+// setAlternatives selects each of the alternatives that has been registered
+// (by the maintainer scripts of the packages configured so far), and returns
+// the alternatives that are still waiting to be registered.
+func setAlternatives(ctx context.Context, alternatives []Alternative) ([]Alternative, error) {
+	var pending []Alternative
+	for _, alternative := range alternatives {
+		registered, err := isRegistered(alternative)
+		if err != nil {
+			return nil, err
+		}
+
+		if !registered {
+			pending = append(pending, alternative)
+			continue
+		}
+
+		if err := setAlternative(ctx, alternative); err != nil {
+			return nil, err
+		}
+	}
+
+	return pending, nil
+}
+
+func setAlternative(ctx context.Context, alternative Alternative) error {
+	slog.Info("Setting alternative",
+		slog.String("name", alternative.Name), slog.String("path", alternative.Path))
+
+	out, err := exec.CommandContext(ctx, "update-alternatives", "--set", alternative.Name, alternative.Path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to set alternative %q: %w: %s", alternative.Name, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// isRegistered checks if the path has been registered as a choice for the
+// alternative group.
+func isRegistered(alternative Alternative) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(AlternativesDir, alternative.Name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to read alternative %q: %w", alternative.Name, err)
+	}
+
+	return slices.Contains(strings.Split(string(data), "\n"), alternative.Path), nil
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/dpeckett/deb822"
+	"github.com/immutos/immutos/internal/types"
+)
+
+// StatusPath is the path to the dpkg status file.
+const StatusPath = "/var/lib/dpkg/status"
+
+// Error is returned when dpkg fails to configure a batch of packages.
+type Error struct {
+	// Packages is the batch of packages that was being configured.
+	Packages []string
+	// Package is the name of the package that failed to configure (if known).
+	Package string
+	// Reason is the reason reported by dpkg, eg. which maintainer script failed.
+	Reason string
+	// Output is the combined output of dpkg and the maintainer scripts.
+	Output string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Package != "" {
+		return fmt.Sprintf("failed to configure package %s: %s\n%s", e.Package, e.Reason, e.Output)
+	}
+
+	return fmt.Sprintf("failed to configure packages (%s): %v\n%s", strings.Join(e.Packages, ", "), e.Err, e.Output)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Configure configures the unpacked packages in the dpkg status file in
+// dependency order, and then processes any pending triggers. Each of the
+// requested alternatives is selected as soon as a configured package has
+// registered it, so the maintainer scripts of later packages observe the
+// selection.
+func Configure(ctx context.Context, statusPath string, alternatives []Alternative) error {
+	f, err := os.Open(statusPath)
+	if err != nil {
+		return fmt.Errorf("failed to open dpkg status file: %w", err)
+	}
+	defer f.Close()
+
+	decoder, err := deb822.NewDecoder(f, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create decoder: %w", err)
+	}
+
+	var packages []types.Package
+	if err := decoder.Decode(&packages); err != nil {
+		return fmt.Errorf("failed to decode dpkg status file: %w", err)
+	}
+
+	batches := Order(packages)
+	for i, batch := range batches {
+		slog.Info("Configuring packages",
+			slog.Int("batch", i+1), slog.Int("batches", len(batches)),
+			slog.Int("packages", len(batch)))
+
+		if err := dpkg(ctx, batch, append([]string{"--configure"}, batch...)...); err != nil {
+			return err
+		}
+
+		alternatives, err = setAlternatives(ctx, alternatives)
+		if err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Processing triggers")
+
+	// Configure anything that is left (eg. packages awaiting triggers).
+	if err := dpkg(ctx, nil, "--configure", "--pending"); err != nil {
+		return err
+	}
+
+	// Alternatives registered by triggers (or not at all, in which case
+	// update-alternatives will report the error).
+	for _, alternative := range alternatives {
+		if err := setAlternative(ctx, alternative); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func dpkg(ctx context.Context, packages []string, args ...string) error {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "dpkg", args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+
+	slog.Debug("Ran dpkg", slog.Any("args", args), slog.String("output", output.String()))
+
+	if err != nil {
+		configureErr := &Error{
+			Packages: packages,
+			Output:   output.String(),
+			Err:      err,
+		}
+
+		configureErr.Package, configureErr.Reason = parseFailure(output.String())
+
+		return configureErr
+	}
+
+	return nil
+}
+
+var failureRegexp = regexp.MustCompile(`dpkg: error processing package (\S+) \(--configure\):\n\s*(.+)`)
+
+// parseFailure extracts the first package that failed to configure, and the
+// reason (eg. which maintainer script failed), from the output of dpkg.
+func parseFailure(output string) (string, string) {
+	matches := failureRegexp.FindStringSubmatch(output)
+	if matches == nil {
+		return "", ""
+	}
+
+	return matches[1], strings.TrimSpace(matches[2])
+}
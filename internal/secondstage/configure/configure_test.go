@@ -0,0 +1,184 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/deb822"
+	"github.com/immutos/immutos/internal/secondstage/configure"
+	"github.com/immutos/immutos/internal/testutil"
+	"github.com/immutos/immutos/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+const status = `Package: libc6
+Status: install ok unpacked
+Version: 2.36-9
+Architecture: amd64
+Depends: libgcc-s1
+
+Package: libgcc-s1
+Status: install ok unpacked
+Version: 12.2.0-14
+Architecture: amd64
+Depends: libc6 (>= 2.35), gcc-12-base
+
+Package: gcc-12-base
+Status: install ok installed
+Version: 12.2.0-14
+Architecture: amd64
+
+Package: dpkg
+Status: install ok unpacked
+Version: 1.21.22
+Architecture: amd64
+Pre-Depends: libc6 (>= 2.34), tar
+Depends: base-files
+
+Package: tar
+Status: install ok unpacked
+Version: 1.34+dfsg-1.2
+Architecture: amd64
+Pre-Depends: libc6 (>= 2.34)
+
+Package: base-files
+Status: install ok unpacked
+Version: 12.4
+Architecture: amd64
+Provides: base
+
+Package: bash
+Status: install ok unpacked
+Version: 5.2.15-2
+Architecture: amd64
+Pre-Depends: libc6
+Depends: base, dash | missing
+
+Package: dash
+Status: install ok unpacked
+Version: 0.5.12-2
+Architecture: amd64
+Pre-Depends: libc6
+Depends: bash
+`
+
+func TestOrder(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	decoder, err := deb822.NewDecoder(strings.NewReader(status), nil)
+	require.NoError(t, err)
+
+	var packages []types.Package
+	require.NoError(t, decoder.Decode(&packages))
+
+	batches := configure.Order(packages)
+
+	expected := [][]string{
+		// The libc6/libgcc-s1 cycle is broken by name, gcc-12-base is already
+		// configured.
+		{"base-files", "libc6", "libgcc-s1"},
+		// Pre-Depends are configured before the packages that need them.
+		{"bash", "dash", "tar"},
+		{"dpkg"},
+	}
+
+	require.Equal(t, expected, batches)
+
+	// The order should not depend on the order of the status file.
+	for i, j := 0, len(packages)-1; i < j; i, j = i+1, j-1 {
+		packages[i], packages[j] = packages[j], packages[i]
+	}
+
+	require.Equal(t, expected, configure.Order(packages))
+}
+
+func TestOrderPreDependsCycle(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	packages := []types.Package{}
+	decoder, err := deb822.NewDecoder(strings.NewReader(`Package: a
+Status: install ok unpacked
+Version: 1
+Architecture: all
+Depends: b
+
+Package: b
+Status: install ok unpacked
+Version: 1
+Architecture: all
+Pre-Depends: a
+`), nil)
+	require.NoError(t, err)
+	require.NoError(t, decoder.Decode(&packages))
+
+	require.Equal(t, [][]string{{"a", "b"}}, configure.Order(packages))
+
+	// Now a pre-depends on b, so b must come first.
+	packages[0].PreDepends, packages[0].Depends = packages[0].Depends, packages[0].PreDepends
+	packages[1].PreDepends, packages[1].Depends = packages[1].Depends, packages[1].PreDepends
+
+	require.Equal(t, [][]string{{"b", "a"}}, configure.Order(packages))
+}
+
+func TestOrderVirtualPackage(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	parse := func(status string) []types.Package {
+		decoder, err := deb822.NewDecoder(strings.NewReader(status), nil)
+		require.NoError(t, err)
+
+		var packages []types.Package
+		require.NoError(t, decoder.Decode(&packages))
+
+		return packages
+	}
+
+	const providers = `Package: mawk
+Status: install ok unpacked
+Version: 1.3.4
+Architecture: amd64
+Provides: awk
+Depends: b
+
+Package: gawk
+Status: install ok %s
+Version: 5.2.1
+Architecture: amd64
+Provides: awk
+
+Package: b
+Status: install ok unpacked
+Version: 1
+Architecture: all
+
+Package: a
+Status: install ok unpacked
+Version: 1
+Architecture: all
+Depends: awk
+`
+
+	// Only the first pending provider needs to be configured first.
+	require.Equal(t, [][]string{{"gawk", "b"}, {"a", "mawk"}},
+		configure.Order(parse(strings.Replace(providers, "%s", "unpacked", 1))))
+
+	// A provider that is already configured satisfies the dependency.
+	require.Equal(t, [][]string{{"a", "b"}, {"mawk"}},
+		configure.Order(parse(strings.Replace(providers, "%s", "installed", 1))))
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package configure
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/deb822/types/dependency"
+	"github.com/immutos/immutos/internal/types"
+)
+
+// Order computes the order in which the unconfigured packages should be
+// configured. Packages are grouped into batches, every package in a batch
+// only depends on packages in earlier batches (or on packages in the same
+// dependency cycle). Within a batch, packages are ordered so that
+// Pre-Depends are configured first. The order is deterministic.
+func Order(packages []types.Package) [][]string {
+	installed := map[string]types.Package{}
+	providers := map[string][]string{}
+	for _, pkg := range packages {
+		installed[pkg.Name] = pkg
+
+		for _, rel := range pkg.Provides.Relations {
+			for _, possi := range rel.Possibilities {
+				providers[possi.Name] = append(providers[possi.Name], pkg.Name)
+			}
+		}
+	}
+
+	for name := range providers {
+		slices.Sort(providers[name])
+	}
+
+	var names []string
+	for _, pkg := range packages {
+		if !isConfigured(pkg) {
+			names = append(names, pkg.Name)
+		}
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	pending := map[string]bool{}
+	for _, name := range names {
+		pending[name] = true
+	}
+
+	// Resolve the dependencies of each package that still need to be configured.
+	resolve := func(relations []dependency.Relation) []string {
+		var deps []string
+		for _, rel := range relations {
+			for _, possi := range rel.Possibilities {
+				var candidates []string
+				if _, ok := installed[possi.Name]; ok {
+					candidates = []string{possi.Name}
+				} else {
+					candidates = providers[possi.Name]
+				}
+
+				if len(candidates) == 0 {
+					continue
+				}
+
+				// The first installed alternative satisfies the relation. A
+				// single provider is enough, preferring one that is already
+				// configured, otherwise the first pending one.
+				if !slices.ContainsFunc(candidates, func(candidate string) bool {
+					return !pending[candidate]
+				}) {
+					deps = append(deps, candidates[0])
+				}
+
+				break
+			}
+		}
+
+		slices.Sort(deps)
+		return slices.Compact(deps)
+	}
+
+	preDepends := map[string][]string{}
+	depends := map[string][]string{}
+	for _, name := range names {
+		pkg := installed[name]
+		preDepends[name] = resolve(pkg.PreDepends.Relations)
+
+		deps := append(slices.Clone(preDepends[name]), resolve(pkg.Depends.Relations)...)
+		slices.Sort(deps)
+		depends[name] = slices.Compact(deps)
+	}
+
+	components := stronglyConnectedComponents(names, depends)
+
+	componentOf := map[string]int{}
+	for i, component := range components {
+		for _, name := range component {
+			componentOf[name] = i
+		}
+	}
+
+	// Components are returned in reverse topological order (dependencies
+	// first), so the level of each component can be computed in one pass.
+	levels := make([]int, len(components))
+	var batches [][]string
+	for i, component := range components {
+		for _, name := range component {
+			for _, dep := range depends[name] {
+				if j := componentOf[dep]; j != i && levels[j]+1 > levels[i] {
+					levels[i] = levels[j] + 1
+				}
+			}
+		}
+
+		for len(batches) <= levels[i] {
+			batches = append(batches, nil)
+		}
+	}
+
+	for i, component := range components {
+		batches[levels[i]] = append(batches[levels[i]], orderComponent(component, preDepends)...)
+	}
+
+	return batches
+}
+
+// orderComponent orders the packages of a dependency cycle, so that
+// Pre-Depends are satisfied where possible. Remaining cycles are broken by
+// choosing the package with the lexically smallest name.
+func orderComponent(component []string, preDepends map[string][]string) []string {
+	remaining := slices.Clone(component)
+	slices.Sort(remaining)
+
+	done := map[string]bool{}
+	var ordered []string
+	for len(remaining) > 0 {
+		next := 0
+		for i, name := range remaining {
+			ready := !slices.ContainsFunc(preDepends[name], func(dep string) bool {
+				return slices.Contains(remaining, dep) && !done[dep]
+			})
+
+			if ready {
+				next = i
+				break
+			}
+		}
+
+		done[remaining[next]] = true
+		ordered = append(ordered, remaining[next])
+		remaining = slices.Delete(remaining, next, next+1)
+	}
+
+	return ordered
+}
+
+// stronglyConnectedComponents returns the strongly connected components of
+// the dependency graph (using Tarjan's algorithm), dependencies first.
+func stronglyConnectedComponents(names []string, edges map[string][]string) [][]string {
+	var (
+		index      int
+		indices    = map[string]int{}
+		lowLinks   = map[string]int{}
+		onStack    = map[string]bool{}
+		stack      []string
+		components [][]string
+	)
+
+	var visit func(name string)
+	visit = func(name string) {
+		indices[name] = index
+		lowLinks[name] = index
+		index++
+
+		stack = append(stack, name)
+		onStack[name] = true
+
+		for _, dep := range edges[name] {
+			if _, visited := indices[dep]; !visited {
+				visit(dep)
+				lowLinks[name] = min(lowLinks[name], lowLinks[dep])
+			} else if onStack[dep] {
+				lowLinks[name] = min(lowLinks[name], indices[dep])
+			}
+		}
+
+		if lowLinks[name] == indices[name] {
+			var component []string
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+
+				component = append(component, top)
+
+				if top == name {
+					break
+				}
+			}
+
+			slices.Sort(component)
+			components = append(components, component)
+		}
+	}
+
+	for _, name := range names {
+		if _, visited := indices[name]; !visited {
+			visit(name)
+		}
+	}
+
+	return components
+}
+
+func isConfigured(pkg types.Package) bool {
+	return len(pkg.Status) == 3 && strings.EqualFold(pkg.Status[2], "installed")
+}
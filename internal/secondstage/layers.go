@@ -0,0 +1,62 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secondstage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/immutos/immutos/internal/layers"
+)
+
+// WriteLayers splits a (mounted) root filesystem into layer tarballs
+// (layer-0.tar, layer-1.tar, etc), according to a layer plan (see
+// layers.Plan).
+func WriteLayers(rootFSDir, planPath, outputDir string) error {
+	data, err := os.ReadFile(planPath)
+	if err != nil {
+		return fmt.Errorf("failed to read layer plan: %w", err)
+	}
+
+	var plan [][]string
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return fmt.Errorf("failed to unmarshal layer plan: %w", err)
+	}
+
+	owners, err := layers.ReadOwners(os.DirFS(rootFSDir))
+	if err != nil {
+		return err
+	}
+
+	var layerPaths []string
+	for i := 0; i <= len(plan); i++ {
+		layerPaths = append(layerPaths, filepath.Join(outputDir, fmt.Sprintf("layer-%d.tar", i)))
+	}
+
+	slog.Info("Writing layers", slog.Int("count", len(layerPaths)))
+
+	// Timestamps are clamped by the exporter.
+	if err := layers.Write(rootFSDir, layerPaths, layers.Assign(plan, owners), time.Time{}); err != nil {
+		return fmt.Errorf("failed to write layers: %w", err)
+	}
+
+	return nil
+}
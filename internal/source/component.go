@@ -45,8 +45,10 @@ type Component struct {
 	// SHA256Sums are the SHA256 sums of files in the component.
 	SHA256Sums map[string]string
 	// Internal fields.
-	keyring   openpgp.EntityList
-	sourceURL *url.URL
+	keyring         openpgp.EntityList
+	sourceURL       *url.URL
+	packageSignedBy string
+	releaseOrigin   types.Origin
 }
 
 func (c *Component) Packages(ctx context.Context) ([]types.Package, time.Time, error) {
@@ -123,6 +125,11 @@ func (c *Component) Packages(ctx context.Context) ([]types.Package, time.Time, e
 		for i := range packageList {
 			packageURL.Path = path.Join(basePath, packageList[i].Filename)
 			packageList[i].URLs = append(packageList[i].URLs, packageURL.String())
+
+			origin := c.releaseOrigin
+			origin.URL = packageURL.String()
+			packageList[i].Origins = append(packageList[i].Origins, origin)
+			packageList[i].SignedBy = c.packageSignedBy
 		}
 
 		return packageList, lastUpdated, nil
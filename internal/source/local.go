@@ -0,0 +1,117 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package source
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/immutos/immutos/internal/deb"
+	"github.com/immutos/immutos/internal/types"
+)
+
+// IsLocal returns true if the package include entry refers to local .deb
+// files (a path or glob) rather than to a package name.
+func IsLocal(nameVersion string) bool {
+	return strings.HasSuffix(nameVersion, ".deb") || strings.ContainsRune(nameVersion, '/')
+}
+
+// LocalPackages reads the control data of the local .deb files matching the
+// given paths or globs. Relative paths are resolved against baseDir.
+func LocalPackages(baseDir string, patterns []string) ([]types.Package, error) {
+	var packageList []types.Package
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid package pattern %q: %w", pattern, err)
+		}
+
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no packages found matching: %s", pattern)
+		}
+
+		for _, match := range matches {
+			pkg, err := localPackage(match)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read local package %s: %w", match, err)
+			}
+
+			packageList = append(packageList, *pkg)
+		}
+	}
+
+	return packageList, nil
+}
+
+func localPackage(packagePath string) (*types.Package, error) {
+	packagePath, err := filepath.Abs(packagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	slog.Debug("Reading local package", slog.String("path", packagePath))
+
+	f, err := os.Open(packagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open package: %w", err)
+	}
+	defer f.Close()
+
+	debArchive, err := deb.Open(f)
+	if err != nil {
+		return nil, err
+	}
+
+	control, err := debArchive.Control()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek package: %w", err)
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash package: %w", err)
+	}
+
+	control.Filename = filepath.Base(packagePath)
+	control.Size = int(size)
+	control.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	packageURL := url.URL{Scheme: "file", Path: filepath.ToSlash(packagePath)}
+
+	return &types.Package{
+		Package: *control,
+		URLs:    []string{packageURL.String()},
+		Origins: []types.Origin{{URL: packageURL.String()}},
+		IsLocal: true,
+	}, nil
+}
@@ -25,6 +25,7 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/dpeckett/deb822"
@@ -32,6 +33,7 @@ import (
 	"github.com/dpeckett/deb822/types/arch"
 	"github.com/immutos/immutos/internal/keyring"
 	latestrecipe "github.com/immutos/immutos/internal/recipe/v1alpha1"
+	internaltypes "github.com/immutos/immutos/internal/types"
 )
 
 const defaultDistribution = "stable"
@@ -40,10 +42,11 @@ var defaultComponents = []string{"main"}
 
 // Source represents a Debian repository source.
 type Source struct {
-	keyring      openpgp.EntityList
-	sourceURL    *url.URL
-	distribution string
-	components   []string
+	keyring         openpgp.EntityList
+	sourceURL       *url.URL
+	distribution    string
+	components      []string
+	packageSignedBy string
 }
 
 // NewSource creates a new Debian repository source.
@@ -69,10 +72,11 @@ func NewSource(ctx context.Context, conf latestrecipe.SourceConfig) (*Source, er
 	}
 
 	return &Source{
-		keyring:      keyring,
-		sourceURL:    sourceURL,
-		distribution: distribution,
-		components:   components,
+		keyring:         keyring,
+		sourceURL:       sourceURL,
+		distribution:    distribution,
+		components:      components,
+		packageSignedBy: conf.PackageSignedBy,
 	}, nil
 }
 
@@ -114,6 +118,17 @@ func (s *Source) Components(ctx context.Context, targetArch arch.Arch) ([]Compon
 		return nil, fmt.Errorf("failed to unmarshal InRelease file: %w", err)
 	}
 
+	suite := release.Suite
+	if suite == "" {
+		suite = s.distribution
+	}
+
+	releaseOrigin := internaltypes.Origin{
+		Suite:    suite,
+		Date:     time.Time(release.Date),
+		SignedBy: fmt.Sprintf("%X", decoder.Signer().PrimaryKey.Fingerprint),
+	}
+
 	allArch := arch.MustParse("all")
 	var availableArchitectures []arch.Arch
 	for _, releaseArch := range release.Architectures {
@@ -167,12 +182,14 @@ func (s *Source) Components(ctx context.Context, targetArch arch.Arch) ([]Compon
 			}
 
 			components = append(components, Component{
-				Name:       component,
-				Arch:       arch,
-				URL:        componentURL,
-				SHA256Sums: componentSHA256Sums,
-				keyring:    s.keyring,
-				sourceURL:  s.sourceURL,
+				Name:            component,
+				Arch:            arch,
+				URL:             componentURL,
+				SHA256Sums:      componentSHA256Sums,
+				keyring:         s.keyring,
+				sourceURL:       s.sourceURL,
+				packageSignedBy: s.packageSignedBy,
+				releaseOrigin:   releaseOrigin,
 			})
 		}
 	}
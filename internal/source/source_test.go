@@ -29,6 +29,7 @@ import (
 	latestrecipe "github.com/immutos/immutos/internal/recipe/v1alpha1"
 	"github.com/immutos/immutos/internal/source"
 	"github.com/immutos/immutos/internal/testutil"
+	"github.com/immutos/immutos/internal/types"
 	"github.com/stretchr/testify/require"
 )
 
@@ -71,6 +72,29 @@ func TestSource(t *testing.T) {
 	require.NotEqual(t, time.Time{}, lastUpdated)
 }
 
+func TestLocalPackages(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	require.True(t, source.IsLocal("./debs/*.deb"))
+	require.True(t, source.IsLocal("hello_1.0_amd64.deb"))
+	require.False(t, source.IsLocal("bash=5.2.15-2+b2"))
+
+	packageList, err := source.LocalPackages(testutil.Root(), []string{"testdata/debs/base-*.deb"})
+	require.NoError(t, err)
+
+	require.Len(t, packageList, 2)
+	require.Equal(t, "base-files", packageList[0].Name)
+	require.Equal(t, "base-files_12.4+deb12u5_amd64.deb", packageList[0].Filename)
+	require.Equal(t, "file://"+filepath.Join(testutil.Root(), "testdata/debs/base-files_12.4+deb12u5_amd64.deb"), packageList[0].URLs[0])
+	require.Equal(t, []types.Origin{{URL: packageList[0].URLs[0]}}, packageList[0].Origins)
+	require.NotEmpty(t, packageList[0].SHA256)
+	require.True(t, packageList[0].IsLocal)
+	require.Equal(t, "base-passwd", packageList[1].Name)
+
+	_, err = source.LocalPackages(testutil.Root(), []string{"testdata/debs/missing_*.deb"})
+	require.Error(t, err)
+}
+
 type runMirrorResult struct {
 	err  error
 	addr net.Addr
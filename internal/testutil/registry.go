@@ -0,0 +1,274 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testutil
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Registry is an in-memory stand-in for an OCI distribution registry, that
+// requires token authentication.
+type Registry struct {
+	// Host is the address of the registry (eg. 127.0.0.1:5000).
+	Host string
+
+	username string
+	password string
+	token    string
+
+	mu        sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifests map[string]RegistryManifest
+	uploads   int
+}
+
+// RegistryManifest is a manifest (or index) stored in the registry.
+type RegistryManifest struct {
+	MediaType string
+	Data      []byte
+}
+
+// NewRegistry starts a registry stand-in, which accepts the given credentials.
+func NewRegistry(t *testing.T, username, password string) *Registry {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Registry{
+		username:  username,
+		password:  password,
+		token:     hex.EncodeToString(token),
+		blobs:     map[digest.Digest][]byte{},
+		manifests: map[string]RegistryManifest{},
+	}
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	r.Host = strings.TrimPrefix(srv.URL, "http://")
+
+	return r
+}
+
+// SetupDockerConfig writes a Docker configuration file containing the
+// credentials for the registry, and points DOCKER_CONFIG at it.
+func (r *Registry) SetupDockerConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	conf := map[string]any{
+		"auths": map[string]any{
+			r.Host: map[string]string{
+				"auth": base64.StdEncoding.EncodeToString([]byte(r.username + ":" + r.password)),
+			},
+		},
+	}
+
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("DOCKER_CONFIG", dir)
+}
+
+// Blob returns the content of a blob.
+func (r *Registry) Blob(dgst digest.Digest) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, ok := r.blobs[dgst]
+	return data, ok
+}
+
+// Manifest returns a manifest by repository name and tag (or digest).
+func (r *Registry) Manifest(name, ref string) (RegistryManifest, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.manifests[name+"/"+ref]
+	return m, ok
+}
+
+// Uploads returns the number of blobs that have been uploaded.
+func (r *Registry) Uploads() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.uploads
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		username, password, ok := req.BasicAuth()
+		if !ok || username != r.username || password != r.password {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": r.token})
+		return
+	}
+
+	if !strings.HasPrefix(req.URL.Path, "/v2/") {
+		http.NotFound(w, req)
+		return
+	}
+
+	if req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="registry"`, req.Host))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+
+	switch {
+	case strings.Contains(path, "/blobs/uploads/"):
+		r.serveUpload(w, req, path[:strings.Index(path, "/blobs/uploads/")])
+	case strings.Contains(path, "/blobs/"):
+		i := strings.LastIndex(path, "/blobs/")
+
+		data, ok := r.blobs[digest.Digest(path[i+len("/blobs/"):])]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, name string) {
+	switch req.Method {
+	case http.MethodPost:
+		id := make([]byte, 8)
+		_, _ = rand.Read(id)
+
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, hex.EncodeToString(id)))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		dgst := digest.Digest(req.URL.Query().Get("digest"))
+		if dgst != digest.FromBytes(data) {
+			http.Error(w, "digest mismatch", http.StatusBadRequest)
+			return
+		}
+
+		r.blobs[dgst] = data
+		r.uploads++
+
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, name, ref string) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		m, ok := r.manifests[name+"/"+ref]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+
+		w.Header().Set("Content-Type", m.MediaType)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(m.Data)
+		}
+	case http.MethodPut:
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Everything referenced by the manifest must have been pushed first.
+		var content struct {
+			Config    *ocispecs.Descriptor  `json:"config"`
+			Layers    []ocispecs.Descriptor `json:"layers"`
+			Manifests []ocispecs.Descriptor `json:"manifests"`
+		}
+		if err := json.Unmarshal(data, &content); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		refs := content.Layers
+		if content.Config != nil {
+			refs = append(refs, *content.Config)
+		}
+
+		for _, desc := range refs {
+			if _, ok := r.blobs[desc.Digest]; !ok {
+				http.Error(w, "blob unknown: "+desc.Digest.String(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		for _, desc := range content.Manifests {
+			if _, ok := r.manifests[name+"/"+desc.Digest.String()]; !ok {
+				http.Error(w, "manifest unknown: "+desc.Digest.String(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		m := RegistryManifest{MediaType: req.Header.Get("Content-Type"), Data: data}
+		r.manifests[name+"/"+ref] = m
+		r.manifests[name+"/"+digest.FromBytes(data).String()] = m
+
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -17,6 +17,8 @@
 package types
 
 import (
+	"time"
+
 	debtypes "github.com/dpeckett/deb822/types"
 	"github.com/google/btree"
 )
@@ -29,12 +31,32 @@ type Package struct {
 
 	// URLs is a list of URLs that the package can be downloaded from.
 	URLs []string `json:"-"`
+	// Origins describes the repositories that supplied the package.
+	Origins []Origin `json:"-"`
 	// IsVirtual is true if the package is a virtual package.
 	IsVirtual bool `json:"-"`
+	// IsLocal is true if the package was provided as a local .deb file. Local
+	// packages take precedence over packages from remote sources.
+	IsLocal bool `json:"-"`
+	// SignedBy is an optional public key URL (https) or file path used to verify
+	// the embedded (debsig) signature of the package.
+	SignedBy string `json:"-"`
 	// Providers lists packages that provide this virtual package.
 	Providers []Package `json:"-"`
 }
 
+// Origin describes a repository that supplied a package.
+type Origin struct {
+	// URL is the URL of the package file.
+	URL string
+	// Suite is the suite (eg. stable) of the repository.
+	Suite string
+	// Date is when the Release file of the repository was published.
+	Date time.Time
+	// SignedBy is the fingerprint of the key that signed the Release file.
+	SignedBy string
+}
+
 func (p Package) Compare(other Package) int {
 	return p.Package.Compare(other.Package)
 }
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unpack
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Diversion is a dpkg diversion (see dpkg-divert(1)).
+type Diversion struct {
+	// Path is the absolute path of the diverted file.
+	Path string
+	// DivertTo is the absolute path that the file is diverted to.
+	DivertTo string
+	// Package is the name of the package that owns the diversion, if empty the
+	// diversion is local (and applies to all packages).
+	Package string
+}
+
+func validateDiversions(diversions []Diversion) error {
+	seen := map[string]bool{}
+	for _, d := range diversions {
+		if !path.IsAbs(d.Path) || !path.IsAbs(d.DivertTo) {
+			return fmt.Errorf("diversion paths must be absolute: %s -> %s", d.Path, d.DivertTo)
+		}
+
+		if path.Clean(d.Path) == path.Clean(d.DivertTo) {
+			return fmt.Errorf("cannot divert %s to itself", d.Path)
+		}
+
+		for _, p := range []string{path.Clean(d.Path), path.Clean(d.DivertTo)} {
+			if seen[p] {
+				return fmt.Errorf("conflicting diversions for %s", p)
+			}
+			seen[p] = true
+		}
+	}
+
+	return nil
+}
+
+// divertedPaths returns the paths (relative to the root) that are diverted
+// for the given package.
+func divertedPaths(diversions []Diversion, packageName string) map[string]string {
+	diverted := map[string]string{}
+	for _, d := range diversions {
+		// The package that owns a diversion is not diverted.
+		if d.Package != "" && d.Package == packageName {
+			continue
+		}
+
+		diverted[strings.TrimPrefix(path.Clean(d.Path), "/")] = strings.TrimPrefix(path.Clean(d.DivertTo), "/")
+	}
+
+	return diverted
+}
+
+// diversionsDatabase returns the contents of the dpkg diversions database
+// (var/lib/dpkg/diversions). Each diversion is recorded as three lines, the
+// diverted path, the path it is diverted to, and the owning package (or ":"
+// for local diversions).
+func diversionsDatabase(diversions []Diversion) []byte {
+	diversions = slices.Clone(diversions)
+	slices.SortFunc(diversions, func(a, b Diversion) int {
+		return strings.Compare(path.Clean(a.Path), path.Clean(b.Path))
+	})
+
+	var sb strings.Builder
+	for _, d := range diversions {
+		packageName := d.Package
+		if packageName == "" {
+			packageName = ":"
+		}
+
+		fmt.Fprintf(&sb, "%s\n%s\n%s\n", path.Clean(d.Path), path.Clean(d.DivertTo), packageName)
+	}
+
+	return []byte(sb.String())
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Immutos Community Edition License, Version 1.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License. You may obtain a copy of the License at
+ *
+ *    http://immutos.com/licenses/LICENSE-1.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unpack
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/dependency"
+	"github.com/dpeckett/deb822/types/version"
+)
+
+// Overlap is a regular file that is shipped by more than one package.
+type Overlap struct {
+	// Path is the absolute path of the file.
+	Path string
+	// Packages are the names of the packages that ship the file.
+	Packages []string
+}
+
+// OverlapError is returned when packages overwrite each others files without
+// declaring Replaces (or being permitted to by the recipe).
+type OverlapError struct {
+	Overlaps []Overlap
+}
+
+func (e *OverlapError) Error() string {
+	var lines []string
+	for _, overlap := range e.Overlaps {
+		lines = append(lines, fmt.Sprintf("%s (shipped by %s)", overlap.Path, strings.Join(overlap.Packages, ", ")))
+	}
+
+	return fmt.Sprintf("%d files are shipped by more than one package (declare Replaces or allow the overlap in the recipe):\n  %s",
+		len(e.Overlaps), strings.Join(lines, "\n  "))
+}
+
+// resolveOverlaps builds an index of the regular files shipped by each
+// package and checks that overlapping files are permitted. Ownership of a
+// permitted overlap is transferred to the replacing package (as dpkg would),
+// and the packages are reordered so that replacing packages are unpacked last.
+func resolveOverlaps(unpackedPackages []*unpackedPackage, allowedOverlaps []string) ([]*unpackedPackage, error) {
+	// owners maps the physical path of each file (after diversions) to the
+	// package that ships it (and the name of the file in that package).
+	type owner struct {
+		index int
+		name  string
+	}
+	owners := map[string]owner{}
+
+	// mustFollow[i] lists the packages that package i must be unpacked after.
+	mustFollow := make([][]int, len(unpackedPackages))
+
+	// Files that have been taken over by another package.
+	replaced := make([]map[string]bool, len(unpackedPackages))
+
+	var overlaps []Overlap
+	for i, unpacked := range unpackedPackages {
+		for _, name := range unpacked.filesList {
+			md5sum, isFile := unpacked.md5sums[name]
+			if !isFile {
+				continue
+			}
+
+			physicalName := name
+			if divertTo, ok := unpacked.diverted[name]; ok {
+				physicalName = divertTo
+			}
+
+			existing, exists := owners[physicalName]
+			if !exists {
+				owners[physicalName] = owner{index: i, name: name}
+				continue
+			}
+
+			j := existing.index
+			other := unpackedPackages[j]
+
+			switch {
+			case other.pkg.Name == unpacked.pkg.Name && other.md5sums[existing.name] == md5sum:
+				// Multi-Arch: same packages may share identical files.
+				continue
+			case replaces(&unpacked.pkg, &other.pkg):
+				owners[physicalName] = owner{index: i, name: name}
+				mustFollow[i] = append(mustFollow[i], j)
+				markReplaced(replaced, j, existing.name)
+			case replaces(&other.pkg, &unpacked.pkg):
+				mustFollow[j] = append(mustFollow[j], i)
+				markReplaced(replaced, i, name)
+			case isAllowedOverlap(physicalName, allowedOverlaps):
+				// The package that takes over the file must not depend on the
+				// order of the packages, so the last package (by name) wins.
+				winner, loser := owner{index: i, name: name}, existing
+				if comparePackages(&unpacked.pkg, &other.pkg) < 0 {
+					winner, loser = loser, winner
+				}
+
+				slog.Debug("Allowing overlapping file",
+					slog.String("path", "/"+physicalName),
+					slog.String("package", unpackedPackages[winner.index].pkg.Name),
+					slog.String("replaces", unpackedPackages[loser.index].pkg.Name))
+
+				owners[physicalName] = winner
+				mustFollow[winner.index] = append(mustFollow[winner.index], loser.index)
+				markReplaced(replaced, loser.index, loser.name)
+			default:
+				overlaps = append(overlaps, Overlap{
+					Path:     "/" + physicalName,
+					Packages: []string{other.pkg.Name, unpacked.pkg.Name},
+				})
+			}
+		}
+	}
+
+	if len(overlaps) > 0 {
+		slices.SortFunc(overlaps, func(a, b Overlap) int {
+			return strings.Compare(a.Path, b.Path)
+		})
+
+		return nil, &OverlapError{Overlaps: overlaps}
+	}
+
+	for i, unpacked := range unpackedPackages {
+		if len(replaced[i]) > 0 {
+			unpacked.filesList = slices.DeleteFunc(unpacked.filesList, func(name string) bool {
+				return replaced[i][name]
+			})
+
+			// Otherwise dpkg --verify would report the files as modified.
+			for name := range replaced[i] {
+				delete(unpacked.md5sums, name)
+			}
+
+			for j, controlFile := range unpacked.controlFiles {
+				if controlFile.name == "md5sums" {
+					unpacked.controlFiles[j].content = removeMD5Sums(controlFile.content, replaced[i])
+				}
+			}
+		}
+	}
+
+	return unpackOrder(unpackedPackages, mustFollow), nil
+}
+
+// removeMD5Sums removes the entries of the given files from a md5sums file.
+func removeMD5Sums(md5sums []byte, names map[string]bool) []byte {
+	var kept strings.Builder
+	for _, line := range strings.SplitAfter(string(md5sums), "\n") {
+		_, name, _ := strings.Cut(strings.TrimRight(line, "\n"), "  ")
+		if !names[strings.TrimPrefix(name, "/")] {
+			kept.WriteString(line)
+		}
+	}
+
+	return []byte(kept.String())
+}
+
+// comparePackages orders packages by name and then architecture.
+func comparePackages(a, b *types.Package) int {
+	if n := strings.Compare(a.Name, b.Name); n != 0 {
+		return n
+	}
+
+	return strings.Compare(a.Architecture.String(), b.Architecture.String())
+}
+
+func markReplaced(replaced []map[string]bool, i int, name string) {
+	if replaced[i] == nil {
+		replaced[i] = map[string]bool{}
+	}
+
+	replaced[i][name] = true
+}
+
+// unpackOrder returns the packages in their original order, except that each
+// package is moved after the packages it must follow. Cycles are broken by
+// falling back to the original order.
+func unpackOrder(unpackedPackages []*unpackedPackage, mustFollow [][]int) []*unpackedPackage {
+	ordered := make([]*unpackedPackage, 0, len(unpackedPackages))
+	done := make([]bool, len(unpackedPackages))
+
+	for len(ordered) < len(unpackedPackages) {
+		next := -1
+		for i := range unpackedPackages {
+			if done[i] {
+				continue
+			}
+
+			ready := !slices.ContainsFunc(mustFollow[i], func(j int) bool {
+				return !done[j]
+			})
+
+			if ready {
+				next = i
+				break
+			}
+		}
+
+		// Cycle, take the first remaining package.
+		if next == -1 {
+			next = slices.Index(done, false)
+		}
+
+		done[next] = true
+		ordered = append(ordered, unpackedPackages[next])
+	}
+
+	return ordered
+}
+
+// replaces returns true if pkg declares that it replaces other.
+func replaces(pkg, other *types.Package) bool {
+	for _, rel := range pkg.Replaces.Relations {
+		for _, possi := range rel.Possibilities {
+			if possi.Name != other.Name {
+				continue
+			}
+
+			if possi.Version == nil || satisfies(other.Version, possi.Version) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func satisfies(v version.Version, rel *dependency.VersionRelation) bool {
+	cmp := v.Compare(rel.Version)
+
+	switch rel.Operator {
+	case "<<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case "=":
+		return cmp == 0
+	case ">=":
+		return cmp >= 0
+	case ">>":
+		return cmp > 0
+	default:
+		return false
+	}
+}
+
+// isAllowedOverlap returns true if the file matches one of the allowed overlap
+// patterns. A pattern ending in "/**" matches everything below the directory.
+func isAllowedOverlap(name string, allowedOverlaps []string) bool {
+	for _, pattern := range allowedOverlaps {
+		pattern = strings.TrimPrefix(pattern, "/")
+
+		if dir, ok := strings.CutSuffix(pattern, "/**"); ok {
+			for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+				if matched, _ := path.Match(dir, parent); matched {
+					return true
+				}
+			}
+
+			continue
+		}
+
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
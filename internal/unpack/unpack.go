@@ -17,29 +17,56 @@
 package unpack
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 
-	"github.com/dpeckett/archivefs/arfs"
 	"github.com/dpeckett/archivefs/memfs"
 	"github.com/dpeckett/archivefs/tarfs"
 	"github.com/dpeckett/deb822"
 	"github.com/dpeckett/deb822/types"
-	"github.com/dpeckett/uncompr"
+	"github.com/immutos/immutos/internal/deb"
 	"github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
 	"golang.org/x/sync/errgroup"
 )
 
-func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string, []string, error) {
+// Options configures how packages are unpacked.
+type Options struct {
+	// AllowedOverlaps is a list of path patterns (eg. "/usr/share/doc/**") of
+	// files that packages are permitted to overwrite, even without Replaces.
+	// Patterns use path.Match syntax, and a "/**" suffix matches everything
+	// below the directory.
+	AllowedOverlaps []string
+	// Diversions is a list of diversions to apply to the unpacked files.
+	Diversions []Diversion
+}
+
+// Unpack reads the packages, and writes the data archive of each package and
+// an archive containing the dpkg database to tempDir. The data archives are
+// returned in the order that they should be applied.
+func Unpack(ctx context.Context, tempDir string, packagePaths []string, opts *Options) (string, []string, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if err := validateDiversions(opts.Diversions); err != nil {
+		return "", nil, err
+	}
+
 	var progressOutput io.Writer = os.Stdout
 	if slog.Default().Enabled(ctx, slog.LevelDebug) {
 		progressOutput = io.Discard
@@ -48,9 +75,8 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 	progress := mpb.NewWithContext(ctx, mpb.WithOutput(progressOutput))
 	defer progress.Shutdown()
 
-	// Decompress the packages in parallel.
-	controlArchivePaths := make([]string, len(packagePaths))
-	dataArchivePaths := make([]string, len(packagePaths))
+	// Read the packages in parallel.
+	unpackedPackages := make([]*unpackedPackage, len(packagePaths))
 	{
 		bar := progress.AddBar(int64(len(packagePaths)),
 			mpb.PrependDecorators(
@@ -72,13 +98,12 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 			g.Go(func() error {
 				defer bar.Increment()
 
-				controlArchivePath, dataArchivePath, err := decompressPackage(tempDir, packagePath)
+				unpacked, err := unpackPackage(tempDir, packagePath, opts.Diversions)
 				if err != nil {
 					return fmt.Errorf("failed to decompress package %s: %w", filepath.Base(packagePath), err)
 				}
 
-				controlArchivePaths[i] = controlArchivePath
-				dataArchivePaths[i] = dataArchivePath
+				unpackedPackages[i] = unpacked
 
 				return nil
 			})
@@ -98,12 +123,19 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 		}
 	}
 
+	slog.Debug("Checking for overlapping files")
+
+	unpackedPackages, err := resolveOverlaps(unpackedPackages, opts.AllowedOverlaps)
+	if err != nil {
+		return "", nil, err
+	}
+
 	dpkgDatabaseFS := memfs.New()
 	if err := dpkgDatabaseFS.MkdirAll("var/lib/dpkg/info", 0o755); err != nil {
 		return "", nil, fmt.Errorf("failed to create dpkg info directory: %w", err)
 	}
 
-	var packages []types.Package
+	dataArchivePaths := make([]string, len(packagePaths))
 	{
 		bar := progress.AddBar(int64(len(packagePaths)),
 			mpb.PrependDecorators(
@@ -115,61 +147,59 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 			),
 		)
 
-		for i := range packagePaths {
-			slog.Debug("Extracting control archive",
-				slog.String("path", filepath.Base(controlArchivePaths[i])))
+		var g errgroup.Group
+		g.SetLimit(runtime.NumCPU())
 
-			controlArchiveFile, err := os.Open(controlArchivePaths[i])
-			if err != nil {
-				bar.Abort(true)
-				bar.Wait()
+		for i, unpacked := range unpackedPackages {
+			i := i
+			unpacked := unpacked
 
-				return "", nil, fmt.Errorf("failed to open control archive file: %w", err)
-			}
+			g.Go(func() error {
+				defer bar.Increment()
 
-			pkg, err := extractControlArchive(dpkgDatabaseFS, controlArchiveFile)
-			_ = controlArchiveFile.Close()
-			if err != nil {
-				bar.Abort(true)
-				bar.Wait()
+				if err := writePackageMetadata(dpkgDatabaseFS, unpacked); err != nil {
+					return fmt.Errorf("failed to write metadata for package %s: %w", unpacked.pkg.Name, err)
+				}
 
-				return "", nil, fmt.Errorf("failed to extract control archive: %w", err)
-			}
+				dataArchivePaths[i] = unpacked.dataArchivePath
 
-			pkg.Status = []string{"install", "ok", "unpacked"}
-			packages = append(packages, *pkg)
+				return nil
+			})
+		}
 
-			// Get the list of files in the data archive.
-			dataArchiveFile, err := os.Open(dataArchivePaths[i])
-			if err != nil {
-				bar.Abort(true)
-				bar.Wait()
+		err := g.Wait()
 
-				return "", nil, fmt.Errorf("failed to open data archive file: %w", err)
-			}
+		if err != nil {
+			bar.Abort(true)
+		} else {
+			bar.SetTotal(bar.Current(), true)
+		}
+		bar.Wait()
 
-			filesList, err := getDataArchiveFileList(dataArchiveFile)
-			_ = dataArchiveFile.Close()
-			if err != nil {
-				bar.Abort(true)
-				bar.Wait()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to extract packages: %w", err)
+		}
+	}
 
-				return "", nil, fmt.Errorf("failed to get data archive file list: %w", err)
-			}
+	// Sort the status file entries, so that the database is independent of the
+	// order the packages were provided in.
+	packages := make([]types.Package, len(unpackedPackages))
+	for i, unpacked := range unpackedPackages {
+		packages[i] = unpacked.pkg
+		packages[i].Status = []string{"install", "ok", "unpacked"}
+	}
 
-			if len(filesList) > 0 {
-				// Write the files list to the dpkg info directory.
-				filesListPath := filepath.Join("var/lib/dpkg/info", fmt.Sprintf("%s.list", pkg.Name))
-				if err := dpkgDatabaseFS.WriteFile(filesListPath, []byte(strings.Join(filesList, "\n")+"\n"), 0o644); err != nil {
-					bar.Abort(true)
-					bar.Wait()
+	slices.SortFunc(packages, func(a, b types.Package) int {
+		if cmp := a.Compare(b); cmp != 0 {
+			return cmp
+		}
 
-					return "", nil, fmt.Errorf("failed to write files list: %w", err)
-				}
-			}
+		return strings.Compare(a.Architecture.String(), b.Architecture.String())
+	})
 
-			bar.Increment()
-		}
+	// Write the dpkg diversions database.
+	if err := dpkgDatabaseFS.WriteFile("var/lib/dpkg/diversions", diversionsDatabase(opts.Diversions), 0o644); err != nil {
+		return "", nil, fmt.Errorf("failed to write dpkg diversions file: %w", err)
 	}
 
 	// Write the dpkg status file.
@@ -195,192 +225,332 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 	return dpkgDatabaseArchiveFile.Name(), dataArchivePaths, nil
 }
 
-func decompressPackage(tempDir string, packagePath string) (string, string, error) {
-	pf, err := os.Open(packagePath)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to open package file: %w", err)
-	}
-	defer pf.Close()
+// writePackageMetadata writes the control files and the files list of a
+// package to the dpkg info directory.
+func writePackageMetadata(dpkgDatabaseFS *memfs.FS, unpacked *unpackedPackage) error {
+	slog.Debug("Writing package metadata", slog.String("name", unpacked.pkg.Name))
 
-	debFS, err := arfs.Open(pf)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to parse debian package: %w", err)
-	}
-
-	// Check that the package is a debian 2.0 format package.
-	debianBinaryFile, err := debFS.Open("debian-binary")
-	if err != nil {
-		return "", "", fmt.Errorf("failed to open debian-binary file: %w", err)
+	for _, controlFile := range unpacked.controlFiles {
+		if err := dpkgDatabaseFS.WriteFile(filepath.Join("var/lib/dpkg/info", fmt.Sprintf("%s.%s", unpacked.pkg.Name, controlFile.name)),
+			controlFile.content, controlFile.mode); err != nil {
+			return fmt.Errorf("failed to write file in control archive: %w", err)
+		}
 	}
 
-	debianBinary, err := io.ReadAll(debianBinaryFile)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to read debian-binary file: %w", err)
-	}
+	if len(unpacked.filesList) > 0 {
+		// Write the files list to the dpkg info directory (in the same format as
+		// dpkg, eg. absolute paths, starting with the root directory).
+		var filesList strings.Builder
+		filesList.WriteString("/.\n")
+		for _, name := range unpacked.filesList {
+			filesList.WriteString("/" + name + "\n")
+		}
 
-	if string(debianBinary) != "2.0\n" {
-		return "", "", fmt.Errorf("unsupported debian package version: %s", debianBinary)
+		filesListPath := filepath.Join("var/lib/dpkg/info", fmt.Sprintf("%s.list", unpacked.pkg.Name))
+		if err := dpkgDatabaseFS.WriteFile(filesListPath, []byte(filesList.String()), 0o644); err != nil {
+			return fmt.Errorf("failed to write files list: %w", err)
+		}
 	}
 
-	// Look for control and data archives in the debian package.
-	entries, err := debFS.ReadDir(".")
-	if err != nil {
-		return "", "", fmt.Errorf("failed to read debian package: %w", err)
-	}
+	return nil
+}
 
-	var controlArchivePath, dataArchivePath string
-	for _, entry := range entries {
-		if strings.HasPrefix(entry.Name(), "control.tar") {
-			controlArchivePath = entry.Name()
-		} else if strings.HasPrefix(entry.Name(), "data.tar") {
-			dataArchivePath = entry.Name()
-		}
-	}
-	if controlArchivePath == "" {
-		return "", "", fmt.Errorf("failed to find control archive in debian package")
-	}
-	if dataArchivePath == "" {
-		return "", "", fmt.Errorf("failed to find data archive in debian package")
-	}
+// unpackedPackage is the result of reading a package.
+type unpackedPackage struct {
+	// pkg is the parsed control file.
+	pkg types.Package
+	// controlFiles are the remaining files in the control archive (eg.
+	// maintainer scripts).
+	controlFiles []controlFile
+	// filesList is the list of paths in the data archive.
+	filesList []string
+	// md5sums are the MD5 checksums of the regular files in the data archive.
+	md5sums map[string]string
+	// diverted maps the paths in the data archive that have been diverted to
+	// the paths they were diverted to.
+	diverted map[string]string
+	// dataArchivePath is the path to the decompressed data archive.
+	dataArchivePath string
+}
 
-	// Decompress the control archive.
-	slog.Debug("Decompressing control archive",
-		slog.String("packagePath", packagePath),
-		slog.String("controlArchivePath", filepath.Base(controlArchivePath)))
+type controlFile struct {
+	name    string
+	mode    fs.FileMode
+	content []byte
+}
 
-	controlArchive, err := debFS.Open(controlArchivePath)
+// unpackPackage reads a package in a single pass. The control archive is read
+// into memory, and the data archive is decompressed into tempDir while its
+// file list is collected.
+func unpackPackage(tempDir string, packagePath string, diversions []Diversion) (*unpackedPackage, error) {
+	pf, err := os.Open(packagePath)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to open control archive: %w", err)
+		return nil, fmt.Errorf("failed to open package file: %w", err)
 	}
+	defer pf.Close()
 
-	dr, err := uncompr.NewReader(controlArchive)
+	debArchive, err := deb.Open(pf)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to decompress control archive: %w", err)
+		return nil, err
 	}
 
-	decompressedControlArchivePath := filepath.Join(tempDir, strings.TrimSuffix(filepath.Base(packagePath), ".deb")+"_control.tar")
+	slog.Debug("Reading control archive",
+		slog.String("packagePath", packagePath),
+		slog.String("controlArchivePath", debArchive.ControlArchiveName()))
 
-	decompressedControlArchive, err := os.Create(decompressedControlArchivePath)
+	controlArchive, err := debArchive.ControlArchive()
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create decompressed control archive: %w", err)
+		return nil, fmt.Errorf("failed to open control archive: %w", err)
 	}
-	defer decompressedControlArchive.Close()
+	defer controlArchive.Close()
 
-	if _, err := io.Copy(decompressedControlArchive, dr); err != nil {
-		return "", "", fmt.Errorf("failed to write to decompressed control archive: %w", err)
+	pkg, controlFiles, err := readControlArchive(controlArchive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read control archive: %w", err)
 	}
 
-	// Decompress the data archive.
 	slog.Debug("Decompressing data archive",
 		slog.String("packagePath", packagePath),
-		slog.String("dataArchivePath", filepath.Base(dataArchivePath)))
+		slog.String("dataArchivePath", debArchive.DataArchiveName()))
 
-	dataArchive, err := debFS.Open(dataArchivePath)
+	dataArchive, err := debArchive.DataArchive()
 	if err != nil {
-		return "", "", fmt.Errorf("failed to open data archive: %w", err)
+		return nil, fmt.Errorf("failed to open data archive: %w", err)
 	}
+	defer dataArchive.Close()
+
+	decompressedDataArchivePath := filepath.Join(tempDir, strings.TrimSuffix(filepath.Base(packagePath), ".deb")+"_data.tar")
 
-	dr, err = uncompr.NewReader(dataArchive)
+	decompressedDataArchive, err := os.Create(decompressedDataArchivePath)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to decompress data archive: %w", err)
+		return nil, fmt.Errorf("failed to create decompressed data archive: %w", err)
 	}
+	defer decompressedDataArchive.Close()
 
-	decompressedDataArchivePath := filepath.Join(tempDir, strings.TrimSuffix(filepath.Base(packagePath), ".deb")+"_data.tar")
+	diverted := divertedPaths(diversions, pkg.Name)
 
-	decompressedDataArchive, err := os.Create(decompressedDataArchivePath)
+	filesList, md5sums, err := readDataArchive(dataArchive, decompressedDataArchive, diverted)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create decompressed data archive: %w", err)
+		return nil, fmt.Errorf("failed to read data archive: %w", err)
 	}
 
-	if _, err := io.Copy(decompressedDataArchive, dr); err != nil {
-		return "", "", fmt.Errorf("failed to write to decompressed data archive: %w", err)
+	if err := decompressedDataArchive.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close decompressed data archive: %w", err)
 	}
 
-	return decompressedControlArchivePath, decompressedDataArchivePath, nil
-}
+	unpacked := &unpackedPackage{
+		pkg:             *pkg,
+		controlFiles:    controlFiles,
+		filesList:       filesList,
+		md5sums:         md5sums,
+		diverted:        diverted,
+		dataArchivePath: decompressedDataArchivePath,
+	}
 
-func extractControlArchive(dpkgDatabaseFS *memfs.FS, controlArchiveFile *os.File) (*types.Package, error) {
-	controlFS, err := tarfs.Open(controlArchiveFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open control archive: %w", err)
+	if err := generateDpkgMetadata(unpacked); err != nil {
+		return nil, err
 	}
 
-	controlFile, err := controlFS.Open("control")
-	if err != nil {
-		return nil, fmt.Errorf("failed to open control file: %w", err)
+	return unpacked, nil
+}
+
+// generateDpkgMetadata populates the Conffiles field of the package, and
+// generates a md5sums file for packages that do not ship one.
+func generateDpkgMetadata(unpacked *unpackedPackage) error {
+	conffiles := map[string]bool{}
+	hasMD5Sums := false
+
+	for _, controlFile := range unpacked.controlFiles {
+		switch controlFile.name {
+		case "conffiles":
+			for _, line := range strings.Split(string(controlFile.content), "\n") {
+				// Skip empty lines and conffiles with flags (eg. remove-on-upgrade),
+				// which are not shipped in the data archive.
+				name := strings.TrimSpace(line)
+				if !strings.HasPrefix(name, "/") {
+					continue
+				}
+
+				md5sum, ok := unpacked.md5sums[strings.TrimPrefix(name, "/")]
+				if !ok {
+					return fmt.Errorf("conffile %s not found in data archive", name)
+				}
+
+				conffiles[strings.TrimPrefix(name, "/")] = true
+				unpacked.pkg.Conffiles = append(unpacked.pkg.Conffiles, name+" "+md5sum)
+			}
+		case "md5sums":
+			hasMD5Sums = true
+		}
 	}
-	defer controlFile.Close()
 
-	// Parse the control file.
-	decoder, err := deb822.NewDecoder(controlFile, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create control file decoder: %w", err)
+	if hasMD5Sums {
+		return nil
 	}
 
-	var pkg types.Package
-	if err := decoder.Decode(&pkg); err != nil {
-		return nil, fmt.Errorf("failed to decode control file: %w", err)
+	// Like dh_md5sums, conffiles are not included.
+	var md5sums strings.Builder
+	for _, name := range unpacked.filesList {
+		if md5sum, ok := unpacked.md5sums[name]; ok && !conffiles[name] {
+			fmt.Fprintf(&md5sums, "%s  %s\n", md5sum, name)
+		}
 	}
 
-	files, err := controlFS.ReadDir(".")
-	if err != nil {
-		return nil, fmt.Errorf("failed to read control archive: %w", err)
+	if md5sums.Len() > 0 {
+		unpacked.controlFiles = append(unpacked.controlFiles, controlFile{
+			name:    "md5sums",
+			mode:    0o644,
+			content: []byte(md5sums.String()),
+		})
 	}
 
-	// Iterate over the files in the control archive and add relevant files to the dpkg database.
-	for _, file := range files {
-		if file.Name() == "control" {
+	return nil
+}
+
+// readControlArchive parses the control file and reads the remaining files
+// from the control archive.
+func readControlArchive(r io.Reader) (*types.Package, []controlFile, error) {
+	var pkg *types.Package
+	var controlFiles []controlFile
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, nil, err
+		}
+
+		// Only regular files in the root of the control archive are relevant.
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || strings.Contains(name, "/") {
 			continue
 		}
 
-		f, err := controlFS.Open(file.Name())
-		if err != nil {
-			return nil, fmt.Errorf("failed to open file in control archive: %w", err)
+		if name == "control" {
+			// Parse the control file.
+			decoder, err := deb822.NewDecoder(tr, nil)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to create control file decoder: %w", err)
+			}
+
+			pkg = &types.Package{}
+			if err := decoder.Decode(pkg); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode control file: %w", err)
+			}
+
+			continue
 		}
 
-		content, err := io.ReadAll(f)
-		_ = f.Close()
+		content, err := io.ReadAll(tr)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read file from control archive: %w", err)
+			return nil, nil, fmt.Errorf("failed to read %s: %w", name, err)
 		}
 
-		fi, err := f.Stat()
+		controlFiles = append(controlFiles, controlFile{
+			name:    name,
+			mode:    hdr.FileInfo().Mode(),
+			content: content,
+		})
+	}
+
+	if pkg == nil {
+		return nil, nil, errors.New("failed to find control file")
+	}
+
+	return pkg, controlFiles, nil
+}
+
+// readDataArchive reads the data archive to the end, returning the list of
+// paths it contains (including implied parent directories) in walk order, and
+// the MD5 checksums of the regular files (including hard links).
+// The archive is copied to w, with any diverted paths renamed.
+func readDataArchive(r io.Reader, w io.Writer, diverted map[string]string) ([]string, map[string]string, error) {
+	paths := map[string]bool{}
+	md5sums := map[string]string{}
+
+	// Only rewrite the archive if there are diversions that could apply to it.
+	var tw *tar.Writer
+	if len(diverted) > 0 {
+		tw = tar.NewWriter(w)
+	} else {
+		r = io.TeeReader(r, w)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
 		if err != nil {
-			return nil, fmt.Errorf("failed to get file info from control archive: %w", err)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, nil, err
 		}
 
-		if err := dpkgDatabaseFS.WriteFile(filepath.Join("var/lib/dpkg/info", fmt.Sprintf("%s.%s", pkg.Name, file.Name())),
-			content, fi.Mode()); err != nil {
-			return nil, fmt.Errorf("failed to write file in control archive: %w", err)
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+
+		var content io.Reader = tr
+		if tw != nil {
+			if divertTo, ok := diverted[name]; ok {
+				hdr.Name = "./" + divertTo
+			}
+
+			if hdr.Typeflag == tar.TypeLink {
+				if divertTo, ok := diverted[path.Clean(strings.TrimPrefix(hdr.Linkname, "/"))]; ok {
+					hdr.Linkname = "./" + divertTo
+				}
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return nil, nil, fmt.Errorf("failed to write %s: %w", name, err)
+			}
+
+			content = io.TeeReader(tr, tw)
 		}
-	}
 
-	return &pkg, nil
-}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			h := md5.New()
+			if _, err := io.Copy(h, content); err != nil {
+				return nil, nil, fmt.Errorf("failed to read %s: %w", name, err)
+			}
 
-func getDataArchiveFileList(dataArchiveFile *os.File) ([]string, error) {
-	// Open the data archive as a tar archive.
-	dataFS, err := tarfs.Open(dataArchiveFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open data archive: %w", err)
+			md5sums[name] = hex.EncodeToString(h.Sum(nil))
+		case tar.TypeLink:
+			if md5sum, ok := md5sums[path.Clean(strings.TrimPrefix(hdr.Linkname, "/"))]; ok {
+				md5sums[name] = md5sum
+			}
+		}
+
+		for ; name != "." && name != "/"; name = path.Dir(name) {
+			paths[name] = true
+		}
 	}
 
-	var filesList []string
-	err = fs.WalkDir(dataFS, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+	if tw != nil {
+		if err := tw.Close(); err != nil {
+			return nil, nil, err
 		}
-		if path == "." {
-			return nil
+	} else {
+		// Consume any trailing padding, so that the archive is copied in full.
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, nil, err
 		}
+	}
 
-		filesList = append(filesList, path)
+	filesList := make([]string, 0, len(paths))
+	for name := range paths {
+		filesList = append(filesList, name)
+	}
 
-		return nil
+	// Sort by path component (eg. "a", "a/b", "a-b"), to match fs.WalkDir.
+	slices.SortFunc(filesList, func(a, b string) int {
+		return slices.Compare(strings.Split(a, "/"), strings.Split(b, "/"))
 	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to walk data archive: %w", err)
-	}
 
-	return filesList, nil
+	return filesList, md5sums, nil
 }
@@ -17,14 +17,27 @@
 package unpack_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/dpeckett/deb822"
 	"github.com/immutos/immutos/internal/testutil"
+	"github.com/immutos/immutos/internal/types"
 	"github.com/immutos/immutos/internal/unpack"
 	"github.com/stretchr/testify/require"
 )
@@ -41,13 +54,28 @@ func TestUnpack(t *testing.T) {
 		filepath.Join(testutil.Root(), "testdata/debs/base-passwd_3.6.1_amd64.deb"),
 	}
 
-	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths)
+	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths, nil)
 	require.NoError(t, err)
 
 	require.Len(t, dataArchivePaths, 2)
 	require.Equal(t, "base-files_12.4+deb12u5_amd64_data.tar", filepath.Base(dataArchivePaths[0]))
 	require.Equal(t, "base-passwd_3.6.1_amd64_data.tar", filepath.Base(dataArchivePaths[1]))
 
+	// Only the data archives (and the dpkg database) should be written to disk.
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+
+	var tempFiles []string
+	for _, entry := range entries {
+		tempFiles = append(tempFiles, entry.Name())
+	}
+
+	require.ElementsMatch(t, []string{
+		"base-files_12.4+deb12u5_amd64_data.tar",
+		"base-passwd_3.6.1_amd64_data.tar",
+		"dpkg_database.tar",
+	}, tempFiles)
+
 	dpkgDatabaseArchiveFile, err := os.Open(dpkgDatabaseArchivePath)
 	require.NoError(t, err)
 	t.Cleanup(func() {
@@ -75,6 +103,7 @@ func TestUnpack(t *testing.T) {
 		"var",
 		"var/lib",
 		"var/lib/dpkg",
+		"var/lib/dpkg/diversions",
 		"var/lib/dpkg/info",
 		"var/lib/dpkg/info/base-files.conffiles",
 		"var/lib/dpkg/info/base-files.list",
@@ -90,4 +119,333 @@ func TestUnpack(t *testing.T) {
 	}
 
 	require.ElementsMatch(t, expectedFilesList, filesList)
+
+	filesListData, err := fs.ReadFile(tarFS, "var/lib/dpkg/info/base-files.list")
+	require.NoError(t, err)
+
+	require.True(t, strings.HasPrefix(string(filesListData), "/.\n/bin\n/boot\n"))
+
+	statusFile, err := tarFS.Open("var/lib/dpkg/status")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, statusFile.Close())
+	})
+
+	decoder, err := deb822.NewDecoder(statusFile, nil)
+	require.NoError(t, err)
+
+	var packages []types.Package
+	require.NoError(t, decoder.Decode(&packages))
+
+	require.Len(t, packages, 2)
+	require.Equal(t, "base-files", packages[0].Name)
+	require.Contains(t, []string(packages[0].Conffiles), "/etc/debian_version 0900545d517886d6e52125fc9ed787a5")
+	require.Empty(t, packages[1].Conffiles)
+}
+
+func TestUnpackDeterministic(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	packagesDir := t.TempDir()
+
+	var packagePaths []string
+	for i := 0; i < 20; i++ {
+		packagePaths = append(packagePaths, writeTestPackage(t, packagesDir, fmt.Sprintf("package%d", i), "", nil))
+	}
+
+	dpkgDatabaseArchivePath, _, err := unpack.Unpack(ctx, t.TempDir(), packagePaths, nil)
+	require.NoError(t, err)
+
+	expected, err := os.ReadFile(dpkgDatabaseArchivePath)
+	require.NoError(t, err)
+
+	// The dpkg database should not depend on the order of the packages.
+	slices.Reverse(packagePaths)
+
+	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, t.TempDir(), packagePaths, nil)
+	require.NoError(t, err)
+
+	actual, err := os.ReadFile(dpkgDatabaseArchivePath)
+	require.NoError(t, err)
+
+	require.Equal(t, expected, actual)
+
+	// But the data archives should be layered in the order provided.
+	require.Equal(t, "package19_1.0_amd64_data.tar", filepath.Base(dataArchivePaths[0]))
+
+	// Packages without md5sums should have them generated.
+	dpkgDatabaseArchiveFile, err := os.Open(dpkgDatabaseArchivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dpkgDatabaseArchiveFile.Close())
+	})
+
+	tarFS, err := tarfs.Open(dpkgDatabaseArchiveFile)
+	require.NoError(t, err)
+
+	md5sums, err := fs.ReadFile(tarFS, "var/lib/dpkg/info/package0.md5sums")
+	require.NoError(t, err)
+
+	sum := md5.Sum([]byte("package0 file 0\n"))
+	require.Contains(t, string(md5sums), hex.EncodeToString(sum[:])+"  usr/share/package0/file0\n")
+}
+
+func TestUnpackOverlaps(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	packagesDir := t.TempDir()
+
+	t.Run("Conflict", func(t *testing.T) {
+		packagePaths := []string{
+			writeTestPackage(t, packagesDir, "conflict-a", "", map[string]string{"usr/bin/foo": "a"}),
+			writeTestPackage(t, packagesDir, "conflict-b", "", map[string]string{"usr/bin/foo": "b"}),
+		}
+
+		_, _, err := unpack.Unpack(ctx, t.TempDir(), packagePaths, nil)
+		require.Error(t, err)
+
+		var overlapErr *unpack.OverlapError
+		require.True(t, errors.As(err, &overlapErr))
+		require.Equal(t, []unpack.Overlap{{
+			Path:     "/usr/bin/foo",
+			Packages: []string{"conflict-a", "conflict-b"},
+		}}, overlapErr.Overlaps)
+	})
+
+	t.Run("Replaces", func(t *testing.T) {
+		packagePaths := []string{
+			writeTestPackage(t, packagesDir, "replaces-new", "Replaces: replaces-old (<< 2.0)\n", map[string]string{"usr/bin/bar": "new"}),
+			writeTestPackage(t, packagesDir, "replaces-old", "", map[string]string{"usr/bin/bar": "old", "usr/bin/baz": "old"}),
+		}
+
+		dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, t.TempDir(), packagePaths, nil)
+		require.NoError(t, err)
+
+		// The replacing package must be applied last.
+		require.Equal(t, "replaces-old_1.0_amd64_data.tar", filepath.Base(dataArchivePaths[0]))
+		require.Equal(t, "replaces-new_1.0_amd64_data.tar", filepath.Base(dataArchivePaths[1]))
+
+		dpkgDatabaseArchiveFile, err := os.Open(dpkgDatabaseArchivePath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, dpkgDatabaseArchiveFile.Close())
+		})
+
+		tarFS, err := tarfs.Open(dpkgDatabaseArchiveFile)
+		require.NoError(t, err)
+
+		// And the replaced package no longer owns the file.
+		filesList, err := fs.ReadFile(tarFS, "var/lib/dpkg/info/replaces-old.list")
+		require.NoError(t, err)
+		require.Equal(t, "/.\n/usr\n/usr/bin\n/usr/bin/baz\n", string(filesList))
+	})
+
+	t.Run("Allowed", func(t *testing.T) {
+		packagePaths := []string{
+			writeTestPackage(t, packagesDir, "allowed-b", "", map[string]string{"usr/share/doc/README": "b"}),
+			writeTestPackage(t, packagesDir, "allowed-a", "", map[string]string{"usr/share/doc/README": "a", "usr/share/doc/a": "a"}),
+		}
+
+		dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, t.TempDir(), packagePaths, &unpack.Options{
+			AllowedOverlaps: []string{"/usr/share/doc/*"},
+		})
+		require.NoError(t, err)
+
+		// The last package by name wins, regardless of the order provided.
+		require.Equal(t, "allowed-a_1.0_amd64_data.tar", filepath.Base(dataArchivePaths[0]))
+		require.Equal(t, "allowed-b_1.0_amd64_data.tar", filepath.Base(dataArchivePaths[1]))
+
+		dpkgDatabaseArchiveFile, err := os.Open(dpkgDatabaseArchivePath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, dpkgDatabaseArchiveFile.Close())
+		})
+
+		tarFS, err := tarfs.Open(dpkgDatabaseArchiveFile)
+		require.NoError(t, err)
+
+		filesList, err := fs.ReadFile(tarFS, "var/lib/dpkg/info/allowed-a.list")
+		require.NoError(t, err)
+		require.Equal(t, "/.\n/usr\n/usr/share\n/usr/share/doc\n/usr/share/doc/a\n", string(filesList))
+
+		// Nor should the replaced file be verified against the losing package.
+		md5sums, err := fs.ReadFile(tarFS, "var/lib/dpkg/info/allowed-a.md5sums")
+		require.NoError(t, err)
+		require.NotContains(t, string(md5sums), "usr/share/doc/README")
+		require.Contains(t, string(md5sums), "usr/share/doc/a")
+	})
+
+	t.Run("Allowed Recursive", func(t *testing.T) {
+		packagePaths := []string{
+			writeTestPackage(t, packagesDir, "recursive-a", "", map[string]string{"usr/share/doc/pkg/changelog.gz": "a"}),
+			writeTestPackage(t, packagesDir, "recursive-b", "", map[string]string{"usr/share/doc/pkg/changelog.gz": "b"}),
+		}
+
+		// A single level wildcard doesn't match nested files.
+		_, _, err := unpack.Unpack(ctx, t.TempDir(), packagePaths, &unpack.Options{
+			AllowedOverlaps: []string{"/usr/share/doc/*"},
+		})
+		require.Error(t, err)
+
+		_, dataArchivePaths, err := unpack.Unpack(ctx, t.TempDir(), packagePaths, &unpack.Options{
+			AllowedOverlaps: []string{"/usr/share/doc/**"},
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, "recursive-a_1.0_amd64_data.tar", filepath.Base(dataArchivePaths[0]))
+		require.Equal(t, "recursive-b_1.0_amd64_data.tar", filepath.Base(dataArchivePaths[1]))
+	})
+}
+
+func TestUnpackDiversions(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	packagesDir := t.TempDir()
+
+	packagePaths := []string{
+		writeTestPackage(t, packagesDir, "editor-a", "", map[string]string{"usr/bin/editor": "a"}),
+		writeTestPackage(t, packagesDir, "editor-b", "", map[string]string{"usr/bin/editor": "b"}),
+	}
+
+	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, t.TempDir(), packagePaths, &unpack.Options{
+		Diversions: []unpack.Diversion{{
+			Path:     "/usr/bin/editor",
+			DivertTo: "/usr/bin/editor.a",
+			Package:  "editor-b",
+		}},
+	})
+	require.NoError(t, err)
+
+	// The file shipped by editor-a should be diverted.
+	dataArchiveFile, err := os.Open(dataArchivePaths[0])
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dataArchiveFile.Close())
+	})
+
+	dataFS, err := tarfs.Open(dataArchiveFile)
+	require.NoError(t, err)
+
+	content, err := fs.ReadFile(dataFS, "usr/bin/editor.a")
+	require.NoError(t, err)
+	require.Equal(t, "a", string(content))
+
+	_, err = fs.Stat(dataFS, "usr/bin/editor")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	dpkgDatabaseArchiveFile, err := os.Open(dpkgDatabaseArchivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dpkgDatabaseArchiveFile.Close())
+	})
+
+	tarFS, err := tarfs.Open(dpkgDatabaseArchiveFile)
+	require.NoError(t, err)
+
+	diversions, err := fs.ReadFile(tarFS, "var/lib/dpkg/diversions")
+	require.NoError(t, err)
+	require.Equal(t, "/usr/bin/editor\n/usr/bin/editor.a\neditor-b\n", string(diversions))
+
+	// The files list still records the original path.
+	filesList, err := fs.ReadFile(tarFS, "var/lib/dpkg/info/editor-a.list")
+	require.NoError(t, err)
+	require.Equal(t, "/.\n/usr\n/usr/bin\n/usr/bin/editor\n", string(filesList))
+}
+
+func BenchmarkUnpack(b *testing.B) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	ctx := context.Background()
+
+	packagesDir := b.TempDir()
+
+	var packagePaths []string
+	for i := 0; i < 300; i++ {
+		packagePaths = append(packagePaths, writeTestPackage(b, packagesDir, fmt.Sprintf("package%d", i), "", nil))
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, _, err := unpack.Unpack(ctx, b.TempDir(), packagePaths, nil)
+		require.NoError(b, err)
+	}
+}
+
+// writeTestPackage writes a minimal Debian package containing the given files
+// (or a handful of generated ones if nil). Additional control fields can be
+// provided in extraFields.
+func writeTestPackage(t testing.TB, dir, name, extraFields string, dataFiles map[string]string) string {
+	if dataFiles == nil {
+		dataFiles = map[string]string{}
+		for i := 0; i < 50; i++ {
+			dataFiles[fmt.Sprintf("usr/share/%s/file%d", name, i)] = fmt.Sprintf("%s file %d\n", name, i)
+		}
+	}
+
+	control := fmt.Sprintf("Package: %s\nVersion: 1.0\nArchitecture: amd64\nMaintainer: Test <test@example.com>\n%sDescription: Test package\n", name, extraFields)
+
+	controlArchive := createTarGz(t, map[string]string{
+		"control":  control,
+		"postinst": "#!/bin/sh\nexit 0\n",
+	})
+
+	dataArchive := createTarGz(t, dataFiles)
+
+	var buf bytes.Buffer
+	buf.WriteString("!<arch>\n")
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlArchive},
+		{"data.tar.gz", dataArchive},
+	} {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", member.name, 0, 0, 0, "100644", len(member.data))
+		buf.Write(member.data)
+		if len(member.data)%2 != 0 {
+			buf.WriteByte('\n')
+		}
+	}
+
+	packagePath := filepath.Join(dir, fmt.Sprintf("%s_1.0_amd64.deb", name))
+	require.NoError(t, os.WriteFile(packagePath, buf.Bytes(), 0o644))
+
+	return packagePath
+}
+
+func createTarGz(t testing.TB, files map[string]string) []byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+
+	for _, name := range names {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "./" + name,
+			Mode:     0o644,
+			Size:     int64(len(files[name])),
+		}))
+
+		_, err := tw.Write([]byte(files[name]))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	return buf.Bytes()
 }
@@ -22,36 +22,54 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime"
 	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/adrg/xdg"
 	"github.com/containerd/containerd/platforms"
+	"github.com/docker/go-units"
 	"github.com/dpeckett/deb822/types/arch"
 	"github.com/dpeckett/telemetry"
 	"github.com/dpeckett/telemetry/v1alpha1"
 	"github.com/gregjones/httpcache"
+	"github.com/immutos/immutos/internal/builder"
+	"github.com/immutos/immutos/internal/builder/native"
 	"github.com/immutos/immutos/internal/buildkit"
 	"github.com/immutos/immutos/internal/constants"
 	"github.com/immutos/immutos/internal/database"
+	"github.com/immutos/immutos/internal/debsig"
+	"github.com/immutos/immutos/internal/disk"
+	"github.com/immutos/immutos/internal/download"
+	"github.com/immutos/immutos/internal/fsimage"
+	"github.com/immutos/immutos/internal/keyring"
+	"github.com/immutos/immutos/internal/layers"
+	"github.com/immutos/immutos/internal/manifest"
+	"github.com/immutos/immutos/internal/offline"
+	"github.com/immutos/immutos/internal/pkgstore"
 	"github.com/immutos/immutos/internal/recipe"
 	latestrecipe "github.com/immutos/immutos/internal/recipe/v1alpha1"
+	"github.com/immutos/immutos/internal/repository"
 	"github.com/immutos/immutos/internal/resolve"
 	"github.com/immutos/immutos/internal/secondstage"
+	"github.com/immutos/immutos/internal/secondstage/configure"
 	"github.com/immutos/immutos/internal/source"
 	"github.com/immutos/immutos/internal/types"
 	"github.com/immutos/immutos/internal/unpack"
 	"github.com/immutos/immutos/internal/util"
 	"github.com/immutos/immutos/internal/util/diskcache"
-	"github.com/immutos/immutos/internal/util/hashreader"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	cp "github.com/otiai10/copy"
 	"github.com/urfave/cli/v2"
 	"github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
@@ -59,6 +77,14 @@ import (
 )
 
 func main() {
+	// Assemble a root filesystem, if re-executed by the native builder.
+	native.Init()
+
+	// Support local (file://) repositories.
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	}
+
 	defaultCacheDir, _ := xdg.CacheFile("immutos")
 	defaultStateDir, _ := xdg.StateFile("immutos")
 
@@ -116,10 +142,37 @@ func main() {
 		return nil
 	}
 
+	initHTTPClient := func(c *cli.Context) error {
+		// Cache all HTTP responses on disk.
+		cache, err := diskcache.NewDiskCache(c.String("cache-dir"), "http")
+		if err != nil {
+			return fmt.Errorf("failed to create disk cache: %w", err)
+		}
+
+		// Use the disk cache for all HTTP requests.
+		http.DefaultClient = &http.Client{
+			Transport: httpcache.NewTransport(cache),
+		}
+
+		// When offline, never go to the network, serve everything from the cache.
+		if c.Bool("offline") {
+			http.DefaultClient = &http.Client{
+				Transport: offline.NewTransport(cache),
+			}
+		}
+
+		return nil
+	}
+
 	// Collect anonymized usage statistics.
 	var telemetryReporter *telemetry.Reporter
 
 	initTelemetry := func(c *cli.Context) error {
+		// Don't attempt to contact the telemetry server when offline.
+		if c.Bool("offline") {
+			return nil
+		}
+
 		telemetryReporter = telemetry.NewReporter(c.Context, slog.Default(), telemetry.Configuration{
 			BaseURL: constants.TelemetryURL,
 			Tags:    []string{"immutos"},
@@ -181,7 +234,7 @@ func main() {
 					&cli.StringFlag{
 						Name:    "output",
 						Aliases: []string{"o"},
-						Usage:   "Output OCI image archive",
+						Usage:   "Output OCI image archive, or 'type=oci|docker|tar|local|raw|qcow2|squashfs|erofs|cpio|sysext|portable,dest=<path>[,compression=<algorithm>][,filesystem=erofs|squashfs][,base=<recipe>]'",
 						Value:   "debian-image.tar",
 					},
 					&cli.StringFlag{
@@ -196,23 +249,97 @@ func main() {
 						Usage:   "Name and optionally a tag for the image in the 'name:tag' format",
 						Value:   cli.NewStringSlice(),
 					},
+					&cli.StringSliceFlag{
+						Name:  "push",
+						Usage: "Push the image to a registry in the 'registry/name:tag' format (instead of writing an archive)",
+						Value: cli.NewStringSlice(),
+					},
 					&cli.BoolFlag{
 						Name:  "dev",
 						Usage: "Enable development mode",
 					},
+					&cli.BoolFlag{
+						Name:  "offline",
+						Usage: "Build exclusively from the local cache, without accessing the network",
+					},
+					&cli.StringFlag{
+						Name:  "manifest",
+						Usage: "Directory to write a copy of the build manifest(s) to",
+					},
+					&cli.StringFlag{
+						Name:  "builder",
+						Usage: "Image builder to use (buildkit or native)",
+						Value: "buildkit",
+					},
+					&cli.StringFlag{
+						Name:    "buildkit-addr",
+						Usage:   "Address of an existing BuildKit daemon (unix://, tcp://, or docker-container://), instead of starting one",
+						EnvVars: []string{"BUILDKIT_HOST"},
+					},
+					&cli.StringFlag{
+						Name:  "buildkit-tls-ca",
+						Usage: "CA certificate for verifying an existing BuildKit daemon (tcp:// only)",
+					},
+					&cli.StringFlag{
+						Name:  "buildkit-tls-cert",
+						Usage: "Client certificate for connecting to an existing BuildKit daemon (tcp:// only)",
+					},
+					&cli.StringFlag{
+						Name:  "buildkit-tls-key",
+						Usage: "Client key for connecting to an existing BuildKit daemon (tcp:// only)",
+					},
+					&cli.StringFlag{
+						Name:  "buildkit-tls-server-name",
+						Usage: "Expected server name of an existing BuildKit daemon (tcp:// only)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "cache-from",
+						Usage: "Import the BuildKit cache from 'type=local,src=<dir>' or 'type=registry,ref=<ref>' (or a registry reference)",
+						Value: cli.NewStringSlice(),
+					},
+					&cli.StringFlag{
+						Name:  "cache-to",
+						Usage: "Export the BuildKit cache to 'type=local,dest=<dir>[,mode=min|max]' or 'type=registry,ref=<ref>[,mode=min|max]' (or a registry reference)",
+					},
 				}, persistentFlags...),
-				Before: util.BeforeAll(initLogger, initCacheDir, initStateDir, initTelemetry),
+				Before: util.BeforeAll(initLogger, initCacheDir, initStateDir, initHTTPClient, initTelemetry),
 				After:  shutdownTelemetry,
 				Action: func(c *cli.Context) error {
-					// Cache all HTTP responses on disk.
-					cache, err := diskcache.NewDiskCache(c.String("cache-dir"), "http")
+					// Store downloaded packages in a content-addressed store shared across builds.
+					store, err := pkgstore.Open(filepath.Join(c.String("cache-dir"), "packages"))
+					if err != nil {
+						return fmt.Errorf("failed to open package store: %w", err)
+					}
+
+					output, err := builder.ParseOutput(c.String("output"))
 					if err != nil {
-						return fmt.Errorf("failed to create disk cache: %w", err)
+						return fmt.Errorf("failed to parse output: %w", err)
+					}
+
+					// Pushed images are not written to the output, so every other output
+					// type would silently be discarded.
+					if len(c.StringSlice("push")) > 0 && output.Type != builder.OutputOCI {
+						return fmt.Errorf("--push is not supported for %s outputs", output.Type)
+					}
+
+					// Disk, filesystem, and extension images are assembled from a tarball
+					// of the root filesystem.
+					assembled := output.Type.IsDisk() || output.Type.IsFilesystemImage() || output.Type.IsExtension()
+
+					if assembled && strings.Contains(c.String("platform"), ",") {
+						return fmt.Errorf("%s images can only be built for a single platform", output.Type)
+					}
+
+					if output.Type.IsFilesystemImage() {
+						if err := fsimage.ValidateCompression(fsimage.Format(output.Type), output.Compression); err != nil {
+							return err
+						}
 					}
 
-					// Use the disk cache for all HTTP requests.
-					http.DefaultClient = &http.Client{
-						Transport: httpcache.NewTransport(cache),
+					if output.Type.IsExtension() {
+						if err := fsimage.ValidateCompression(fsimage.Format(output.Filesystem), output.Compression); err != nil {
+							return err
+						}
 					}
 
 					// A temporary directory used during image building.
@@ -224,12 +351,6 @@ func main() {
 						_ = os.RemoveAll(tempDir)
 					}()
 
-					// Mutual TLS certificates for the BuildKit daemon.
-					certsDir := filepath.Join(c.String("state-dir"), "certs")
-					if err := os.MkdirAll(certsDir, 0o700); err != nil {
-						return fmt.Errorf("failed to create certs directory: %w", err)
-					}
-
 					// Load the recipe file.
 					recipeFile, err := os.Open(c.String("filename"))
 					if err != nil {
@@ -242,10 +363,21 @@ func main() {
 						return fmt.Errorf("failed to read recipe: %w", err)
 					}
 
-					// Start the BuildKit daemon.
-					b := buildkit.New("immutos", certsDir)
-					if err := b.StartDaemon(c.Context); err != nil {
-						return fmt.Errorf("failed to start buildkit daemon: %w", err)
+					var b builder.Builder
+					switch c.String("builder") {
+					case "buildkit":
+						b, err = newBuildKit(c, rx, filepath.Dir(c.String("filename")))
+						if err != nil {
+							return err
+						}
+					case "native":
+						if len(c.StringSlice("cache-from")) > 0 || c.String("cache-to") != "" {
+							return fmt.Errorf("--cache-from and --cache-to are only supported by the buildkit builder")
+						}
+
+						b = native.New()
+					default:
+						return fmt.Errorf("unsupported builder: %s", c.String("builder"))
 					}
 
 					// If running in development mode, use the current immutos binary as the
@@ -263,159 +395,1059 @@ func main() {
 						downloadOnly = rx.Options.DownloadOnly
 					}
 
-					buildOpts := buildkit.BuildOptions{
-						OCIArchivePath:        c.String("output"),
+					buildOutput := output
+					if assembled {
+						buildOutput = builder.Output{Type: builder.OutputTar, Dest: filepath.Join(tempDir, "rootfs.tar")}
+					}
+
+					buildOpts := builder.BuildOptions{
+						Output:                buildOutput,
 						RecipePath:            c.String("filename"),
 						SecondStageBinaryPath: secondStageBinaryPath,
 						DownloadOnly:          downloadOnly,
 						ImageConf:             toOCIImageConfig(rx),
 						Tags:                  c.StringSlice("tag"),
+						Push:                  c.StringSlice("push"),
 					}
 
-					for _, platformStr := range strings.Split(c.String("platform"), ",") {
-						platform, err := platforms.Parse(platformStr)
+					if err := preparePlatforms(c, store, rx, c.String("filename"), tempDir, &buildOpts); err != nil {
+						return err
+					}
+
+					// Extension images only contain the files that were added relative to
+					// the base image, so the base image needs to be built too.
+					var baseRootFSArchivePath string
+					if output.Base != "" {
+						slog.Info("Building base image", slog.String("recipe", output.Base))
+
+						baseRecipeFile, err := os.Open(output.Base)
 						if err != nil {
-							return fmt.Errorf("failed to parse platform: %w", err)
+							return fmt.Errorf("failed to open base recipe file: %w", err)
 						}
+						defer baseRecipeFile.Close()
 
-						if platform.OS != "linux" {
-							return fmt.Errorf("unsupported OS: %s", platform.OS)
+						baseRx, err := recipe.FromYAML(baseRecipeFile)
+						if err != nil {
+							return fmt.Errorf("failed to read base recipe: %w", err)
 						}
 
-						slog.Info("Building image", slog.String("platform", platforms.Format(platform)))
+						baseRootFSArchivePath = filepath.Join(tempDir, "base-rootfs.tar")
 
-						slog.Info("Loading packages")
+						baseBuildOpts := builder.BuildOptions{
+							Output:                builder.Output{Type: builder.OutputTar, Dest: baseRootFSArchivePath},
+							RecipePath:            output.Base,
+							SecondStageBinaryPath: secondStageBinaryPath,
+							DownloadOnly:          baseRx.Options != nil && baseRx.Options.DownloadOnly,
+							ImageConf:             toOCIImageConfig(baseRx),
+						}
 
-						var packageDB *database.PackageDB
-						packageDB, sourceDateEpoch, err := loadPackageDB(c.Context, rx, platform)
-						if err != nil {
+						if err := preparePlatforms(c, store, baseRx, output.Base, filepath.Join(tempDir, "base"), &baseBuildOpts); err != nil {
 							return err
 						}
 
-						if sourceDateEpoch.After(buildOpts.SourceDateEpoch) {
-							buildOpts.SourceDateEpoch = sourceDateEpoch
+						// The cache is only exported by the extension build, as it would
+						// otherwise replace the cache exported by the base build.
+						baseBuilder := b
+						if bk, ok := b.(*buildkit.BuildKit); ok {
+							baseBuilder = bk.WithoutCacheExport()
+						}
+
+						if err := baseBuilder.Build(c.Context, baseBuildOpts); err != nil {
+							return fmt.Errorf("failed to build base image: %w", err)
 						}
+					}
+
+					if len(buildOpts.Push) > 0 {
+						slog.Info("Building multi-platform image", slog.Any("push", buildOpts.Push))
+					} else {
+						slog.Info("Building multi-platform image", slog.String("type", string(output.Type)), slog.String("dest", output.Dest))
+					}
+
+					if err := b.Build(c.Context, buildOpts); err != nil {
+						return fmt.Errorf("failed to build OCI image: %w", err)
+					}
 
-						var requiredNameVersions []string
+					switch {
+					case output.Type.IsDisk():
+						slog.Info("Creating disk image", slog.String("format", string(output.Type)), slog.String("dest", output.Dest))
 
-						// By default, install the immutos binary (for second-stage provisioning).
-						if !c.Bool("dev") {
-							requiredNameVersions = append(requiredNameVersions, "immutos")
+						var diskConf latestrecipe.DiskConfig
+						if rx.Disk != nil {
+							diskConf = *rx.Disk
 						}
 
-						// By default, install all priority required packages.
-						if !(rx.Options != nil && rx.Options.OmitRequired) {
-							_ = packageDB.ForEach(func(pkg types.Package) error {
-								if pkg.Priority == "required" {
-									requiredNameVersions = append(requiredNameVersions, pkg.Package.Name)
-								}
+						err := disk.Create(c.Context, output.Dest, diskConf, disk.Options{
+							RootFSArchivePath: buildOutput.Dest,
+							Platform:          buildOpts.PlatformOpts[0].Platform,
+							Format:            disk.Format(output.Type),
+							SourceDateEpoch:   buildOpts.SourceDateEpoch,
+						})
+						if err != nil {
+							return fmt.Errorf("failed to create disk image: %w", err)
+						}
+					case output.Type.IsFilesystemImage():
+						slog.Info("Creating filesystem image", slog.String("format", string(output.Type)), slog.String("dest", output.Dest))
 
-								return nil
-							})
+						err := fsimage.Create(c.Context, output.Dest, fsimage.Format(output.Type), buildOutput.Dest, fsimage.Options{
+							Compression:     output.Compression,
+							SourceDateEpoch: buildOpts.SourceDateEpoch,
+						})
+						if err != nil {
+							return fmt.Errorf("failed to create filesystem image: %w", err)
+						}
+					case output.Type.IsExtension():
+						slog.Info("Creating extension image", slog.String("type", string(output.Type)),
+							slog.String("filesystem", output.Filesystem), slog.String("dest", output.Dest))
+
+						err := fsimage.CreateExtension(c.Context, output.Dest, fsimage.Format(output.Filesystem), buildOutput.Dest, fsimage.ExtensionOptions{
+							Options: fsimage.Options{
+								Compression:     output.Compression,
+								SourceDateEpoch: buildOpts.SourceDateEpoch,
+							},
+							Type:                  fsimage.ExtensionType(output.Type),
+							BaseRootFSArchivePath: baseRootFSArchivePath,
+							Architecture:          buildOpts.PlatformOpts[0].Platform.Architecture,
+						})
+						if err != nil {
+							return fmt.Errorf("failed to create extension image: %w", err)
+						}
+					}
+
+					// The output destination isn't necessarily a file (eg. a registry
+					// reference when pushing, or a directory), so manifests are written
+					// to a directory of their own.
+					if manifestDir := c.String("manifest"); manifestDir != "" {
+						if err := os.MkdirAll(manifestDir, 0o755); err != nil {
+							return fmt.Errorf("failed to create manifest directory: %w", err)
+						}
+
+						for _, platformOpt := range buildOpts.PlatformOpts {
+							platformStr := strings.ReplaceAll(platforms.Format(platformOpt.Platform), "/", "-")
+							manifestPath := filepath.Join(manifestDir, platformStr+".manifest.json")
+
+							if err := cp.Copy(platformOpt.ManifestPath, manifestPath); err != nil {
+								return fmt.Errorf("failed to copy manifest: %w", err)
+							}
+
+							slog.Info("Wrote build manifest", slog.String("path", manifestPath))
+						}
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:  "fetch",
+				Usage: "Download the packages of a recipe into a signed local apt repository",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "filename",
+						Aliases:  []string{"f"},
+						Usage:    "Recipe file to use",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output repository directory",
+						Value:   "repository",
+					},
+					&cli.StringFlag{
+						Name:    "platform",
+						Aliases: []string{"p"},
+						Usage:   "Target platform(s) in the 'os/arch' format",
+						Value:   "linux/" + runtime.GOARCH,
+					},
+					&cli.StringFlag{
+						Name:  "signing-key",
+						Usage: "Armored OpenPGP private key used to sign the repository (generated if it does not exist)",
+					},
+					&cli.StringFlag{
+						Name:  "distribution",
+						Usage: "Distribution name of the repository",
+						Value: "stable",
+					},
+					&cli.StringFlag{
+						Name:  "component",
+						Usage: "Component name of the repository",
+						Value: "main",
+					},
+				}, persistentFlags...),
+				Before: util.BeforeAll(initLogger, initCacheDir, initStateDir, initHTTPClient, initTelemetry),
+				After:  shutdownTelemetry,
+				Action: func(c *cli.Context) error {
+					store, err := pkgstore.Open(filepath.Join(c.String("cache-dir"), "packages"))
+					if err != nil {
+						return fmt.Errorf("failed to open package store: %w", err)
+					}
+
+					tempDir, err := os.MkdirTemp("", "immutos-*")
+					if err != nil {
+						return fmt.Errorf("failed to create temporary directory: %w", err)
+					}
+					defer func() {
+						_ = os.RemoveAll(tempDir)
+					}()
+
+					signingKeyPath := c.String("signing-key")
+					if signingKeyPath == "" {
+						signingKeyPath = filepath.Join(c.String("state-dir"), "signing-key.asc")
+					}
+
+					signingKey, err := keyring.LoadOrGenerateSigningKey(signingKeyPath, "immutos")
+					if err != nil {
+						return fmt.Errorf("failed to load signing key: %w", err)
+					}
+
+					recipeFile, err := os.Open(c.String("filename"))
+					if err != nil {
+						return fmt.Errorf("failed to open recipe file: %w", err)
+					}
+					defer recipeFile.Close()
+
+					rx, err := recipe.FromYAML(recipeFile)
+					if err != nil {
+						return fmt.Errorf("failed to read recipe: %w", err)
+					}
+
+					var sourceDateEpoch time.Time
+					var packagePaths []string
+					for _, platformStr := range strings.Split(c.String("platform"), ",") {
+						platform, err := platforms.Parse(platformStr)
+						if err != nil {
+							return fmt.Errorf("failed to parse platform: %w", err)
+						}
+
+						if platform.OS != "linux" {
+							return fmt.Errorf("unsupported OS: %s", platform.OS)
 						}
 
-						slog.Info("Resolving selected packages")
+						slog.Info("Fetching packages", slog.String("platform", platforms.Format(platform)))
 
-						selectedDB, err := resolve.Resolve(packageDB,
-							append(requiredNameVersions, rx.Packages.Include...),
-							rx.Packages.Exclude)
+						packageDB, lastUpdated, err := loadPackageDB(c.Context, rx, filepath.Dir(c.String("filename")), platform)
 						if err != nil {
 							return err
 						}
 
-						platformTempDir := filepath.Join(tempDir, strings.ReplaceAll(platforms.Format(platform), "/", "-"))
-						if err := os.MkdirAll(platformTempDir, 0o755); err != nil {
-							return fmt.Errorf("failed to create platform temp directory: %w", err)
+						if lastUpdated.After(sourceDateEpoch) {
+							sourceDateEpoch = lastUpdated
 						}
 
-						slog.Info("Downloading selected packages")
-
-						packagePaths, err := downloadSelectedPackages(c.Context, platformTempDir, selectedDB)
+						selectedDB, err := selectPackages(packageDB, rx, true)
 						if err != nil {
 							return err
 						}
 
-						slog.Info("Unpacking packages")
+						platformTempDir := filepath.Join(tempDir, strings.ReplaceAll(platforms.Format(platform), "/", "-"))
+						if err := os.MkdirAll(platformTempDir, 0o755); err != nil {
+							return fmt.Errorf("failed to create platform temp directory: %w", err)
+						}
 
-						dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(c.Context, platformTempDir, packagePaths)
+						platformPackagePaths, _, err := downloadSelectedPackages(c.Context, store, platformTempDir, selectedDB)
 						if err != nil {
 							return err
 						}
 
-						buildOpts.PlatformOpts = append(buildOpts.PlatformOpts, buildkit.PlatformBuildOptions{
-							Platform:                platform,
-							BuildContextDir:         platformTempDir,
-							DpkgDatabaseArchivePath: dpkgDatabaseArchivePath,
-							DataArchivePaths:        dataArchivePaths,
-						})
+						packagePaths = append(packagePaths, platformPackagePaths...)
 					}
 
-					slog.Info("Building multi-platform image", slog.String("output", c.String("output")))
+					slog.Info("Writing repository", slog.String("output", c.String("output")))
 
-					if err := b.Build(c.Context, buildOpts); err != nil {
-						return fmt.Errorf("failed to build OCI image: %w", err)
+					if err := repository.Create(c.String("output"), packagePaths, repository.Options{
+						Distribution: c.String("distribution"),
+						Component:    c.String("component"),
+						Date:         sourceDateEpoch,
+						SigningKey:   signingKey,
+					}); err != nil {
+						return fmt.Errorf("failed to create repository: %w", err)
 					}
 
+					outputDir, err := filepath.Abs(c.String("output"))
+					if err != nil {
+						return fmt.Errorf("failed to get absolute path of output directory: %w", err)
+					}
+
+					slog.Info("Repository created, to use it add the following source to your recipe",
+						slog.String("url", "file://"+outputDir),
+						slog.String("signedBy", filepath.Join(outputDir, repository.PublicKeyFilename)),
+						slog.String("distribution", c.String("distribution")))
+
 					return nil
 				},
 			},
 			{
-				Name:        "second-stage",
-				Description: "Operations that will be run after the image is built",
-				Hidden:      true,
+				Name:  "repo",
+				Usage: "Manage signed local apt repositories",
 				Subcommands: []*cli.Command{
 					{
-						// MergeUsr is a separate command as it needs to be run before
-						// packages are configured.
-						Name:        "merge-usr",
-						Description: "Merge the /usr directory into the root filesystem",
-						Flags:       persistentFlags,
-						Before:      util.BeforeAll(initLogger),
-						Action: func(_ *cli.Context) error {
-							return secondstage.MergeUsr()
+						Name:      "create",
+						Usage:     "Create (or update) a signed apt repository from the packages in a directory",
+						ArgsUsage: "<dir>",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:  "signing-key",
+								Usage: "Armored OpenPGP private key used to sign the repository (generated if it does not exist)",
+							},
+							&cli.StringFlag{
+								Name:  "distribution",
+								Usage: "Distribution name of the repository",
+								Value: "stable",
+							},
+							&cli.StringFlag{
+								Name:  "component",
+								Usage: "Component name of the repository",
+								Value: "main",
+							},
+							&cli.StringFlag{
+								Name:  "origin",
+								Usage: "Origin of the repository",
+							},
+							&cli.StringFlag{
+								Name:  "label",
+								Usage: "Label of the repository",
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger, initStateDir),
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a single repository directory argument")
+							}
+
+							dir := c.Args().First()
+
+							signingKeyPath := c.String("signing-key")
+							if signingKeyPath == "" {
+								signingKeyPath = filepath.Join(c.String("state-dir"), "signing-key.asc")
+							}
+
+							signingKey, err := keyring.LoadOrGenerateSigningKey(signingKeyPath, "immutos")
+							if err != nil {
+								return fmt.Errorf("failed to load signing key: %w", err)
+							}
+
+							packagePaths, err := repository.Scan(dir)
+							if err != nil {
+								return err
+							}
+
+							slog.Info("Writing repository",
+								slog.String("dir", dir), slog.Int("packages", len(packagePaths)))
+
+							if err := repository.Create(dir, packagePaths, repository.Options{
+								Origin:       c.String("origin"),
+								Label:        c.String("label"),
+								Distribution: c.String("distribution"),
+								Component:    c.String("component"),
+								SigningKey:   signingKey,
+							}); err != nil {
+								return fmt.Errorf("failed to create repository: %w", err)
+							}
+
+							return nil
 						},
 					},
 					{
-						Name:        "provision",
-						Description: "Set up the image with the requested recipe",
+						Name:      "serve",
+						Usage:     "Serve an apt repository over HTTP",
+						ArgsUsage: "<dir>",
 						Flags: append([]cli.Flag{
 							&cli.StringFlag{
-								Name:     "filename",
-								Aliases:  []string{"f"},
-								Usage:    "Recipe file to use",
-								Required: true,
+								Name:  "listen-address",
+								Usage: "Address to listen on",
+								Value: "localhost:8080",
 							},
 						}, persistentFlags...),
 						Before: util.BeforeAll(initLogger),
 						Action: func(c *cli.Context) error {
-							// Load the recipe file.
-							recipeFile, err := os.Open(c.String("filename"))
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a single repository directory argument")
+							}
+
+							dir := c.Args().First()
+
+							ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+							defer stop()
+
+							lis, err := net.Listen("tcp", c.String("listen-address"))
 							if err != nil {
-								return fmt.Errorf("failed to open recipe file: %w", err)
+								return fmt.Errorf("failed to listen: %w", err)
 							}
-							defer recipeFile.Close()
 
-							rx, err := recipe.FromYAML(recipeFile)
+							srv := &http.Server{
+								Handler:           http.FileServer(http.Dir(dir)),
+								ReadHeaderTimeout: 10 * time.Second,
+							}
+
+							go func() {
+								<-ctx.Done()
+
+								shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+								defer cancel()
+
+								_ = srv.Shutdown(shutdownCtx)
+							}()
+
+							absDir, err := filepath.Abs(dir)
 							if err != nil {
-								return fmt.Errorf("failed to read recipe: %w", err)
+								return fmt.Errorf("failed to get absolute path of repository directory: %w", err)
 							}
 
-							return secondstage.Provision(c.Context, rx)
+							// Keys can only be downloaded over HTTPS, so refer to the local file.
+							slog.Info("Serving repository",
+								slog.String("url", "http://"+lis.Addr().String()),
+								slog.String("signedBy", filepath.Join(absDir, repository.PublicKeyFilename)))
+
+							if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+								return fmt.Errorf("failed to serve repository: %w", err)
+							}
+
+							return nil
 						},
 					},
 				},
 			},
-		},
-	}
-
-	if err := app.Run(os.Args); err != nil {
-		slog.Error("Error", slog.Any("error", err))
-		os.Exit(1)
-	}
-}
-
-func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, platform ocispecs.Platform) (*database.PackageDB, time.Time, error) {
-	var componentsMu sync.Mutex
+			{
+				Name:  "cache",
+				Usage: "Manage the local cache",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "gc",
+						Usage: "Remove packages that have not been used recently",
+						Flags: append([]cli.Flag{
+							&cli.DurationFlag{
+								Name:  "keep-duration",
+								Usage: "Keep packages that have been used within this duration",
+								Value: 30 * 24 * time.Hour,
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger, initCacheDir),
+						Action: func(c *cli.Context) error {
+							store, err := pkgstore.Open(filepath.Join(c.String("cache-dir"), "packages"))
+							if err != nil {
+								return fmt.Errorf("failed to open package store: %w", err)
+							}
+
+							result, err := store.GC(c.Duration("keep-duration"))
+							if err != nil {
+								return fmt.Errorf("failed to garbage collect package store: %w", err)
+							}
+
+							slog.Info("Removed unreferenced packages",
+								slog.Int("count", result.Removed),
+								slog.Int64("reclaimedBytes", result.ReclaimedBytes))
+
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "daemon",
+				Usage: "Manage the BuildKit daemon started by immutos",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "status",
+						Usage:  "Show the state and address of the BuildKit daemon",
+						Flags:  persistentFlags,
+						Before: util.BeforeAll(initLogger, initStateDir),
+						Action: func(c *cli.Context) error {
+							b := managedBuildKit(c)
+
+							status, err := b.DaemonStatus(c.Context)
+							if err != nil {
+								return fmt.Errorf("failed to get buildkit daemon status: %w", err)
+							}
+
+							if status == nil {
+								slog.Info("BuildKit daemon container does not exist")
+								return nil
+							}
+
+							slog.Info("BuildKit daemon",
+								slog.String("container", status.ContainerName),
+								slog.String("id", status.ContainerID),
+								slog.String("image", status.Image),
+								slog.String("state", status.State),
+								slog.String("status", status.Status),
+								slog.String("address", status.Address))
+
+							return nil
+						},
+					},
+					{
+						Name:  "stop",
+						Usage: "Stop the BuildKit daemon",
+						Flags: append([]cli.Flag{
+							&cli.BoolFlag{
+								Name:  "remove",
+								Usage: "Also remove the daemon container and its cache",
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger, initStateDir),
+						Action: func(c *cli.Context) error {
+							b := managedBuildKit(c)
+
+							if c.Bool("remove") {
+								if err := b.RemoveDaemon(c.Context); err != nil {
+									return fmt.Errorf("failed to remove buildkit daemon: %w", err)
+								}
+
+								return nil
+							}
+
+							if err := b.StopDaemon(c.Context); err != nil {
+								return fmt.Errorf("failed to stop buildkit daemon: %w", err)
+							}
+
+							return nil
+						},
+					},
+					{
+						Name:  "logs",
+						Usage: "Show the logs of the BuildKit daemon",
+						Flags: append([]cli.Flag{
+							&cli.BoolFlag{
+								Name:    "follow",
+								Aliases: []string{"F"},
+								Usage:   "Follow the log output",
+							},
+							&cli.StringFlag{
+								Name:  "tail",
+								Usage: "Number of lines to show from the end of the logs (or 'all')",
+								Value: "all",
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger, initStateDir),
+						Action: func(c *cli.Context) error {
+							b := managedBuildKit(c)
+
+							if err := b.DaemonLogs(c.Context, os.Stdout, c.String("tail"), c.Bool("follow")); err != nil {
+								return fmt.Errorf("failed to get buildkit daemon logs: %w", err)
+							}
+
+							return nil
+						},
+					},
+					{
+						Name:  "prune",
+						Usage: "Remove BuildKit cache that has not been used recently",
+						Flags: append([]cli.Flag{
+							&cli.DurationFlag{
+								Name:  "keep-duration",
+								Usage: "Keep cache that has been used within this duration",
+								Value: 7 * 24 * time.Hour,
+							},
+							&cli.StringFlag{
+								Name:  "keep-storage",
+								Usage: "Maximum amount of cache to keep (eg. 10GB)",
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger, initStateDir),
+						Action: func(c *cli.Context) error {
+							var keepBytes int64
+							if keepStorage := c.String("keep-storage"); keepStorage != "" {
+								var err error
+								keepBytes, err = units.RAMInBytes(keepStorage)
+								if err != nil {
+									return fmt.Errorf("failed to parse keep storage: %w", err)
+								}
+							}
+
+							b := managedBuildKit(c)
+
+							result, err := b.Prune(c.Context, c.Duration("keep-duration"), keepBytes)
+							if err != nil {
+								return err
+							}
+
+							slog.Info("Removed BuildKit cache",
+								slog.Int("count", result.Removed),
+								slog.Int64("reclaimedBytes", result.ReclaimedBytes))
+
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:        "second-stage",
+				Description: "Operations that will be run after the image is built",
+				Hidden:      true,
+				Subcommands: []*cli.Command{
+					{
+						// MergeUsr is a separate command as it needs to be run before
+						// packages are configured.
+						Name:        "merge-usr",
+						Description: "Merge the /usr directory into the root filesystem",
+						Flags:       persistentFlags,
+						Before:      util.BeforeAll(initLogger),
+						Action: func(_ *cli.Context) error {
+							return secondstage.MergeUsr()
+						},
+					},
+					{
+						Name:        "configure",
+						Description: "Configure the unpacked packages in dependency order",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:    "filename",
+								Aliases: []string{"f"},
+								Usage:   "Recipe file to select alternatives from",
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger),
+						Action: func(c *cli.Context) error {
+							var alternatives []configure.Alternative
+							if c.IsSet("filename") {
+								recipeFile, err := os.Open(c.String("filename"))
+								if err != nil {
+									return fmt.Errorf("failed to open recipe file: %w", err)
+								}
+								defer recipeFile.Close()
+
+								rx, err := recipe.FromYAML(recipeFile)
+								if err != nil {
+									return fmt.Errorf("failed to read recipe: %w", err)
+								}
+
+								for _, alternative := range rx.Alternatives {
+									alternatives = append(alternatives, configure.Alternative{
+										Name: alternative.Name,
+										Path: alternative.Path,
+									})
+								}
+							}
+
+							return configure.Configure(c.Context, configure.StatusPath, alternatives)
+						},
+					},
+					{
+						Name:        "provision",
+						Description: "Set up the image with the requested recipe",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:     "filename",
+								Aliases:  []string{"f"},
+								Usage:    "Recipe file to use",
+								Required: true,
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger),
+						Action: func(c *cli.Context) error {
+							// Load the recipe file.
+							recipeFile, err := os.Open(c.String("filename"))
+							if err != nil {
+								return fmt.Errorf("failed to open recipe file: %w", err)
+							}
+							defer recipeFile.Close()
+
+							rx, err := recipe.FromYAML(recipeFile)
+							if err != nil {
+								return fmt.Errorf("failed to read recipe: %w", err)
+							}
+
+							return secondstage.Provision(c.Context, rx)
+						},
+					},
+					{
+						// WriteLayers is run in a separate root filesystem, as the image
+						// no longer contains the immutos binary.
+						Name:        "write-layers",
+						Description: "Split a root filesystem into layer tarballs",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:     "filename",
+								Aliases:  []string{"f"},
+								Usage:    "Layer plan file to use",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "rootfs",
+								Usage:    "Root filesystem directory to split",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "output",
+								Aliases:  []string{"o"},
+								Usage:    "Directory to write the layer tarballs to",
+								Required: true,
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger),
+						Action: func(c *cli.Context) error {
+							return secondstage.WriteLayers(c.String("rootfs"), c.String("filename"), c.String("output"))
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		slog.Error("Error", slog.Any("error", err))
+		os.Exit(1)
+	}
+}
+
+// preparePlatforms resolves, downloads, verifies, and unpacks the packages of a
+// recipe for each of the platforms given by the --platform flag, adding them
+// to the build options.
+func preparePlatforms(c *cli.Context, store *pkgstore.Store, rx *latestrecipe.Recipe, recipePath, tempDir string, buildOpts *builder.BuildOptions) error {
+	// In offline mode, the artifacts missing for every platform are reported
+	// at once.
+	var notCached error
+
+	for _, platformStr := range strings.Split(c.String("platform"), ",") {
+		platform, err := platforms.Parse(platformStr)
+		if err != nil {
+			return fmt.Errorf("failed to parse platform: %w", err)
+		}
+
+		if platform.OS != "linux" {
+			return fmt.Errorf("unsupported OS: %s", platform.OS)
+		}
+
+		slog.Info("Building image", slog.String("platform", platforms.Format(platform)))
+
+		slog.Info("Loading packages")
+
+		var packageDB *database.PackageDB
+		packageDB, sourceDateEpoch, err := loadPackageDB(c.Context, rx, filepath.Dir(recipePath), platform)
+		if err != nil {
+			if isNotCached(c, err) {
+				notCached = errors.Join(notCached, err)
+				continue
+			}
+
+			return err
+		}
+
+		if sourceDateEpoch.After(buildOpts.SourceDateEpoch) {
+			buildOpts.SourceDateEpoch = sourceDateEpoch
+		}
+
+		slog.Info("Resolving selected packages")
+
+		// By default, install the immutos binary (for second-stage provisioning).
+		selectedDB, err := selectPackages(packageDB, rx, !c.Bool("dev"))
+		if err != nil {
+			return err
+		}
+
+		platformTempDir := filepath.Join(tempDir, strings.ReplaceAll(platforms.Format(platform), "/", "-"))
+		if err := os.MkdirAll(platformTempDir, 0o755); err != nil {
+			return fmt.Errorf("failed to create platform temp directory: %w", err)
+		}
+
+		if c.Bool("offline") {
+			if err := checkPackagesCached(store, selectedDB); err != nil {
+				notCached = errors.Join(notCached, err)
+				continue
+			}
+		}
+
+		slog.Info("Downloading selected packages")
+
+		packagePaths, packageURLs, err := downloadSelectedPackages(c.Context, store, platformTempDir, selectedDB)
+		if err != nil {
+			return err
+		}
+
+		slog.Info("Verifying package signatures")
+
+		packageSigners, err := verifyPackageSignatures(c.Context, rx, filepath.Dir(recipePath), selectedDB, platformTempDir)
+		if err != nil {
+			return err
+		}
+
+		manifestPath := filepath.Join(platformTempDir, "manifest.json")
+		if err := newManifest(platform, selectedDB, packageURLs, packageSigners).WriteFile(manifestPath); err != nil {
+			return err
+		}
+
+		layerPlan, err := planLayers(rx, selectedDB)
+		if err != nil {
+			return err
+		}
+
+		slog.Info("Unpacking packages")
+
+		var diversions []unpack.Diversion
+		for _, diversionConf := range rx.Diversions {
+			diversions = append(diversions, unpack.Diversion{
+				Path:     diversionConf.Path,
+				DivertTo: diversionConf.DivertTo,
+				Package:  diversionConf.Package,
+			})
+		}
+
+		dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(c.Context, platformTempDir, packagePaths, &unpack.Options{
+			AllowedOverlaps: rx.Packages.AllowOverlaps,
+			Diversions:      diversions,
+		})
+		if err != nil {
+			return err
+		}
+
+		buildOpts.PlatformOpts = append(buildOpts.PlatformOpts, builder.PlatformBuildOptions{
+			Platform:                platform,
+			BuildContextDir:         platformTempDir,
+			DpkgDatabaseArchivePath: dpkgDatabaseArchivePath,
+			DataArchivePaths:        dataArchivePaths,
+			ManifestPath:            manifestPath,
+			Layers:                  layerPlan,
+		})
+	}
+
+	if notCached != nil {
+		return offline.Collect(notCached)
+	}
+
+	return nil
+}
+
+// isNotCached returns true if the build is offline and the error is caused by
+// artifacts missing from the local cache.
+func isNotCached(c *cli.Context, err error) bool {
+	var notCachedErr *offline.NotCachedError
+	return c.Bool("offline") && errors.As(err, &notCachedErr)
+}
+
+// planLayers groups the selected packages into layers, according to the
+// layering strategy of the recipe.
+func planLayers(rx *latestrecipe.Recipe, selectedDB *database.PackageDB) ([][]string, error) {
+	if rx.Container == nil || rx.Container.Layers == nil {
+		return nil, nil
+	}
+
+	var selected []types.Package
+	providers := map[string][]string{}
+	_ = selectedDB.ForEach(func(pkg types.Package) error {
+		// The immutos package is removed once the image has been provisioned.
+		if pkg.Name != "immutos" {
+			selected = append(selected, pkg)
+
+			for _, rel := range pkg.Provides.Relations {
+				for _, possi := range rel.Possibilities {
+					providers[possi.Name] = append(providers[possi.Name], pkg.Name)
+				}
+			}
+		}
+
+		return nil
+	})
+
+	// Count the packages that depend on each package (directly, or via a
+	// virtual package), for ranking packages by popularity.
+	dependents := map[string]int{}
+	for _, pkg := range selected {
+		dependencies := map[string]bool{}
+		for _, rel := range append(slices.Clone(pkg.PreDepends.Relations), pkg.Depends.Relations...) {
+			for _, possi := range rel.Possibilities {
+				dependencies[possi.Name] = true
+				for _, provider := range providers[possi.Name] {
+					dependencies[provider] = true
+				}
+			}
+		}
+
+		for name := range dependencies {
+			if name != pkg.Name {
+				dependents[name]++
+			}
+		}
+	}
+
+	var packages []layers.Package
+	for _, pkg := range selected {
+		packages = append(packages, layers.Package{
+			Name:          pkg.Name,
+			InstalledSize: int64(pkg.InstalledSize),
+			Dependents:    dependents[pkg.Name],
+		})
+	}
+
+	layersConf := rx.Container.Layers
+	plan, err := layers.Plan(layers.Strategy(layersConf.Strategy), layersConf.MaxLayers,
+		layers.Ranking(layersConf.RankBy), layersConf.Application, packages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan layers: %w", err)
+	}
+
+	return plan, nil
+}
+
+// newBuildKit connects to the BuildKit daemon given by the --buildkit-addr
+// flag (or the buildkit option of the recipe), or otherwise starts a BuildKit
+// daemon managed by immutos.
+func newBuildKit(c *cli.Context, rx *latestrecipe.Recipe, recipeDir string) (*buildkit.BuildKit, error) {
+	address, tlsOpts, err := buildKitAddress(c, rx, recipeDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if address != "" {
+		b, err := buildkit.Connect(address, tlsOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to buildkit daemon: %w", err)
+		}
+
+		slog.Debug("Using existing BuildKit daemon", slog.String("address", address))
+
+		if err := setBuildKitCache(c, b); err != nil {
+			return nil, err
+		}
+
+		return b, nil
+	}
+
+	// Start the BuildKit daemon.
+	b := managedBuildKit(c)
+	if err := setBuildKitCache(c, b); err != nil {
+		return nil, err
+	}
+
+	if err := b.StartDaemon(c.Context); err != nil {
+		return nil, fmt.Errorf("failed to start buildkit daemon: %w", err)
+	}
+
+	return b, nil
+}
+
+// buildKitAddress returns the address (and TLS credentials) of an existing
+// BuildKit daemon, if one is given by the flags or the recipe.
+func buildKitAddress(c *cli.Context, rx *latestrecipe.Recipe, recipeDir string) (string, *buildkit.TLSOptions, error) {
+	if address := c.String("buildkit-addr"); address != "" {
+		if !c.IsSet("buildkit-tls-ca") && !c.IsSet("buildkit-tls-cert") && !c.IsSet("buildkit-tls-key") {
+			return address, nil, nil
+		}
+
+		if !c.IsSet("buildkit-tls-ca") {
+			return "", nil, fmt.Errorf("--buildkit-tls-ca is required when using TLS")
+		}
+
+		return address, &buildkit.TLSOptions{
+			ServerName: c.String("buildkit-tls-server-name"),
+			CACert:     c.String("buildkit-tls-ca"),
+			Cert:       c.String("buildkit-tls-cert"),
+			Key:        c.String("buildkit-tls-key"),
+		}, nil
+	}
+
+	if rx.Options == nil || rx.Options.BuildKit == nil {
+		return "", nil, nil
+	}
+
+	conf := rx.Options.BuildKit
+	if conf.Address == "" {
+		return "", nil, fmt.Errorf("buildkit address is required")
+	}
+
+	if conf.TLS == nil {
+		return conf.Address, nil, nil
+	}
+
+	if conf.TLS.CACert == "" {
+		return "", nil, fmt.Errorf("buildkit tls caCert is required when using TLS")
+	}
+
+	// Relative paths are resolved against the directory of the recipe.
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+
+		return filepath.Join(recipeDir, path)
+	}
+
+	return conf.Address, &buildkit.TLSOptions{
+		ServerName: conf.TLS.ServerName,
+		CACert:     resolve(conf.TLS.CACert),
+		Cert:       resolve(conf.TLS.Cert),
+		Key:        resolve(conf.TLS.Key),
+	}, nil
+}
+
+// managedBuildKit returns the BuildKit daemon managed by immutos (without
+// starting it).
+func managedBuildKit(c *cli.Context) *buildkit.BuildKit {
+	return buildkit.New("immutos", filepath.Join(c.String("state-dir"), "certs"))
+}
+
+// setBuildKitCache configures the caches given by the --cache-from and
+// --cache-to flags.
+func setBuildKitCache(c *cli.Context, b *buildkit.BuildKit) error {
+	var imports, exports []buildkit.CacheOptions
+	for _, spec := range c.StringSlice("cache-from") {
+		opts, err := buildkit.ParseCacheOptions(spec, false)
+		if err != nil {
+			return fmt.Errorf("failed to parse cache import: %w", err)
+		}
+
+		imports = append(imports, opts)
+	}
+
+	// BuildKit only supports a single cache export.
+	if spec := c.String("cache-to"); spec != "" {
+		opts, err := buildkit.ParseCacheOptions(spec, true)
+		if err != nil {
+			return fmt.Errorf("failed to parse cache export: %w", err)
+		}
+
+		exports = append(exports, opts)
+	}
+
+	b.SetCache(imports, exports)
+
+	return nil
+}
+
+// selectPackages resolves the complete set of packages to install for the recipe.
+func selectPackages(packageDB *database.PackageDB, rx *latestrecipe.Recipe, includeImmutos bool) (*database.PackageDB, error) {
+	var requiredNameVersions []string
+
+	// Local packages are requested by name, rather than by path.
+	var includeNameVersions []string
+	for _, nameVersion := range rx.Packages.Include {
+		if !source.IsLocal(nameVersion) {
+			includeNameVersions = append(includeNameVersions, nameVersion)
+		}
+	}
+
+	_ = packageDB.ForEach(func(pkg types.Package) error {
+		if pkg.IsLocal {
+			includeNameVersions = append(includeNameVersions, pkg.Name)
+		}
+
+		return nil
+	})
+
+	if includeImmutos {
+		requiredNameVersions = append(requiredNameVersions, "immutos")
+	}
+
+	if rx.Disk != nil && rx.Disk.Kernel != "" {
+		includeNameVersions = append(includeNameVersions, rx.Disk.Kernel)
+	}
+
+	// By default, install all priority required packages.
+	if !(rx.Options != nil && rx.Options.OmitRequired) {
+		_ = packageDB.ForEach(func(pkg types.Package) error {
+			if pkg.Priority == "required" {
+				requiredNameVersions = append(requiredNameVersions, pkg.Package.Name)
+			}
+
+			return nil
+		})
+	}
+
+	return resolve.Resolve(packageDB,
+		append(requiredNameVersions, includeNameVersions...),
+		rx.Packages.Exclude)
+}
+
+func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, recipeDir string, platform ocispecs.Platform) (*database.PackageDB, time.Time, error) {
+	var componentsMu sync.Mutex
 	var components []source.Component
 
 	var progressOutput io.Writer = os.Stdout
@@ -426,10 +1458,24 @@ func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, platform ocispe
 	progress := mpb.NewWithContext(ctx, mpb.WithOutput(progressOutput))
 	defer progress.Shutdown()
 
+	// Collect all errors (rather than just the first), so that every problem
+	// can be reported at once (eg. all the missing artifacts in offline mode).
+	// For the same reason, a failure doesn't cancel the other fetches.
+	var errsMu sync.Mutex
+	var errs error
+	recordErr := func(err error) error {
+		errsMu.Lock()
+		defer errsMu.Unlock()
+
+		errs = errors.Join(errs, err)
+
+		return err
+	}
+
 	{
 		sourceConfs := append([]latestrecipe.SourceConfig{}, rx.Sources...)
 
-		g, ctx := errgroup.WithContext(ctx)
+		var g errgroup.Group
 
 		bar := progress.AddBar(int64(len(sourceConfs)),
 			mpb.PrependDecorators(
@@ -449,17 +1495,17 @@ func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, platform ocispe
 
 				s, err := source.NewSource(ctx, sourceConf)
 				if err != nil {
-					return fmt.Errorf("failed to create source: %w", err)
+					return recordErr(fmt.Errorf("failed to create source: %w", err))
 				}
 
 				targetArch, err := arch.Parse(platform.Architecture)
 				if err != nil {
-					return fmt.Errorf("failed to parse target architecture: %w", err)
+					return recordErr(fmt.Errorf("failed to parse target architecture: %w", err))
 				}
 
 				sourceComponents, err := s.Components(ctx, targetArch)
 				if err != nil {
-					return fmt.Errorf("failed to get components: %w", err)
+					return recordErr(fmt.Errorf("failed to get components: %w", err))
 				}
 
 				componentsMu.Lock()
@@ -470,17 +1516,17 @@ func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, platform ocispe
 			})
 		}
 
-		err := g.Wait()
-
-		if err != nil {
+		if err := g.Wait(); err != nil {
 			bar.Abort(true)
 		} else {
 			bar.SetTotal(bar.Current(), true)
 		}
 		bar.Wait()
 
-		if err != nil {
-			return nil, time.Time{}, fmt.Errorf("failed to get components: %w", err)
+		// Carry on with the components of the remaining sources, so that their
+		// errors are reported too.
+		if err := ctx.Err(); err != nil {
+			return nil, time.Time{}, err
 		}
 	}
 
@@ -488,7 +1534,7 @@ func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, platform ocispe
 
 	var sourceDateEpoch time.Time
 	{
-		g, ctx := errgroup.WithContext(ctx)
+		var g errgroup.Group
 
 		bar := progress.AddBar(int64(len(components)),
 			mpb.PrependDecorators(
@@ -508,7 +1554,7 @@ func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, platform ocispe
 
 				componentPackages, lastUpdated, err := component.Packages(ctx)
 				if err != nil {
-					return fmt.Errorf("failed to get packages: %w", err)
+					return recordErr(fmt.Errorf("failed to get packages: %w", err))
 				}
 
 				if lastUpdated.After(sourceDateEpoch) {
@@ -521,24 +1567,64 @@ func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, platform ocispe
 			})
 		}
 
-		err := g.Wait()
-
-		if err != nil {
+		if err := g.Wait(); err != nil {
 			bar.Abort(true)
 		} else {
 			bar.SetTotal(bar.Current(), true)
 		}
 		bar.Wait()
 
+		if err := ctx.Err(); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+
+	if errs != nil {
+		return nil, time.Time{}, errs
+	}
+
+	// Local packages are added last, so that they replace any remote packages
+	// with the same name and version.
+	var localPatterns []string
+	for _, nameVersion := range rx.Packages.Include {
+		if source.IsLocal(nameVersion) {
+			localPatterns = append(localPatterns, nameVersion)
+		}
+	}
+
+	if len(localPatterns) > 0 {
+		localPackages, err := source.LocalPackages(recipeDir, localPatterns)
 		if err != nil {
-			return nil, time.Time{}, fmt.Errorf("failed to get packages: %w", err)
+			return nil, time.Time{}, fmt.Errorf("failed to get local packages: %w", err)
+		}
+
+		targetArch, err := arch.Parse(platform.Architecture)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to parse target architecture: %w", err)
+		}
+
+		allArch := arch.MustParse("all")
+		for _, pkg := range localPackages {
+			if !pkg.Architecture.Is(&targetArch) && !pkg.Architecture.Is(&allArch) {
+				continue
+			}
+
+			if existing, ok := packageDB.ExactlyEqual(pkg.Name, pkg.Version); ok {
+				packageDB.Remove(*existing)
+			}
+
+			packageDB.Add(pkg)
 		}
 	}
 
 	return packageDB, sourceDateEpoch, nil
 }
 
-func downloadSelectedPackages(ctx context.Context, tempDir string, selectedDB *database.PackageDB) ([]string, error) {
+// downloadSelectedPackages downloads the selected packages (unless they are
+// already in the package store) and links them into the temporary directory.
+// It returns the paths of the packages, and the URL that each package was
+// downloaded from (keyed by the SHA256 checksum of the package, if known).
+func downloadSelectedPackages(ctx context.Context, store *pkgstore.Store, tempDir string, selectedDB *database.PackageDB) ([]string, map[string]string, error) {
 	var progressOutput io.Writer = os.Stdout
 	if slog.Default().Enabled(ctx, slog.LevelDebug) {
 		progressOutput = io.Discard
@@ -547,10 +1633,16 @@ func downloadSelectedPackages(ctx context.Context, tempDir string, selectedDB *d
 	progress := mpb.NewWithContext(ctx, mpb.WithOutput(progressOutput))
 	defer progress.Shutdown()
 
-	bar := progress.AddBar(int64(selectedDB.Len()),
+	var totalBytes int64
+	_ = selectedDB.ForEach(func(pkg types.Package) error {
+		totalBytes += int64(pkg.Size)
+		return nil
+	})
+
+	bar := progress.AddBar(totalBytes,
 		mpb.PrependDecorators(
 			decor.Name("Downloading: "),
-			decor.CountersNoUnit("%d / %d"),
+			decor.CountersKibiByte("% .1f / % .1f"),
 		),
 		mpb.AppendDecorators(
 			decor.Percentage(),
@@ -562,28 +1654,55 @@ func downloadSelectedPackages(ctx context.Context, tempDir string, selectedDB *d
 
 	var packagePathsMu sync.Mutex
 	var packagePaths []string
+	packageURLs := map[string]string{}
 
 	_ = selectedDB.ForEach(func(pkg types.Package) error {
 		g.Go(func() error {
-			defer bar.Increment()
-
-			var errs error
-			for _, pkgURL := range util.Shuffle(pkg.URLs) {
-				slog.Debug("Downloading package", slog.String("url", pkgURL))
-
-				packagePath, err := downloadPackage(ctx, tempDir, pkgURL, pkg.SHA256)
-				errs = errors.Join(errs, err)
-				if err == nil {
-					packagePathsMu.Lock()
-					packagePaths = append(packagePaths, packagePath)
-					packagePathsMu.Unlock()
-					errs = nil
-					break
+			if store.Has(pkg.SHA256) {
+				slog.Debug("Using cached package",
+					slog.String("name", pkg.Name), slog.String("sha256", pkg.SHA256))
+
+				bar.IncrInt64(int64(pkg.Size))
+			} else {
+				var errs error
+				for _, pkgURL := range util.Shuffle(pkg.URLs) {
+					slog.Debug("Downloading package", slog.String("url", pkgURL))
+
+					err := downloadPackage(ctx, store, pkgURL, pkg.SHA256, bar.IncrInt64)
+					errs = errors.Join(errs, err)
+					if err == nil {
+						errs = nil
+
+						// Remember where the package came from, for later builds.
+						if err := store.SetOrigin(pkg.SHA256, pkgURL); err != nil {
+							return err
+						}
+
+						break
+					}
+				}
+				if errs != nil {
+					return fmt.Errorf("failed to download package: %w", errs)
 				}
 			}
-			if errs != nil {
-				return fmt.Errorf("failed to download package: %w", errs)
+
+			// Local packages from different directories can share a filename.
+			packageFilename := path.Base(pkg.Filename)
+			if pkg.IsLocal {
+				packageFilename = pkg.SHA256 + ".deb"
+			}
+
+			packagePath := filepath.Join(tempDir, packageFilename)
+			if err := store.Link(pkg.SHA256, packagePath); err != nil {
+				return fmt.Errorf("failed to link package: %w", err)
+			}
+
+			packagePathsMu.Lock()
+			packagePaths = append(packagePaths, packagePath)
+			if pkgURL, ok := store.Origin(pkg.SHA256); ok {
+				packageURLs[pkg.SHA256] = pkgURL
 			}
+			packagePathsMu.Unlock()
 
 			return nil
 		})
@@ -601,52 +1720,76 @@ func downloadSelectedPackages(ctx context.Context, tempDir string, selectedDB *d
 	bar.Wait()
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to download packages: %w", err)
+		return nil, nil, fmt.Errorf("failed to download packages: %w", err)
 	}
 
 	// Sort the package filenames so that they are in a deterministic order.
 	slices.Sort(packagePaths)
 
-	return packagePaths, nil
+	return packagePaths, packageURLs, nil
 }
 
-func downloadPackage(ctx context.Context, downloadDir, pkgURL, sha256 string) (string, error) {
-	url, err := url.Parse(pkgURL)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse package URL: %w", err)
-	}
+// checkPackagesCached returns an error listing any selected (remote) packages
+// that are not available in the package store.
+func checkPackagesCached(store *pkgstore.Store, selectedDB *database.PackageDB) error {
+	var missing []string
+	_ = selectedDB.ForEach(func(pkg types.Package) error {
+		// Local packages are read from disk.
+		if !pkg.IsLocal && !store.Has(pkg.SHA256) {
+			missing = append(missing, path.Base(pkg.Filename))
+		}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil
+	})
+
+	if len(missing) > 0 {
+		return &offline.NotCachedError{Artifacts: missing}
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	return nil
+}
+
+func downloadPackage(ctx context.Context, store *pkgstore.Store, pkgURL, sha256 string, onProgress func(n int64)) error {
+	// Waits for any other build that is downloading the same package.
+	partial, err := store.OpenPartial(sha256)
 	if err != nil {
-		return "", fmt.Errorf("failed to download package: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
+	defer partial.Close()
 
-	// Read the package completely so the cache can be populated.
-	hr := hashreader.NewReader(resp.Body)
+	// Another build might have downloaded the package in the meantime.
+	if store.Has(sha256) {
+		_ = os.Remove(partial.Path())
+		return nil
+	}
 
-	packageFile, err := os.Create(filepath.Join(downloadDir, filepath.Base(url.Path)))
-	if err != nil {
-		return "", fmt.Errorf("failed to create package file: %w", err)
+	// Account for any previously downloaded bytes.
+	var written int64
+	if fi, err := os.Stat(partial.Path()); err == nil {
+		written = fi.Size()
+		onProgress(written)
 	}
-	defer packageFile.Close()
 
-	if _, err := io.Copy(packageFile, hr); err != nil {
-		_ = packageFile.Close()
-		return "", fmt.Errorf("failed to read package: %w", err)
+	// Packages are kept in the package store, so the HTTP cache is bypassed
+	// to avoid storing a second copy of each package.
+	err = download.ToFile(ctx, pkgURL, partial.Path(), &download.Options{
+		OnProgress: func(n int64) {
+			written += n
+			onProgress(n)
+		},
+	})
+	if err == nil {
+		err = partial.Commit()
 	}
+	if err != nil {
+		// Discount the bytes of this attempt (including the resumed partial
+		// file), the next attempt accounts for whatever remains of them.
+		onProgress(-written)
 
-	if err := hr.Verify(sha256); err != nil {
-		_ = packageFile.Close()
-		return "", fmt.Errorf("failed to verify package: %w", err)
+		return fmt.Errorf("failed to download package: %w", err)
 	}
 
-	return packageFile.Name(), nil
+	return nil
 }
 
 func toOCIImageConfig(rx *latestrecipe.Recipe) ocispecs.ImageConfig {
@@ -666,3 +1809,115 @@ func toOCIImageConfig(rx *latestrecipe.Recipe) ocispecs.ImageConfig {
 		StopSignal:   rx.Container.StopSignal,
 	}
 }
+
+// verifyPackageSignatures verifies the embedded (debsig) signatures of the
+// selected packages. It returns the fingerprint of the signing key for each
+// verified package (keyed by the SHA256 checksum of the package). Relative key
+// paths are resolved against the recipe directory (like local packages).
+func verifyPackageSignatures(ctx context.Context, rx *latestrecipe.Recipe, recipeDir string, selectedDB *database.PackageDB, tempDir string) (map[string]string, error) {
+	keyrings := map[string]openpgp.EntityList{}
+	packageSigners := map[string]string{}
+
+	err := selectedDB.ForEach(func(pkg types.Package) error {
+		// Package specific keys take precedence over the source key.
+		signedBy := pkg.SignedBy
+		for _, signatureConf := range rx.Packages.Signatures {
+			matched, err := path.Match(signatureConf.Package, pkg.Name)
+			if err != nil {
+				return fmt.Errorf("invalid package pattern %q: %w", signatureConf.Package, err)
+			}
+
+			if matched {
+				signedBy = signatureConf.SignedBy
+				break
+			}
+		}
+
+		if signedBy == "" {
+			// The origin of local packages is otherwise unauthenticated.
+			if pkg.IsLocal {
+				return fmt.Errorf("local package %s must be signed, but no key is configured to verify it", pkg.Name)
+			}
+
+			return nil
+		}
+
+		if !strings.Contains(signedBy, "://") && !filepath.IsAbs(signedBy) {
+			signedBy = filepath.Join(recipeDir, signedBy)
+		}
+
+		keys, ok := keyrings[signedBy]
+		if !ok {
+			var err error
+			keys, err = keyring.Load(ctx, signedBy)
+			if err != nil {
+				return fmt.Errorf("failed to read keyring: %w", err)
+			}
+
+			keyrings[signedBy] = keys
+		}
+
+		fingerprint, err := debsig.Verify(filepath.Join(tempDir, path.Base(pkg.Filename)), keys)
+		if err != nil {
+			return fmt.Errorf("failed to verify signature of package %s: %w", pkg.Name, err)
+		}
+
+		slog.Debug("Verified package signature",
+			slog.String("name", pkg.Name), slog.String("fingerprint", fingerprint))
+
+		packageSigners[pkg.SHA256] = fingerprint
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return packageSigners, nil
+}
+
+// newManifest creates a build manifest recording the provenance of the
+// selected packages. The origin of each package is the repository of the URL
+// it was downloaded from.
+func newManifest(platform ocispecs.Platform, selectedDB *database.PackageDB, packageURLs, packageSigners map[string]string) *manifest.Manifest {
+	m := manifest.Manifest{Platform: platforms.Format(platform)}
+	_ = selectedDB.ForEach(func(pkg types.Package) error {
+		var manifestOrigin *manifest.Origin
+		for _, origin := range pkg.Origins {
+			if origin.URL != packageURLs[pkg.SHA256] {
+				continue
+			}
+
+			manifestOrigin = &manifest.Origin{
+				URL:      origin.URL,
+				Suite:    origin.Suite,
+				SignedBy: origin.SignedBy,
+			}
+
+			if !origin.Date.IsZero() {
+				date := origin.Date.UTC()
+				manifestOrigin.Date = &date
+			}
+
+			break
+		}
+
+		if manifestOrigin == nil {
+			slog.Warn("Unknown package origin",
+				slog.String("name", pkg.Name), slog.String("sha256", pkg.SHA256))
+		}
+
+		m.Packages = append(m.Packages, manifest.Package{
+			Name:          pkg.Name,
+			Version:       pkg.Version.String(),
+			Architecture:  pkg.Architecture.String(),
+			SHA256:        pkg.SHA256,
+			Origin:        manifestOrigin,
+			PackageSigner: packageSigners[pkg.SHA256],
+		})
+
+		return nil
+	})
+
+	return &m
+}
@@ -0,0 +1,92 @@
+#!/bin/sh
+# Regenerates the .deb format fixtures (requires dpkg-deb >= 1.21.18 and gzip).
+set -eu
+
+cd "$(dirname "$0")"
+
+export SOURCE_DATE_EPOCH=0
+
+work=$(mktemp -d)
+trap 'rm -rf "$work"' EXIT
+
+mkdir -p "$work/hello/DEBIAN" "$work/hello/usr/share/hello"
+printf 'Hello, world!\n' >"$work/hello/usr/share/hello/greeting"
+cat >"$work/hello/DEBIAN/control" <<CONTROL
+Package: hello
+Version: 1.0
+Architecture: all
+Maintainer: Immutos Developers <developers@immutos.com>
+Description: Test package
+CONTROL
+
+dpkg-deb --root-owner-group -Znone --uniform-compression -b "$work/hello" hello_1.0_all_none.deb
+dpkg-deb --root-owner-group -Zzstd -b "$work/hello" hello_1.0_all_zstd.deb
+dpkg-deb --root-owner-group -Zgzip -b "$work/hello" "$work/gzip.deb"
+
+(cd "$work" && ar x gzip.deb)
+
+# ar_header <name> <size> writes an ar(1) member header.
+ar_header() {
+	printf '%-16s%-12s%-6s%-6s%-8s%-10s`\n' "$1" 0 0 0 100644 "$2"
+}
+
+# ar_member <name> <file> writes an ar(1) member (including any padding).
+ar_member() {
+	size=$(wc -c <"$2")
+	ar_header "$1" "$size"
+	cat "$2"
+	if [ $((size % 2)) -eq 1 ]; then
+		printf '\n'
+	fi
+}
+
+printf 'not a real signature\n' >"$work/_gpgbuilder"
+printf 'odd' >"$work/_odd"
+printf '2.1\n' >"$work/debian-binary-2.1"
+printf '3.0\n' >"$work/debian-binary-3.0"
+
+# Extra (ignored) members before, between, and after the control and data members.
+{
+	printf '!<arch>\n'
+	ar_member debian-binary "$work/debian-binary"
+	ar_member _odd "$work/_odd"
+	ar_member control.tar.gz "$work/control.tar.gz"
+	ar_member _odd "$work/_odd"
+	ar_member data.tar.gz "$work/data.tar.gz"
+	ar_member _gpgbuilder "$work/_gpgbuilder"
+} >hello_1.0_all_extra-members.deb
+
+# GNU ar(1) style member names (with a trailing slash), odd sized members
+# (padded to an even offset), and a newer minor format version.
+{
+	printf '!<arch>\n'
+	ar_member debian-binary/ "$work/debian-binary-2.1"
+	ar_member _odd/ "$work/_odd"
+	ar_member control.tar.gz/ "$work/control.tar.gz"
+	ar_member data.tar.gz/ "$work/data.tar.gz"
+} >hello_1.0_all_gnu.deb
+
+# Invalid: the data member comes before the control member.
+{
+	printf '!<arch>\n'
+	ar_member debian-binary "$work/debian-binary"
+	ar_member data.tar.gz "$work/data.tar.gz"
+	ar_member control.tar.gz "$work/control.tar.gz"
+} >invalid_order.deb
+
+# Invalid: unsupported major format version.
+{
+	printf '!<arch>\n'
+	ar_member debian-binary "$work/debian-binary-3.0"
+	ar_member control.tar.gz "$work/control.tar.gz"
+	ar_member data.tar.gz "$work/data.tar.gz"
+} >invalid_version.deb
+
+# Invalid: an unknown (non underscore prefixed) member.
+{
+	printf '!<arch>\n'
+	ar_member debian-binary "$work/debian-binary"
+	ar_member extra "$work/_odd"
+	ar_member control.tar.gz "$work/control.tar.gz"
+	ar_member data.tar.gz "$work/data.tar.gz"
+} >invalid_member.deb